@@ -0,0 +1,194 @@
+// Package access stores requests for access to routes a user's role is
+// not permitted to use, and the decisions made on them.
+package access
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Request statuses.
+const (
+	Pending  = "pending"
+	Approved = "approved"
+	Rejected = "rejected"
+)
+
+// Decisions on a request.
+const (
+	// GrantRoute gives the route to a role.
+	GrantRoute = "grant_route"
+	// MoveRole moves the requester to another role.
+	MoveRole = "move_role"
+	// Reject refuses the request.
+	Reject = "reject"
+)
+
+// ErrNotPending is returned when deciding a request that was already
+// decided.
+var ErrNotPending = errors.New("access request has already been decided")
+
+// Request is a user's request for access to a route.
+type Request struct {
+	ID            string    `bson:"_id"`
+	Username      string    `bson:"username"`
+	RoleID        string    `bson:"roleid"`
+	Path          string    `bson:"path"`
+	Justification string    `bson:"justification"`
+	Status        string    `bson:"status"`
+	Decision      string    `bson:"decision,omitempty"`
+	GrantRoleID   string    `bson:"grantroleid,omitempty"`
+	Comment       string    `bson:"comment,omitempty"`
+	DecidedBy     string    `bson:"decidedby,omitempty"`
+	DecidedAt     time.Time `bson:"decidedat,omitempty"`
+	Notified      bool      `bson:"notified"`
+	CreatedAt     time.Time `bson:"createdat"`
+}
+
+// Store keeps access requests in MongoDB.
+type Store struct {
+	col *mongo.Collection
+}
+
+// NewStore returns a Store using col.
+func NewStore(col *mongo.Collection) *Store {
+	return &Store{col: col}
+}
+
+// Create adds a pending request and returns its id.
+func (s *Store) Create(ctx context.Context, req *Request) (string, error) {
+	req.ID = primitive.NewObjectID().Hex()
+	req.Status = Pending
+	req.Notified = false
+	req.CreatedAt = time.Now().UTC()
+
+	_, err := s.col.InsertOne(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return req.ID, nil
+}
+
+// Read returns a request by id.
+func (s *Store) Read(ctx context.Context, id string) (*Request, error) {
+	req := new(Request)
+	err := s.col.FindOne(ctx, bson.M{"_id": id}).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ReadPending returns the pending request of a user for a path, or nil if
+// there is none.
+func (s *Store) ReadPending(ctx context.Context, username, path string) (*Request, error) {
+	req := new(Request)
+	err := s.col.FindOne(ctx, bson.M{
+		"username": username,
+		"path":     path,
+		"status":   Pending,
+	}).Decode(req)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// List returns requests, pending ones first and then newest first. An
+// empty status returns every request.
+func (s *Store) List(ctx context.Context, status string) ([]*Request, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	return s.find(ctx, filter, options.Find().SetSort(bson.D{
+		{Key: "status", Value: 1},
+		{Key: "createdat", Value: -1},
+	}))
+}
+
+// Decide approves or rejects a pending request.
+func (s *Store) Decide(ctx context.Context, id, status, decision, grantRoleID, comment, decidedBy string) error {
+	res, err := s.col.UpdateOne(ctx,
+		bson.M{
+			"_id":    id,
+			"status": Pending,
+		},
+		bson.M{
+			"$set": bson.M{
+				"status":      status,
+				"decision":    decision,
+				"grantroleid": grantRoleID,
+				"comment":     comment,
+				"decidedby":   decidedBy,
+				"decidedat":   time.Now().UTC(),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotPending
+	}
+	return nil
+}
+
+// Outcomes returns the decided requests of a user that the user has not
+// been told about yet and marks them as told.
+func (s *Store) Outcomes(ctx context.Context, username string) ([]*Request, error) {
+	filter := bson.M{
+		"username": username,
+		"status":   bson.M{"$ne": Pending},
+		"notified": false,
+	}
+
+	reqs, err := s.find(ctx, filter, options.Find().SetSort(bson.D{{Key: "decidedat", Value: 1}}))
+	if err != nil || len(reqs) == 0 {
+		return reqs, err
+	}
+
+	ids := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		ids = append(ids, req.ID)
+	}
+	_, err = s.col.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{"$set": bson.M{"notified": true}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return reqs, nil
+}
+
+func (s *Store) find(ctx context.Context, filter interface{}, opts *options.FindOptions) ([]*Request, error) {
+	cursor, err := s.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var reqs []*Request
+	for cursor.Next(ctx) {
+		req := new(Request)
+		err := cursor.Decode(req)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+
+	return reqs, cursor.Err()
+}
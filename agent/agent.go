@@ -0,0 +1,233 @@
+// Package agent lets lightweight agents on the servers in the inventory
+// check in with a heartbeat and the facts of their host. Agents
+// authenticate with a per-server enrolment token, only a hash of which is
+// kept, and servers whose agent stops checking in are marked stale.
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/go-stuff/web/inventory"
+)
+
+// ErrInvalidToken is returned for a token that was never issued or has
+// been revoked.
+var ErrInvalidToken = errors.New("invalid enrolment token")
+
+// Token is the enrolment token of a server, a server has at most one.
+type Token struct {
+	ServerID string `bson:"_id"`
+	// Hash is the sha256 of the token, the token itself is only shown
+	// when it is issued.
+	Hash string `bson:"hash"`
+	// Prefix is the start of the token so it can be recognised.
+	Prefix    string    `bson:"prefix"`
+	CreatedBy string    `bson:"createdby"`
+	CreatedAt time.Time `bson:"createdat"`
+	UsedAt    time.Time `bson:"usedat,omitempty"`
+}
+
+// Entry is a set of facts in the history of a server, a new entry is only
+// added when the facts change.
+type Entry struct {
+	ID         string          `bson:"_id"`
+	ServerID   string          `bson:"serverid"`
+	Facts      inventory.Facts `bson:"facts"`
+	ReportedAt time.Time       `bson:"reportedat"`
+}
+
+// Change is what changed in the facts of a server at a time.
+type Change struct {
+	At      time.Time
+	Changes []string
+}
+
+// Changes lists what changed between entries, which are newest first. The
+// oldest entry is the first report.
+func Changes(entries []*Entry) []*Change {
+	changes := make([]*Change, 0, len(entries))
+	for i, entry := range entries {
+		change := &Change{At: entry.ReportedAt}
+		if i+1 < len(entries) {
+			change.Changes = inventory.DiffFacts(&entries[i+1].Facts, &entry.Facts)
+		} else {
+			change.Changes = []string{"first report"}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// hash returns the hex sha256 of a token.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store keeps enrolment tokens and facts histories in MongoDB.
+type Store struct {
+	tokens  *mongo.Collection
+	history *mongo.Collection
+}
+
+// NewStore returns a Store keeping tokens in tokens and facts histories in
+// history, and makes sure the indexes exist.
+func NewStore(tokens, history *mongo.Collection) (*Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := tokens.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "serverid", Value: 1}, {Key: "reportedat", Value: -1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		tokens:  tokens,
+		history: history,
+	}, nil
+}
+
+// Issue creates a new enrolment token for a server, replacing any it had,
+// and returns it. It can not be read back later.
+func (s *Store) Issue(ctx context.Context, serverID, createdBy string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	_, err = s.tokens.ReplaceOne(ctx,
+		bson.M{"_id": serverID},
+		&Token{
+			ServerID:  serverID,
+			Hash:      hash(token),
+			Prefix:    token[:8],
+			CreatedBy: createdBy,
+			CreatedAt: time.Now().UTC(),
+		},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Token returns the enrolment token of a server, or nil if it has none.
+func (s *Store) Token(ctx context.Context, serverID string) (*Token, error) {
+	token := new(Token)
+	err := s.tokens.FindOne(ctx, bson.M{"_id": serverID}).Decode(token)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Verify returns the id of the server a token was issued for and notes
+// that it was used.
+func (s *Store) Verify(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrInvalidToken
+	}
+
+	t := new(Token)
+	err := s.tokens.FindOneAndUpdate(ctx,
+		bson.M{"hash": hash(token)},
+		bson.M{"$set": bson.M{"usedat": time.Now().UTC()}},
+	).Decode(t)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return t.ServerID, nil
+}
+
+// Revoke removes the enrolment token of a server.
+func (s *Store) Revoke(ctx context.Context, serverID string) error {
+	_, err := s.tokens.DeleteOne(ctx, bson.M{"_id": serverID})
+	return err
+}
+
+// Record adds facts to the history of a server if they differ from prev,
+// the facts the server had before, and reports whether they did. prev comes
+// from the check-in that stored facts, not from the history, so two
+// check-ins at once can not both add the same facts.
+func (s *Store) Record(ctx context.Context, serverID string, prev, facts *inventory.Facts) (bool, error) {
+	if prev != nil && len(inventory.DiffFacts(prev, facts)) == 0 {
+		return false, nil
+	}
+
+	_, err := s.history.InsertOne(ctx, &Entry{
+		ID:         primitive.NewObjectID().Hex(),
+		ServerID:   serverID,
+		Facts:      *facts,
+		ReportedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// History returns up to limit entries of the facts history of a server,
+// newest first.
+func (s *Store) History(ctx context.Context, serverID string, limit int64) ([]*Entry, error) {
+	cursor, err := s.history.Find(ctx,
+		bson.M{"serverid": serverID},
+		options.Find().SetSort(bson.D{{Key: "reportedat", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []*Entry
+	for cursor.Next(ctx) {
+		entry := new(Entry)
+		err := cursor.Decode(entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, cursor.Err()
+}
+
+// Forget removes the token and facts history of a server that was
+// deleted.
+func (s *Store) Forget(ctx context.Context, serverID string) error {
+	err := s.Revoke(ctx, serverID)
+	if err != nil {
+		return err
+	}
+	_, err = s.history.DeleteMany(ctx, bson.M{"serverid": serverID})
+	return err
+}
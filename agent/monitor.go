@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/notify"
+)
+
+// Options tune the Monitor.
+type Options struct {
+	// Interval is the time between looks for stale servers.
+	Interval time.Duration
+	// StaleAfter is how long after its last check-in a server is stale.
+	StaleAfter time.Duration
+}
+
+// DefaultOptions look every minute for servers that have not checked in
+// for 15 minutes.
+var DefaultOptions = Options{
+	Interval:   time.Minute,
+	StaleAfter: 15 * time.Minute,
+}
+
+// Suppressor holds back the alerts about a server, such as while it is in
+// a maintenance window.
+type Suppressor interface {
+	Suppressed(ctx context.Context, server *inventory.Server, t time.Time) (bool, error)
+}
+
+// Monitor takes check-ins from agents, marks servers stale when they stop
+// checking in and alerts through a Notifier when a server goes stale or
+// checks in again, unless the Suppressor holds it back.
+type Monitor struct {
+	servers    *inventory.Store
+	store      *Store
+	notifier   *notify.Notifier
+	suppressor Suppressor
+	opts       Options
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewMonitor returns a Monitor, Start runs it. suppressor may be nil.
+func NewMonitor(servers *inventory.Store, store *Store, notifier *notify.Notifier, suppressor Suppressor, opts Options) *Monitor {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultOptions.Interval
+	}
+	if opts.StaleAfter <= 0 {
+		opts.StaleAfter = DefaultOptions.StaleAfter
+	}
+
+	return &Monitor{
+		servers:    servers,
+		store:      store,
+		notifier:   notifier,
+		suppressor: suppressor,
+		opts:       opts,
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start looks for stale servers once per Interval in the background until
+// Close is called.
+func (m *Monitor) Start() {
+	go m.run()
+}
+
+// Close stops the monitor and waits for it to finish.
+func (m *Monitor) Close() {
+	close(m.quit)
+	<-m.done
+}
+
+func (m *Monitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		ctx := context.Background()
+		err := m.Sweep(ctx)
+		if err != nil {
+			logging.Error(ctx, "Sweep() failed", "error", err)
+		}
+
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StaleAfter returns how long after its last check-in a server is stale.
+func (m *Monitor) StaleAfter() time.Duration {
+	return m.opts.StaleAfter
+}
+
+// Sweep marks the servers that stopped checking in as stale and sends the
+// alerts that are due, including those held back by a maintenance window
+// that has since closed.
+func (m *Monitor) Sweep(ctx context.Context) error {
+	_, err := m.servers.MarkStale(ctx, time.Now().Add(-m.opts.StaleAfter))
+	if err != nil {
+		return err
+	}
+
+	due, err := m.servers.StaleDue(ctx)
+	if err != nil {
+		return err
+	}
+	for _, server := range due {
+		err := m.alert(ctx, server)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// alert tells that server went stale, or checked in again, unless that is
+// held back. A server that went stale and checked in again within a
+// window was never alerted about and gets no alert.
+func (m *Monitor) alert(ctx context.Context, server *inventory.Server) error {
+	if m.suppressor != nil {
+		suppressed, err := m.suppressor.Suppressed(ctx, server, time.Now())
+		if err != nil {
+			logging.Error(ctx, "Suppressed() failed", "hostname", server.Hostname, "error", err)
+		} else if suppressed {
+			return nil
+		}
+	}
+
+	// another instance may have sent it
+	noted, err := m.servers.StaleAlerted(ctx, server.ID, server.Stale)
+	if err != nil || !noted {
+		return err
+	}
+
+	alert := notify.Alert{
+		Source:  "agent",
+		Kind:    "stale",
+		Subject: server.Hostname,
+		Message: fmt.Sprintf("%s has not checked in since %s", server.Hostname, server.CheckedInAt.Format(time.RFC3339)),
+		Fields: map[string]string{
+			"checkedinat": server.CheckedInAt.Format(time.RFC3339),
+		},
+	}
+	if !server.Stale {
+		alert.Kind = "checkedin"
+		alert.Message = fmt.Sprintf("%s checked in again", server.Hostname)
+	}
+	m.notifier.Send(alert)
+
+	return nil
+}
+
+// CheckIn records a check-in of the agent of a server, with the facts it
+// reported or nil for a heartbeat.
+func (m *Monitor) CheckIn(ctx context.Context, serverID string, facts *inventory.Facts) error {
+	if facts != nil {
+		facts.Normalize()
+	}
+
+	prev, err := m.servers.CheckIn(ctx, serverID, facts)
+	if err != nil {
+		return err
+	}
+
+	if facts != nil {
+		_, err := m.store.Record(ctx, serverID, prev.Facts, facts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the server is no longer stale, only an alert that said it was needs
+	// an answer
+	if prev.StaleAlerted {
+		prev.Stale = false
+		return m.alert(ctx, prev)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+// Package audit writes audit records durably through an on-disk spool and
+// exports them to external sinks such as syslog, JSON-lines files and
+// signed webhooks.
+package audit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// Record is an audit entry as it is handed to a sink.
+type Record struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Action    string    `json:"action"`
+	Session   string    `json:"session"`
+	CreatedBy string    `json:"createdby"`
+	CreatedAt time.Time `json:"createdat"`
+	RequestID string    `json:"requestid,omitempty"`
+}
+
+// Sink is a destination for audit records.
+type Sink interface {
+	// Name identifies the sink in log messages.
+	Name() string
+	// Write delivers a single record. Returning an error causes the
+	// record to be retried according to the sink's Retry settings.
+	Write(ctx context.Context, rec *Record) error
+	// Close releases any connections or files held by the sink.
+	Close() error
+}
+
+// Retry controls how often and how quickly a failed write is retried.
+type Retry struct {
+	// Attempts is the total number of tries, including the first one.
+	Attempts int
+	// Backoff is the delay before the first retry, it doubles after
+	// every failed attempt.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetry is used for sinks added without explicit retry settings.
+var DefaultRetry = Retry{
+	Attempts:   5,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+}
+
+// permanentError marks an error that should not be retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// do runs fn until it succeeds, returns a permanent error, the attempts
+// are exhausted or the context is done.
+func (rt Retry) do(ctx context.Context, fn func() error) error {
+	attempts := rt.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := rt.Backoff
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+		if i == attempts-1 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if rt.MaxBackoff > 0 && backoff > rt.MaxBackoff {
+			backoff = rt.MaxBackoff
+		}
+	}
+	return err
+}
+
+// Exporter fans audit records out to every registered sink. Each sink
+// has its own queue and worker so a slow or failing sink does not hold
+// up the others or the request that produced the record.
+type Exporter struct {
+	mu      sync.Mutex
+	workers []*worker
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type worker struct {
+	sink  Sink
+	retry Retry
+	queue chan *Record
+}
+
+// NewExporter returns an Exporter without any sinks.
+func NewExporter() *Exporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Exporter{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Add registers a sink with its own retry settings and starts its worker.
+// queueSize is the number of records that may wait for the sink before
+// new records are dropped.
+func (e *Exporter) Add(sink Sink, retry Retry, queueSize int) {
+	if queueSize < 1 {
+		queueSize = 1000
+	}
+
+	wk := &worker{
+		sink:  sink,
+		retry: retry,
+		queue: make(chan *Record, queueSize),
+	}
+
+	e.mu.Lock()
+	e.workers = append(e.workers, wk)
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go e.run(wk)
+
+	logging.Info(context.Background(), "audit sink enabled", "sink", sink.Name())
+}
+
+func (e *Exporter) run(wk *worker) {
+	defer e.wg.Done()
+
+	for rec := range wk.queue {
+		err := wk.retry.do(e.ctx, func() error {
+			return wk.sink.Write(e.ctx, rec)
+		})
+		if err != nil {
+			logging.Error(logging.WithRequestID(e.ctx, rec.RequestID), "record not exported", "sink", wk.sink.Name(), "record", rec.ID, "error", err)
+		}
+	}
+}
+
+// Export queues a record for every sink. It never blocks, a record is
+// dropped and logged if a sink's queue is full. Export on a nil Exporter
+// does nothing.
+func (e *Exporter) Export(rec *Record) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, wk := range e.workers {
+		select {
+		case wk.queue <- rec:
+		default:
+			logging.Error(logging.WithRequestID(context.Background(), rec.RequestID), "queue full, record dropped", "sink", wk.sink.Name(), "record", rec.ID)
+		}
+	}
+}
+
+// Close stops accepting records, waits for the queues to drain until ctx
+// is done and closes every sink.
+func (e *Exporter) Close(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	for _, wk := range e.workers {
+		close(wk.queue)
+	}
+	workers := e.workers
+	e.workers = nil
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// abandon any retries still in progress
+		e.cancel()
+		<-done
+		err = ctx.Err()
+	}
+	e.cancel()
+
+	for _, wk := range workers {
+		cerr := wk.sink.Close()
+		if cerr != nil {
+			logging.Error(ctx, "sink.Close() failed", "sink", wk.sink.Name(), "error", cerr)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileSink appends records as JSON lines to a file and rotates it once it
+// grows past MaxSize bytes. Rotated files are named path.1, path.2, ...
+// with path.1 being the most recent.
+type FileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink returns a FileSink for path. A maxSize of 0 disables
+// rotation.
+func NewFileSink(path string, maxSize int64, maxBackups int) *FileSink {
+	return &FileSink{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+}
+
+// Name identifies the sink.
+func (s *FileSink) Name() string {
+	return fmt.Sprintf("file(%s)", s.Path)
+}
+
+// Write appends one record followed by a newline.
+func (s *FileSink) Write(ctx context.Context, rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return permanentError{err}
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxSize {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+
+	if s.MaxBackups < 1 {
+		// nothing to keep, start over
+		err = os.Remove(s.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+
+	// shift path.N-1 to path.N, dropping the oldest
+	os.Remove(fmt.Sprintf("%s.%d", s.Path, s.MaxBackups))
+	for i := s.MaxBackups - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = os.Rename(s.Path, s.Path+".1")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.open()
+}
+
+// Close flushes and closes the current file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		s.file.Close()
+		s.file = nil
+		return err
+	}
+	err = s.file.Close()
+	s.file = nil
+	return err
+}
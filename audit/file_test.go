@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readRecords returns the ids of the records in a JSON lines file.
+func readRecords(t *testing.T, path string) []string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec Record
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		ids = append(ids, rec.ID)
+	}
+	return ids
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	// each record is the same size, so the size of one line sets how many
+	// fit in a file
+	line, err := json.Marshal(&Record{ID: "00", CreatedAt: time.Unix(0, 0).UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(line) + 1)
+
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		records    int
+		// ids in the file and each backup, path first
+		want [][]string
+	}{
+		{
+			name:    "no rotation",
+			maxSize: 0,
+			records: 5,
+			want:    [][]string{{"00", "01", "02", "03", "04"}},
+		},
+		{
+			name:       "two per file",
+			maxSize:    2 * size,
+			maxBackups: 3,
+			records:    5,
+			want:       [][]string{{"04"}, {"02", "03"}, {"00", "01"}},
+		},
+		{
+			name:       "oldest backup is dropped",
+			maxSize:    2 * size,
+			maxBackups: 1,
+			records:    5,
+			want:       [][]string{{"04"}, {"02", "03"}},
+		},
+		{
+			name:       "no backups starts over",
+			maxSize:    2 * size,
+			maxBackups: 0,
+			records:    5,
+			want:       [][]string{{"04"}},
+		},
+		{
+			name:       "a record larger than max size is still written",
+			maxSize:    1,
+			maxBackups: 2,
+			records:    3,
+			want:       [][]string{{"02"}, {"01"}, {"00"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "filesink")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "audit.log")
+			sink := NewFileSink(path, tt.maxSize, tt.maxBackups)
+			for i := 0; i < tt.records; i++ {
+				err := sink.Write(context.Background(), &Record{ID: fmt.Sprintf("%02d", i), CreatedAt: time.Unix(0, 0).UTC()})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = sink.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.want {
+				p := path
+				if i > 0 {
+					p = fmt.Sprintf("%s.%d", path, i)
+				}
+				got := readRecords(t, p)
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("%s has %v, want %v", filepath.Base(p), got, want)
+				}
+			}
+
+			// nothing past the last backup
+			extra := fmt.Sprintf("%s.%d", path, len(tt.want))
+			if _, err := os.Stat(extra); !os.IsNotExist(err) {
+				t.Errorf("%s exists, want at most %d backups", filepath.Base(extra), len(tt.want)-1)
+			}
+		})
+	}
+}
+
+func TestFileSinkAppendsToExistingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	for _, id := range []string{"a", "b"} {
+		sink := NewFileSink(path, 0, 0)
+		err := sink.Write(context.Background(), &Record{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.Close()
+	}
+
+	got := readRecords(t, path)
+	if fmt.Sprint(got) != "[a b]" {
+		t.Errorf("file has %v, want [a b]", got)
+	}
+}
@@ -0,0 +1,652 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stuff/grpc/api"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/repository"
+)
+
+// Backend is where spooled records are ultimately stored.
+type Backend interface {
+	Create(ctx context.Context, rec *Record) error
+}
+
+// repositoryBackend stores records in the audit log of a data backend.
+type repositoryBackend struct {
+	audits repository.Audits
+}
+
+// NewBackend returns a Backend that writes to audits.
+func NewBackend(audits repository.Audits) Backend {
+	return &repositoryBackend{audits: audits}
+}
+
+func (b *repositoryBackend) Create(ctx context.Context, rec *Record) error {
+	createdAt, err := ptypes.TimestampProto(rec.CreatedAt)
+	if err != nil {
+		// the record can never be stored
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// the audit service has no field for the request id, it is sent with
+	// the call like the request's own calls
+	if rec.RequestID != "" {
+		ctx = logging.WithRequestID(ctx, rec.RequestID)
+	}
+
+	auditReq := new(api.AuditCreateReq)
+	auditReq.Audit = &api.Audit{
+		ID:        rec.ID,
+		Username:  rec.Username,
+		Action:    rec.Action,
+		Session:   rec.Session,
+		CreatedBy: rec.CreatedBy,
+		CreatedAt: createdAt,
+	}
+	_, err = b.audits.Create(ctx, auditReq)
+	// a record replayed after a crash may already have been stored, the
+	// duplicate id means there is nothing left to do
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// rejected reports whether the backend refused the record itself, sending
+// it again will fail the same way. Anything else, such as the backend not
+// answering, is tried again until it is stored.
+func rejected(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return true
+	}
+	return false
+}
+
+// SpoolOptions tune how a Spool flushes to its backend.
+type SpoolOptions struct {
+	// BatchSize is the most records sent in one flush.
+	BatchSize int
+	// FlushInterval is how often pending records are flushed when no new
+	// records arrive.
+	FlushInterval time.Duration
+	// Timeout bounds each backend call.
+	Timeout time.Duration
+	// MaxBackoff caps the wait between attempts while the backend fails.
+	MaxBackoff time.Duration
+	// MaxRejections is how many times the backend may reject a record
+	// before it is moved to the dead letter file, so it does not hold up
+	// the records behind it.
+	MaxRejections int
+}
+
+// DefaultSpoolOptions are used for any zero SpoolOptions fields.
+var DefaultSpoolOptions = SpoolOptions{
+	BatchSize:     100,
+	FlushInterval: time.Second,
+	Timeout:       30 * time.Second,
+	MaxBackoff:    time.Minute,
+	MaxRejections: 5,
+}
+
+// SpoolStats describe the records waiting to be sent.
+type SpoolStats struct {
+	Depth        int       `json:"depth"`
+	Oldest       time.Time `json:"oldest"`
+	Sent         uint64    `json:"sent"`
+	Failures     uint64    `json:"failures"`
+	DeadLettered uint64    `json:"deadlettered"`
+}
+
+// OldestAge returns how long the oldest unsent record has been waiting.
+func (st SpoolStats) OldestAge() time.Duration {
+	if st.Depth == 0 {
+		return 0
+	}
+	return time.Since(st.Oldest)
+}
+
+type pendingRecord struct {
+	rec *Record
+	end int64 // file offset just after this record
+}
+
+// Spool is a durable, asynchronous audit writer. Write appends a record to
+// a write-ahead file and syncs it to disk before returning, a background
+// worker sends the records to the Backend in batches and only then moves
+// the committed offset forward. Records that were not committed when the
+// process stopped are replayed when the spool is opened again, so a
+// record is never lost once Write has returned without an error.
+//
+// A record the backend rejects MaxRejections times is appended to the dead
+// letter file, audit.dead in the spool directory, with the error and
+// skipped. Records the backend has stored are passed on to the Exporter.
+type Spool struct {
+	backend  Backend
+	exporter *Exporter
+	opts     SpoolOptions
+
+	walPath    string
+	offsetPath string
+	deadPath   string
+
+	mu        sync.Mutex
+	wal       *os.File
+	size      int64
+	committed int64
+	pending   []pendingRecord
+	sent      uint64
+	failures  uint64
+	dead      uint64
+	closed    bool
+
+	// the record at the head of the spool the backend rejected and how
+	// many times
+	rejectedID string
+	rejections int
+
+	// opened is closed once the wal has been replayed, or the open
+	// failed with openErr
+	opened  chan struct{}
+	openErr error
+
+	notify chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// OpenSpool opens or creates the spool in dir, queues any records that
+// were not sent before the last shutdown and starts the flush worker.
+func OpenSpool(dir string, backend Backend, exporter *Exporter, opts SpoolOptions) (*Spool, error) {
+	s, err := newSpool(dir, backend, exporter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.open()
+	if err != nil {
+		return nil, err
+	}
+	close(s.opened)
+
+	return s, nil
+}
+
+// OpenSpoolAfter returns a spool that is opened in the background once wait
+// returns, such as when another process has closed the spool in dir. Writes
+// wait until it is open and fail if wait or the open does.
+func OpenSpoolAfter(wait func() error, dir string, backend Backend, exporter *Exporter, opts SpoolOptions) (*Spool, error) {
+	s, err := newSpool(dir, backend, exporter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := wait()
+		if err == nil {
+			err = s.open()
+		}
+		if err != nil {
+			logging.Error(context.Background(), "open() failed", "dir", filepath.Dir(s.walPath), "error", err)
+		}
+		s.openErr = err
+		close(s.opened)
+	}()
+
+	return s, nil
+}
+
+func newSpool(dir string, backend Backend, exporter *Exporter, opts SpoolOptions) (*Spool, error) {
+	if opts.BatchSize < 1 {
+		opts.BatchSize = DefaultSpoolOptions.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultSpoolOptions.FlushInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultSpoolOptions.Timeout
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultSpoolOptions.MaxBackoff
+	}
+	if opts.MaxRejections < 1 {
+		opts.MaxRejections = DefaultSpoolOptions.MaxRejections
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		backend:    backend,
+		exporter:   exporter,
+		opts:       opts,
+		walPath:    filepath.Join(dir, "audit.wal"),
+		offsetPath: filepath.Join(dir, "audit.offset"),
+		deadPath:   filepath.Join(dir, "audit.dead"),
+		opened:     make(chan struct{}),
+		notify:     make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	return s, nil
+}
+
+// open replays the wal and starts the flush worker.
+func (s *Spool) open() error {
+	err := s.replay()
+	if err != nil {
+		return err
+	}
+
+	if len(s.pending) > 0 {
+		logging.Info(context.Background(), "replaying unsent audit records", "records", len(s.pending))
+	}
+
+	go s.run()
+
+	return nil
+}
+
+// replay reads the committed offset and queues every complete record after
+// it. A torn record at the end of the file, left by a crash during Write,
+// is truncated since its Write never returned successfully.
+func (s *Spool) replay() error {
+	offsetBytes, err := ioutil.ReadFile(s.offsetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(offsetBytes) > 0 {
+		s.committed, err = strconv.ParseInt(strings.TrimSpace(string(offsetBytes)), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	wal, err := os.OpenFile(s.walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.wal = wal
+
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return err
+	}
+	s.size = info.Size()
+
+	// the wal was compacted after the offset was written
+	if s.committed > s.size {
+		s.committed = 0
+	}
+
+	_, err = wal.Seek(s.committed, io.SeekStart)
+	if err != nil {
+		wal.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(wal)
+	offset := s.committed
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logging.Warn(context.Background(), "truncating an incomplete record", "bytes", len(line))
+				err = wal.Truncate(offset)
+				if err != nil {
+					wal.Close()
+					return err
+				}
+				s.size = offset
+			}
+			break
+		}
+		if err != nil {
+			wal.Close()
+			return err
+		}
+
+		offset += int64(len(line))
+
+		rec := new(Record)
+		err = json.Unmarshal(bytes.TrimSpace(line), rec)
+		if err != nil {
+			wal.Close()
+			return err
+		}
+		s.pending = append(s.pending, pendingRecord{rec: rec, end: offset})
+	}
+
+	return nil
+}
+
+// Write appends a record to the spool and syncs it to disk. An error means
+// the record was not accepted and the caller should fail the request.
+func (s *Spool) Write(rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	<-s.opened
+	if s.openErr != nil {
+		return s.openErr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("audit spool is closed")
+	}
+
+	n, err := s.wal.Write(line)
+	if err != nil {
+		// drop whatever part of the record made it to the file
+		if n > 0 {
+			s.wal.Truncate(s.size)
+		}
+		return err
+	}
+
+	err = s.wal.Sync()
+	if err != nil {
+		s.wal.Truncate(s.size)
+		return err
+	}
+
+	s.size += int64(n)
+	s.pending = append(s.pending, pendingRecord{rec: rec, end: s.size})
+
+	// wake the flush worker without blocking
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Stats returns the current queue depth and the time of the oldest unsent
+// record.
+func (s *Spool) Stats() SpoolStats {
+	// nothing is known about the records until the wal is replayed
+	select {
+	case <-s.opened:
+	default:
+		return SpoolStats{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := SpoolStats{
+		Depth:        len(s.pending),
+		Sent:         s.sent,
+		Failures:     s.failures,
+		DeadLettered: s.dead,
+	}
+	if len(s.pending) > 0 {
+		st.Oldest = s.pending[0].rec.CreatedAt
+	}
+	return st
+}
+
+func (s *Spool) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var backoff time.Duration
+	var retryAt time.Time
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-s.notify:
+		case <-ticker.C:
+		}
+
+		// the backend failed recently, wait for the backoff to pass
+		if time.Now().Before(retryAt) {
+			continue
+		}
+
+		ctx := context.Background()
+		err := s.flush(ctx)
+		if err != nil {
+			if backoff == 0 {
+				backoff = s.opts.FlushInterval
+			} else {
+				backoff *= 2
+			}
+			if backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+			retryAt = time.Now().Add(backoff)
+			logging.Error(ctx, "flush() failed", "retry_in", backoff, "error", err)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// flush sends pending records in batches until none are left or the
+// backend returns an error. A record rejected too often is dead lettered
+// and the flush goes on with the next one.
+func (s *Spool) flush(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		n := len(s.pending)
+		if n > s.opts.BatchSize {
+			n = s.opts.BatchSize
+		}
+		batch := make([]pendingRecord, n)
+		copy(batch, s.pending[:n])
+		s.mu.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		// done counts the records stored or dead lettered, only stored
+		// records are exported
+		var done, dead int
+		var stored []*Record
+		var err error
+		for _, p := range batch {
+			callCtx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+			err = s.backend.Create(callCtx, p.rec)
+			cancel()
+			if err == nil {
+				stored = append(stored, p.rec)
+				done++
+				continue
+			}
+			if !rejected(err) || !s.reject(p.rec) {
+				break
+			}
+
+			derr := s.deadLetter(p.rec, err)
+			if derr != nil {
+				err = derr
+				break
+			}
+			logging.Error(logging.WithRequestID(ctx, p.rec.RequestID), "record rejected, dead lettered", "record", p.rec.ID, "rejections", s.opts.MaxRejections, "file", s.deadPath, "error", err)
+			err = nil
+			dead++
+			done++
+		}
+
+		if done > 0 {
+			cerr := s.commit(batch[done-1].end, done-dead, dead)
+			if cerr != nil {
+				return cerr
+			}
+			for _, rec := range stored {
+				s.exporter.Export(rec)
+			}
+		}
+
+		if err != nil {
+			s.mu.Lock()
+			s.failures++
+			s.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// reject counts a rejection of rec, the record at the head of the spool,
+// and reports whether it has been rejected MaxRejections times.
+func (s *Spool) reject(rec *Record) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectedID != rec.ID {
+		s.rejectedID = rec.ID
+		s.rejections = 0
+	}
+	s.rejections++
+	return s.rejections >= s.opts.MaxRejections
+}
+
+// deadRecord is a line of the dead letter file.
+type deadRecord struct {
+	Record *Record   `json:"record"`
+	Error  string    `json:"error"`
+	At     time.Time `json:"at"`
+}
+
+// deadLetter appends rec and why it was rejected to the dead letter file
+// and syncs it, the record is only skipped once it is kept there.
+func (s *Spool) deadLetter(rec *Record, reason error) error {
+	line, err := json.Marshal(deadRecord{Record: rec, Error: reason.Error(), At: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	file, err := os.OpenFile(s.deadPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(line)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// commit records that everything up to offset has been stored by the
+// backend or dead lettered and compacts the wal once nothing is pending.
+func (s *Spool) commit(offset int64, sent, dead int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.writeOffset(offset)
+	if err != nil {
+		return err
+	}
+	s.committed = offset
+	s.pending = s.pending[sent+dead:]
+	s.sent += uint64(sent)
+	s.dead += uint64(dead)
+
+	if len(s.pending) == 0 && !s.closed {
+		err = s.wal.Truncate(0)
+		if err != nil {
+			return err
+		}
+		s.size = 0
+		s.committed = 0
+		return s.writeOffset(0)
+	}
+
+	return nil
+}
+
+// writeOffset atomically replaces the offset file.
+func (s *Spool) writeOffset(offset int64) error {
+	tmp := s.offsetPath + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.FormatInt(offset, 10))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.offsetPath)
+}
+
+// Close stops accepting records and tries to flush what is pending until
+// ctx is done. Anything still unsent stays in the wal and is replayed the
+// next time the spool is opened.
+func (s *Spool) Close(ctx context.Context) error {
+	select {
+	case <-s.opened:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	// a spool that never opened has nothing to flush or close
+	if s.openErr != nil {
+		return nil
+	}
+
+	close(s.quit)
+	<-s.done
+
+	err := s.flush(ctx)
+	if err != nil {
+		logging.Warn(ctx, "audit records left in the spool", "records", s.Stats().Depth, "error", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wal.Close()
+}
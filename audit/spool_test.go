@@ -0,0 +1,425 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/repository"
+)
+
+// fakeBackend stores records in memory, fail decides the error for each
+// attempt.
+type fakeBackend struct {
+	mu       sync.Mutex
+	stored   []string
+	attempts map[string]int
+	fail     func(rec *Record) error
+}
+
+func (b *fakeBackend) Create(ctx context.Context, rec *Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.attempts == nil {
+		b.attempts = make(map[string]int)
+	}
+	b.attempts[rec.ID]++
+	if b.fail != nil {
+		if err := b.fail(rec); err != nil {
+			return err
+		}
+	}
+	b.stored = append(b.stored, rec.ID)
+	return nil
+}
+
+func (b *fakeBackend) ids() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Join(b.stored, ",")
+}
+
+func (b *fakeBackend) tries(id string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.attempts[id]
+}
+
+var testSpoolOptions = SpoolOptions{
+	FlushInterval: 5 * time.Millisecond,
+	MaxBackoff:    5 * time.Millisecond,
+	Timeout:       time.Second,
+	MaxRejections: 3,
+}
+
+func tempSpoolDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// waitFor polls cond until it is true or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func closeSpool(t *testing.T, s *Spool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := s.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeRecords(t *testing.T, s *Spool, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		err := s.Write(&Record{ID: id, CreatedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpoolSendsInOrder(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	backend := &fakeBackend{}
+	s, err := OpenSpool(dir, backend, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, s, "a", "b", "c")
+	waitFor(t, "the records to be sent", func() bool { return s.Stats().Depth == 0 })
+	closeSpool(t, s)
+
+	if got := backend.ids(); got != "a,b,c" {
+		t.Errorf("stored %s, want a,b,c", got)
+	}
+	if st := s.Stats(); st.Sent != 3 {
+		t.Errorf("sent %d, want 3", st.Sent)
+	}
+
+	// nothing pending, the wal is compacted
+	info, err := os.Stat(filepath.Join(dir, "audit.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("wal is %d bytes, want it compacted", info.Size())
+	}
+}
+
+func TestSpoolReplaysUnsentRecords(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// the backend can not be reached, nothing is sent before the close
+	down := &fakeBackend{fail: func(rec *Record) error {
+		return status.Error(codes.Unavailable, "backend down")
+	}}
+	s, err := OpenSpool(dir, down, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, s, "a", "b")
+	closeSpool(t, s)
+
+	if got := down.ids(); got != "" {
+		t.Fatalf("stored %s, want nothing", got)
+	}
+
+	// an unreachable backend never dead letters a record
+	if _, err := os.Stat(filepath.Join(dir, "audit.dead")); !os.IsNotExist(err) {
+		t.Errorf("dead letter file exists, want records kept in the spool")
+	}
+
+	up := &fakeBackend{}
+	s, err = OpenSpool(dir, up, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replayed records to be sent", func() bool { return s.Stats().Depth == 0 })
+	closeSpool(t, s)
+
+	if got := up.ids(); got != "a,b" {
+		t.Errorf("replayed %s, want a,b", got)
+	}
+}
+
+func TestSpoolOpenAfter(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// the old process leaves a record it could not send
+	down := &fakeBackend{fail: func(rec *Record) error {
+		return status.Error(codes.Unavailable, "backend down")
+	}}
+	old, err := OpenSpool(dir, down, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, old, "a")
+
+	exited := make(chan struct{})
+	up := &fakeBackend{}
+	s, err := OpenSpoolAfter(func() error { <-exited; return nil }, dir, up, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a write waits until the old spool is closed and this one is open
+	written := make(chan error, 1)
+	go func() { written <- s.Write(&Record{ID: "b", CreatedAt: time.Now().UTC()}) }()
+	select {
+	case err := <-written:
+		t.Fatalf("Write() = %v before the spool was open", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if st := s.Stats(); st.Depth != 0 {
+		t.Errorf("depth %d before the spool was open, want 0", st.Depth)
+	}
+
+	closeSpool(t, old)
+	close(exited)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the records to be sent", func() bool { return s.Stats().Depth == 0 })
+	closeSpool(t, s)
+
+	if got := up.ids(); got != "a,b" {
+		t.Errorf("stored %s, want a,b", got)
+	}
+
+	t.Run("wait fails", func(t *testing.T) {
+		failed := errors.New("the old process did not exit")
+		s, err := OpenSpoolAfter(func() error { return failed }, dir, up, nil, testSpoolOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Write(&Record{ID: "c", CreatedAt: time.Now().UTC()})
+		if err != failed {
+			t.Errorf("Write() = %v, want %v", err, failed)
+		}
+		closeSpool(t, s)
+	})
+}
+
+func TestSpoolReplaySkipsCommittedRecords(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// a is stored, b is not, and the spool stops before b is sent
+	backend := &fakeBackend{fail: func(rec *Record) error {
+		if rec.ID == "b" {
+			return status.Error(codes.Unavailable, "backend down")
+		}
+		return nil
+	}}
+	s, err := OpenSpool(dir, backend, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, s, "a", "b")
+	waitFor(t, "a to be sent", func() bool { return s.Stats().Sent == 1 })
+	closeSpool(t, s)
+
+	up := &fakeBackend{}
+	s, err = OpenSpool(dir, up, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to be sent", func() bool { return s.Stats().Depth == 0 })
+	closeSpool(t, s)
+
+	if got := up.ids(); got != "b" {
+		t.Errorf("replayed %s, want only b", got)
+	}
+}
+
+func TestSpoolTruncatesTornRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+	}{
+		{"half a record", `{"id":"torn","username":"bo`},
+		{"no newline", `{"id":"torn"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempSpoolDir(t)
+			defer os.RemoveAll(dir)
+
+			// two complete records and a torn one, as a crash during Write
+			// leaves them
+			wal := `{"id":"a"}` + "\n" + `{"id":"b"}` + "\n" + tt.tail
+			err := ioutil.WriteFile(filepath.Join(dir, "audit.wal"), []byte(wal), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			backend := &fakeBackend{}
+			s, err := OpenSpool(dir, backend, nil, testSpoolOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a record written after the torn one starts on its own line
+			writeRecords(t, s, "c")
+			waitFor(t, "the records to be sent", func() bool { return s.Stats().Depth == 0 })
+			closeSpool(t, s)
+
+			if got := backend.ids(); got != "a,b,c" {
+				t.Errorf("stored %s, want a,b,c", got)
+			}
+		})
+	}
+}
+
+func TestSpoolReplayRejectsCorruptRecord(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// a complete line that is not a record was not written by Write, the
+	// spool does not guess what to do with it
+	err := ioutil.WriteFile(filepath.Join(dir, "audit.wal"), []byte("not json\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenSpool(dir, &fakeBackend{}, nil, testSpoolOptions)
+	if err == nil {
+		t.Error("OpenSpool() = nil, want an error for a corrupt wal")
+	}
+}
+
+func TestSpoolDeadLettersRejectedRecord(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	backend := &fakeBackend{fail: func(rec *Record) error {
+		if rec.ID == "bad" {
+			return status.Error(codes.InvalidArgument, "bad record")
+		}
+		return nil
+	}}
+	s, err := OpenSpool(dir, backend, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, s, "a", "bad", "c")
+	waitFor(t, "the records behind the rejected one", func() bool { return s.Stats().Depth == 0 })
+	closeSpool(t, s)
+
+	if got := backend.ids(); got != "a,c" {
+		t.Errorf("stored %s, want a,c", got)
+	}
+	if got := backend.tries("bad"); got != testSpoolOptions.MaxRejections {
+		t.Errorf("bad was tried %d times, want %d", got, testSpoolOptions.MaxRejections)
+	}
+	if st := s.Stats(); st.Sent != 2 || st.DeadLettered != 1 {
+		t.Errorf("sent %d dead lettered %d, want 2 and 1", st.Sent, st.DeadLettered)
+	}
+
+	dead, err := ioutil.ReadFile(filepath.Join(dir, "audit.dead"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dead), `"id":"bad"`) || !strings.Contains(string(dead), "bad record") {
+		t.Errorf("dead letter file %q, want the record and its error", dead)
+	}
+}
+
+func TestSpoolRetriesOtherErrors(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// errors that say nothing about the record itself are tried again,
+	// however often they happen
+	var mu sync.Mutex
+	failures := 0
+	backend := &fakeBackend{fail: func(rec *Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures < 2*testSpoolOptions.MaxRejections {
+			failures++
+			return errors.New("connection reset")
+		}
+		return nil
+	}}
+	s, err := OpenSpool(dir, backend, nil, testSpoolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, s, "a")
+	waitFor(t, "the record to be sent", func() bool { return s.Stats().Depth == 0 })
+	closeSpool(t, s)
+
+	if got := backend.ids(); got != "a" {
+		t.Errorf("stored %s, want a", got)
+	}
+	if st := s.Stats(); st.DeadLettered != 0 || st.Failures == 0 {
+		t.Errorf("dead lettered %d failures %d, want none and some", st.DeadLettered, st.Failures)
+	}
+}
+
+func TestRepositoryBackendDuplicate(t *testing.T) {
+	backend := NewBackend(repository.NewMemory(nil).Audits)
+	rec := &Record{ID: "5d0000000000000000000001", Action: "POST: /role/create", CreatedAt: time.Now()}
+
+	// a record replayed after it was stored is not an error
+	for i := 0; i < 2; i++ {
+		err := backend.Create(context.Background(), rec)
+		if err != nil {
+			t.Fatalf("Create() #%d = %v, want nil", i+1, err)
+		}
+	}
+}
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.InvalidArgument, ""), true},
+		{status.Error(codes.FailedPrecondition, ""), true},
+		{status.Error(codes.OutOfRange, ""), true},
+		{status.Error(codes.Unavailable, ""), false},
+		{status.Error(codes.DeadlineExceeded, ""), false},
+		{status.Error(codes.Internal, ""), false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("network"), false},
+	}
+
+	for _, tt := range tests {
+		if got := rejected(tt.err); got != tt.want {
+			t.Errorf("rejected(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapeSDParam(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{`say "hi"`, `say \"hi\"`},
+		{`C:\path`, `C:\\path`},
+		{"a]b", `a\]b`},
+		{`\"]`, `\\\"\]`},
+	}
+
+	for _, tt := range tests {
+		got := escapeSDParam(tt.in)
+		if got != tt.want {
+			t.Errorf("escapeSDParam(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSyslogSinkFormat(t *testing.T) {
+	createdAt := time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		sink     *SyslogSink
+		rec      *Record
+		contains []string
+		prefix   string
+	}{
+		{
+			name:   "header",
+			sink:   &SyslogSink{Facility: FacilityLogAudit, Severity: SeverityNotice, AppName: "web", Hostname: "host1"},
+			rec:    &Record{ID: "1", Username: "alice", Action: "POST: /role/create", CreatedBy: "System", CreatedAt: createdAt},
+			prefix: "<109>1 2019-06-01T12:30:00Z host1 web " + strconv.Itoa(os.Getpid()) + " audit ",
+			contains: []string{
+				`[audit@32473 id="1" username="alice" action="POST: /role/create" createdby="System" requestid=""]`,
+				`"username":"alice"`,
+			},
+		},
+		{
+			name:   "empty header fields are nil",
+			sink:   &SyslogSink{Facility: 1, Severity: 2},
+			rec:    &Record{ID: "2", CreatedAt: createdAt},
+			prefix: "<10>1 2019-06-01T12:30:00Z - - ",
+		},
+		{
+			name:   "hostname is printable ascii only",
+			sink:   &SyslogSink{Hostname: "bad host\n", AppName: "web"},
+			rec:    &Record{ID: "3", CreatedAt: createdAt},
+			prefix: "<0>1 2019-06-01T12:30:00Z badhost web ",
+		},
+		{
+			name: "params are escaped",
+			sink: &SyslogSink{},
+			rec:  &Record{ID: "4", Username: `x"]`, Action: `a\b`, RequestID: "r1", CreatedAt: createdAt},
+			contains: []string{
+				`username="x\"\]"`,
+				`action="a\\b"`,
+				`requestid="r1"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := tt.sink.Format(tt.rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(msg), tt.prefix) {
+				t.Errorf("message %q does not start with %q", msg, tt.prefix)
+			}
+			for _, c := range tt.contains {
+				if !strings.Contains(string(msg), c) {
+					t.Errorf("message %q does not contain %q", msg, c)
+				}
+			}
+		})
+	}
+}
+
+func TestSyslogSinkTCPFraming(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// octet counting, "<length> <message>"
+		r := bufio.NewReader(conn)
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			return
+		}
+		received <- string(msg)
+	}()
+
+	sink := NewSyslogSink("tcp", ln.Addr().String(), nil)
+	defer sink.Close()
+
+	err = sink.Write(context.Background(), &Record{ID: "tcp1", Username: "bob", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, `id="tcp1"`) {
+			t.Errorf("received %q, want the record", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink := NewSyslogSink("udp", conn.LocalAddr().String(), nil)
+	defer sink.Close()
+
+	err = sink.Write(context.Background(), &Record{ID: "udp1", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no framing over udp, one message per datagram
+	if !strings.HasPrefix(string(buf[:n]), "<109>1 ") || !strings.Contains(string(buf[:n]), `id="udp1"`) {
+		t.Errorf("received %q, want the record", buf[:n])
+	}
+}
+
+func TestSyslogSinkUnsupportedNetwork(t *testing.T) {
+	sink := NewSyslogSink("sctp", "127.0.0.1:514", nil)
+	err := sink.Write(context.Background(), &Record{ID: "x"})
+	if _, ok := err.(permanentError); !ok {
+		t.Errorf("Write() = %v, want a permanent error", err)
+	}
+}
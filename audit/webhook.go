@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers set on every webhook request.
+const (
+	WebhookTimestampHeader = "X-Audit-Timestamp"
+	WebhookSignatureHeader = "X-Audit-Signature"
+)
+
+// WebhookSink POSTs each record as JSON to a URL. When a secret is set the
+// request carries an HMAC-SHA256 signature of "<timestamp>.<body>" in the
+// X-Audit-Signature header as "sha256=<hex>", receivers should recompute
+// it and reject stale timestamps.
+type WebhookSink struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+// NewWebhookSink returns a WebhookSink with a 10 second client timeout.
+func NewWebhookSink(url string, secret []byte) *WebhookSink {
+	return &WebhookSink{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the sink.
+func (s *WebhookSink) Name() string {
+	return fmt.Sprintf("webhook(%s)", s.URL)
+}
+
+// Write posts one record. Client errors other than 408 and 429 are not
+// retried, everything else is.
+func (s *WebhookSink) Write(ctx context.Context, rec *Record) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req = req.WithContext(ctx)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if len(s.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+Sign(s.Secret, timestamp, body))
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("webhook returned %s", res.Status)
+	if res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusRequestTimeout &&
+		res.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// Close does nothing, the http client holds no resources that need
+// releasing.
+func (s *WebhookSink) Close() error {
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>".
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookSinkRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		wantErr  bool
+		wantHits int32
+	}{
+		{"ok", []int{http.StatusOK}, 3, false, 1},
+		{"accepted", []int{http.StatusAccepted}, 3, false, 1},
+		{"server errors are retried", []int{500, 502, http.StatusOK}, 3, false, 3},
+		{"timeouts and rate limits are retried", []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusOK}, 3, false, 3},
+		{"client errors are not retried", []int{http.StatusBadRequest, http.StatusOK}, 3, true, 1},
+		{"gives up after the attempts", []int{503, 503, 503, http.StatusOK}, 3, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&hits, 1)
+				w.WriteHeader(tt.statuses[int(n)-1])
+			}))
+			defer srv.Close()
+
+			sink := NewWebhookSink(srv.URL, nil)
+			retry := Retry{Attempts: tt.attempts, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+			rec := &Record{ID: "1"}
+			err := retry.do(context.Background(), func() error {
+				return sink.Write(context.Background(), rec)
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&hits); got != tt.wantHits {
+				t.Errorf("%d requests, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkSignature(t *testing.T) {
+	secret := []byte("secret")
+
+	type request struct {
+		timestamp string
+		signature string
+		body      []byte
+	}
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{
+			timestamp: r.Header.Get(WebhookTimestampHeader),
+			signature: r.Header.Get(WebhookSignatureHeader),
+			body:      body,
+		}
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL, secret)
+	err := sink.Write(context.Background(), &Record{ID: "signed", Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if req.timestamp == "" {
+		t.Fatal("no timestamp header")
+	}
+	if want := "sha256=" + Sign(secret, req.timestamp, req.body); req.signature != want {
+		t.Errorf("signature %q, want %q", req.signature, want)
+	}
+
+	var rec Record
+	err = json.Unmarshal(req.body, &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != "signed" || rec.Username != "alice" {
+		t.Errorf("body %s, want the record", req.body)
+	}
+}
+
+func TestWebhookSinkUnsigned(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(WebhookSignatureHeader) != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	err := NewWebhookSink(srv.URL, nil).Write(context.Background(), &Record{ID: "1"})
+	if err != nil {
+		t.Errorf("Write() = %v, want no signature without a secret", err)
+	}
+}
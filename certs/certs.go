@@ -0,0 +1,324 @@
+// Package certs tracks the TLS certificates of the servers in the
+// inventory, either found by a TLS handshake with their endpoints or
+// uploaded as PEM for hosts that can not be reached, and warns before they
+// expire.
+package certs
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Where a certificate came from.
+const (
+	Scan   = "scan"
+	Upload = "upload"
+)
+
+// ErrNoCertificate is returned for PEM data without a certificate.
+var ErrNoCertificate = errors.New("no certificate found in PEM data")
+
+// Cert is the leaf certificate found on an endpoint or uploaded for a
+// server.
+type Cert struct {
+	ID          string    `bson:"_id"`
+	ServerID    string    `bson:"serverid"`
+	Hostname    string    `bson:"hostname"`
+	Endpoint    string    `bson:"endpoint"`
+	Source      string    `bson:"source"`
+	Subject     string    `bson:"subject"`
+	SANs        []string  `bson:"sans"`
+	Issuer      string    `bson:"issuer"`
+	Serial      string    `bson:"serial"`
+	Fingerprint string    `bson:"fingerprint"`
+	NotBefore   time.Time `bson:"notbefore"`
+	NotAfter    time.Time `bson:"notafter"`
+	ChainValid  bool      `bson:"chainvalid"`
+	ChainError  string    `bson:"chainerror,omitempty"`
+	// Error is set when the last scan failed, the certificate details are
+	// from the last scan that worked.
+	Error     string    `bson:"error,omitempty"`
+	CheckedAt time.Time `bson:"checkedat"`
+	// WarnedDays is the tightest warning threshold an alert was sent for,
+	// it only counts when WarnedAt is set.
+	WarnedDays int       `bson:"warneddays"`
+	WarnedAt   time.Time `bson:"warnedat,omitempty"`
+	CreatedBy  string    `bson:"createdby,omitempty"`
+}
+
+// DaysLeft returns the whole days until the certificate expires, negative
+// once it has expired.
+func (c *Cert) DaysLeft() int {
+	return int(math.Floor(time.Until(c.NotAfter).Hours() / 24))
+}
+
+// Expired reports whether the certificate has expired.
+func (c *Cert) Expired() bool {
+	return time.Now().After(c.NotAfter)
+}
+
+// ScanID is the id of the scanned certificate of a server endpoint.
+func ScanID(serverID, endpoint string) string {
+	return serverID + "/" + endpoint
+}
+
+// describe fills in the details of leaf and checks its chain against
+// roots, or the system roots when roots is nil. An empty name skips the
+// hostname check.
+func describe(leaf *x509.Certificate, intermediates []*x509.Certificate, name string, roots *x509.CertPool) *Cert {
+	sum := sha256.Sum256(leaf.Raw)
+
+	sans := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	cert := &Cert{
+		Subject:     leaf.Subject.String(),
+		SANs:        sans,
+		Issuer:      leaf.Issuer.String(),
+		Serial:      leaf.SerialNumber.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotBefore:   leaf.NotBefore.UTC(),
+		NotAfter:    leaf.NotAfter.UTC(),
+		CheckedAt:   time.Now().UTC(),
+	}
+
+	pool := x509.NewCertPool()
+	for _, c := range intermediates {
+		pool.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Intermediates: pool,
+		Roots:         roots,
+	})
+	cert.ChainValid = err == nil
+	if err != nil {
+		cert.ChainError = err.Error()
+	}
+
+	return cert
+}
+
+// Inspect completes a TLS handshake with endpoint, a host:port, and
+// describes the certificate it presents, its chain is checked against
+// roots or the system roots when roots is nil.
+func Inspect(ctx context.Context, endpoint string, timeout time.Duration, roots *x509.CertPool) (*Cert, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// the chain is verified by describe so an untrusted certificate is
+	// still recorded
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+	})
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := tlsConn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	return describe(peers[0], peers[1:], host, roots), nil
+}
+
+// ParsePEM describes the first certificate in data, any further
+// certificates are used as intermediates. name is checked against the
+// certificate if it is not empty, the chain against roots or the system
+// roots when roots is nil.
+func ParsePEM(data []byte, name string, roots *x509.CertPool) (*Cert, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, c)
+	}
+	if len(chain) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	return describe(chain[0], chain[1:], name, roots), nil
+}
+
+// LoadRoots returns the system roots with the certificates in the PEM file
+// added, for chains signed by a private CA.
+func LoadRoots(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: %v", file, ErrNoCertificate)
+	}
+	return roots, nil
+}
+
+// Threshold returns the tightest of thresholds, in days, that daysLeft is
+// within, and false if it is within none. An expired certificate is within
+// a threshold of 0.
+func Threshold(daysLeft int, thresholds []int) (int, bool) {
+	if daysLeft < 0 {
+		return 0, true
+	}
+
+	found := false
+	min := 0
+	for _, t := range thresholds {
+		if daysLeft <= t && (!found || t < min) {
+			min = t
+			found = true
+		}
+	}
+	return min, found
+}
+
+// ParseThresholds reads warning thresholds written as "30,14,7,1".
+func ParseThresholds(s string) ([]int, error) {
+	var thresholds []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		days, err := strconv.Atoi(f)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("warning threshold %q is not a number of days", f)
+		}
+		thresholds = append(thresholds, days)
+	}
+	return thresholds, nil
+}
+
+// Store keeps certificates in MongoDB.
+type Store struct {
+	col *mongo.Collection
+}
+
+// NewStore returns a Store using col.
+func NewStore(col *mongo.Collection) *Store {
+	return &Store{col: col}
+}
+
+// List returns every certificate, the first to expire first.
+func (s *Store) List(ctx context.Context) ([]*Cert, error) {
+	return s.find(ctx, bson.M{})
+}
+
+// ListByServer returns the certificates of a server, the first to expire
+// first.
+func (s *Store) ListByServer(ctx context.Context, serverID string) ([]*Cert, error) {
+	return s.find(ctx, bson.M{"serverid": serverID})
+}
+
+// Read returns a certificate by id, or nil if there is none.
+func (s *Store) Read(ctx context.Context, id string) (*Cert, error) {
+	cert := new(Cert)
+	err := s.col.FindOne(ctx, bson.M{"_id": id}).Decode(cert)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Upload adds an uploaded certificate and returns its id.
+func (s *Store) Upload(ctx context.Context, cert *Cert) (string, error) {
+	cert.ID = primitive.NewObjectID().Hex()
+	cert.Source = Upload
+
+	_, err := s.col.InsertOne(ctx, cert)
+	if err != nil {
+		return "", err
+	}
+	return cert.ID, nil
+}
+
+// Save replaces a certificate, adding it if it is new.
+func (s *Store) Save(ctx context.Context, cert *Cert) error {
+	_, err := s.col.ReplaceOne(ctx, bson.M{"_id": cert.ID}, cert, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Delete removes a certificate.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	res, err := s.col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (s *Store) find(ctx context.Context, filter interface{}) ([]*Cert, error) {
+	cursor, err := s.col.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "notafter", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var list []*Cert
+	for cursor.Next(ctx) {
+		cert := new(Cert)
+		err := cursor.Decode(cert)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, cert)
+	}
+
+	return list, cursor.Err()
+}
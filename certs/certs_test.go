@@ -0,0 +1,266 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issued is a certificate and the key it was issued for.
+type issued struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate from template signed by parent, or self
+// signed when parent is nil.
+func issue(t *testing.T, template *x509.Certificate, parent *issued) *issued {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issued{cert: cert, key: key}
+}
+
+func ca(serial int64, name string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+}
+
+func leaf(serial int64, notAfter time.Time) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "web1.example.com"},
+		DNSNames:     []string{"web1.example.com", "web1"},
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+func encode(certs ...*issued) []byte {
+	var b bytes.Buffer
+	for _, c := range certs {
+		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	}
+	return b.Bytes()
+}
+
+func pool(certs ...*issued) *x509.CertPool {
+	p := x509.NewCertPool()
+	for _, c := range certs {
+		p.AddCert(c.cert)
+	}
+	return p
+}
+
+func TestDescribe(t *testing.T) {
+	root := issue(t, ca(1, "Test Root"), nil)
+	inter := issue(t, ca(2, "Test Intermediate"), root)
+	notAfter := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	cert := issue(t, leaf(3, notAfter), inter)
+	expired := issue(t, leaf(4, time.Now().Add(-time.Minute)), root)
+
+	tests := []struct {
+		name          string
+		leaf          *issued
+		intermediates []*x509.Certificate
+		host          string
+		roots         *x509.CertPool
+		wantValid     bool
+		wantError     string
+	}{
+		{"trusted chain", cert, []*x509.Certificate{inter.cert}, "web1.example.com", pool(root), true, ""},
+		{"no name skips the hostname check", cert, []*x509.Certificate{inter.cert}, "", pool(root), true, ""},
+		{"short name in the sans", cert, []*x509.Certificate{inter.cert}, "web1", pool(root), true, ""},
+		{"ip in the sans", cert, []*x509.Certificate{inter.cert}, "10.0.0.1", pool(root), true, ""},
+		{"wrong name", cert, []*x509.Certificate{inter.cert}, "web2.example.com", pool(root), false, "web2.example.com"},
+		{"missing intermediate", cert, nil, "web1.example.com", pool(root), false, "unknown authority"},
+		{"intermediate as root", cert, nil, "web1.example.com", pool(inter), true, ""},
+		{"unknown root", cert, []*x509.Certificate{inter.cert}, "web1.example.com", pool(issue(t, ca(5, "Other Root"), nil)), false, "unknown authority"},
+		{"system roots", cert, []*x509.Certificate{inter.cert}, "web1.example.com", nil, false, "x509"},
+		{"expired", expired, nil, "web1.example.com", pool(root), false, "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := describe(tt.leaf.cert, tt.intermediates, tt.host, tt.roots)
+
+			if c.ChainValid != tt.wantValid {
+				t.Errorf("chain valid = %v, want %v, error %q", c.ChainValid, tt.wantValid, c.ChainError)
+			}
+			if !strings.Contains(c.ChainError, tt.wantError) || (tt.wantError == "") != (c.ChainError == "") {
+				t.Errorf("chain error = %q, want %q", c.ChainError, tt.wantError)
+			}
+		})
+	}
+
+	t.Run("details", func(t *testing.T) {
+		c := describe(cert.cert, nil, "", nil)
+
+		sum := sha256.Sum256(cert.cert.Raw)
+		want := &Cert{
+			Subject:     "CN=web1.example.com",
+			SANs:        []string{"web1.example.com", "web1", "10.0.0.1"},
+			Issuer:      "CN=Test Intermediate",
+			Serial:      "3",
+			Fingerprint: hex.EncodeToString(sum[:]),
+			NotAfter:    notAfter.UTC(),
+		}
+		if c.Subject != want.Subject || c.Issuer != want.Issuer || c.Serial != want.Serial || c.Fingerprint != want.Fingerprint {
+			t.Errorf("got %s %s %s %s, want %s %s %s %s", c.Subject, c.Issuer, c.Serial, c.Fingerprint,
+				want.Subject, want.Issuer, want.Serial, want.Fingerprint)
+		}
+		if strings.Join(c.SANs, ",") != strings.Join(want.SANs, ",") {
+			t.Errorf("sans %v, want %v", c.SANs, want.SANs)
+		}
+		if !c.NotAfter.Equal(want.NotAfter) || c.NotAfter.Location() != time.UTC || c.NotBefore.Location() != time.UTC {
+			t.Errorf("not after %v, want %v in UTC", c.NotAfter, want.NotAfter)
+		}
+		if c.DaysLeft() != 9 && c.DaysLeft() != 10 {
+			t.Errorf("%d days left, want 9 or 10", c.DaysLeft())
+		}
+		if c.Expired() {
+			t.Error("expired")
+		}
+		if c.CheckedAt.IsZero() {
+			t.Error("checked at not set")
+		}
+	})
+}
+
+func TestParsePEM(t *testing.T) {
+	root := issue(t, ca(1, "Test Root"), nil)
+	inter := issue(t, ca(2, "Test Intermediate"), root)
+	cert := issue(t, leaf(3, time.Now().Add(24*time.Hour)), inter)
+
+	key, err := x509.MarshalECPrivateKey(cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+
+	tests := []struct {
+		name        string
+		data        []byte
+		host        string
+		wantErr     error
+		wantSubject string
+		wantValid   bool
+	}{
+		{"leaf and intermediate", encode(cert, inter), "web1.example.com", nil, "CN=web1.example.com", true},
+		{"leaf alone", encode(cert), "web1.example.com", nil, "CN=web1.example.com", false},
+		{"first certificate is the leaf", encode(inter, cert), "", nil, "CN=Test Intermediate", true},
+		{"other blocks are skipped", append(keyPEM, encode(cert, inter)...), "web1.example.com", nil, "CN=web1.example.com", true},
+		{"wrong name", encode(cert, inter), "web2.example.com", nil, "CN=web1.example.com", false},
+		{"text around the blocks", append([]byte("subject=web1\n"), encode(cert, inter)...), "", nil, "CN=web1.example.com", true},
+		{"empty", nil, "", ErrNoCertificate, "", false},
+		{"not pem", []byte("hello"), "", ErrNoCertificate, "", false},
+		{"key only", keyPEM, "", ErrNoCertificate, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParsePEM(tt.data, tt.host, pool(root))
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if c.Subject != tt.wantSubject {
+				t.Errorf("subject %q, want %q", c.Subject, tt.wantSubject)
+			}
+			if c.ChainValid != tt.wantValid {
+				t.Errorf("chain valid = %v, want %v, error %q", c.ChainValid, tt.wantValid, c.ChainError)
+			}
+		})
+	}
+
+	t.Run("bad certificate", func(t *testing.T) {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not der")})
+		_, err := ParsePEM(data, "", nil)
+		if err == nil || err == ErrNoCertificate {
+			t.Errorf("err = %v, want a parse error", err)
+		}
+	})
+}
+
+func TestLoadRoots(t *testing.T) {
+	root := issue(t, ca(1, "Test Root"), nil)
+	cert := issue(t, leaf(2, time.Now().Add(24*time.Hour)), root)
+
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(bundle, encode(root), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := LoadRoots(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ParsePEM(encode(cert), "web1.example.com", roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.ChainValid {
+		t.Errorf("chain not valid with the bundle: %s", c.ChainError)
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	err = ioutil.WriteFile(empty, []byte("nothing here"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadRoots(empty)
+	if err == nil {
+		t.Error("a bundle without certificates loaded")
+	}
+
+	_, err = LoadRoots(filepath.Join(dir, "missing.pem"))
+	if err == nil {
+		t.Error("a missing bundle loaded")
+	}
+}
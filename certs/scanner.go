@@ -0,0 +1,263 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/notify"
+)
+
+// Options tune the Scanner.
+type Options struct {
+	// Interval is the time between scans.
+	Interval time.Duration
+	// Timeout bounds a single handshake.
+	Timeout time.Duration
+	// Thresholds are the days before expiry at which a warning is sent,
+	// each threshold is only warned about once per certificate.
+	Thresholds []int
+	// Roots verify certificate chains, nil uses the system roots.
+	Roots *x509.CertPool
+}
+
+// DefaultOptions scan twice a day and warn 30, 14, 7 and 1 days before a
+// certificate expires.
+var DefaultOptions = Options{
+	Interval:   12 * time.Hour,
+	Timeout:    10 * time.Second,
+	Thresholds: []int{30, 14, 7, 1},
+}
+
+// Scanner inspects the TLS endpoints of every server in the inventory,
+// records their certificates and warns through a Notifier as they get
+// close to expiry.
+type Scanner struct {
+	servers  *inventory.Store
+	store    *Store
+	notifier *notify.Notifier
+	opts     Options
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewScanner returns a Scanner, Start runs it.
+func NewScanner(servers *inventory.Store, store *Store, notifier *notify.Notifier, opts Options) *Scanner {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultOptions.Interval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultOptions.Timeout
+	}
+
+	return &Scanner{
+		servers:  servers,
+		store:    store,
+		notifier: notifier,
+		opts:     opts,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start scans once per Interval in the background until Close is called.
+func (s *Scanner) Start() {
+	go s.run()
+}
+
+// Close stops the scanner and waits for a running scan to finish.
+func (s *Scanner) Close() {
+	close(s.quit)
+	<-s.done
+}
+
+func (s *Scanner) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		ctx := context.Background()
+		err := s.ScanAll(ctx)
+		if err != nil {
+			logging.Error(ctx, "ScanAll() failed", "error", err)
+		}
+
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScanAll inspects every TLS endpoint once, drops the certificates of
+// endpoints and servers that are gone and sends the warnings that are due,
+// uploaded certificates included. A certificate that can not be saved or
+// dropped does not hold up the others, the failures are returned together.
+func (s *Scanner) ScanAll(ctx context.Context) error {
+	servers, err := s.servers.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]*Cert, len(existing))
+	for _, cert := range existing {
+		known[cert.ID] = cert
+	}
+
+	var failed []string
+	alive := make(map[string]bool)
+	for _, server := range servers {
+		alive[server.ID] = true
+
+		for _, endpoint := range server.TLSEndpoints {
+			id := ScanID(server.ID, endpoint)
+			cert := s.scan(ctx, server, endpoint, known[id])
+			delete(known, id)
+
+			err := s.store.Save(ctx, cert)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("save %s: %v", id, err))
+			}
+		}
+	}
+
+	// what is left was uploaded, or belongs to an endpoint that is gone
+	for id, cert := range known {
+		if cert.Source == Upload && alive[cert.ServerID] {
+			err := s.Warn(ctx, cert)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("save %s: %v", id, err))
+			}
+			continue
+		}
+
+		err := s.store.Delete(ctx, id)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("delete %s: %v", id, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d certificates failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// scan inspects one endpoint. A failed scan keeps the details of the last
+// certificate found so it is still warned about.
+func (s *Scanner) scan(ctx context.Context, server *inventory.Server, endpoint string, prev *Cert) *Cert {
+	cert, err := Inspect(ctx, endpoint, s.opts.Timeout, s.opts.Roots)
+	if err != nil {
+		logging.Warn(ctx, "Inspect() failed", "endpoint", endpoint, "error", err)
+		if prev == nil {
+			prev = &Cert{
+				ID:       ScanID(server.ID, endpoint),
+				ServerID: server.ID,
+				Endpoint: endpoint,
+				Source:   Scan,
+			}
+		}
+		prev.Hostname = server.Hostname
+		prev.Error = err.Error()
+		prev.CheckedAt = time.Now().UTC()
+		s.warn(prev)
+		return prev
+	}
+
+	cert.ID = ScanID(server.ID, endpoint)
+	cert.ServerID = server.ID
+	cert.Hostname = server.Hostname
+	cert.Endpoint = endpoint
+	cert.Source = Scan
+
+	// warnings already sent carry over until the certificate is renewed
+	if prev != nil && prev.Fingerprint == cert.Fingerprint {
+		cert.WarnedDays = prev.WarnedDays
+		cert.WarnedAt = prev.WarnedAt
+	}
+
+	s.warn(cert)
+	return cert
+}
+
+// Roots returns the roots certificate chains are verified against, nil
+// for the system roots.
+func (s *Scanner) Roots() *x509.CertPool {
+	return s.opts.Roots
+}
+
+// WarnDays returns the widest warning threshold, certificates expiring
+// within it are about to be warned about.
+func (s *Scanner) WarnDays() int {
+	max := 0
+	for _, t := range s.opts.Thresholds {
+		if t > max {
+			max = t
+		}
+	}
+	return max
+}
+
+// Warn sends the warning that is due for cert, if any, and saves it.
+func (s *Scanner) Warn(ctx context.Context, cert *Cert) error {
+	if !s.warn(cert) {
+		return nil
+	}
+	return s.store.Save(ctx, cert)
+}
+
+// warn sends the warning that is due for cert, if any, and reports whether
+// it did. The caller saves the certificate.
+func (s *Scanner) warn(cert *Cert) bool {
+	// nothing was ever found on the endpoint
+	if cert.Fingerprint == "" {
+		return false
+	}
+
+	days := cert.DaysLeft()
+	threshold, ok := Threshold(days, s.opts.Thresholds)
+	if !ok {
+		return false
+	}
+	if !cert.WarnedAt.IsZero() && threshold >= cert.WarnedDays {
+		return false
+	}
+
+	cert.WarnedDays = threshold
+	cert.WarnedAt = time.Now().UTC()
+
+	kind := "expiring"
+	message := fmt.Sprintf("certificate of %s on %s expires in %d days", cert.Hostname, cert.Endpoint, days)
+	if cert.Expired() {
+		kind = "expired"
+		message = fmt.Sprintf("certificate of %s on %s has expired", cert.Hostname, cert.Endpoint)
+	}
+
+	s.notifier.Send(notify.Alert{
+		Source:  "certs",
+		Kind:    kind,
+		Subject: cert.Hostname,
+		Message: message,
+		Fields: map[string]string{
+			"endpoint":    cert.Endpoint,
+			"subject":     cert.Subject,
+			"issuer":      cert.Issuer,
+			"notafter":    cert.NotAfter.Format(time.RFC3339),
+			"fingerprint": cert.Fingerprint,
+		},
+	})
+
+	return true
+}
@@ -0,0 +1,415 @@
+// Package config loads the configuration of the web app. Each setting is
+// read from, lowest precedence first, its default, the config file, the
+// environment, a secret file named by <ENV>_FILE and a flag.
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-stuff/web/agent"
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/certs"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/reachability"
+	"github.com/go-stuff/web/repository"
+	"github.com/go-stuff/web/security"
+	"github.com/go-stuff/web/sessionstore"
+	"github.com/go-stuff/web/tlsconfig"
+)
+
+// Config is the configuration of the web app. A setting has an env tag,
+// its environment variable is the env tags of its sections and its own
+// joined by "_", and a toml tag, its key in the config file and its flag
+// are the toml tags joined by ".". Settings tagged secret are redacted
+// when the config is dumped.
+type Config struct {
+	Server   Server   `toml:"server"`
+	TLS      TLS      `toml:"tls" env:"TLS"`
+	Mongo    Mongo    `toml:"mongo"`
+	Data     Data     `toml:"data"`
+	GRPC     GRPC     `toml:"grpc" env:"GRPC"`
+	LDAP     LDAP     `toml:"ldap"`
+	Session  Session  `toml:"session"`
+	CSRF     CSRF     `toml:"csrf"`
+	Redact   Redact   `toml:"redact"`
+	Audit    Audit    `toml:"audit" env:"AUDIT"`
+	Security Security `toml:"security" env:"SECURITY"`
+	Alert    Alert    `toml:"alert" env:"ALERT"`
+	Checks   Checks   `toml:"checks" env:"SERVER_CHECK"`
+	Certs    Certs    `toml:"certs" env:"CERT"`
+	Agents   Agents   `toml:"agents" env:"AGENT"`
+	Metrics  Metrics  `toml:"metrics" env:"METRICS"`
+	Log      Log      `toml:"log" env:"LOG"`
+
+	// Args are the arguments left after the flags, the subcommand and its
+	// own arguments.
+	Args []string
+	// PrintConfig is set by -print-config, the effective config is dumped
+	// instead of running.
+	PrintConfig bool
+
+	// sources records where each setting was last set from, by env name.
+	sources map[string]string
+}
+
+// Server is how the app is served.
+type Server struct {
+	// Addr is the tcp address to listen on, or unix:/path for a unix
+	// socket, unless a socket is passed by systemd or a restart.
+	Addr string `toml:"addr" env:"SERVER_ADDR"`
+	// BasePath is the path the app is mounted under, empty for the root.
+	BasePath     string        `toml:"base_path" env:"BASE_PATH"`
+	ReadTimeout  time.Duration `toml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout time.Duration `toml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `toml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	// ShutdownTimeout is how long requests are drained for when the app is
+	// stopped.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	// RestartTimeout is how long the new process started on SIGHUP has to
+	// set up before it is killed and the old one keeps serving.
+	RestartTimeout time.Duration `toml:"restart_timeout" env:"SERVER_RESTART_TIMEOUT"`
+}
+
+// TLS is how https is served, it is on when CertFile is set. The session
+// and csrf cookies are only sent over https when it is.
+type TLS struct {
+	CertFile string `toml:"cert_file" env:"CERT_FILE"`
+	KeyFile  string `toml:"key_file" env:"KEY_FILE"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string `toml:"min_version" env:"MIN_VERSION"`
+	// Ciphers is the cipher suite policy, modern or compatible.
+	Ciphers string `toml:"ciphers" env:"CIPHERS"`
+	// ClientCAFile, when set, is the ca bundle client certificates must be
+	// signed by.
+	ClientCAFile   string        `toml:"client_ca_file" env:"CLIENT_CA_FILE"`
+	ReloadInterval time.Duration `toml:"reload_interval" env:"RELOAD_INTERVAL"`
+	// RedirectAddr, when set, is the address, such as :80, plain http is
+	// redirected to https from.
+	RedirectAddr string `toml:"redirect_addr" env:"REDIRECT_ADDR"`
+	// HSTSMaxAge is how long browsers only use https for, 0 does not send
+	// Strict-Transport-Security.
+	HSTSMaxAge            time.Duration `toml:"hsts_max_age" env:"HSTS_MAX_AGE"`
+	HSTSIncludeSubdomains bool          `toml:"hsts_include_subdomains" env:"HSTS_INCLUDE_SUBDOMAINS"`
+}
+
+// Enabled reports whether https is served.
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Mongo is the database of the inventory, sessions and events.
+type Mongo struct {
+	URL    string `toml:"url" env:"MONGOURL" secret:"true"`
+	DBName string `toml:"db_name" env:"MONGO_DB_NAME"`
+}
+
+// Data is where users, roles, routes, the audit log and the list of
+// sessions are kept, grpc or mongo.
+type Data struct {
+	Backend string `toml:"backend" env:"DATA_BACKEND"`
+}
+
+// GRPC is how the go-stuff/grpc service of the grpc data backend is
+// reached.
+type GRPC struct {
+	Addr string `toml:"addr" env:"ADDR"`
+	// TLS verifies the service against the system roots, or CAFile when it
+	// is set. CertFile and KeyFile are a client certificate for mutual tls.
+	TLS        bool   `toml:"tls" env:"TLS"`
+	CAFile     string `toml:"ca_file" env:"CA_FILE"`
+	CertFile   string `toml:"cert_file" env:"CERT_FILE"`
+	KeyFile    string `toml:"key_file" env:"KEY_FILE"`
+	ServerName string `toml:"server_name" env:"SERVER_NAME"`
+	// Timeout is the deadline of each call, DialTimeout how long the
+	// service has to answer at startup.
+	Timeout     time.Duration `toml:"timeout" env:"TIMEOUT"`
+	DialTimeout time.Duration `toml:"dial_timeout" env:"DIAL_TIMEOUT"`
+	// Retry is how a call is retried while the service can not be reached.
+	Retry Retry `toml:""`
+	// BreakerThreshold failures in a row stop calls to the service for
+	// BreakerCooldown.
+	BreakerThreshold int           `toml:"breaker_threshold" env:"BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration `toml:"breaker_cooldown" env:"BREAKER_COOLDOWN"`
+}
+
+// Options returns the settings as repository.GRPCOptions.
+func (g GRPC) Options() repository.GRPCOptions {
+	return repository.GRPCOptions{
+		Addr:             g.Addr,
+		TLS:              g.TLS,
+		CAFile:           g.CAFile,
+		CertFile:         g.CertFile,
+		KeyFile:          g.KeyFile,
+		ServerName:       g.ServerName,
+		Timeout:          g.Timeout,
+		Attempts:         g.Retry.Retries,
+		Backoff:          g.Retry.Backoff,
+		MaxBackoff:       g.Retry.MaxBackoff,
+		DialTimeout:      g.DialTimeout,
+		BreakerThreshold: g.BreakerThreshold,
+		BreakerCooldown:  g.BreakerCooldown,
+	}
+}
+
+// LDAP is the directory users log in against.
+type LDAP struct {
+	Server           string `toml:"server" env:"LDAP_SERVER"`
+	Port             string `toml:"port" env:"LDAP_PORT"`
+	BindDN           string `toml:"bind_dn" env:"LDAP_BIND_DN"`
+	BindPass         string `toml:"bind_pass" env:"LDAP_BIND_PASS" secret:"true"`
+	UserBaseDN       string `toml:"user_base_dn" env:"LDAP_USER_BASE_DN"`
+	UserSearchAttr   string `toml:"user_search_attr" env:"LDAP_USER_SEARCH_ATTR"`
+	GroupBaseDN      string `toml:"group_base_dn" env:"LDAP_GROUP_BASE_DN"`
+	GroupObjectClass string `toml:"group_object_class" env:"LDAP_GROUP_OBJECT_CLASS"`
+	GroupSearchAttr  string `toml:"group_search_attr" env:"LDAP_GROUP_SEARCH_ATTR"`
+	GroupSearchFull  bool   `toml:"group_search_full" env:"LDAP_GROUP_SEARCH_FULL"`
+	// AdminGroup is the ad group whose members are given the Admin role.
+	AdminGroup string `toml:"admin_group" env:"ADMIN_AD_GROUP"`
+}
+
+// Session is how sessions are kept and limited.
+type Session struct {
+	// Store is mongo, memory, cookie or token, by default mongo.
+	Store string `toml:"store" env:"SESSION_STORE"`
+	// TTL is the session lifetime in seconds.
+	TTL       int    `toml:"ttl" env:"MONGOSTORE_SESSION_TTL"`
+	HTTPSOnly bool   `toml:"https_only" env:"MONGOSTORE_HTTPS_ONLY"`
+	AuthKey   string `toml:"auth_key" env:"GORILLA_SESSION_AUTH_KEY" secret:"true"`
+	EncKey    string `toml:"enc_key" env:"GORILLA_SESSION_ENC_KEY" secret:"true"`
+	TokenKey  string `toml:"token_key" env:"SESSION_TOKEN_KEY" secret:"true"`
+	// RefreshInterval is how often an unchanged session is written again
+	// to push its expiry out.
+	RefreshInterval time.Duration `toml:"refresh_interval" env:"SESSION_REFRESH_INTERVAL"`
+	Limit           int           `toml:"limit" env:"SESSION_LIMIT"`
+	// LimitRoles are limits by role name, such as "Admin=2,Read Only=5".
+	LimitRoles  string `toml:"limit_roles" env:"SESSION_LIMIT_ROLES"`
+	LimitPolicy string `toml:"limit_policy" env:"SESSION_LIMIT_POLICY"`
+}
+
+// CSRF protects forms from cross site requests.
+type CSRF struct {
+	Key string `toml:"key" env:"GORILLA_CSRF_KEY" secret:"true"`
+}
+
+// Redact is what is masked in logs, audit records and alerts.
+type Redact struct {
+	// Fields are session value keys masked on top of redact.DefaultFields.
+	Fields       []string `toml:"fields" env:"REDACT_FIELDS"`
+	PatternsFile string   `toml:"patterns_file" env:"REDACT_PATTERNS_FILE"`
+	Mask         string   `toml:"mask" env:"REDACT_MASK"`
+	SessionIDKey string   `toml:"session_id_key" env:"REDACT_SESSION_ID_KEY" secret:"true"`
+}
+
+// Audit is how audit records are spooled and exported.
+type Audit struct {
+	// ExportCloseTimeout is how long the sinks have to export what they
+	// hold when the app is stopped.
+	ExportCloseTimeout time.Duration `toml:"export_close_timeout" env:"EXPORT_CLOSE_TIMEOUT"`
+
+	Spool   AuditSpool   `toml:"spool" env:"SPOOL"`
+	Syslog  AuditSyslog  `toml:"syslog" env:"SYSLOG"`
+	File    AuditFile    `toml:"file" env:"FILE"`
+	Webhook AuditWebhook `toml:"webhook" env:"WEBHOOK"`
+}
+
+// AuditSpool is the write-ahead file audit records wait in.
+type AuditSpool struct {
+	Dir           string        `toml:"dir" env:"DIR"`
+	BatchSize     int           `toml:"batch_size" env:"BATCH_SIZE"`
+	FlushInterval time.Duration `toml:"flush_interval" env:"FLUSH_INTERVAL"`
+	MaxBackoff    time.Duration `toml:"max_backoff" env:"MAX_BACKOFF"`
+	MaxRejections int           `toml:"max_rejections" env:"MAX_REJECTIONS"`
+	// CloseTimeout is how long pending records are flushed for when the
+	// app is stopped.
+	CloseTimeout time.Duration `toml:"close_timeout" env:"CLOSE_TIMEOUT"`
+}
+
+// Retry is how an audit sink retries a failed export, or the grpc backend
+// a failed call.
+type Retry struct {
+	Retries    int           `toml:"retries" env:"RETRIES"`
+	Backoff    time.Duration `toml:"backoff" env:"BACKOFF"`
+	MaxBackoff time.Duration `toml:"max_backoff" env:"MAX_BACKOFF"`
+}
+
+// Audit returns the retry as an audit.Retry.
+func (r Retry) Audit() audit.Retry {
+	return audit.Retry{Attempts: r.Retries, Backoff: r.Backoff, MaxBackoff: r.MaxBackoff}
+}
+
+// AuditSyslog is the syslog sink, enabled when Addr is set.
+type AuditSyslog struct {
+	Addr    string `toml:"addr" env:"ADDR"`
+	Network string `toml:"network" env:"NETWORK"`
+	CAFile  string `toml:"ca_file" env:"CA_FILE"`
+	AppName string `toml:"app_name" env:"APP_NAME"`
+	Retry   Retry  `toml:""`
+}
+
+// AuditFile is the rotating json-lines file sink, enabled when Path is set.
+type AuditFile struct {
+	Path       string `toml:"path" env:"PATH"`
+	MaxSizeMB  int64  `toml:"max_size_mb" env:"MAX_SIZE_MB"`
+	MaxBackups int    `toml:"max_backups" env:"MAX_BACKUPS"`
+	Retry      Retry  `toml:""`
+}
+
+// AuditWebhook is the hmac signed webhook sink, enabled when URL is set.
+type AuditWebhook struct {
+	URL    string `toml:"url" env:"URL" secret:"true"`
+	Secret string `toml:"secret" env:"SECRET" secret:"true"`
+	Retry  Retry  `toml:""`
+}
+
+// Security is when security events are raised.
+type Security struct {
+	FailureThreshold int           `toml:"failure_threshold" env:"FAILURE_THRESHOLD"`
+	FailureWindow    time.Duration `toml:"failure_window" env:"FAILURE_WINDOW"`
+	LockoutDuration  time.Duration `toml:"lockout_duration" env:"LOCKOUT_DURATION"`
+	// AdminHours are the usual admin hours as "start-end" in 24 hour
+	// clock, such as "07-19".
+	AdminHours string `toml:"admin_hours" env:"ADMIN_HOURS"`
+}
+
+// Alert is where alerts are posted besides the log.
+type Alert struct {
+	WebhookURL    string `toml:"webhook_url" env:"WEBHOOK_URL" secret:"true"`
+	WebhookSecret string `toml:"webhook_secret" env:"WEBHOOK_SECRET" secret:"true"`
+}
+
+// Checks are the reachability checks of servers.
+type Checks struct {
+	Interval  time.Duration `toml:"interval" env:"INTERVAL"`
+	Timeout   time.Duration `toml:"timeout" env:"TIMEOUT"`
+	Dampening int           `toml:"dampening" env:"DAMPENING"`
+	Retention time.Duration `toml:"retention" env:"RETENTION"`
+}
+
+// Certs are the tls certificate scans of servers.
+type Certs struct {
+	ScanInterval time.Duration `toml:"scan_interval" env:"SCAN_INTERVAL"`
+	ScanTimeout  time.Duration `toml:"scan_timeout" env:"SCAN_TIMEOUT"`
+	// WarnDays are the days before expiry to warn at, such as "30,14,7,1".
+	WarnDays string `toml:"warn_days" env:"WARN_DAYS"`
+	// CAFile is a ca bundle trusted on top of the system roots when
+	// certificate chains are checked.
+	CAFile string `toml:"ca_file" env:"CA_FILE"`
+}
+
+// Agents are the check-ins of server agents.
+type Agents struct {
+	StaleAfter time.Duration `toml:"stale_after" env:"STALE_AFTER"`
+}
+
+// Metrics is who may read /metrics, clients connecting from Allow or
+// sending Token as a bearer token.
+type Metrics struct {
+	Allow []string `toml:"allow" env:"ALLOW"`
+	Token string   `toml:"token" env:"TOKEN" secret:"true"`
+}
+
+// Log is how lines are logged, Level is debug, info, warn or error and can
+// be changed while running from the status page, Format is logfmt or json.
+type Log struct {
+	Level  string `toml:"level" env:"LEVEL"`
+	Format string `toml:"format" env:"FORMAT"`
+}
+
+// Defaults returns the configuration used when nothing is set.
+func Defaults() *Config {
+	c := new(Config)
+
+	c.Server.Addr = ":8080"
+	c.Server.ReadTimeout = 10 * time.Second
+	c.Server.WriteTimeout = 10 * time.Second
+	c.Server.IdleTimeout = 2 * time.Minute
+	c.Server.ShutdownTimeout = 30 * time.Second
+	c.Server.RestartTimeout = time.Minute
+	c.TLS.MinVersion = tlsconfig.DefaultOptions.MinVersion
+	c.TLS.Ciphers = tlsconfig.DefaultOptions.Ciphers
+	c.TLS.ReloadInterval = tlsconfig.DefaultOptions.ReloadInterval
+	c.TLS.HSTSMaxAge = 365 * 24 * time.Hour
+
+	c.Mongo.URL = "mongodb://localhost:27017"
+	c.Mongo.DBName = "test"
+	c.Data.Backend = "grpc"
+	c.GRPC.Addr = repository.DefaultGRPCOptions.Addr
+	c.GRPC.Timeout = repository.DefaultGRPCOptions.Timeout
+	c.GRPC.DialTimeout = repository.DefaultGRPCOptions.DialTimeout
+	c.GRPC.Retry.Retries = repository.DefaultGRPCOptions.Attempts
+	c.GRPC.Retry.Backoff = repository.DefaultGRPCOptions.Backoff
+	c.GRPC.Retry.MaxBackoff = repository.DefaultGRPCOptions.MaxBackoff
+	c.GRPC.BreakerThreshold = repository.DefaultGRPCOptions.BreakerThreshold
+	c.GRPC.BreakerCooldown = repository.DefaultGRPCOptions.BreakerCooldown
+	c.LDAP.AdminGroup = "SomeADGroup"
+
+	c.Session.Store = "mongo"
+	c.Session.TTL = 20 * 60
+	c.Session.RefreshInterval = time.Minute
+	c.Session.LimitPolicy = sessionstore.Evict
+
+	c.Audit.Spool.Dir = "./spool"
+	c.Audit.Spool.BatchSize = audit.DefaultSpoolOptions.BatchSize
+	c.Audit.Spool.FlushInterval = audit.DefaultSpoolOptions.FlushInterval
+	c.Audit.Spool.MaxBackoff = audit.DefaultSpoolOptions.MaxBackoff
+	c.Audit.Spool.MaxRejections = audit.DefaultSpoolOptions.MaxRejections
+	c.Audit.Spool.CloseTimeout = 10 * time.Second
+	c.Audit.ExportCloseTimeout = 10 * time.Second
+	c.Audit.Syslog.Network = "udp"
+	c.Audit.File.MaxSizeMB = 100
+	c.Audit.File.MaxBackups = 5
+	for _, r := range []*Retry{&c.Audit.Syslog.Retry, &c.Audit.File.Retry, &c.Audit.Webhook.Retry} {
+		r.Retries = audit.DefaultRetry.Attempts
+		r.Backoff = audit.DefaultRetry.Backoff
+		r.MaxBackoff = audit.DefaultRetry.MaxBackoff
+	}
+
+	c.Security.FailureThreshold = security.DefaultOptions.FailureThreshold
+	c.Security.FailureWindow = security.DefaultOptions.FailureWindow
+	c.Security.LockoutDuration = security.DefaultOptions.LockoutDuration
+	c.Security.AdminHours = fmt.Sprintf("%02d-%02d", security.DefaultOptions.AdminHoursStart, security.DefaultOptions.AdminHoursEnd)
+
+	c.Checks.Interval = reachability.DefaultOptions.Interval
+	c.Checks.Timeout = reachability.DefaultOptions.Timeout
+	c.Checks.Dampening = reachability.DefaultOptions.Dampening
+	c.Checks.Retention = 30 * 24 * time.Hour
+
+	c.Certs.ScanInterval = certs.DefaultOptions.Interval
+	c.Certs.ScanTimeout = certs.DefaultOptions.Timeout
+	var days []string
+	for _, d := range certs.DefaultOptions.Thresholds {
+		days = append(days, fmt.Sprint(d))
+	}
+	c.Certs.WarnDays = strings.Join(days, ",")
+
+	c.Agents.StaleAfter = agent.DefaultOptions.StaleAfter
+
+	c.Metrics.Allow = []string{"127.0.0.0/8", "::1"}
+
+	c.Log.Level = logging.LevelInfo.String()
+	c.Log.Format = logging.Logfmt
+
+	return c
+}
+
+// resolve fills in the settings whose default depends on other settings.
+func (c *Config) resolve() {
+	c.Server.BasePath = strings.TrimSuffix(c.Server.BasePath, "/")
+
+	// cookies are only sent over https once it is served
+	if c.TLS.Enabled() && !c.Session.HTTPSOnly {
+		c.Session.HTTPSOnly = true
+		c.sources["MONGOSTORE_HTTPS_ONLY"] = "TLS_CERT_FILE"
+	}
+}
+
+// Source returns where the setting with the environment variable env was
+// set from: default, the config file, env, the secret file or flag.
+func (c *Config) Source(env string) string {
+	if s, ok := c.sources[env]; ok {
+		return s
+	}
+	return "default"
+}
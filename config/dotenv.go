@@ -0,0 +1,94 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readDotEnv reads a .env file of KEY=value lines. Values may be double
+// quoted with escapes, single quoted as they are, or unquoted up to a
+// comment. Blank lines, # comment lines and a leading export are
+// skipped.
+func readDotEnv(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	vars := make(map[string]string)
+	var problems Errors
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" || strings.ContainsAny(key, " \t\"'") {
+			problems = append(problems, fmt.Sprintf("%s:%d: %q is not KEY=value", path, n, line))
+			continue
+		}
+
+		value := strings.TrimSpace(kv[1])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			value, err = strconv.Unquote(strings.TrimSpace(stripComment(value)))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s:%d: %s has an unterminated or badly escaped \"value\"", path, n, key))
+				continue
+			}
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				problems = append(problems, fmt.Sprintf("%s:%d: %s has an unterminated 'value'", path, n, key))
+				continue
+			}
+			value = value[1 : end+1]
+		default:
+			// a # only starts a comment after a space, so it can be part
+			// of an unquoted password
+			for i := 0; i < len(value); i++ {
+				if value[i] == '#' && (i == 0 || value[i-1] == ' ' || value[i-1] == '\t') {
+					value = strings.TrimSpace(value[:i])
+					break
+				}
+			}
+		}
+
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(problems) > 0 {
+		return vars, problems
+	}
+	return vars, nil
+}
+
+// stripComment drops a # comment that is not inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == '"' && line[i] == '\\':
+			i++
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && line[i] == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
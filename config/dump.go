@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Dump writes the effective configuration as a config file, each setting
+// followed by its environment variable and where it was set from. Secrets
+// that are set are written as "<redacted>".
+func (c *Config) Dump(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	table := ""
+	for _, s := range c.settings() {
+		t, key := "", s.key
+		if i := strings.LastIndex(s.key, "."); i >= 0 {
+			t, key = s.key[:i], s.key[i+1:]
+		}
+		if t != table {
+			// a table ends the alignment of the one before
+			tw.Flush()
+			fmt.Fprintf(tw, "\n[%s]\n", t)
+			table = t
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t# %s, %s\n", key, s.format(), s.env, c.Source(s.env))
+	}
+	return tw.Flush()
+}
+
+// format writes the value of s as a config file value.
+func (s setting) format() string {
+	if s.secret && !isZero(s.value) {
+		return strconv.Quote("<redacted>")
+	}
+	switch {
+	case s.value.Type() == durationType:
+		return strconv.Quote(time.Duration(s.value.Int()).String())
+	case s.value.Kind() == reflect.String:
+		return strconv.Quote(s.value.String())
+	case s.value.Kind() == reflect.Slice:
+		var items []string
+		for i := 0; i < s.value.Len(); i++ {
+			items = append(items, strconv.Quote(s.value.Index(i).String()))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(s.value.Interface())
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileValue is a setting read from a file.
+type fileValue struct {
+	key string
+	raw string
+}
+
+// readFile reads a config file, YAML when it ends in .yaml or .yml and TOML
+// otherwise. Tables are flattened into dotted keys and each value is
+// returned as the text a setting is parsed from, arrays are joined with
+// commas.
+func readFile(path string) ([]fileValue, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	default:
+		_, err = toml.Decode(string(b), &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var values []fileValue
+	var problems Errors
+	flatten(doc, "", func(key string, v interface{}) {
+		raw, err := format(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s: %v", path, key, err))
+			return
+		}
+		values = append(values, fileValue{key: key, raw: raw})
+	})
+
+	// maps have no order, settings are applied and reported by key
+	sort.Slice(values, func(i, j int) bool { return values[i].key < values[j].key })
+	sort.Strings(problems)
+
+	if len(problems) > 0 {
+		return values, problems
+	}
+	return values, nil
+}
+
+// flatten calls set for every value below a table with its dotted key.
+func flatten(table interface{}, prefix string, set func(key string, v interface{})) {
+	switch t := table.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			flatten(v, join(prefix, k, "."), set)
+		}
+	case map[interface{}]interface{}:
+		// yaml decodes the tables below the top as maps of interface keys
+		for k, v := range t {
+			flatten(v, join(prefix, fmt.Sprint(k), "."), set)
+		}
+	default:
+		set(prefix, table)
+	}
+}
+
+// format returns a value as the text a setting is parsed from.
+func format(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}, map[interface{}]interface{}:
+				return "", fmt.Errorf("arrays can only hold strings, whole numbers or booleans")
+			}
+			s, err := format(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case []map[string]interface{}:
+		return "", fmt.Errorf("arrays of tables are not settings")
+	case nil:
+		return "", fmt.Errorf("missing value")
+	}
+	return "", fmt.Errorf("%v is not a string, whole number, boolean or array", v)
+}
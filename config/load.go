@@ -0,0 +1,248 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting is one leaf of a Config.
+type setting struct {
+	env    string
+	key    string
+	secret bool
+	value  reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// settings returns the settings of c in the order they are declared.
+func (c *Config) settings() []setting {
+	var settings []setting
+	walk(reflect.ValueOf(c).Elem(), "", "", &settings)
+	return settings
+}
+
+func walk(v reflect.Value, env, key string, settings *[]setting) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := f.Tag.Lookup("toml")
+		if !ok {
+			continue
+		}
+		fieldEnv := join(env, f.Tag.Get("env"), "_")
+		fieldKey := join(key, name, ".")
+
+		if f.Type.Kind() == reflect.Struct {
+			walk(v.Field(i), fieldEnv, fieldKey, settings)
+			continue
+		}
+
+		*settings = append(*settings, setting{
+			env:    fieldEnv,
+			key:    fieldKey,
+			secret: f.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+}
+
+func join(a, b, sep string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + sep + b
+}
+
+// set parses raw into the setting, the error says what raw should be.
+func (s setting) set(raw string) error {
+	switch {
+	case s.value.Type() == durationType:
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 90s or 5m", raw)
+		}
+		s.value.SetInt(int64(d))
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(raw)
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		s.value.SetBool(b)
+	case s.value.Kind() == reflect.Int || s.value.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, s.value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		s.value.SetInt(n)
+	case s.value.Kind() == reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("settings of type %s are not supported", s.value.Type())
+	}
+	return nil
+}
+
+// Load reads the configuration, args are the command line arguments
+// without the program name. The config file is named by -config or
+// WEB_CONFIG, a .env file in the working directory sets environment
+// variables that are not already set. The returned error is Errors
+// listing every problem found, or a flag error.
+func Load(args []string) (*Config, error) {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) == 2 {
+			env[pair[0]] = pair[1]
+		}
+	}
+	return load(args, env, ".env")
+}
+
+func load(args []string, env map[string]string, dotenv string) (*Config, error) {
+	c := Defaults()
+	c.sources = make(map[string]string)
+	settings := c.settings()
+	var errs Errors
+
+	// the flags are parsed first to find the config file, they are set
+	// last so they win
+	flags := flag.NewFlagSet("web", flag.ContinueOnError)
+	file := flags.String("config", "", "the config `file`, WEB_CONFIG by default")
+	flags.BoolVar(&c.PrintConfig, "print-config", false, "print the effective config with secrets redacted and exit")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		flags.Var(&flagValue{key: s.key, values: flagValues}, s.key, "sets "+s.env)
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	c.Args = flags.Args()
+
+	// .env only fills in what the environment does not set
+	if dotenv != "" {
+		vars, err := readDotEnv(dotenv)
+		if err != nil && !os.IsNotExist(err) {
+			errs = errs.add(err)
+		}
+		for k, v := range vars {
+			if _, ok := env[k]; !ok {
+				env[k] = v
+			}
+		}
+	}
+
+	if *file == "" {
+		*file = env["WEB_CONFIG"]
+	}
+	if *file != "" {
+		values, err := readFile(*file)
+		if err != nil {
+			errs = errs.add(err)
+		}
+		known := make(map[string]bool)
+		for _, s := range settings {
+			known[s.key] = true
+			known[s.env] = true
+		}
+		for _, v := range values {
+			if !known[v.key] {
+				errs = append(errs, fmt.Sprintf("%s: unknown setting %s", *file, v.key))
+			}
+		}
+		for _, s := range settings {
+			for _, v := range values {
+				// a setting can be written by its key or, like in .env, by
+				// its environment variable
+				if v.key == s.key || v.key == s.env {
+					c.apply(s, v.raw, *file, &errs)
+				}
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := env[s.env]; ok {
+			c.apply(s, raw, "env", &errs)
+		}
+	}
+
+	// secrets can be mounted as files, such as docker and kubernetes
+	// secrets, instead of being put in the environment
+	for _, s := range settings {
+		path, ok := env[s.env+"_FILE"]
+		if !ok {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s_FILE: %v", s.env, err))
+			continue
+		}
+		c.apply(s, strings.TrimRight(string(b), "\r\n"), s.env+"_FILE", &errs)
+	}
+
+	for _, s := range settings {
+		if raw, ok := flagValues[s.key]; ok {
+			c.apply(s, raw, "flag", &errs)
+		}
+	}
+
+	c.resolve()
+
+	if err := c.Validate(); err != nil {
+		errs = errs.add(err)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// apply sets s to raw, recording the source or the problem.
+func (c *Config) apply(s setting, raw, source string, errs *Errors) {
+	err := s.set(raw)
+	if err != nil {
+		*errs = append(*errs, fmt.Sprintf("%s from %s: %v", s.env, source, err))
+		return
+	}
+	c.sources[s.env] = source
+}
+
+// flagValue keeps the raw value of a setting flag until the other sources
+// have been read.
+type flagValue struct {
+	key    string
+	values map[string]string
+}
+
+func (f *flagValue) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values[f.key]
+}
+
+func (f *flagValue) Set(raw string) error {
+	f.values[f.key] = raw
+	return nil
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stuff/web/certs"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/metrics"
+	"github.com/go-stuff/web/sessionstore"
+	"github.com/go-stuff/web/tlsconfig"
+)
+
+// Errors lists every problem found in a configuration.
+type Errors []string
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return "invalid configuration: " + e[0]
+	}
+	return fmt.Sprintf("invalid configuration, %d problems:\n\t%s", len(e), strings.Join(e, "\n\t"))
+}
+
+// add appends the problems of err.
+func (e Errors) add(err error) Errors {
+	if errs, ok := err.(Errors); ok {
+		return append(e, errs...)
+	}
+	return append(e, err.Error())
+}
+
+var adminHours = regexp.MustCompile(`^([0-9]{1,2})-([0-9]{1,2})$`)
+
+// Validate checks the settings that can be wrong once they are parsed,
+// returning Errors listing every problem or nil.
+func (c *Config) Validate() error {
+	var errs Errors
+	problem := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+	oneOf := func(env, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problem("%s %q is not one of %s", env, value, strings.Join(allowed, ", "))
+	}
+	positive := func(env string, d time.Duration) {
+		if d <= 0 {
+			problem("%s %s must be more than 0s", env, d)
+		}
+	}
+	exists := func(env, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			problem("%s: %v", env, err)
+		}
+	}
+
+	if c.Server.Addr == "" || c.Server.Addr == "unix:" {
+		problem("SERVER_ADDR must be set")
+	}
+	if c.Server.BasePath != "" && !strings.HasPrefix(c.Server.BasePath, "/") {
+		problem("BASE_PATH %q must start with /", c.Server.BasePath)
+	}
+	positive("SERVER_READ_TIMEOUT", c.Server.ReadTimeout)
+	positive("SERVER_WRITE_TIMEOUT", c.Server.WriteTimeout)
+	positive("SERVER_IDLE_TIMEOUT", c.Server.IdleTimeout)
+	positive("SERVER_SHUTDOWN_TIMEOUT", c.Server.ShutdownTimeout)
+	positive("SERVER_RESTART_TIMEOUT", c.Server.RestartTimeout)
+
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			problem("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		exists("TLS_CERT_FILE", c.TLS.CertFile)
+		exists("TLS_KEY_FILE", c.TLS.KeyFile)
+		exists("TLS_CLIENT_CA_FILE", c.TLS.ClientCAFile)
+		if _, err := tlsconfig.ParseVersion(c.TLS.MinVersion); err != nil {
+			problem("TLS_MIN_VERSION: %v", err)
+		}
+		if _, err := tlsconfig.CipherSuites(c.TLS.Ciphers); err != nil {
+			problem("TLS_CIPHERS: %v", err)
+		}
+		positive("TLS_RELOAD_INTERVAL", c.TLS.ReloadInterval)
+		if c.TLS.HSTSMaxAge < 0 {
+			problem("TLS_HSTS_MAX_AGE %s must not be negative", c.TLS.HSTSMaxAge)
+		}
+	} else {
+		if c.TLS.ClientCAFile != "" {
+			problem("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		if c.TLS.RedirectAddr != "" {
+			problem("TLS_REDIRECT_ADDR needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+	}
+
+	if !strings.HasPrefix(c.Mongo.URL, "mongodb://") && !strings.HasPrefix(c.Mongo.URL, "mongodb+srv://") {
+		problem("MONGOURL must start with mongodb:// or mongodb+srv://")
+	}
+	if c.Mongo.DBName == "" {
+		problem("MONGO_DB_NAME must be set")
+	}
+
+	oneOf("DATA_BACKEND", c.Data.Backend, "grpc", "mongo", "memory")
+	if c.Data.Backend == "grpc" {
+		if c.GRPC.Addr == "" {
+			problem("GRPC_ADDR must be set")
+		}
+		if c.GRPC.TLS {
+			if (c.GRPC.CertFile == "") != (c.GRPC.KeyFile == "") {
+				problem("GRPC_CERT_FILE and GRPC_KEY_FILE must be set together")
+			}
+			exists("GRPC_CA_FILE", c.GRPC.CAFile)
+			exists("GRPC_CERT_FILE", c.GRPC.CertFile)
+			exists("GRPC_KEY_FILE", c.GRPC.KeyFile)
+		} else if c.GRPC.CAFile != "" || c.GRPC.CertFile != "" || c.GRPC.KeyFile != "" {
+			problem("GRPC_CA_FILE, GRPC_CERT_FILE and GRPC_KEY_FILE need GRPC_TLS")
+		}
+		positive("GRPC_TIMEOUT", c.GRPC.Timeout)
+		positive("GRPC_DIAL_TIMEOUT", c.GRPC.DialTimeout)
+		if c.GRPC.Retry.Retries < 1 {
+			problem("GRPC_RETRIES %d must be at least 1", c.GRPC.Retry.Retries)
+		}
+		if c.GRPC.Retry.Backoff < 0 || c.GRPC.Retry.MaxBackoff < c.GRPC.Retry.Backoff {
+			problem("GRPC_MAX_BACKOFF %s must be at least GRPC_BACKOFF %s", c.GRPC.Retry.MaxBackoff, c.GRPC.Retry.Backoff)
+		}
+		if c.GRPC.BreakerThreshold < 1 {
+			problem("GRPC_BREAKER_THRESHOLD %d must be at least 1", c.GRPC.BreakerThreshold)
+		}
+		positive("GRPC_BREAKER_COOLDOWN", c.GRPC.BreakerCooldown)
+	}
+
+	oneOf("SESSION_STORE", c.Session.Store, "mongo", "memory", "cookie", "token")
+	if c.Session.TTL <= 0 {
+		problem("MONGOSTORE_SESSION_TTL %d must be more than 0 seconds", c.Session.TTL)
+	}
+	// the encryption key is an aes key
+	switch len(c.Session.EncKey) {
+	case 0, 16, 24, 32:
+	default:
+		problem("GORILLA_SESSION_ENC_KEY must be 16, 24 or 32 bytes, not %d", len(c.Session.EncKey))
+	}
+	if c.Session.RefreshInterval < 0 {
+		problem("SESSION_REFRESH_INTERVAL %s must not be negative", c.Session.RefreshInterval)
+	}
+	if c.Session.Limit < 0 {
+		problem("SESSION_LIMIT %d must not be negative", c.Session.Limit)
+	}
+	if _, err := sessionstore.ParseRoleLimits(c.Session.LimitRoles); err != nil {
+		problem("SESSION_LIMIT_ROLES: %v", err)
+	}
+	oneOf("SESSION_LIMIT_POLICY", c.Session.LimitPolicy, sessionstore.Reject, sessionstore.Evict)
+
+	exists("REDACT_PATTERNS_FILE", c.Redact.PatternsFile)
+
+	if c.Audit.Spool.Dir == "" {
+		problem("AUDIT_SPOOL_DIR must be set")
+	}
+	if c.Audit.Spool.BatchSize < 1 {
+		problem("AUDIT_SPOOL_BATCH_SIZE %d must be at least 1", c.Audit.Spool.BatchSize)
+	}
+	positive("AUDIT_SPOOL_FLUSH_INTERVAL", c.Audit.Spool.FlushInterval)
+	positive("AUDIT_SPOOL_MAX_BACKOFF", c.Audit.Spool.MaxBackoff)
+	positive("AUDIT_SPOOL_CLOSE_TIMEOUT", c.Audit.Spool.CloseTimeout)
+	positive("AUDIT_EXPORT_CLOSE_TIMEOUT", c.Audit.ExportCloseTimeout)
+	if c.Audit.Spool.MaxRejections < 1 {
+		problem("AUDIT_SPOOL_MAX_REJECTIONS %d must be at least 1", c.Audit.Spool.MaxRejections)
+	}
+	if c.Audit.Syslog.Addr != "" {
+		oneOf("AUDIT_SYSLOG_NETWORK", c.Audit.Syslog.Network, "udp", "tcp", "tls")
+		exists("AUDIT_SYSLOG_CA_FILE", c.Audit.Syslog.CAFile)
+	}
+	if c.Audit.File.Path != "" {
+		if c.Audit.File.MaxSizeMB < 1 {
+			problem("AUDIT_FILE_MAX_SIZE_MB %d must be at least 1", c.Audit.File.MaxSizeMB)
+		}
+		if c.Audit.File.MaxBackups < 0 {
+			problem("AUDIT_FILE_MAX_BACKUPS %d must not be negative", c.Audit.File.MaxBackups)
+		}
+	}
+	for _, sink := range []struct {
+		prefix string
+		retry  Retry
+	}{
+		{"AUDIT_SYSLOG", c.Audit.Syslog.Retry},
+		{"AUDIT_FILE", c.Audit.File.Retry},
+		{"AUDIT_WEBHOOK", c.Audit.Webhook.Retry},
+	} {
+		prefix, r := sink.prefix, sink.retry
+		if r.Retries < 1 {
+			problem("%s_RETRIES %d must be at least 1", prefix, r.Retries)
+		}
+		if r.Backoff < 0 || r.MaxBackoff < r.Backoff {
+			problem("%s_MAX_BACKOFF %s must be at least %s_BACKOFF %s", prefix, r.MaxBackoff, prefix, r.Backoff)
+		}
+	}
+
+	if c.Security.FailureThreshold < 1 {
+		problem("SECURITY_FAILURE_THRESHOLD %d must be at least 1", c.Security.FailureThreshold)
+	}
+	positive("SECURITY_FAILURE_WINDOW", c.Security.FailureWindow)
+	positive("SECURITY_LOCKOUT_DURATION", c.Security.LockoutDuration)
+	if _, _, err := c.Security.Hours(); err != nil {
+		problem("SECURITY_ADMIN_HOURS: %v", err)
+	}
+
+	positive("SERVER_CHECK_INTERVAL", c.Checks.Interval)
+	positive("SERVER_CHECK_TIMEOUT", c.Checks.Timeout)
+	if c.Checks.Dampening < 1 {
+		problem("SERVER_CHECK_DAMPENING %d must be at least 1", c.Checks.Dampening)
+	}
+	positive("SERVER_CHECK_RETENTION", c.Checks.Retention)
+
+	positive("CERT_SCAN_INTERVAL", c.Certs.ScanInterval)
+	positive("CERT_SCAN_TIMEOUT", c.Certs.ScanTimeout)
+	if _, err := certs.ParseThresholds(c.Certs.WarnDays); err != nil {
+		problem("CERT_WARN_DAYS: %v", err)
+	}
+	exists("CERT_CA_FILE", c.Certs.CAFile)
+
+	positive("AGENT_STALE_AFTER", c.Agents.StaleAfter)
+
+	if _, err := metrics.ParseAllow(c.Metrics.Allow); err != nil {
+		problem("METRICS_ALLOW: %v", err)
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		problem("LOG_LEVEL: %v", err)
+	}
+	oneOf("LOG_FORMAT", c.Log.Format, logging.Logfmt, logging.JSON)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Hours returns the start and end of AdminHours.
+func (s Security) Hours() (int, int, error) {
+	m := adminHours.FindStringSubmatch(s.AdminHours)
+	if m == nil {
+		return 0, 0, fmt.Errorf("%q must look like 07-19", s.AdminHours)
+	}
+	start, _ := strconv.Atoi(m[1])
+	end, _ := strconv.Atoi(m[2])
+	if start > 23 || end > 24 {
+		return 0, 0, fmt.Errorf("%q are not hours of a day", s.AdminHours)
+	}
+	return start, end, nil
+}
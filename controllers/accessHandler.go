@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/grpc/api"
+
+	"github.com/go-stuff/web/access"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+)
+
+func (a *App) accessListHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get all requests, pending first
+		reqs, err := a.requests.List(ctx, "")
+		if err != nil {
+			logging.Error(r.Context(), "requests.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// role service
+		roleSvc := a.data.Roles
+
+		// get all roles so role ids can be shown by name
+		roleReq := new(api.RoleListReq)
+		roleRes, err := roleSvc.List(ctx, roleReq)
+		if err != nil {
+			logging.Error(r.Context(), "roleSvc.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		roleNames := make(map[string]string)
+		for _, role := range roleRes.Roles {
+			roleNames[role.ID] = role.Name
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "accessList.html",
+			struct {
+				Notification string
+				Requests     []*access.Request
+				RoleNames    map[string]string
+			}{
+				Notification: notification,
+				Requests:     reqs,
+				RoleNames:    roleNames,
+			},
+		)
+	}
+
+	// save session
+	err = session.Save(r, w)
+	if err != nil {
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) accessUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// get variables from uri
+	vars := mux.Vars(r)
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// get the request
+	req, err := a.requests.Read(ctx, vars["id"])
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.Error(r.Context(), "requests.Read() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// role, route and user services
+	roleSvc := a.data.Roles
+	routeSvc := a.data.Routes
+	userSvc := a.data.Users
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// get all roles
+		roleReq := new(api.RoleListReq)
+		roleRes, err := roleSvc.List(ctx, roleReq)
+		if err != nil {
+			logging.Error(r.Context(), "roleSvc.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		var roleName string
+		for _, role := range roleRes.Roles {
+			if role.ID == req.RoleID {
+				roleName = role.Name
+			}
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "accessUpdate.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Request      *access.Request
+				RoleName     string
+				Roles        []*api.Role
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Request:      req,
+				RoleName:     roleName,
+				Roles:        roleRes.Roles,
+			},
+		)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			logging.Error(r.Context(), "r.ParseForm() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		if req.Status != access.Pending {
+			a.addNotification(w, r, fmt.Sprintf("The request from '%s' for '%s' has already been %s.", req.Username, req.Path, req.Status))
+			http.Redirect(w, r, a.prefix+"/access/list", http.StatusSeeOther)
+			return
+		}
+
+		decision := r.FormValue("decision")
+		comment := strings.TrimSpace(r.FormValue("comment"))
+		decidedBy := session.Values["username"].(string)
+
+		status := access.Approved
+		var grantRoleID string
+
+		switch decision {
+		case access.GrantRoute:
+			// give the route to the requester's role
+			routeReq := new(api.RouteUpdateByRoleIDAndPathReq)
+			routeReq.RoleID = req.RoleID
+			routeReq.Path = req.Path
+			routeReq.Permission = true
+			_, err = routeSvc.UpdateByRoleIDAndPath(ctx, routeReq)
+			if err != nil {
+				logging.Error(r.Context(), "routeSvc.UpdateByRoleIDAndPath() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
+			grantRoleID = req.RoleID
+
+		case access.MoveRole:
+			roleID := r.FormValue("role")
+			if roleID == "" {
+				a.addNotification(w, r, "Choose a role to move the user to.")
+				http.Redirect(w, r, a.prefix+fmt.Sprintf("/access/update/%s", req.ID), http.StatusSeeOther)
+				return
+			}
+
+			// make sure the role still exists
+			roleReq := new(api.RoleReadReq)
+			roleReq.ID = roleID
+			roleRes, err := roleSvc.Read(ctx, roleReq)
+			if err != nil {
+				logging.Error(r.Context(), "roleSvc.Read() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
+			if roleRes.Role == nil || roleRes.Role.ID == "" {
+				a.addNotification(w, r, "The role chosen no longer exists, choose another.")
+				http.Redirect(w, r, a.prefix+fmt.Sprintf("/access/update/%s", req.ID), http.StatusSeeOther)
+				return
+			}
+
+			// find the requester
+			readReq := new(api.UserReadByUsernameReq)
+			readReq.Username = req.Username
+			readRes, err := userSvc.ReadByUsername(ctx, readReq)
+			if err != nil {
+				logging.Error(r.Context(), "userSvc.ReadByUsername() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
+
+			// move the requester to the role
+			userReq := new(api.UserUpdateReq)
+			userReq.ID = readRes.User.ID
+			userReq.Groups = readRes.User.Groups
+			userReq.RoleID = roleID
+			userReq.ModifiedBy = decidedBy
+			_, err = userSvc.Update(ctx, userReq)
+			if err != nil {
+				logging.Error(r.Context(), "userSvc.Update() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
+			grantRoleID = roleID
+
+		case access.Reject:
+			status = access.Rejected
+			decision = ""
+
+		default:
+			http.Error(w, fmt.Sprintf("unknown decision '%s'", decision), http.StatusBadRequest)
+			return
+		}
+
+		// record the decision, the requester sees it on their next login
+		err = a.requests.Decide(ctx, req.ID, status, decision, grantRoleID, comment, decidedBy)
+		if err != nil {
+			logging.Error(r.Context(), "requests.Decide() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that the request was decided
+		a.addNotification(w, r, fmt.Sprintf("Access to '%s' for '%s' has been %s!", req.Path, req.Username, status))
+
+		// redirect to access request list
+		http.Redirect(w, r, a.prefix+"/access/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = session.Save(r, w)
+	if err != nil {
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+// accessOutcomes describes the decisions on a user's access requests that
+// the user has not seen yet, or returns an empty string
+func (a *App) accessOutcomes(ctx context.Context, username string) (string, error) {
+	reqs, err := a.requests.Outcomes(ctx, username)
+	if err != nil {
+		return "", err
+	}
+
+	var outcomes []string
+	for _, req := range reqs {
+		outcome := fmt.Sprintf("Your request for access to '%s' was %s by %s.", req.Path, req.Status, req.DecidedBy)
+		if req.Comment != "" {
+			outcome = fmt.Sprintf("%s %s", outcome, req.Comment)
+		}
+		outcomes = append(outcomes, outcome)
+	}
+
+	return strings.Join(outcomes, " "), nil
+}
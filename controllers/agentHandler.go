@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/web/agent"
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+)
+
+// maxFactsSize bounds a facts document sent by an agent.
+const maxFactsSize = 1 << 20
+
+// agentServer returns the id of the server whose enrolment token is the
+// bearer token of the request, refusals are recorded as security events.
+func (a *App) agentServer(ctx context.Context, r *http.Request) (string, error) {
+	token := ""
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	serverID, err := a.agents.Verify(ctx, token)
+	if err == agent.ErrInvalidToken {
+		rerr := a.monitor.TokenRefused(ctx, "agent", r.RemoteAddr, r.URL.Path, err.Error())
+		if rerr != nil {
+			logging.Error(r.Context(), "monitor.TokenRefused() failed", "error", rerr)
+		}
+	}
+	return serverID, err
+}
+
+func (a *App) agentHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	serverID, err := a.agentServer(ctx, r)
+	if err == agent.ErrInvalidToken {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logging.Error(r.Context(), "agentServer() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	err = a.agentMonitor.CheckIn(ctx, serverID, nil)
+	if err != nil {
+		logging.Error(r.Context(), "agentMonitor.CheckIn() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *App) agentFactsHandler(w http.ResponseWriter, r *http.Request) {
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	serverID, err := a.agentServer(ctx, r)
+	if err == agent.ErrInvalidToken {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logging.Error(r.Context(), "agentServer() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// unknown facts are refused so a misspelt one is not silently dropped,
+	// anything else goes in extra
+	facts := new(inventory.Facts)
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFactsSize))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(facts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid facts document: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	err = a.agentMonitor.CheckIn(ctx, serverID, facts)
+	if err != nil {
+		logging.Error(r.Context(), "agentMonitor.CheckIn() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *App) serverTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the server the token is for
+		server, err := a.servers.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "servers.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// issue a token, replacing the one the server had
+		token, err := a.agents.Issue(ctx, server.ID, fmt.Sprintf("%v", session.Values["username"]))
+		if err != nil {
+			logging.Error(r.Context(), "agents.Issue() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// the token is shown once and never stored in the session
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		a.Render(w, r, "serverToken.html",
+			struct {
+				Server *inventory.Server
+				Token  string
+				URL    string
+			}{
+				Server: server,
+				Token:  token,
+				URL:    fmt.Sprintf("%s://%s%s/api/agent", scheme, r.Host, a.prefix),
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) serverTokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the server so the notification can name it
+		server, err := a.servers.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "servers.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		err = a.agents.Revoke(ctx, server.ID)
+		if err != nil {
+			logging.Error(r.Context(), "agents.Revoke() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that the token was revoked
+		a.addNotification(w, r, fmt.Sprintf("Agent token of '%s' was revoked!", server.Hostname))
+
+		// redirect to the server
+		http.Redirect(w, r, a.prefix+fmt.Sprintf("/server/read/%s", template.URLQueryEscaper(server.ID)), http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
@@ -0,0 +1,629 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/web/graph"
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+)
+
+// unsafeFilename matches what is replaced in the name of a download.
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// environmentGroup is the servers of an application in an environment.
+type environmentGroup struct {
+	Environment string
+	Servers     []*inventory.Server
+}
+
+// applicationFromForm reads an application from the upsert form.
+func applicationFromForm(r *http.Request) *inventory.Application {
+	app := new(inventory.Application)
+	app.Name = r.FormValue("name")
+	app.Description = r.FormValue("description")
+	app.Owner = r.FormValue("owner")
+	app.Servers = r.Form["servers"]
+	app.DependsOnApps = r.Form["dependsonapps"]
+	app.DependsOnServers = r.Form["dependsonservers"]
+
+	app.Normalize()
+	return app
+}
+
+// setOf returns the items of list as a set.
+func setOf(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, item := range list {
+		set[item] = true
+	}
+	return set
+}
+
+// loadGraph returns the dependency graph of the whole inventory, and the
+// servers and applications in it.
+func (a *App) loadGraph(ctx context.Context) (*graph.Graph, []*inventory.Server, []*inventory.Application, error) {
+	serverList, err := a.servers.List(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	appList, err := a.applications.List(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return graph.Build(serverList, appList), serverList, appList, nil
+}
+
+// renderApplicationUpsert renders the create and update form.
+func (a *App) renderApplicationUpsert(w http.ResponseWriter, r *http.Request, title, action string, app *inventory.Application, serverList []*inventory.Server, appList []*inventory.Application, err error) {
+	a.Render(w, r, "applicationUpsert.html",
+		struct {
+			CSRF             template.HTML
+			Title            string
+			Application      *inventory.Application
+			Servers          []*inventory.Server
+			Applications     []*inventory.Application
+			RunsOn           map[string]bool
+			DependsOnApps    map[string]bool
+			DependsOnServers map[string]bool
+			Action           string
+			Error            error
+		}{
+			CSRF:             csrf.TemplateField(r),
+			Title:            title,
+			Application:      app,
+			Servers:          serverList,
+			Applications:     appList,
+			RunsOn:           setOf(app.Servers),
+			DependsOnApps:    setOf(app.DependsOnApps),
+			DependsOnServers: setOf(app.DependsOnServers),
+			Action:           action,
+			Error:            err,
+		},
+	)
+}
+
+func (a *App) applicationListHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get all applications, and every node for the impact query
+		g, _, appList, err := a.loadGraph(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "loadGraph() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "applicationList.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Applications []*inventory.Application
+				Nodes        []*graph.Node
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Applications: appList,
+				Nodes:        g.Nodes,
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) applicationCreateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// the application runs on and depends on what is in the inventory
+	_, serverList, appList, err := a.loadGraph(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "loadGraph() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page, owned by the user by default
+		app := &inventory.Application{Owner: fmt.Sprintf("%v", session.Values["username"])}
+		a.renderApplicationUpsert(w, r, "Create Application", "Create", app, serverList, appList, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show the form again if it is not valid
+		app := applicationFromForm(r)
+		err = app.Validate()
+		if err != nil {
+			a.renderApplicationUpsert(w, r, "Create Application", "Create", app, serverList, appList, err)
+			break
+		}
+
+		// create an application
+		_, err = a.applications.Create(ctx, app, fmt.Sprintf("%v", session.Values["username"]))
+		if err == inventory.ErrDuplicateApplication {
+			a.renderApplicationUpsert(w, r, "Create Application", "Create", app, serverList, appList, err)
+			break
+		}
+		if err != nil {
+			logging.Error(r.Context(), "applications.Create() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that an application was added
+		a.addNotification(w, r, fmt.Sprintf("Application '%s' has been created!", app.Name))
+
+		// redirect to the application
+		http.Redirect(w, r, a.prefix+"/application/read/"+app.ID, http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) applicationReadHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the application
+		app, err := a.applications.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "applications.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		g, serverList, _, err := a.loadGraph(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "loadGraph() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// group the servers of the application by environment, servers that
+		// are no longer in the inventory are listed on their own
+		byHostname := make(map[string]*inventory.Server, len(serverList))
+		for _, server := range serverList {
+			byHostname[server.Hostname] = server
+		}
+		var groups []*environmentGroup
+		var missing []string
+		for _, env := range inventory.Environments {
+			group := &environmentGroup{Environment: env}
+			for _, hostname := range app.Servers {
+				if server := byHostname[hostname]; server != nil && server.Environment == env {
+					group.Servers = append(group.Servers, server)
+				}
+			}
+			if len(group.Servers) > 0 {
+				groups = append(groups, group)
+			}
+		}
+		for _, hostname := range app.Servers {
+			if byHostname[hostname] == nil {
+				missing = append(missing, hostname)
+			}
+		}
+
+		// draw what the application depends on and what depends on it,
+		// only the servers in an environment if one is picked
+		id := graph.ID(graph.Application, app.Name)
+		around := g.Around(id)
+		if r.FormValue("environment") != "" {
+			around = around.Environment(r.FormValue("environment"))
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page, the graph is built from escaped values only
+		a.Render(w, r, "applicationRead.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Application  *inventory.Application
+				Groups       []*environmentGroup
+				Missing      []string
+				Environments []string
+				Environment  string
+				Graph        template.HTML
+				NodeID       string
+				Impact       []*graph.Node
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Application:  app,
+				Groups:       groups,
+				Missing:      missing,
+				Environments: inventory.Environments,
+				Environment:  r.FormValue("environment"),
+				Graph:        template.HTML(around.SVG(id)),
+				NodeID:       id,
+				Impact:       g.Impact(id),
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) applicationUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// get variables from uri
+	vars := mux.Vars(r)
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// get the application
+	app, err := a.applications.Read(ctx, vars["id"])
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.Error(r.Context(), "applications.Read() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// the application runs on and depends on what is in the inventory,
+	// but not on itself
+	_, serverList, appList, err := a.loadGraph(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "loadGraph() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+	var others []*inventory.Application
+	for _, other := range appList {
+		if other.ID != app.ID {
+			others = append(others, other)
+		}
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderApplicationUpsert(w, r, "Update Application", "Update", app, serverList, others, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show the form again if it is not valid, keep the created and
+		// modified details of the stored application
+		update := applicationFromForm(r)
+		update.ID = app.ID
+		update.CreatedBy, update.CreatedAt = app.CreatedBy, app.CreatedAt
+		update.ModifiedBy, update.ModifiedAt = app.ModifiedBy, app.ModifiedAt
+		err = update.Validate()
+		if err != nil {
+			a.renderApplicationUpsert(w, r, "Update Application", "Update", update, serverList, others, err)
+			break
+		}
+
+		// update the application
+		err = a.applications.Update(ctx, update, fmt.Sprintf("%v", session.Values["username"]))
+		if err == inventory.ErrDuplicateApplication {
+			a.renderApplicationUpsert(w, r, "Update Application", "Update", update, serverList, others, err)
+			break
+		}
+		if err != nil {
+			logging.Error(r.Context(), "applications.Update() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that an application was updated
+		a.addNotification(w, r, fmt.Sprintf("Application '%s' has been updated!", update.Name))
+
+		// redirect to the application
+		http.Redirect(w, r, a.prefix+"/application/read/"+update.ID, http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) applicationDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the application so the notification can name it
+		app, err := a.applications.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "applications.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// delete the application and the dependencies on it
+		err = a.applications.Delete(ctx, app.ID)
+		if err != nil {
+			logging.Error(r.Context(), "applications.Delete() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that an application was deleted
+		a.addNotification(w, r, fmt.Sprintf("Application '%s' was deleted!", app.Name))
+
+		// redirect to applications list
+		http.Redirect(w, r, a.prefix+"/application/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) applicationImpactHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		g, _, _, err := a.loadGraph(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "loadGraph() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// split what goes down with the node into applications and servers
+		node := g.Node(r.FormValue("node"))
+		var apps, affected []*graph.Node
+		if node != nil {
+			for _, n := range g.Impact(node.ID) {
+				if n.Kind == graph.Application {
+					apps = append(apps, n)
+				} else {
+					affected = append(affected, n)
+				}
+			}
+		}
+
+		// render to page
+		a.Render(w, r, "applicationImpact.html",
+			struct {
+				Nodes        []*graph.Node
+				Node         *graph.Node
+				Applications []*graph.Node
+				Servers      []*graph.Node
+			}{
+				Nodes:        g.Nodes,
+				Node:         node,
+				Applications: apps,
+				Servers:      affected,
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) applicationGraphHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		g, _, _, err := a.loadGraph(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "loadGraph() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// the graph of an application, or of the whole inventory without an id
+		name := "inventory"
+		if vars["id"] != "" {
+			app, err := a.applications.Read(ctx, vars["id"])
+			if err == mongo.ErrNoDocuments {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				logging.Error(r.Context(), "applications.Read() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
+			name = app.Name
+			g = g.Around(graph.ID(graph.Application, app.Name))
+		}
+		if r.FormValue("environment") != "" {
+			g = g.Environment(r.FormValue("environment"))
+		}
+
+		filename := unsafeFilename.ReplaceAllString(name, "_")
+		switch r.FormValue("format") {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", filename))
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(g)
+			if err != nil {
+				logging.Error(r.Context(), "enc.Encode() failed", "error", err)
+			}
+		case "dot", "":
+			w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.dot", filename))
+			err = g.WriteDOT(w, name)
+			if err != nil {
+				logging.Error(r.Context(), "g.WriteDOT() failed", "error", err)
+			}
+		default:
+			http.Error(w, fmt.Sprintf("'%s' is not a graph format, use dot or json", r.FormValue("format")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		return
+	}
+}
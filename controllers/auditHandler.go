@@ -2,45 +2,51 @@ package controllers
 
 import (
 	"context"
-	"log"
 	"net/http"
 
 	"time"
 
 	"github.com/go-stuff/grpc/api"
+
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/redact"
 )
 
-func auditList100Handler(w http.ResponseWriter, r *http.Request) {
+func (a *App) auditList100Handler(w http.ResponseWriter, r *http.Request) {
 	// get audit
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/auditHandler.go > auditList100Handler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
 	// display audit
-	log.Printf("INFO > controllers/auditHandler.go > auditList100Handler() > audit: %v %v\n", session.Values["_id"], session.Values["username"])
+	logging.Debug(r.Context(), "list audits", "session", redact.SessionID(session.ID), "username", session.Values["username"])
 
 	// call api to get a slice of sessions
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 	defer cancel()
 
-	auditSvc := api.NewAuditServiceClient(apiClient)
+	auditSvc := a.data.Audits
 
 	auditReq := new(api.AuditList100Req)
 	auditRes, err := auditSvc.List100(ctx, auditReq)
 	if err != nil {
-		log.Printf("ERROR > controllers/auditHandler.go > auditList100Handler() > auditSvc.List(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "auditSvc.List() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
-	render(w, r, "auditList.html",
+	a.Render(w, r, "auditList.html",
 		struct {
 			Audit []*api.Audit
+			Spool audit.SpoolStats
 		}{
 			Audit: auditRes.Audits,
+			Spool: a.spool.Stats(),
 		},
 	)
 }
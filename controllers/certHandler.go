@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/web/certs"
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/redact"
+)
+
+// maxPEMSize bounds an uploaded PEM file.
+const maxPEMSize = 1 << 20
+
+func (a *App) certListHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get all certificates, the first to expire first
+		list, err := a.certStore.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "certStore.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "certList.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Certs        []*certs.Cert
+				WarnDays     int
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Certs:        list,
+				WarnDays:     a.certScanner.WarnDays(),
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+// renderCertUpload renders the upload form.
+func (a *App) renderCertUpload(w http.ResponseWriter, r *http.Request, list []*inventory.Server, err error) {
+	a.Render(w, r, "certUpload.html",
+		struct {
+			CSRF     template.HTML
+			Servers  []*inventory.Server
+			ServerID string
+			Endpoint string
+			PEM      string
+			Error    error
+		}{
+			CSRF:     csrf.TemplateField(r),
+			Servers:  list,
+			ServerID: r.FormValue("server"),
+			Endpoint: r.FormValue("endpoint"),
+			PEM:      r.FormValue("pem"),
+			Error:    err,
+		},
+	)
+}
+
+func (a *App) certUploadHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// the certificate is uploaded for one of the servers
+	list, err := a.servers.List(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "servers.List() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderCertUpload(w, r, list, nil)
+
+	case "POST":
+		// parse form fields, the pem is pasted or sent as a file
+		err := r.ParseMultipartForm(maxPEMSize)
+		if err != nil && err != http.ErrNotMultipart {
+			http.Error(w, redact.Error(err), http.StatusBadRequest)
+			return
+		}
+
+		data := []byte(r.FormValue("pem"))
+		file, _, err := r.FormFile("file")
+		if err == nil {
+			data, err = ioutil.ReadAll(http.MaxBytesReader(w, file, maxPEMSize))
+			file.Close()
+			if err != nil {
+				a.renderCertUpload(w, r, list, err)
+				break
+			}
+		}
+
+		server, err := a.servers.Read(ctx, r.FormValue("server"))
+		if err == mongo.ErrNoDocuments {
+			a.renderCertUpload(w, r, list, fmt.Errorf("please select a server"))
+			break
+		}
+		if err != nil {
+			logging.Error(r.Context(), "servers.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// the certificate is checked against the host of the endpoint if
+		// one is given
+		endpoint := strings.TrimSpace(r.FormValue("endpoint"))
+		name := ""
+		if host, _, err := net.SplitHostPort(endpoint); err == nil {
+			name = host
+		}
+		if endpoint == "" {
+			endpoint = "uploaded"
+		}
+
+		cert, err := certs.ParsePEM(data, name, a.certScanner.Roots())
+		if err != nil {
+			a.renderCertUpload(w, r, list, err)
+			break
+		}
+		cert.ServerID = server.ID
+		cert.Hostname = server.Hostname
+		cert.Endpoint = endpoint
+		cert.CreatedBy = fmt.Sprintf("%v", session.Values["username"])
+
+		_, err = a.certStore.Upload(ctx, cert)
+		if err != nil {
+			logging.Error(r.Context(), "certStore.Upload() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// warn straight away if it is already close to expiry
+		err = a.certScanner.Warn(ctx, cert)
+		if err != nil {
+			logging.Error(r.Context(), "certScanner.Warn() failed", "error", err)
+		}
+
+		// put a notification in the session.Values that a certificate was uploaded
+		a.addNotification(w, r, fmt.Sprintf("Certificate '%s' for '%s' has been uploaded!", cert.Subject, server.Hostname))
+
+		// redirect to certificates list
+		http.Redirect(w, r, a.prefix+"/cert/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) certDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// only uploaded certificates are deleted, scanned ones come back
+		// with the next scan
+		cert, err := a.certStore.Read(ctx, vars["id"])
+		if err != nil {
+			logging.Error(r.Context(), "certStore.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+		if cert == nil || cert.Source != certs.Upload {
+			http.NotFound(w, r)
+			return
+		}
+
+		err = a.certStore.Delete(ctx, cert.ID)
+		if err != nil {
+			logging.Error(r.Context(), "certStore.Delete() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a certificate was deleted
+		a.addNotification(w, r, fmt.Sprintf("Certificate '%s' for '%s' was deleted!", cert.Subject, cert.Hostname))
+
+		// redirect to certificates list
+		http.Redirect(w, r, a.prefix+"/cert/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
@@ -2,85 +2,293 @@ package controllers
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"html/template"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/go-stuff/mongostore"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/mongo"
-	"google.golang.org/grpc"
 
 	"github.com/go-stuff/grpc/api"
-)
 
-var (
-	client      *mongo.Client
-	apiClient   *grpc.ClientConn
-	store       *mongostore.MongoStore
-	router      *mux.Router
-	routes      []string
-	layout      *template.Template
-	templates   map[string]*template.Template
-	permissions map[string]string
+	"github.com/go-stuff/web/access"
+	"github.com/go-stuff/web/agent"
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/certs"
+	"github.com/go-stuff/web/config"
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/maintenance"
+	"github.com/go-stuff/web/metrics"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/reachability"
+	"github.com/go-stuff/web/repository"
+	"github.com/go-stuff/web/security"
+	"github.com/go-stuff/web/sessionstore"
 )
 
-// Init gets the store pointer from main.go and returns a router
-// pointer to main.go
-func Init(mongoclient *mongo.Client, mongostore *mongostore.MongoStore, apiclient *grpc.ClientConn) *mux.Router {
-	client = mongoclient
-	store = mongostore
-	apiClient = apiclient
+// Config is what an App is built from. The stores and clients are
+// required, the rest have defaults.
+type Config struct {
+	// Sessions loads the session of a request once and writes it at most
+	// once.
+	Sessions *sessionstore.RequestStore
+	// Data keeps the users, roles, routes and audit log, DataBackend is
+	// the name of its backend. Backend is the connection of the grpc
+	// backend, nil with the others.
+	Data         *repository.Repositories
+	DataBackend  string
+	Backend      *repository.GRPCConn
+	Spool        *audit.Spool
+	Monitor      *security.Monitor
+	Requests     *access.Store
+	Limits       sessionstore.Limits
+	Servers      *inventory.Store
+	Fields       *inventory.FieldStore
+	Applications *inventory.ApplicationStore
+	Checks       *reachability.Store
+	Certs        *certs.Store
+	CertScanner  *certs.Scanner
+	Agents       *agent.Store
+	AgentMonitor *agent.Monitor
+	Windows      *maintenance.Store
+	Feeds        *maintenance.FeedStore
+
+	// Mongo is the client of the inventory database, /readyz pings it.
+	Mongo *mongo.Client
+
+	// Metrics is the registry the app counts and times in and /metrics
+	// serves, the app makes its own when it is nil.
+	Metrics *metrics.Registry
+	// MetricsAllow are the networks that may read /metrics, so may
+	// clients sending MetricsToken as a bearer token when it is set.
+	MetricsAllow []*net.IPNet
+	MetricsToken string
+
+	// LDAP is the directory users log in against and the ad group of the
+	// admins.
+	LDAP config.LDAP
+
+	// CSRFKey is the 32 byte key of the csrf tokens, CSRFSecure only sends
+	// the csrf cookie over https.
+	CSRFKey    []byte
+	CSRFSecure bool
+
+	// Prefix is the path the app is mounted under, such as /inventory, it
+	// is empty when the app is served from the root.
+	Prefix string
+	// Templates and Static are the directories of the templates and the
+	// static files, ./templates and ./static by default.
+	Templates string
+	Static    string
+}
+
+// App is the web application, New builds it and Handler serves it. More
+// than one App can be served by a process.
+type App struct {
+	prefix      string
+	templateDir string
+	staticDir   string
+
+	data         *repository.Repositories
+	dataBackend  string
+	backend      *repository.GRPCConn
+	mongo        *mongo.Client
+	store        sessionstore.Store
+	router       *mux.Router
+	api          *mux.Router
+	routes       []string
+	layout       *template.Template
+	templates    map[string]*template.Template
+	spool        *audit.Spool
+	monitor      *security.Monitor
+	requests     *access.Store
+	limits       sessionstore.Limits
+	servers      *inventory.Store
+	fieldStore   *inventory.FieldStore
+	applications *inventory.ApplicationStore
+	checks       *reachability.Store
+	certStore    *certs.Store
+	certScanner  *certs.Scanner
+	agents       *agent.Store
+	agentMonitor *agent.Monitor
+	windows      *maintenance.Store
+	feeds        *maintenance.FeedStore
+	ldap         config.LDAP
+	metrics      http.Handler
+
+	logins         *metrics.CounterVec
+	renderDuration *metrics.HistogramVec
+}
+
+// New parses the templates, builds the routes and their middleware and
+// seeds the roles and routes of the backend.
+func New(cfg Config) (*App, error) {
+	registry := cfg.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+
+	a := &App{
+		prefix:       strings.TrimSuffix(cfg.Prefix, "/"),
+		templateDir:  cfg.Templates,
+		staticDir:    cfg.Static,
+		data:         cfg.Data,
+		dataBackend:  cfg.DataBackend,
+		backend:      cfg.Backend,
+		mongo:        cfg.Mongo,
+		store:        cfg.Sessions,
+		spool:        cfg.Spool,
+		monitor:      cfg.Monitor,
+		requests:     cfg.Requests,
+		limits:       cfg.Limits,
+		servers:      cfg.Servers,
+		fieldStore:   cfg.Fields,
+		applications: cfg.Applications,
+		checks:       cfg.Checks,
+		certStore:    cfg.Certs,
+		certScanner:  cfg.CertScanner,
+		agents:       cfg.Agents,
+		agentMonitor: cfg.AgentMonitor,
+		windows:      cfg.Windows,
+		feeds:        cfg.Feeds,
+		ldap:         cfg.LDAP,
+		metrics:      metrics.Handler(registry, cfg.MetricsAllow, cfg.MetricsToken),
+		logins: registry.NewCounterVec("web_logins_total",
+			"Logins by provider, local or ldap, and result, success, failure or locked.", "provider", "result"),
+		renderDuration: registry.NewHistogramVec("web_template_render_seconds",
+			"How long templates took to render by template, writing the page included.", metrics.DefaultBuckets, "template"),
+	}
+	if a.templateDir == "" {
+		a.templateDir = "./templates"
+	}
+	if a.staticDir == "" {
+		a.staticDir = "./static"
+	}
+
+	err := a.initTemplates()
+	if err != nil {
+		return nil, err
+	}
 
-	err := initTemplates()
+	a.router = a.initRouter()
+	a.api = a.initAPIRouter()
+
+	// All POST requests without a valid token will return HTTP 403 Forbidden.
+	// We should also ensure that our mutating (non-idempotent) handler only
+	// matches on POST requests. We can check that here, at the router level, or
+	// within the handler itself via r.Method.
+	middlewareCSRF := csrf.Protect(cfg.CSRFKey, csrf.Secure(cfg.CSRFSecure))
+
+	// apply middleware
+	mw := middleware.New(cfg.Sessions, cfg.Data.Routes, cfg.Spool, cfg.Monitor, registry, a.prefix)
+	a.router.Use(mw.Metrics) // Metrics should be first so it sees every response
+	a.api.Use(mw.Metrics)
+	a.router.Use(a.unavailable) // Unavailable should be before the rest so it sees their errors
+	a.router.Use(middlewareCSRF)
+	a.router.Use(middleware.Headers)
+	a.router.Use(mw.Session) // Session should be before anything using the session
+	a.router.Use(mw.Auth)    // Auth should be before Permissions
+	a.router.Use(mw.Permissions)
+	a.router.Use(mw.Audit)
+
+	err = a.Seed()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Handler returns the handler of the app, to be mounted at the prefix of
+// the app. Agents and calendar clients authenticate with tokens, not
+// sessions, so the api is served next to the router and its middleware.
+// So are /healthz and /readyz, probes have no session and the routes are
+// not seeded, and /metrics, which is limited to networks and a token.
+// The probes are also served at the root when there is a prefix, so the
+// probes of a deployment do not depend on it. Every request is given a
+// request id before any of them.
+func (a *App) Handler() http.Handler {
+	handler := http.NewServeMux()
+	handler.Handle("/api/", a.api)
+	handler.HandleFunc("/healthz", a.healthzHandler)
+	handler.HandleFunc("/readyz", a.readyzHandler)
+	handler.Handle("/metrics", a.metrics)
+	handler.Handle("/", a.router)
+
+	if a.prefix == "" {
+		return middleware.RequestID(handler)
 	}
 
-	router = initRouter()
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", a.healthzHandler)
+	root.HandleFunc("/readyz", a.readyzHandler)
+	root.Handle("/", http.StripPrefix(a.prefix, handler))
+	return middleware.RequestID(root)
+}
+
+// Router returns the router of the app. Routes added to it are served
+// behind the same session, auth, permission, audit and csrf middleware,
+// call Seed after adding them so roles can be given permission to them.
+func (a *App) Router() *mux.Router {
+	return a.router
+}
+
+// Use adds middleware to the router after the middleware of the app.
+func (a *App) Use(mwf ...mux.MiddlewareFunc) {
+	a.router.Use(mwf...)
+}
 
+// Seed adds the default roles and gives every role a permission, denied
+// unless it is a default, on each route of the router.
+func (a *App) Seed() error {
 	// seed roles
-	err = roleSeed()
+	err := a.roleSeed()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// seed routes
-	err = routeSeed()
-	if err != nil {
-		log.Fatal(err)
-	}
+	return a.routeSeed()
+}
 
-	return router
+// AddTemplates adds the content templates in dir, rendered inside the
+// layout with the menu like the pages of the app. A template replaces one
+// of the app with the same file name.
+func (a *App) AddTemplates(dir string) error {
+	return a.initTemplatesWithNavAndContent(dir)
 }
 
-func initTemplates() error {
-	log.Println("INFO > controllers/controllers.go > initTemplates()")
+func (a *App) initTemplates() error {
+	logging.Debug(context.Background(), "init templates")
 
 	// initialize the content files templates map
-	templates = make(map[string]*template.Template)
+	a.templates = make(map[string]*template.Template)
 
 	// build templates with auth and content
-	err := initTemplatesWithAuthAndContent()
+	err := a.initTemplatesWithAuthAndContent()
 	if err != nil {
 		return err
 	}
 
 	// build templates with content
-	err = initTemplatesWithContent()
+	err = a.initTemplatesWithContent()
 	if err != nil {
 		return err
 	}
 
 	// build templates with nav and content
-	err = initTemplatesWithNavAndContent()
+	err = a.initTemplatesWithNavAndContent(filepath.Join(a.templateDir, "mainMenuContent"))
 	if err != nil {
 		return err
 	}
@@ -88,90 +296,87 @@ func initTemplates() error {
 	return nil
 }
 
-func initTemplatesWithAuthAndContent() error {
-	log.Println("INFO > controllers/controllers.go > initTemplatesWithAuthAndContent()")
+func (a *App) initTemplatesWithAuthAndContent() error {
+	logging.Debug(context.Background(), "init templates with auth and content")
 
-	layout = template.New("mainAuthContent.html")
+	a.layout = template.New("mainAuthContent.html")
 
-	layout.Funcs(timestampFM())
-	layout.Funcs(permissionFM(nil))
+	a.layout.Funcs(timestampFM())
+	a.layout.Funcs(a.baseFM())
+	a.layout.Funcs(a.permissionFM(nil))
 
 	// check the validity of login.html by parsing
-	_, err := layout.ParseFiles(
-		"./templates/layout/mainAuthContent.html",
-		"./templates/layout/head.html",
-		"./templates/layout/header.html",
-		"./templates/layout/footer.html",
-		"./templates/layout/script.html",
+	_, err := a.layout.ParseFiles(
+		filepath.Join(a.templateDir, "layout", "mainAuthContent.html"),
+		filepath.Join(a.templateDir, "layout", "head.html"),
+		filepath.Join(a.templateDir, "layout", "header.html"),
+		filepath.Join(a.templateDir, "layout", "footer.html"),
+		filepath.Join(a.templateDir, "layout", "script.html"),
 	)
 	if err != nil {
 		return err
 	}
 
 	// recurse content files templates and build separate templates for each of them
-	filepath.Walk("./templates/mainAuthContent", walkTemplatesPath)
-
-	return nil
+	return filepath.Walk(filepath.Join(a.templateDir, "mainAuthContent"), a.walkTemplatesPath)
 }
 
-func initTemplatesWithContent() error {
-	log.Println("INFO > controllers/controllers.go > initTemplatesWithContent()")
+func (a *App) initTemplatesWithContent() error {
+	logging.Debug(context.Background(), "init templates with content")
 
-	layout = template.New("mainContent.html")
+	a.layout = template.New("mainContent.html")
 
-	layout.Funcs(timestampFM())
-	layout.Funcs(permissionFM(nil))
+	a.layout.Funcs(timestampFM())
+	a.layout.Funcs(a.baseFM())
+	a.layout.Funcs(a.permissionFM(nil))
 
 	// check the validity of login.html by parsing
-	_, err := layout.ParseFiles(
-		"./templates/layout/mainContent.html",
-		"./templates/layout/head.html",
-		"./templates/layout/header.html",
-		"./templates/layout/logout.html",
-		"./templates/layout/footer.html",
-		"./templates/layout/script.html",
+	_, err := a.layout.ParseFiles(
+		filepath.Join(a.templateDir, "layout", "mainContent.html"),
+		filepath.Join(a.templateDir, "layout", "head.html"),
+		filepath.Join(a.templateDir, "layout", "header.html"),
+		filepath.Join(a.templateDir, "layout", "logout.html"),
+		filepath.Join(a.templateDir, "layout", "footer.html"),
+		filepath.Join(a.templateDir, "layout", "script.html"),
 	)
 	if err != nil {
 		return err
 	}
 
 	// recurse content files templates and build separate templates for each of them
-	filepath.Walk("./templates/mainContent", walkTemplatesPath)
-
-	return nil
+	return filepath.Walk(filepath.Join(a.templateDir, "mainContent"), a.walkTemplatesPath)
 }
 
-func initTemplatesWithNavAndContent() error {
-	log.Println("INFO > controllers/controllers.go > initTemplatesWithNavAndContent()")
+func (a *App) initTemplatesWithNavAndContent(dir string) error {
+	logging.Debug(context.Background(), "init templates with nav and content")
 	//var err error
 
-	layout = template.New("mainNavContent.html")
+	a.layout = template.New("mainNavContent.html")
 
-	layout.Funcs(timestampFM())
-	layout.Funcs(permissionFM(nil))
+	a.layout.Funcs(timestampFM())
+	a.layout.Funcs(a.baseFM())
+	a.layout.Funcs(a.permissionFM(nil))
 
 	// check the validity of the files that make up layout.html by parsing
-	_, err := layout.ParseFiles(
-		"./templates/layout/mainNavContent.html",
-		"./templates/layout/head.html",
-		"./templates/layout/header.html",
-		"./templates/layout/nav.html",
-		"./templates/layout/logout.html",
-		"./templates/layout/footer.html",
-		"./templates/layout/script.html",
+	_, err := a.layout.ParseFiles(
+		filepath.Join(a.templateDir, "layout", "mainNavContent.html"),
+		filepath.Join(a.templateDir, "layout", "head.html"),
+		filepath.Join(a.templateDir, "layout", "header.html"),
+		filepath.Join(a.templateDir, "layout", "nav.html"),
+		filepath.Join(a.templateDir, "layout", "logout.html"),
+		filepath.Join(a.templateDir, "layout", "footer.html"),
+		filepath.Join(a.templateDir, "layout", "script.html"),
 	)
 	if err != nil {
 		return err
 	}
 
 	// recurse content files templates and build separate templates for each of them
-	filepath.Walk("./templates/mainMenuContent", walkTemplatesPath)
-
-	return nil
+	return filepath.Walk(dir, a.walkTemplatesPath)
 }
 
 // recurse a directory and build templates
-func walkTemplatesPath(path string, fileInfo os.FileInfo, err error) error {
+func (a *App) walkTemplatesPath(path string, fileInfo os.FileInfo, err error) error {
 
 	// if the current fileInfo is not a directory
 	if fileInfo.IsDir() == false {
@@ -190,9 +395,10 @@ func walkTemplatesPath(path string, fileInfo os.FileInfo, err error) error {
 		file.Close()
 
 		// clone the base template
-		content := template.Must(layout.Clone())
+		content := template.Must(a.layout.Clone())
 		content.Funcs(timestampFM())
-		content.Funcs(permissionFM(nil))
+		content.Funcs(a.baseFM())
+		content.Funcs(a.permissionFM(nil))
 
 		// merge the base template and fileContents
 		_, err = content.Parse(string(fileContents))
@@ -201,68 +407,130 @@ func walkTemplatesPath(path string, fileInfo os.FileInfo, err error) error {
 		}
 
 		// add the merged content to the templates map
-		templates[fileInfo.Name()] = content
+		a.templates[fileInfo.Name()] = content
 
-		log.Printf("INFO > controllers/controllers.go > walkTemplatesPath(): - %s", fileInfo.Name())
+		logging.Debug(context.Background(), "template found", "file", fileInfo.Name())
 	}
 
 	return nil
 }
 
-// render templates with data
-func render(w http.ResponseWriter, r *http.Request, tmpl string, data interface{}) {
-	log.Printf("INFO > controllers/controllers.go > render(): %s", tmpl)
+// Render renders the content template tmpl with data inside its layout.
+func (a *App) Render(w http.ResponseWriter, r *http.Request, tmpl string, data interface{}) {
+	logging.Debug(r.Context(), "render", "template", tmpl)
 
 	// Set the content type.
 	w.Header().Set("Content-Type", "text/html")
 
-	templates[tmpl].Funcs(timestampFM())
-	templates[tmpl].Funcs(permissionFM(r))
+	a.templates[tmpl].Funcs(timestampFM())
+	a.templates[tmpl].Funcs(a.permissionFM(r))
 
 	// Execute the template.
-	err := templates[tmpl].Execute(w, data)
+	start := time.Now()
+	err := a.templates[tmpl].Execute(w, data)
 	if err != nil {
-		log.Printf("ERROR > controllers.go > render(): %v", err)
+		logging.Error(r.Context(), "template execute failed", "template", tmpl, "error", err)
 	}
+	a.renderDuration.Observe(time.Since(start).Seconds(), tmpl)
+}
+
+// initAPIRouter returns the router of the api used by agents and calendar
+// clients. They authenticate with a token instead of a session, so it is
+// served without the session, auth, permission and csrf middleware of the
+// router.
+func (a *App) initAPIRouter() *mux.Router {
+	logging.Debug(context.Background(), "init api router")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/agent/heartbeat", a.agentHeartbeatHandler).Methods("POST")
+	router.HandleFunc("/api/agent/facts", a.agentFactsHandler).Methods("POST")
+	router.HandleFunc("/api/maintenance.ics", a.maintenanceFeedHandler).Methods("GET")
+
+	return router
 }
 
-func initRouter() *mux.Router {
-	log.Println("INFO > controllers/controllers.go > initRouter()")
+func (a *App) initRouter() *mux.Router {
+	logging.Debug(context.Background(), "init router")
 
 	router := mux.NewRouter()
 
 	// System Routes
-	router.HandleFunc("/audit/list100", auditList100Handler).Methods("GET")
+	router.HandleFunc("/access/list", a.accessListHandler).Methods("GET")
+	router.HandleFunc("/access/update/{id}", a.accessUpdateHandler).Methods("GET", "POST")
 
-	router.HandleFunc("/login", loginHandler).Methods("GET", "POST")
-	router.HandleFunc("/logout", loginHandler).Methods("GET")
+	router.HandleFunc("/audit/list100", a.auditList100Handler).Methods("GET")
 
-	router.HandleFunc("/noauth", noauthHandler).Methods("GET")
+	router.HandleFunc("/login", a.loginHandler).Methods("GET", "POST")
+	router.HandleFunc("/logout", a.loginHandler).Methods("GET")
 
-	router.HandleFunc("/role/list", roleListHandler).Methods("GET")
-	router.HandleFunc("/role/create", roleCreateHandler).Methods("GET", "POST")
-	router.HandleFunc("/role/read/{id}", roleReadHandler).Methods("GET")
-	router.HandleFunc("/role/update/{id}", roleUpdateHandler).Methods("GET", "POST")
-	router.HandleFunc("/role/delete/{id}", roleDeleteHandler).Methods("POST")
+	router.HandleFunc("/noauth", a.noauthHandler).Methods("GET")
+	router.HandleFunc("/noauth/request", a.noauthRequestHandler).Methods("POST")
 
-	router.HandleFunc("/route/list", routeListHandler).Methods("GET", "POST")
+	router.HandleFunc("/role/list", a.roleListHandler).Methods("GET")
+	router.HandleFunc("/role/create", a.roleCreateHandler).Methods("GET", "POST")
+	router.HandleFunc("/role/read/{id}", a.roleReadHandler).Methods("GET")
+	router.HandleFunc("/role/update/{id}", a.roleUpdateHandler).Methods("GET", "POST")
+	router.HandleFunc("/role/delete/{id}", a.roleDeleteHandler).Methods("POST")
 
-	router.HandleFunc("/session/list", sessionListHandler).Methods("GET")
+	router.HandleFunc("/route/list", a.routeListHandler).Methods("GET", "POST")
 
-	router.HandleFunc("/user/list", userListHandler).Methods("GET")
-	router.HandleFunc("/user/read/{id}", userReadHandler).Methods("GET")
-	router.HandleFunc("/user/update/{id}", userUpdateHandler).Methods("GET", "POST")
-	router.HandleFunc("/user/delete/{id}", userDeleteHandler).Methods("GET")
+	router.HandleFunc("/security/list", a.securityListHandler).Methods("GET")
 
-	// App Routes
-	router.HandleFunc("/", homeHandler).Methods("GET", "POST")
-	router.HandleFunc("/home", homeHandler).Methods("GET")
+	router.HandleFunc("/status", a.statusHandler).Methods("GET")
+	router.HandleFunc("/status/log", a.statusLogHandler).Methods("POST")
+
+	router.HandleFunc("/session/list", a.sessionListHandler).Methods("GET")
+	router.HandleFunc("/session/revoke/{id}", a.sessionRevokeHandler).Methods("POST")
+
+	router.HandleFunc("/user/list", a.userListHandler).Methods("GET")
+	router.HandleFunc("/user/read/{id}", a.userReadHandler).Methods("GET")
+	router.HandleFunc("/user/update/{id}", a.userUpdateHandler).Methods("GET", "POST")
+	router.HandleFunc("/user/delete/{id}", a.userDeleteHandler).Methods("GET")
 
-	router.HandleFunc("/server/list", serverListHandler).Methods("GET")
-	router.HandleFunc("/server/create", serverCreateHandler).Methods("GET", "POST")
+	// App Routes
+	router.HandleFunc("/", a.homeHandler).Methods("GET", "POST")
+	router.HandleFunc("/home", a.homeHandler).Methods("GET")
+
+	router.HandleFunc("/server/list", a.serverListHandler).Methods("GET")
+	router.HandleFunc("/server/create", a.serverCreateHandler).Methods("GET", "POST")
+	router.HandleFunc("/server/read/{id}", a.serverReadHandler).Methods("GET")
+	router.HandleFunc("/server/update/{id}", a.serverUpdateHandler).Methods("GET", "POST")
+	router.HandleFunc("/server/delete/{id}", a.serverDeleteHandler).Methods("POST")
+	router.HandleFunc("/server/import", a.serverImportHandler).Methods("GET", "POST")
+	router.HandleFunc("/server/export", a.serverExportHandler).Methods("GET")
+	router.HandleFunc("/server/token/{id}", a.serverTokenHandler).Methods("POST")
+	router.HandleFunc("/server/token/revoke/{id}", a.serverTokenRevokeHandler).Methods("POST")
+
+	router.HandleFunc("/field/list", a.fieldListHandler).Methods("GET")
+	router.HandleFunc("/field/create", a.fieldCreateHandler).Methods("GET", "POST")
+	router.HandleFunc("/field/update/{id}", a.fieldUpdateHandler).Methods("GET", "POST")
+	router.HandleFunc("/field/delete/{id}", a.fieldDeleteHandler).Methods("POST")
+
+	router.HandleFunc("/application/list", a.applicationListHandler).Methods("GET")
+	router.HandleFunc("/application/create", a.applicationCreateHandler).Methods("GET", "POST")
+	router.HandleFunc("/application/read/{id}", a.applicationReadHandler).Methods("GET")
+	router.HandleFunc("/application/update/{id}", a.applicationUpdateHandler).Methods("GET", "POST")
+	router.HandleFunc("/application/delete/{id}", a.applicationDeleteHandler).Methods("POST")
+	router.HandleFunc("/application/impact", a.applicationImpactHandler).Methods("GET")
+	router.HandleFunc("/application/graph", a.applicationGraphHandler).Methods("GET")
+	router.HandleFunc("/application/graph/{id}", a.applicationGraphHandler).Methods("GET")
+
+	router.HandleFunc("/maintenance/list", a.maintenanceListHandler).Methods("GET")
+	router.HandleFunc("/maintenance/calendar", a.maintenanceCalendarHandler).Methods("GET")
+	router.HandleFunc("/maintenance/create", a.maintenanceCreateHandler).Methods("GET", "POST")
+	router.HandleFunc("/maintenance/update/{id}", a.maintenanceUpdateHandler).Methods("GET", "POST")
+	router.HandleFunc("/maintenance/delete/{id}", a.maintenanceDeleteHandler).Methods("POST")
+	router.HandleFunc("/maintenance/feed", a.maintenanceFeedTokenHandler).Methods("POST")
+
+	router.HandleFunc("/cert/list", a.certListHandler).Methods("GET")
+	router.HandleFunc("/cert/upload", a.certUploadHandler).Methods("GET", "POST")
+	router.HandleFunc("/cert/delete/{id}", a.certDeleteHandler).Methods("POST")
+
+	// Runtime counters, including the audit spool depth
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
 
 	// Setup or static files.
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(a.staticDir))))
 
 	return router
 }
@@ -280,8 +548,18 @@ func timestampFM() template.FuncMap {
 	}
 }
 
+// base gives templates the prefix the app is mounted under, links in
+// templates start with it.
+func (a *App) baseFM() template.FuncMap {
+	return template.FuncMap{
+		"base": func() string {
+			return a.prefix
+		},
+	}
+}
+
 // funcMapPermissions allows us to inject our own way of using permissions in an html template.
-func permissionFM(r *http.Request) template.FuncMap {
+func (a *App) permissionFM(r *http.Request) template.FuncMap {
 	// the first time the template is generated r will be nil
 	if r == nil {
 		return template.FuncMap{
@@ -294,9 +572,9 @@ func permissionFM(r *http.Request) template.FuncMap {
 	return template.FuncMap{
 		"P": func(route string) bool {
 			// get session
-			session, err := store.Get(r, "session")
+			session, err := a.store.Get(r, "session")
 			if err != nil {
-				log.Printf("ERROR > controllers/controllers.go > permissionFM() > store.Get(): %s\n", err.Error())
+				logging.Error(r.Context(), "store.Get() failed", "error", err)
 				// 	//http.Error(w, err.Error(), http.StatusInternalServerError)
 				return false
 			}
@@ -305,24 +583,24 @@ func permissionFM(r *http.Request) template.FuncMap {
 				return false
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 			defer cancel()
 
-			routeSvc := api.NewRouteServiceClient(apiClient)
+			routeSvc := a.data.Routes
 
 			// use the api to find a role
 			routeReq := new(api.RouteReadByRoleIDAndPathReq)
 
 			roleid := fmt.Sprintf("%v", session.Values["roleid"])
 
-			log.Printf("INFO > controllers/controllers.go > get permissions for roleid: %v, pathtemplate: %v\n", roleid, route)
+			logging.Debug(r.Context(), "get permission", "roleid", roleid, "route", route)
 
 			routeReq.Route = new(api.Route)
 			routeReq.Route.RoleID = roleid
 			routeReq.Route.Path = route
 			routeRes, err := routeSvc.ReadByRoleIDAndPath(ctx, routeReq)
 			if err != nil {
-				log.Printf("ERROR > controllers/controllers.go > permissionFM() > routeSvc.RouteReadByRoleIDAndPath(): %s\n", err.Error())
+				logging.Error(r.Context(), "routeSvc.RouteReadByRoleIDAndPath() failed", "error", err)
 				return false
 			}
 
@@ -332,12 +610,12 @@ func permissionFM(r *http.Request) template.FuncMap {
 }
 
 // addNotification adds a notification message to session.Values
-func addNotification(w http.ResponseWriter, r *http.Request, notification string) {
+func (a *App) addNotification(w http.ResponseWriter, r *http.Request, notification string) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/controllers.go > addNotification() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -346,8 +624,8 @@ func addNotification(w http.ResponseWriter, r *http.Request, notification string
 	// save session
 	err = session.Save(r, w)
 	if err != nil {
-		log.Printf("ERROR > controllers/controllers.go > addNotification() > session.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
@@ -356,13 +634,13 @@ func addNotification(w http.ResponseWriter, r *http.Request, notification string
 // one exists, otherwise it returns an empty string
 // if a notification was returned, the notification session.Value
 // is emptied
-func getNotification(w http.ResponseWriter, r *http.Request) (string, error) {
+func (a *App) getNotification(w http.ResponseWriter, r *http.Request) (string, error) {
 
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("controllers/controllers.go > ERROR > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return "", err
 	}
 
@@ -379,8 +657,8 @@ func getNotification(w http.ResponseWriter, r *http.Request) (string, error) {
 	// save session
 	err = session.Save(r, w)
 	if err != nil {
-		log.Printf("controllers/controllers.go > ERROR > session.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return "", err
 	}
 
@@ -0,0 +1,344 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+)
+
+// fieldFromForm reads a custom field from the upsert form.
+func fieldFromForm(r *http.Request) *inventory.Field {
+	field := new(inventory.Field)
+	field.Name = r.FormValue("name")
+	field.Label = r.FormValue("label")
+	field.Type = r.FormValue("type")
+	field.Required = r.FormValue("required") != ""
+	field.Values = strings.Split(r.FormValue("values"), "\n")
+	field.Pattern = r.FormValue("pattern")
+
+	field.Normalize()
+	return field
+}
+
+// renderFieldUpsert renders the create and update form.
+func (a *App) renderFieldUpsert(w http.ResponseWriter, r *http.Request, title, action string, field *inventory.Field, err error) {
+	a.Render(w, r, "fieldUpsert.html",
+		struct {
+			CSRF   template.HTML
+			Title  string
+			Field  *inventory.Field
+			Types  []string
+			Action string
+			Error  error
+		}{
+			CSRF:   csrf.TemplateField(r),
+			Title:  title,
+			Field:  field,
+			Types:  inventory.FieldTypes,
+			Action: action,
+			Error:  err,
+		},
+	)
+}
+
+func (a *App) fieldListHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get all custom fields
+		list, err := a.fieldStore.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "fieldList.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Fields       []*inventory.Field
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Fields:       list,
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) fieldCreateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderFieldUpsert(w, r, "Create Server Field", "Create", &inventory.Field{Type: inventory.Text}, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show the form again if it is not valid
+		field := fieldFromForm(r)
+		err = field.Validate()
+		if err != nil {
+			a.renderFieldUpsert(w, r, "Create Server Field", "Create", field, err)
+			break
+		}
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// a required field needs a value on every server already there
+		servers, err := a.servers.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "servers.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+		misfits := inventory.Misfits(servers, field)
+		if len(misfits) > 0 {
+			err = fmt.Errorf("%d servers have values that do not fit: %s", len(misfits), strings.Join(misfits, "; "))
+			a.renderFieldUpsert(w, r, "Create Server Field", "Create", field, err)
+			break
+		}
+
+		// create a field
+		_, err = a.fieldStore.Create(ctx, field, fmt.Sprintf("%v", session.Values["username"]))
+		if err == inventory.ErrDuplicateField {
+			a.renderFieldUpsert(w, r, "Create Server Field", "Create", field, err)
+			break
+		}
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.Create() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a field was added
+		a.addNotification(w, r, fmt.Sprintf("Server field '%s' has been created!", field.Label))
+
+		// redirect to fields list
+		http.Redirect(w, r, a.prefix+"/field/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) fieldUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// get variables from uri
+	vars := mux.Vars(r)
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// get the field
+	field, err := a.fieldStore.Read(ctx, vars["id"])
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.Error(r.Context(), "fieldStore.Read() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderFieldUpsert(w, r, "Update Server Field", "Update", field, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// the name is the key of the values on every server and is kept,
+		// as are the created and modified details
+		update := fieldFromForm(r)
+		update.ID, update.Name = field.ID, field.Name
+		update.CreatedBy, update.CreatedAt = field.CreatedBy, field.CreatedAt
+		update.ModifiedBy, update.ModifiedAt = field.ModifiedBy, field.ModifiedAt
+		if update.Label == "" {
+			update.Label = field.Name
+		}
+
+		// show the form again if it is not valid
+		err = update.Validate()
+		if err != nil {
+			a.renderFieldUpsert(w, r, "Update Server Field", "Update", update, err)
+			break
+		}
+
+		// servers must already fit the new definition, or every later edit
+		// or import of them would be rejected
+		servers, err := a.servers.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "servers.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+		misfits := inventory.Misfits(servers, update)
+		if len(misfits) > 0 {
+			err = fmt.Errorf("%d servers have values that do not fit, change them first: %s", len(misfits), strings.Join(misfits, "; "))
+			a.renderFieldUpsert(w, r, "Update Server Field", "Update", update, err)
+			break
+		}
+
+		// update the field
+		err = a.fieldStore.Update(ctx, update, fmt.Sprintf("%v", session.Values["username"]))
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.Update() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a field was updated
+		a.addNotification(w, r, fmt.Sprintf("Server field '%s' has been updated!", update.Label))
+
+		// redirect to fields list
+		http.Redirect(w, r, a.prefix+"/field/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) fieldDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the field, its values are removed by name
+		field, err := a.fieldStore.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// delete the field and its values on every server
+		err = a.fieldStore.Delete(ctx, field.ID)
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.Delete() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		err = a.servers.UnsetField(ctx, field.Name)
+		if err != nil {
+			logging.Error(r.Context(), "servers.UnsetField() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a field was deleted
+		a.addNotification(w, r, fmt.Sprintf("Server field '%s' was deleted!", field.Label))
+
+		// redirect to fields list
+		http.Redirect(w, r, a.prefix+"/field/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// pages are the templates every app renders, /readyz fails without them.
+var pages = []string{"login.html", "home.html", "noauth.html", "unavailable.html"}
+
+// healthzHandler answers as long as the process is serving requests.
+func (a *App) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler answers 200 when mongo, the grpc backend and the session
+// store can be reached and the templates are loaded, and 503 naming what
+// failed otherwise.
+func (a *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 5*time.Second)
+	defer cancel()
+
+	checks := []struct {
+		name  string
+		check func(ctx context.Context) error
+	}{
+		{"mongo", a.checkMongo},
+		{"grpc", a.checkGRPC},
+		{"sessions", a.store.Ping},
+		{"templates", a.checkTemplates},
+	}
+
+	ready := true
+	results := make([]string, 0, len(checks))
+	for _, c := range checks {
+		err := c.check(ctx)
+		if err != nil {
+			logging.Warn(r.Context(), "not ready", "check", c.name, "error", err)
+			ready = false
+			// the probe is not authenticated, why is only logged
+			results = append(results, c.name+": failed")
+			continue
+		}
+		results = append(results, c.name+": ok")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, result := range results {
+		fmt.Fprintln(w, result)
+	}
+}
+
+func (a *App) checkMongo(ctx context.Context) error {
+	if a.mongo == nil {
+		return nil
+	}
+	return a.mongo.Ping(ctx, readpref.Primary())
+}
+
+// checkGRPC fails while the breaker is open without calling the backend.
+func (a *App) checkGRPC(ctx context.Context) error {
+	if a.backend == nil {
+		return nil
+	}
+	return a.backend.Check(ctx)
+}
+
+func (a *App) checkTemplates(ctx context.Context) error {
+	for _, page := range pages {
+		if _, ok := a.templates[page]; !ok {
+			return fmt.Errorf("%s is not loaded", page)
+		}
+	}
+	return nil
+}
@@ -1,18 +1,20 @@
 package controllers
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/go-stuff/grpc/api"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
 )
 
-func homeHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) homeHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/homeHandler.go > homeHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -24,14 +26,22 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 			Username: session.Values["username"].(string),
 		}
 
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			return
+		}
+
 		// render to template
-		render(w, r, "home.html",
+		a.Render(w, r, "home.html",
 			struct {
-				User  *api.User
-				Error error
+				Notification string
+				User         *api.User
+				Error        error
 			}{
-				User:  user,
-				Error: nil,
+				Notification: notification,
+				User:         user,
+				Error:        nil,
 			},
 		)
 	}
@@ -39,8 +49,8 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	// save session
 	err = session.Save(r, w)
 	if err != nil {
-		log.Printf("ERROR > controllers/homeHandler.go > homeHandler() > sessions.Save: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
@@ -5,47 +5,95 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/go-stuff/grpc/api"
 	"github.com/go-stuff/ldap"
-	"github.com/golang/protobuf/ptypes"
 	"github.com/gorilla/csrf"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/redact"
+	"github.com/go-stuff/web/sessionstore"
 )
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 
 	case "GET":
-		render(w, r, "login.html",
+		// get session
+		session, err := a.store.Get(r, "session")
+		if err != nil {
+			logging.Error(r.Context(), "store.Get() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// tell a user whose session was evicted why they have to log in again
+		var notification string
+		if session.Values[sessionstore.EvictedKey] != nil {
+			notification = fmt.Sprintf("%v", session.Values[sessionstore.EvictedKey])
+		}
+
+		a.Render(w, r, "login.html",
 			struct {
-				CSRF     template.HTML
-				Username string
-				Error    error
+				CSRF         template.HTML
+				Notification string
+				Username     string
+				Error        error
 			}{
-				CSRF:     csrf.TemplateField(r),
-				Username: r.FormValue("username"),
-				Error:    nil,
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Username:     r.FormValue("username"),
+				Error:        nil,
 			})
 
 	case "POST":
 		// parse form fields
 		err := r.ParseForm()
 		if err != nil {
-			log.Printf("ERROR > controllers/loginHandler.go > r.ParseForm(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "r.ParseForm() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// refuse users that are locked out after too many failed logins
+		lockCtx, lockCancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer lockCancel()
+
+		locked, until, err := a.monitor.Locked(lockCtx, r.FormValue("username"))
+		if err != nil {
+			logging.Error(r.Context(), "monitor.Locked() failed", "error", err)
+		}
+		if locked {
+			// the account is refused before any provider is asked
+			// and is not counted as a failure, or guessing would keep the
+			// account locked for good
+			a.logins.Inc("none", "locked")
+
+			a.Render(w, r, "login.html",
+				struct {
+					CSRF         template.HTML
+					Notification string
+					Username     string
+					Error        error
+				}{
+					CSRF:     csrf.TemplateField(r),
+					Username: r.FormValue("username"),
+					Error:    fmt.Errorf("account is locked until %s", until.Local().Format("03:04 PM MST")),
+				})
 			return
 		}
 
 		// start a new session
-		session, err := store.New(r, "session")
+		session, err := a.store.New(r, "session")
 		if err != nil {
-			log.Printf("ERROR > controllers/loginHandler.go > store.New(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "store.New() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
@@ -60,6 +108,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		user := api.User{}
 
 		var found bool
+		provider := "local"
 		for k, v := range authenticatedUser {
 			if r.FormValue("username") == k && r.FormValue("password") == v {
 				user.Username = k
@@ -69,52 +118,56 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 		// if local account was not found check ldap
 		if !found {
+			provider = "ldap"
 			username, groups, err := ldap.Auth(
-				os.Getenv("LDAP_SERVER"),
-				os.Getenv("LDAP_PORT"),
-				os.Getenv("LDAP_BIND_DN"),
-				os.Getenv("LDAP_BIND_PASS"),
-				os.Getenv("LDAP_USER_BASE_DN"),
-				os.Getenv("LDAP_USER_SEARCH_ATTR"),
-				os.Getenv("LDAP_GROUP_BASE_DN"),
-				os.Getenv("LDAP_GROUP_OBJECT_CLASS"),
-				os.Getenv("LDAP_GROUP_SEARCH_ATTR"),
-				os.Getenv("LDAP_GROUP_SEARCH_FULL"),
+				a.ldap.Server,
+				a.ldap.Port,
+				a.ldap.BindDN,
+				a.ldap.BindPass,
+				a.ldap.UserBaseDN,
+				a.ldap.UserSearchAttr,
+				a.ldap.GroupBaseDN,
+				a.ldap.GroupObjectClass,
+				a.ldap.GroupSearchAttr,
+				strconv.FormatBool(a.ldap.GroupSearchFull),
 				r.FormValue("username"),
 				r.FormValue("password"),
 			)
 			if err != nil {
+				a.logins.Inc(provider, "failure")
 
-				// audit a login failure
-				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-				defer cancel()
-				auditSvc := api.NewAuditServiceClient(apiClient)
-
-				auditReq := new(api.AuditCreateReq)
-				auditReq.Audit = &api.Audit{
+				// audit a login failure, keep err for the login page
+				werr := a.spool.Write(&audit.Record{
 					ID:        primitive.NewObjectID().Hex(),
 					Username:  fmt.Sprintf("%v", r.FormValue("username")),
 					Action:    fmt.Sprintf("%v: %v", r.Method, r.URL),
-					Session:   fmt.Sprintf("%v", err),
+					Session:   redact.Error(err),
 					CreatedBy: "System",
-					CreatedAt: ptypes.TimestampNow(),
-				}
-				_, err = auditSvc.Create(ctx, auditReq)
-				if err != nil {
-					log.Printf("ERROR > controllers/loginHandler.go > auditSvc.Create(): %s\n", err.Error())
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					CreatedAt: time.Now().UTC(),
+					RequestID: logging.RequestID(r.Context()),
+				})
+				if werr != nil {
+					logging.Error(r.Context(), "spool.Write() failed", "error", werr)
+					middleware.ServerError(w, werr)
 					return
 				}
 
-				render(w, r, "login.html",
+				// record the failure as a security event
+				werr = a.monitor.LoginFailed(lockCtx, r.FormValue("username"), r.RemoteAddr, redact.Error(err))
+				if werr != nil {
+					logging.Error(r.Context(), "monitor.LoginFailed() failed", "error", werr)
+				}
+
+				a.Render(w, r, "login.html",
 					struct {
-						CSRF     template.HTML
-						Username string
-						Error    error
+						CSRF         template.HTML
+						Notification string
+						Username     string
+						Error        error
 					}{
 						CSRF:     csrf.TemplateField(r),
 						Username: r.FormValue("username"),
-						Error:    err,
+						Error:    errors.New(redact.Error(err)),
 					})
 				return
 			}
@@ -127,33 +180,36 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 		// user not found
 		if !found {
+			a.logins.Inc(provider, "failure")
 
 			// audit a login failure
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-			auditSvc := api.NewAuditServiceClient(apiClient)
-
-			auditReq := new(api.AuditCreateReq)
-			auditReq.Audit = &api.Audit{
+			err = a.spool.Write(&audit.Record{
 				ID:        primitive.NewObjectID().Hex(),
 				Username:  fmt.Sprintf("%v", r.FormValue("username")),
 				Action:    fmt.Sprintf("%v: %v", r.Method, r.URL),
 				Session:   fmt.Sprintf("%v", errors.New("username not found")),
 				CreatedBy: "System",
-				CreatedAt: ptypes.TimestampNow(),
-			}
-			_, err = auditSvc.Create(ctx, auditReq)
+				CreatedAt: time.Now().UTC(),
+				RequestID: logging.RequestID(r.Context()),
+			})
 			if err != nil {
-				log.Printf("ERROR > controllers/loginHandler.go > auditSvc.Create(): %s\n", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				logging.Error(r.Context(), "spool.Write() failed", "error", err)
+				middleware.ServerError(w, err)
 				return
 			}
 
-			render(w, r, "login.html",
+			// record the failure as a security event
+			err = a.monitor.LoginFailed(lockCtx, r.FormValue("username"), r.RemoteAddr, "username not found")
+			if err != nil {
+				logging.Error(r.Context(), "monitor.LoginFailed() failed", "error", err)
+			}
+
+			a.Render(w, r, "login.html",
 				struct {
-					CSRF     template.HTML
-					Username string
-					Error    error
+					CSRF         template.HTML
+					Notification string
+					Username     string
+					Error        error
 				}{
 					CSRF:     csrf.TemplateField(r),
 					Username: r.FormValue("username"),
@@ -162,25 +218,28 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// the eviction notice has been read, the new login replaces it
+		delete(session.Values, sessionstore.EvictedKey)
+
 		// add important values to the session
 		session.Values["remoteaddr"] = r.RemoteAddr
 		session.Values["host"] = r.Host
 		session.Values["username"] = user.Username
 
 		// update user and groups in mongo to use with permissions middleware
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		roleSvc := api.NewRoleServiceClient(apiClient)
-		userSvc := api.NewUserServiceClient(apiClient)
+		roleSvc := a.data.Roles
+		userSvc := a.data.Users
 
 		userReq := new(api.UserReadByUsernameReq)
 		userReq.Username = user.Username
 
 		foundRes, err := userSvc.ReadByUsername(ctx, userReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/loginHandler.go > userSvc.ReadByUsername(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "userSvc.ReadByUsername() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
@@ -199,12 +258,12 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 			// if user is in the admin ad group, give them admin permissions
 			for _, group := range user.Groups {
-				if group == os.Getenv("ADMIN_AD_GROUP") {
+				if group == a.ldap.AdminGroup {
 					readReq := new(api.RoleReadByNameReq)
 					readReq.Name = "Admin"
 					readRes, err := roleSvc.ReadByName(ctx, readReq)
 					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						middleware.ServerError(w, err)
 						return
 					}
 
@@ -215,8 +274,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 				_, err := userSvc.Update(ctx, userReq)
 				if err != nil {
-					log.Printf("controllers/loginHandler.go > ERROR > userSvc.Update(): %s\n", err.Error())
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					logging.Error(r.Context(), "userSvc.Update() failed", "error", err)
+					middleware.ServerError(w, err)
 					return
 				}
 			}
@@ -231,14 +290,14 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 			// if user is in the admin ad group, give the user the admin roleid
 			for _, group := range user.Groups {
-				if group == os.Getenv("ADMIN_AD_GROUP") {
-					log.Printf("%s", group)
+				if group == a.ldap.AdminGroup {
+					logging.Debug(r.Context(), "user is in the admin group", "username", user.Username, "group", group)
 					readReq := new(api.RoleReadByNameReq)
 					readReq.Name = "Admin"
 					readRes, err := roleSvc.ReadByName(ctx, readReq)
 					if err != nil {
-						log.Printf("ERROR > controllers/loginHandler.go > roleSvc.ReadByName(): %s\n", err.Error())
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						logging.Error(r.Context(), "roleSvc.ReadByName() failed", "error", err)
+						middleware.ServerError(w, err)
 						return
 					}
 					userReq.RoleID = readRes.Role.ID
@@ -252,8 +311,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 				readReq.Name = "Read Only"
 				readRes, err := roleSvc.ReadByName(ctx, readReq)
 				if err != nil {
-					log.Printf("ERROR > controllers/loginHandler.go > roleSvc.ReadByName(): %s\n", err.Error())
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					logging.Error(r.Context(), "roleSvc.ReadByName() failed", "error", err)
+					middleware.ServerError(w, err)
 					return
 				}
 				userReq.RoleID = readRes.Role.ID
@@ -262,39 +321,96 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 			_, err = userSvc.Create(ctx, userReq)
 			if err != nil {
-				log.Printf("ERROR > controllers/loginHandler.go > userSvc.Create(): %s\n", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				logging.Error(r.Context(), "userSvc.Create() failed", "error", err)
+				middleware.ServerError(w, err)
 				return
 			}
 		}
 
-		// save the session
+		// tell the user about decisions on their access requests
+		outcomes, err := a.accessOutcomes(ctx, user.Username)
+		if err != nil {
+			logging.Error(r.Context(), "accessOutcomes() failed", "error", err)
+		}
+		if outcomes != "" {
+			session.Values["notification"] = outcomes
+		}
+
+		// save the session, it is counted by logins enforcing the limit at
+		// the same time
 		err = session.Save(r, w)
 		if err != nil {
-			log.Printf("ERROR > middleware/loginHandler.go > loginHandler() > sessions.Save(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		// audit a successful login
-		auditSvc := api.NewAuditServiceClient(apiClient)
+		// hold the user to the concurrent session limit of their role, users
+		// without a role fall back to the global limit
+		var roleName string
+		roleReq := new(api.RoleReadReq)
+		roleReq.ID = fmt.Sprintf("%v", session.Values["roleid"])
+		roleRes, err := roleSvc.Read(ctx, roleReq)
+		if err != nil {
+			logging.Error(r.Context(), "roleSvc.Read() failed", "error", err)
+		} else if roleRes.Role != nil {
+			roleName = roleRes.Role.Name
+		}
 
-		auditReq := new(api.AuditCreateReq)
-		auditReq.Audit = &api.Audit{
+		err = sessionstore.Enforce(ctx, a.store, a.limits, user.Username, roleName, session.ID,
+			fmt.Sprintf("You were logged out because '%s' logged in again from %s.", user.Username, r.RemoteAddr))
+		if err == sessionstore.ErrTooManySessions {
+			logging.Warn(r.Context(), "too many sessions, login rejected", "username", user.Username)
+
+			// the session is deleted again
+			session.Options.MaxAge = -1
+			err = session.Save(r, w)
+			if err != nil {
+				logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+			}
+
+			a.Render(w, r, "login.html",
+				struct {
+					CSRF         template.HTML
+					Notification string
+					Username     string
+					Error        error
+				}{
+					CSRF:     csrf.TemplateField(r),
+					Username: r.FormValue("username"),
+					Error:    errors.New("you have too many active sessions, log out of another session first"),
+				})
+			return
+		}
+		if err != nil && err != sessionstore.ErrNotSupported {
+			logging.Error(r.Context(), "sessionstore.Enforce() failed", "error", err)
+		}
+
+		// audit a successful login
+		err = a.spool.Write(&audit.Record{
 			ID:        primitive.NewObjectID().Hex(),
 			Username:  fmt.Sprintf("%v", r.FormValue("username")),
 			Action:    fmt.Sprintf("%v: %v", r.Method, r.URL),
-			Session:   fmt.Sprintf("%v", session.Values),
+			Session:   redact.Values(session.Values),
 			CreatedBy: "System",
-			CreatedAt: ptypes.TimestampNow(),
-		}
-		_, err = auditSvc.Create(ctx, auditReq)
+			CreatedAt: time.Now().UTC(),
+			RequestID: logging.RequestID(r.Context()),
+		})
 		if err != nil {
-			log.Printf("ERROR > controllers/loginHandler.go > auditSvc.Create(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "spool.Write() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		http.Redirect(w, r, "/home", http.StatusFound)
+		a.logins.Inc(provider, "success")
+
+		// record the login as a security event, admins are checked against
+		// their usual hours, a role that could not be read is not admin
+		err = a.monitor.LoginSucceeded(ctx, user.Username, r.RemoteAddr, roleName == "Admin")
+		if err != nil {
+			logging.Error(r.Context(), "monitor.LoginSucceeded() failed", "error", err)
+		}
+
+		http.Redirect(w, r, a.prefix+"/home", http.StatusFound)
 	}
 }
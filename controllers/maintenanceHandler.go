@@ -0,0 +1,579 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/maintenance"
+	"github.com/go-stuff/web/middleware"
+)
+
+// conflictHorizon is how far ahead windows are checked for conflicts.
+const conflictHorizon = 365 * 24 * time.Hour
+
+// windowFromForm reads a maintenance window from the upsert form, times are
+// in the local time of the server.
+func windowFromForm(r *http.Request) (*maintenance.Window, error) {
+	window := new(maintenance.Window)
+	window.Title = r.FormValue("title")
+	window.ServerIDs = r.Form["servers"]
+	window.Tags = splitList(r.FormValue("tags"))
+	window.Recurrence = r.FormValue("recurrence")
+	window.Owner = r.FormValue("owner")
+	window.Description = r.FormValue("description")
+
+	var err error
+	if r.FormValue("start") != "" {
+		window.Start, err = time.ParseInLocation("2006-01-02T15:04", r.FormValue("start"), time.Local)
+		if err != nil {
+			return window, fmt.Errorf("'%s' is not a start time", r.FormValue("start"))
+		}
+	}
+	if r.FormValue("end") != "" {
+		window.End, err = time.ParseInLocation("2006-01-02T15:04", r.FormValue("end"), time.Local)
+		if err != nil {
+			return window, fmt.Errorf("'%s' is not an end time", r.FormValue("end"))
+		}
+	}
+
+	// a repeat ends at the end of the until day
+	if r.FormValue("until") != "" {
+		until, err := time.ParseInLocation("2006-01-02", r.FormValue("until"), time.Local)
+		if err != nil {
+			return window, fmt.Errorf("'%s' is not a date", r.FormValue("until"))
+		}
+		window.Until = until.AddDate(0, 0, 1).Add(-time.Second)
+	}
+
+	window.Normalize()
+	return window, window.Validate()
+}
+
+// windowConflicts returns the windows that take place at the same time as
+// window on servers that depend on, or are depended on by, its servers.
+func (a *App) windowConflicts(ctx context.Context, window *maintenance.Window, list []*inventory.Server) ([]string, error) {
+	others, err := a.windows.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return maintenance.Conflicts(window, others, list, conflictHorizon), nil
+}
+
+// hostnamesOf maps the ids of servers to their hostnames.
+func hostnamesOf(list []*inventory.Server) map[string]string {
+	hostnames := make(map[string]string, len(list))
+	for _, server := range list {
+		hostnames[server.ID] = server.Hostname
+	}
+	return hostnames
+}
+
+// renderMaintenanceUpsert renders the create and update form, with the
+// conflicts that have to be confirmed if there are any.
+func (a *App) renderMaintenanceUpsert(w http.ResponseWriter, r *http.Request, title, action string, window *maintenance.Window, list []*inventory.Server, conflicts []string, err error) {
+	selected := make(map[string]bool)
+	for _, id := range window.ServerIDs {
+		selected[id] = true
+	}
+
+	a.Render(w, r, "maintenanceUpsert.html",
+		struct {
+			CSRF        template.HTML
+			Title       string
+			Window      *maintenance.Window
+			Servers     []*inventory.Server
+			Selected    map[string]bool
+			Recurrences []string
+			Conflicts   []string
+			Action      string
+			Error       error
+		}{
+			CSRF:        csrf.TemplateField(r),
+			Title:       title,
+			Window:      window,
+			Servers:     list,
+			Selected:    selected,
+			Recurrences: maintenance.Recurrences,
+			Conflicts:   conflicts,
+			Action:      action,
+			Error:       err,
+		},
+	)
+}
+
+func (a *App) maintenanceListHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get all windows
+		list, err := a.windows.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "windows.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get all servers to name the servers of each window
+		serverList, err := a.servers.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "servers.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "maintenanceList.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Windows      []*maintenance.Window
+				Hostnames    map[string]string
+				Now          time.Time
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Windows:      list,
+				Hostnames:    hostnamesOf(serverList),
+				Now:          time.Now(),
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) maintenanceCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// the month to show, this month by default
+		month := time.Now()
+		if r.FormValue("month") != "" {
+			month, err = time.ParseInLocation("2006-01", r.FormValue("month"), time.Local)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("'%s' is not a month like 2006-01", r.FormValue("month")), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get all windows
+		list, err := a.windows.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "windows.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get the feed token of the user
+		token, err := a.feeds.Token(ctx, fmt.Sprintf("%v", session.Values["username"]))
+		if err != nil {
+			logging.Error(r.Context(), "feeds.Token() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "maintenanceCalendar.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Month        time.Time
+				Prev         string
+				Next         string
+				Weeks        [][]*maintenance.Day
+				Token        *maintenance.FeedToken
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Month:        month,
+				Prev:         month.AddDate(0, -1, 1-month.Day()).Format("2006-01"),
+				Next:         month.AddDate(0, 1, 1-month.Day()).Format("2006-01"),
+				Weeks:        maintenance.Month(list, month.In(time.Local)),
+				Token:        token,
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) maintenanceCreateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// the window is for some of the servers
+	serverList, err := a.servers.List(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "servers.List() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page, owned by the user by default
+		window := &maintenance.Window{Owner: fmt.Sprintf("%v", session.Values["username"])}
+		a.renderMaintenanceUpsert(w, r, "Create Maintenance Window", "Create", window, serverList, nil, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show the form again if it is not valid
+		window, err := windowFromForm(r)
+		if err != nil {
+			a.renderMaintenanceUpsert(w, r, "Create Maintenance Window", "Create", window, serverList, nil, err)
+			break
+		}
+
+		// windows on dependent servers at the same time have to be confirmed
+		conflicts, err := a.windowConflicts(ctx, window, serverList)
+		if err != nil {
+			logging.Error(r.Context(), "windowConflicts() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+		if len(conflicts) > 0 && r.FormValue("confirm") == "" {
+			a.renderMaintenanceUpsert(w, r, "Create Maintenance Window", "Create", window, serverList, conflicts, nil)
+			break
+		}
+
+		// create a window
+		_, err = a.windows.Create(ctx, window, fmt.Sprintf("%v", session.Values["username"]))
+		if err != nil {
+			logging.Error(r.Context(), "windows.Create() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a window was added
+		a.addNotification(w, r, fmt.Sprintf("Maintenance window '%s' has been created!", window.Title))
+
+		// redirect to windows list
+		http.Redirect(w, r, a.prefix+"/maintenance/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) maintenanceUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// get variables from uri
+	vars := mux.Vars(r)
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// get the window
+	window, err := a.windows.Read(ctx, vars["id"])
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.Error(r.Context(), "windows.Read() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// the window is for some of the servers
+	serverList, err := a.servers.List(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "servers.List() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderMaintenanceUpsert(w, r, "Update Maintenance Window", "Update", window, serverList, nil, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show the form again if it is not valid, keep the created and
+		// modified details of the stored window
+		update, err := windowFromForm(r)
+		update.ID = window.ID
+		update.CreatedBy, update.CreatedAt = window.CreatedBy, window.CreatedAt
+		update.ModifiedBy, update.ModifiedAt = window.ModifiedBy, window.ModifiedAt
+		if err != nil {
+			a.renderMaintenanceUpsert(w, r, "Update Maintenance Window", "Update", update, serverList, nil, err)
+			break
+		}
+
+		// windows on dependent servers at the same time have to be confirmed
+		conflicts, err := a.windowConflicts(ctx, update, serverList)
+		if err != nil {
+			logging.Error(r.Context(), "windowConflicts() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+		if len(conflicts) > 0 && r.FormValue("confirm") == "" {
+			a.renderMaintenanceUpsert(w, r, "Update Maintenance Window", "Update", update, serverList, conflicts, nil)
+			break
+		}
+
+		// update the window
+		err = a.windows.Update(ctx, update, fmt.Sprintf("%v", session.Values["username"]))
+		if err != nil {
+			logging.Error(r.Context(), "windows.Update() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a window was updated
+		a.addNotification(w, r, fmt.Sprintf("Maintenance window '%s' has been updated!", update.Title))
+
+		// redirect to windows list
+		http.Redirect(w, r, a.prefix+"/maintenance/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) maintenanceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the window so the notification can name it
+		window, err := a.windows.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "windows.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// delete the window
+		err = a.windows.Delete(ctx, window.ID)
+		if err != nil {
+			logging.Error(r.Context(), "windows.Delete() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a window was deleted
+		a.addNotification(w, r, fmt.Sprintf("Maintenance window '%s' was deleted!", window.Title))
+
+		// redirect to windows list
+		http.Redirect(w, r, a.prefix+"/maintenance/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) maintenanceFeedTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// issue a token for the user, replacing the one they had
+		token, err := a.feeds.Issue(ctx, fmt.Sprintf("%v", session.Values["username"]))
+		if err != nil {
+			logging.Error(r.Context(), "feeds.Issue() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// the token is shown once and never stored in the session
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		a.Render(w, r, "maintenanceFeed.html",
+			struct {
+				URL string
+			}{
+				URL: fmt.Sprintf("%s://%s%s/api/maintenance.ics?token=%s", scheme, r.Host, a.prefix, token),
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) maintenanceFeedHandler(w http.ResponseWriter, r *http.Request) {
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// calendar clients can not log in, the feed token is in the url
+	_, err := a.feeds.Verify(ctx, r.FormValue("token"))
+	if err == maintenance.ErrInvalidFeedToken {
+		rerr := a.monitor.TokenRefused(ctx, "calendar", r.RemoteAddr, r.URL.Path, err.Error())
+		if rerr != nil {
+			logging.Error(r.Context(), "monitor.TokenRefused() failed", "error", rerr)
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logging.Error(r.Context(), "feeds.Verify() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// get all windows and the servers to name in them
+	list, err := a.windows.List(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "windows.List() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	serverList, err := a.servers.List(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "servers.List() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename=maintenance.ics")
+	err = maintenance.ICal(w, list, hostnamesOf(serverList))
+	if err != nil {
+		logging.Error(r.Context(), "maintenance.ICal() failed", "error", err)
+	}
+}
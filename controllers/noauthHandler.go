@@ -1,25 +1,145 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"html/template"
 	"net/http"
-	//"github.com/gorilla/mux"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+
+	"github.com/go-stuff/web/access"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
 )
 
-func noauthHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) noauthHandler(w http.ResponseWriter, r *http.Request) {
 	//currentRoute := mux.CurrentRoute(r)
 	//pathTemplate, _ := currentRoute.GetPathTemplate()
 
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	var path string
+	if session.Values["pathtemplate"] != nil {
+		path = fmt.Sprintf("%v", session.Values["pathtemplate"])
+	}
+
+	// a user that is logged in can ask for access, show a request that is
+	// already waiting instead of the form
+	var pending *access.Request
+	loggedIn := session.Values["username"] != nil && session.Values["username"] != ""
+	if loggedIn && path != "" {
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		pending, err = a.requests.ReadPending(ctx, fmt.Sprintf("%v", session.Values["username"]), path)
+		if err != nil {
+			logging.Error(r.Context(), "requests.ReadPending() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+	}
+
+	// get notifications if there are any
+	notification, err := a.getNotification(w, r)
+	if err != nil {
+		return
+	}
+
+	a.Render(w, r, "noauth.html",
+		struct {
+			CSRF         template.HTML
+			Notification string
+			Path         string
+			LoggedIn     bool
+			Pending      *access.Request
+		}{
+			CSRF:         csrf.TemplateField(r),
+			Notification: notification,
+			Path:         path,
+			LoggedIn:     loggedIn,
+			Pending:      pending,
+		},
+	)
+}
+
+// noauthRequestHandler records a request for access to the route the user
+// was last refused
+func (a *App) noauthRequestHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// only a logged in user can ask for access
+	if session.Values["username"] == nil || session.Values["username"] == "" {
+		http.Redirect(w, r, a.prefix+"/login", http.StatusSeeOther)
+		return
+	}
+
+	// parse form fields
+	err = r.ParseForm()
 	if err != nil {
-		log.Printf("ERROR > middleware/Permissions.go > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "r.ParseForm() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
-	noauth := fmt.Sprintf("%v", session.Values["pathtemplate"])
+	// the path comes from the session, not the form, so a user can only ask
+	// for a route they were actually refused
+	if session.Values["pathtemplate"] == nil || session.Values["pathtemplate"] == "" {
+		http.Redirect(w, r, a.prefix+"/noauth", http.StatusSeeOther)
+		return
+	}
+	path := fmt.Sprintf("%v", session.Values["pathtemplate"])
+	username := fmt.Sprintf("%v", session.Values["username"])
+
+	justification := strings.TrimSpace(r.FormValue("justification"))
+	if justification == "" {
+		a.addNotification(w, r, "Please explain why you need access.")
+		http.Redirect(w, r, a.prefix+"/noauth", http.StatusSeeOther)
+		return
+	}
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// one pending request per user and route
+	pending, err := a.requests.ReadPending(ctx, username, path)
+	if err != nil {
+		logging.Error(r.Context(), "requests.ReadPending() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	if pending == nil {
+		_, err = a.requests.Create(ctx, &access.Request{
+			Username:      username,
+			RoleID:        fmt.Sprintf("%v", session.Values["roleid"]),
+			Path:          path,
+			Justification: justification,
+		})
+		if err != nil {
+			logging.Error(r.Context(), "requests.Create() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+	}
+
+	// put a notification in the session.Values that the request was sent
+	a.addNotification(w, r, fmt.Sprintf("Your request for access to '%s' has been sent to an administrator.", path))
 
-	render(w, r, "noauth.html", noauth)
+	http.Redirect(w, r, a.prefix+"/noauth", http.StatusSeeOther)
 }
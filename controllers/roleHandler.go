@@ -4,27 +4,28 @@ import (
 	"context"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 
 	"github.com/go-stuff/grpc/api"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
 )
 
 // roleSeed adds the admin and read only built-in roles
-func roleSeed() error {
+func (a *App) roleSeed() error {
 	// create a context
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// gRPC role service
-	roleSvc := api.NewRoleServiceClient(apiClient)
+	// role service
+	roleSvc := a.data.Roles
 
-	// gRPC get a role named admin
+	// get a role named admin
 	readReq := new(api.RoleReadByNameReq)
 	readReq.Name = "Admin"
 	readRes, err := roleSvc.ReadByName(ctx, readReq)
@@ -34,11 +35,11 @@ func roleSeed() error {
 
 	// if the admin role does not exist create it
 	if readRes.Role.ID == "" {
-		// gRPC create a role
+		// create a role
 		createReq := new(api.RoleCreateReq)
 		createReq.Name = "Admin"
 		createReq.Description = "Administrative Role (Built-In)"
-		createReq.Group = os.Getenv("ADMIN_AD_GROUP")
+		createReq.Group = a.ldap.AdminGroup
 		createReq.CreatedBy = "System"
 		_, err := roleSvc.Create(ctx, createReq)
 		if err != nil {
@@ -46,7 +47,7 @@ func roleSeed() error {
 		}
 	}
 
-	// gRPC get a role named read only
+	// get a role named read only
 	readReq = new(api.RoleReadByNameReq)
 	readReq.Name = "Read Only"
 	readRes, err = roleSvc.ReadByName(ctx, readReq)
@@ -56,7 +57,7 @@ func roleSeed() error {
 
 	// if the read only role does not exist create it
 	if readRes.Role.ID == "" {
-		// gRPC create a role
+		// create a role
 		createReq := new(api.RoleCreateReq)
 		createReq.Name = "Read Only"
 		createReq.Description = "Read Only Role (Built-In)"
@@ -72,12 +73,12 @@ func roleSeed() error {
 	return nil
 }
 
-func roleListHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) roleListHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleListHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -85,30 +86,30 @@ func roleListHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role service
-		roleSvc := api.NewRoleServiceClient(apiClient)
+		// role service
+		roleSvc := a.data.Roles
 
-		// gRPC get all roles
+		// get all roles
 		roleReq := new(api.RoleListReq)
 		roleRes, err := roleSvc.List(ctx, roleReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/rolesHandler.go > roleSvc.List(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "roleSvc.List() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// get notifications if there are any
-		notification, err := getNotification(w, r)
+		notification, err := a.getNotification(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// render to page
-		render(w, r, "roleList.html",
+		a.Render(w, r, "roleList.html",
 			struct {
 				CSRF         template.HTML
 				Notification string
@@ -122,20 +123,20 @@ func roleListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// save session
-	err = store.Save(r, w, session)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleListHandler() > sessions.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
 
-func roleCreateHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) roleCreateHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleCreateHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -143,7 +144,7 @@ func roleCreateHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// render to page
-		render(w, r, "roleUpsert.html",
+		a.Render(w, r, "roleUpsert.html",
 			struct {
 				CSRF   template.HTML
 				Title  string
@@ -161,17 +162,17 @@ func roleCreateHandler(w http.ResponseWriter, r *http.Request) {
 		// parse form fields
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			middleware.ServerError(w, err)
 		}
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role service
-		roleSvc := api.NewRoleServiceClient(apiClient)
+		// role service
+		roleSvc := a.data.Roles
 
-		// gRPC create a role
+		// create a role
 		roleReq := new(api.RoleCreateReq)
 		roleReq.Name = r.FormValue("name")
 		roleReq.Description = r.FormValue("description")
@@ -179,35 +180,35 @@ func roleCreateHandler(w http.ResponseWriter, r *http.Request) {
 		roleReq.CreatedBy = session.Values["username"].(string)
 		_, err = roleSvc.Create(ctx, roleReq)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// put a notification in the session.Values that a role was added
-		addNotification(w, r, fmt.Sprintf("Role '%s' has been created!", roleReq.Name))
+		a.addNotification(w, r, fmt.Sprintf("Role '%s' has been created!", roleReq.Name))
 
 		// reseed routes
-		routeSeed()
+		a.routeSeed()
 
 		// redirect to roles list
-		http.Redirect(w, r, "/role/list", http.StatusSeeOther)
+		http.Redirect(w, r, a.prefix+"/role/list", http.StatusSeeOther)
 	}
 
 	// save session
-	err = store.Save(r, w, session)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleCreateHandler() > sessions.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
 
-func roleReadHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) roleReadHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleReadHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -218,23 +219,23 @@ func roleReadHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role service
-		roleSvc := api.NewRoleServiceClient(apiClient)
+		// role service
+		roleSvc := a.data.Roles
 
-		// gRPC get a role
+		// get a role
 		roleReq := new(api.RoleReadReq)
 		roleReq.ID = vars["id"]
 		roleRes, err := roleSvc.Read(ctx, roleReq)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// render to page
-		render(w, r, "roleRead.html",
+		a.Render(w, r, "roleRead.html",
 			struct {
 				Role *api.Role
 			}{
@@ -244,20 +245,20 @@ func roleReadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// save session
-	err = store.Save(r, w, session)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleReadHandler() > sessions.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
 
-func roleUpdateHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) roleUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleUpdateHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -268,24 +269,24 @@ func roleUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role service
-		roleSvc := api.NewRoleServiceClient(apiClient)
+		// role service
+		roleSvc := a.data.Roles
 
-		// gRPC get a role
+		// get a role
 		roleReq := new(api.RoleReadReq)
 		roleReq.ID = vars["id"]
 		roleRes, err := roleSvc.Read(ctx, roleReq)
 		if err != nil {
-			log.Printf("controllers/rolesHandler.go > ERROR > svc.Read(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "svc.Read() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// reder to page
-		render(w, r, "roleUpsert.html",
+		a.Render(w, r, "roleUpsert.html",
 			struct {
 				CSRF   template.HTML
 				Title  string
@@ -304,13 +305,13 @@ func roleUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role service
-		roleSvc := api.NewRoleServiceClient(apiClient)
+		// role service
+		roleSvc := a.data.Roles
 
-		// gRPC update a role
+		// update a role
 		roleReq := new(api.RoleUpdateReq)
 		roleReq.ID = vars["id"]
 		roleReq.Name = r.FormValue("name")
@@ -319,36 +320,36 @@ func roleUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		roleReq.ModifiedBy = session.Values["username"].(string)
 		_, err := roleSvc.Update(ctx, roleReq)
 		if err != nil {
-			log.Printf("controllers/rolesHandler.go > ERROR > svc.Update(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "svc.Update() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// put a notification in the session.Values that a role was updated
-		addNotification(w, r, fmt.Sprintf("Role '%s' has been updated!", r.FormValue("name")))
+		a.addNotification(w, r, fmt.Sprintf("Role '%s' has been updated!", r.FormValue("name")))
 
 		// reseed routes
-		routeSeed()
+		a.routeSeed()
 
 		// redirect to roles list
-		http.Redirect(w, r, "/role/list", http.StatusSeeOther)
+		http.Redirect(w, r, a.prefix+"/role/list", http.StatusSeeOther)
 	}
 
 	// save session
-	err = store.Save(r, w, session)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleUpdateHandler() > sessions.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
 
-func roleDeleteHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) roleDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleDeleteHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -359,46 +360,46 @@ func roleDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role service
-		roleSvc := api.NewRoleServiceClient(apiClient)
+		// role service
+		roleSvc := a.data.Roles
 
-		// gRPC get a role
+		// get a role
 		readReq := new(api.RoleReadReq)
 		readReq.ID = vars["id"]
 		readRes, err := roleSvc.Read(ctx, readReq)
 		if err != nil {
-			log.Printf("controllers/rolesHandler.go > ERROR > svc.Read(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "svc.Read() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		// gRPC delete a role
+		// delete a role
 		deleteReq := new(api.RoleDeleteReq)
 		deleteReq.ID = vars["id"]
 		_, err = roleSvc.Delete(ctx, deleteReq)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// put a notification in the session.Values that a role was deleted
-		addNotification(w, r, fmt.Sprintf("Role '%s' was deleted!", readRes.Role.Name))
+		a.addNotification(w, r, fmt.Sprintf("Role '%s' was deleted!", readRes.Role.Name))
 
 		// reseed the routes
-		routeSeed()
+		a.routeSeed()
 
 		// redirect to roles list
-		http.Redirect(w, r, "/role/list", http.StatusSeeOther)
+		http.Redirect(w, r, a.prefix+"/role/list", http.StatusSeeOther)
 	}
 
 	// save session
-	err = store.Save(r, w, session)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > roleDeleteHandler() > sessions.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"sort"
 	"time"
@@ -13,27 +12,30 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/go-stuff/grpc/api"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
 )
 
-func routeSeed() error {
+func (a *App) routeSeed() error {
 	// walk and get the routes and sort them
-	routes = nil
-	router.Walk(gorillaWalkFunc)
-	sort.Strings(routes)
+	a.routes = nil
+	a.router.Walk(a.gorillaWalkFunc)
+	sort.Strings(a.routes)
 
 	// create a context
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// gRPC role and route services
-	roleSvc := api.NewRoleServiceClient(apiClient)
-	routeSvc := api.NewRouteServiceClient(apiClient)
+	// role and route services
+	roleSvc := a.data.Roles
+	routeSvc := a.data.Routes
 
-	// gRPC get all roles
+	// get all roles
 	roleReq := new(api.RoleListReq)
 	roleRes, err := roleSvc.List(ctx, roleReq)
 	if err != nil {
-		log.Printf("ERROR > controllers/roleHandler.go > routeSeed() > roleSvc.List(): %s\n", err.Error())
+		logging.Error(ctx, "roleSvc.List() failed", "error", err)
 		return err
 	}
 
@@ -41,7 +43,7 @@ func routeSeed() error {
 	routeReq := new(api.RouteListReq)
 	routeRes, err := routeSvc.List(ctx, routeReq)
 	if err != nil {
-		log.Printf("ERROR > controllers/routeHandler.go > routeSeed() > routeSvc.List(): %s\n", err.Error())
+		logging.Error(ctx, "routeSvc.List() failed", "error", err)
 		return err
 	}
 
@@ -58,17 +60,17 @@ func routeSeed() error {
 			deleteReq.ID = route.ID
 			deleteRes, err := routeSvc.Delete(ctx, deleteReq)
 			if err != nil {
-				log.Printf("ERROR > controllers/routeHandler.go > routeSeed() > routeSvc.Delete(): %s\n", err.Error())
+				logging.Error(ctx, "routeSvc.Delete() failed", "error", err)
 				return err
 			}
 			if deleteRes.Deleted > 0 {
-				log.Printf("INFO > controllers/routeHandler.go > routeSeed(): - delete %v %v\n", route.RoleID, route.Path)
+				logging.Info(ctx, "route seed delete", "roleid", route.RoleID, "route", route.Path)
 			}
 		}
 	}
 
 	// iterate over roles and routes and create any that are missing
-	for _, s := range routes {
+	for _, s := range a.routes {
 		for _, role := range roleRes.Roles {
 			var found bool
 			for _, route := range routeRes.Routes {
@@ -85,17 +87,19 @@ func routeSeed() error {
 					updateReq.Permission = true
 				}
 				if role.Name == "Read Only" {
-					if s == "/" || s == "/home" || s == "/server/list" {
+					if s == "/" || s == "/home" || s == "/server/list" || s == "/server/read/{id}" || s == "/cert/list" ||
+						s == "/application/list" || s == "/application/read/{id}" || s == "/application/impact" || s == "/application/graph" || s == "/application/graph/{id}" ||
+						s == "/maintenance/list" || s == "/maintenance/calendar" {
 						updateReq.Permission = true
 					}
 				}
 				updateRes, err := routeSvc.UpdateByRoleIDAndPath(ctx, updateReq)
 				if err != nil {
-					log.Printf("ERROR > controllers/routeHandler.go > routeSeed() > routeSvc.UpdateByRoleIDAndPath(): %s\n", err.Error())
+					logging.Error(ctx, "routeSvc.UpdateByRoleIDAndPath() failed", "error", err)
 					return err
 				}
 				if updateRes.Updated > 0 {
-					log.Printf("INFO > controllers/routeHandler.go > routeSeed(): - update %v %v\n", role.ID, s)
+					logging.Info(ctx, "route seed update", "roleid", role.ID, "route", s)
 				}
 			}
 		}
@@ -104,7 +108,7 @@ func routeSeed() error {
 	return nil
 }
 
-func gorillaWalkFunc(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+func (a *App) gorillaWalkFunc(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 	pathTemplate, err := route.GetPathTemplate()
 	if err != nil {
 		return err
@@ -114,20 +118,21 @@ func gorillaWalkFunc(route *mux.Route, router *mux.Router, ancestors []*mux.Rout
 		"/login",
 		"/logout",
 		"/noauth",
+		"/noauth/request",
 		"/static/":
 		// do not add public routes to the list
 	default:
-		routes = append(routes, pathTemplate)
+		a.routes = append(a.routes, pathTemplate)
 	}
 	return nil
 }
 
-func routeListHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) routeListHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/routeHandler.go > routeListHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -135,19 +140,19 @@ func routeListHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role and route services
-		roleSvc := api.NewRoleServiceClient(apiClient)
-		routeSvc := api.NewRouteServiceClient(apiClient)
+		// role and route services
+		roleSvc := a.data.Roles
+		routeSvc := a.data.Routes
 
 		// get all roles
 		roleReq := new(api.RoleListReq)
 		roleRes, err := roleSvc.List(ctx, roleReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/rolesHandler.go > roleSvc.List(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "roleSvc.List() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
@@ -155,12 +160,12 @@ func routeListHandler(w http.ResponseWriter, r *http.Request) {
 		routeReq := new(api.RouteListReq)
 		routeRes, err := routeSvc.List(ctx, routeReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/routesHandler.go > routeSvc.List(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "routeSvc.List() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		render(w, r, "routeList.html",
+		a.Render(w, r, "routeList.html",
 			struct {
 				CSRF         template.HTML
 				Notification string
@@ -178,24 +183,24 @@ func routeListHandler(w http.ResponseWriter, r *http.Request) {
 		// parse form fields
 		err := r.ParseForm()
 		if err != nil {
-			log.Printf("ERROR > controllers/routeUpdateHandler.go > r.ParseForm(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "r.ParseForm() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC route service
-		routeSvc := api.NewRouteServiceClient(apiClient)
+		// route service
+		routeSvc := a.data.Routes
 
 		// get all routes
 		routeReq := new(api.RouteListReq)
 		routeRes, err := routeSvc.List(ctx, routeReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/routesHandler.go > routeSvc.List(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "routeSvc.List() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
@@ -217,21 +222,21 @@ func routeListHandler(w http.ResponseWriter, r *http.Request) {
 
 			routeRes, err := routeSvc.UpdateByRoleIDAndPath(ctx, routeReq)
 			if err != nil {
-				log.Printf("ERROR > controllers/routesHandler.go > routeSvc.UpdateByRoleIDAndPath(): %s\n", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				logging.Error(r.Context(), "routeSvc.UpdateByRoleIDAndPath() failed", "error", err)
+				middleware.ServerError(w, err)
 				return
 			}
-			log.Printf("INFO > controllers/routesHandler.go > routeSvc.UpdateByRoleIDAndPath(): %v\n", routeRes.Updated)
+			logging.Info(r.Context(), "route permission updated", "updated", routeRes.Updated)
 		}
 
-		http.Redirect(w, r, "/route/list", http.StatusSeeOther)
+		http.Redirect(w, r, a.prefix+"/route/list", http.StatusSeeOther)
 	}
 
 	// save session
-	err = store.Save(r, w, session)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		log.Printf("ERROR > controllers/routeHandler.go > routeListHandler() > sessions.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/security"
+)
+
+func (a *App) securityListHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// count events of each kind over the last day
+		counts, err := a.monitor.Counts(ctx, time.Now().Add(-24*time.Hour))
+		if err != nil {
+			logging.Error(r.Context(), "monitor.Counts() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get the latest events
+		events, err := a.monitor.List(ctx, 500)
+		if err != nil {
+			logging.Error(r.Context(), "monitor.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "securityList.html",
+			struct {
+				Counts map[string]int64
+				Events []*security.Event
+			}{
+				Counts: counts,
+				Events: events,
+			},
+		)
+	}
+
+	// save session
+	err = session.Save(r, w)
+	if err != nil {
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
@@ -1,65 +1,781 @@
 package controllers
 
 import (
+	"context"
+	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/web/agent"
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/certs"
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/reachability"
+	"github.com/go-stuff/web/redact"
 )
 
-func serverListHandler(w http.ResponseWriter, r *http.Request) {
+// serverFromForm reads a server and its custom fields from the upsert form.
+func serverFromForm(r *http.Request, fields []*inventory.Field) (*inventory.Server, error) {
+	server := new(inventory.Server)
+	server.Hostname = r.FormValue("hostname")
+	server.IPAddresses = splitList(r.FormValue("ipaddresses"))
+	server.Environment = r.FormValue("environment")
+	server.OS = r.FormValue("os")
+	server.Owner = r.FormValue("owner")
+	server.Tags = splitList(r.FormValue("tags"))
+	server.Notes = r.FormValue("notes")
+	server.Check.Type = r.FormValue("checktype")
+	server.Check.Target = r.FormValue("checktarget")
+	server.TLSEndpoints = splitList(r.FormValue("tlsendpoints"))
+	server.DependsOn = splitList(r.FormValue("dependson"))
+
+	server.Fields = make(map[string]string)
+	for _, f := range fields {
+		server.Fields[f.Name] = r.FormValue("field." + f.Name)
+	}
+
+	if r.FormValue("checkstatus") != "" {
+		status, err := strconv.Atoi(r.FormValue("checkstatus"))
+		if err != nil {
+			return server, fmt.Errorf("'%s' is not an http status", r.FormValue("checkstatus"))
+		}
+		server.Check.ExpectStatus = status
+	}
+
+	server.Normalize()
+	err := server.Validate()
+	if err != nil {
+		return server, err
+	}
+	return server, server.ValidateFields(fields)
+}
+
+// splitList splits a comma or space separated list and drops empty items.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+	})
+}
+
+// renderServerUpsert renders the create and update form.
+func (a *App) renderServerUpsert(w http.ResponseWriter, r *http.Request, title, action string, server *inventory.Server, fields []*inventory.Field, err error) {
+	a.Render(w, r, "serverUpsert.html",
+		struct {
+			CSRF         template.HTML
+			Title        string
+			Server       *inventory.Server
+			Fields       []*inventory.Field
+			Environments []string
+			Action       string
+			Error        error
+		}{
+			CSRF:         csrf.TemplateField(r),
+			Title:        title,
+			Server:       server,
+			Fields:       fields,
+			Environments: inventory.Environments,
+			Action:       action,
+			Error:        err,
+		},
+	)
+}
+
+func (a *App) serverListHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the custom fields, servers are filtered on them
+		fields, err := a.fieldStore.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		filter := make(map[string]string)
+		for _, f := range fields {
+			if value := strings.TrimSpace(r.FormValue(f.Name)); value != "" {
+				filter[f.Name] = value
+			}
+		}
+
+		// get the servers matching the filter
+		list, err := a.servers.Search(ctx, fields, filter)
+		if err != nil {
+			logging.Error(r.Context(), "servers.Search() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get the reachability status of every checked server
+		statuses, err := a.checks.Statuses(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "checks.Statuses() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "serverList.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Servers      []*inventory.Server
+				Statuses     map[string]*reachability.Status
+				Fields       []*inventory.Field
+				Filter       map[string]string
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Servers:      list,
+				Statuses:     statuses,
+				Fields:       fields,
+				Filter:       filter,
+			},
+		)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) serverCreateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// get the custom fields of the form
+	fields, err := a.fieldStore.List(ctx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "fieldStore.List() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
-switch r.Method {
-case "GET":
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderServerUpsert(w, r, "Create Server", "Create", new(inventory.Server), fields, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show the form again if it is not valid
+		server, err := serverFromForm(r, fields)
+		if err != nil {
+			a.renderServerUpsert(w, r, "Create Server", "Create", server, fields, err)
+			break
+		}
+
+		// create a server
+		_, err = a.servers.Create(ctx, server, fmt.Sprintf("%v", session.Values["username"]))
+		if err == inventory.ErrDuplicate {
+			a.renderServerUpsert(w, r, "Create Server", "Create", server, fields, err)
+			break
+		}
+		if err != nil {
+			logging.Error(r.Context(), "servers.Create() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a server was added
+		a.addNotification(w, r, fmt.Sprintf("Server '%s' has been created!", server.Hostname))
+
+		// redirect to servers list
+		http.Redirect(w, r, a.prefix+"/server/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
 }
 
+func (a *App) serverReadHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
 
+		// get a server
+		server, err := a.servers.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "servers.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
 
+		// get the reachability status and the last day of history
+		status, err := a.checks.Status(ctx, server.ID)
+		if err != nil {
+			logging.Error(r.Context(), "checks.Status() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		until := time.Now()
+		since := until.Add(-24 * time.Hour)
+		history, err := a.checks.History(ctx, server.ID, since)
+		if err != nil {
+			logging.Error(r.Context(), "checks.History() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get the certificates found on or uploaded for the server
+		certList, err := a.certStore.ListByServer(ctx, server.ID)
+		if err != nil {
+			logging.Error(r.Context(), "certStore.ListByServer() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get the custom fields to label the values of the server
+		fields, err := a.fieldStore.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get the agent token and what changed in the facts of the server
+		token, err := a.agents.Token(ctx, server.ID)
+		if err != nil {
+			logging.Error(r.Context(), "agents.Token() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		entries, err := a.agents.History(ctx, server.ID, 50)
+		if err != nil {
+			logging.Error(r.Context(), "agents.History() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get the applications that run on the server
+		appList, err := a.applications.ListByServer(ctx, server.Hostname)
+		if err != nil {
+			logging.Error(r.Context(), "applications.ListByServer() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// the chart is built from escaped values only
+		var chart template.HTML
+		if len(history) > 0 {
+			chart = template.HTML(reachability.Chart(history, since, until))
+		}
+
+		// render to page
+		a.Render(w, r, "serverRead.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				Server       *inventory.Server
+				Fields       []*inventory.Field
+				Status       *reachability.Status
+				Chart        template.HTML
+				Certs        []*certs.Cert
+				Token        *agent.Token
+				Facts        []*agent.Change
+				StaleAfter   time.Duration
+				Applications []*inventory.Application
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Server:       server,
+				Fields:       fields,
+				Status:       status,
+				Chart:        chart,
+				Certs:        certList,
+				Token:        token,
+				Facts:        agent.Changes(entries),
+				StaleAfter:   a.agentMonitor.StaleAfter(),
+				Applications: appList,
+			},
+		)
+	}
 
 	// save session
-	err = session.Save(r, w)
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) serverUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// get variables from uri
+	vars := mux.Vars(r)
+
+	// create a context
+	ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+	defer cancel()
+
+	// get the server
+	server, err := a.servers.Read(ctx, vars["id"])
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "servers.Read() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
-	// render to template
-	render(w, r, "serverList.html", nil)
+	// get the custom fields of the form
+	fields, err := a.fieldStore.List(ctx)
+	if err != nil {
+		logging.Error(r.Context(), "fieldStore.List() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderServerUpsert(w, r, "Update Server", "Update", server, fields, nil)
+
+	case "POST":
+		// parse form fields
+		err := r.ParseForm()
+		if err != nil {
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show the form again if it is not valid, keep the created and
+		// modified details of the stored server
+		update, err := serverFromForm(r, fields)
+		update.ID = server.ID
+		update.CreatedBy, update.CreatedAt = server.CreatedBy, server.CreatedAt
+		update.ModifiedBy, update.ModifiedAt = server.ModifiedBy, server.ModifiedAt
+		if err != nil {
+			a.renderServerUpsert(w, r, "Update Server", "Update", update, fields, err)
+			break
+		}
+
+		username := fmt.Sprintf("%v", session.Values["username"])
+
+		// update the server
+		err = a.servers.Update(ctx, update, username)
+		if err == inventory.ErrDuplicate {
+			a.renderServerUpsert(w, r, "Update Server", "Update", update, fields, err)
+			break
+		}
+		if err != nil {
+			logging.Error(r.Context(), "servers.Update() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// applications keep running on and depending on a renamed server
+		if update.Hostname != server.Hostname {
+			err = a.applications.RenameServer(ctx, server.Hostname, update.Hostname)
+			if err != nil {
+				logging.Error(r.Context(), "applications.RenameServer() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
+		}
+
+		// audit what changed, custom fields included
+		changes := inventory.Diff(server, update)
+		if len(changes) > 0 {
+			err = a.spool.Write(&audit.Record{
+				ID:        primitive.NewObjectID().Hex(),
+				Username:  username,
+				Action:    fmt.Sprintf("UPDATE: %v: %s: %s", r.URL, update.Hostname, strings.Join(changes, ", ")),
+				Session:   redact.Values(session.Values),
+				CreatedBy: "System",
+				CreatedAt: time.Now().UTC(),
+				RequestID: logging.RequestID(r.Context()),
+			})
+			if err != nil {
+				logging.Error(r.Context(), "spool.Write() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
+		}
+
+		// put a notification in the session.Values that a server was updated
+		a.addNotification(w, r, fmt.Sprintf("Server '%s' has been updated!", update.Hostname))
+
+		// redirect to servers list
+		http.Redirect(w, r, a.prefix+"/server/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
 }
 
-func serverCreateHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) serverDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get the server so the notification can name it
+		server, err := a.servers.Read(ctx, vars["id"])
+		if err == mongo.ErrNoDocuments {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "servers.Read() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// delete the server
+		err = a.servers.Delete(ctx, server.ID)
+		if err != nil {
+			logging.Error(r.Context(), "servers.Delete() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// the agent of a deleted server can no longer check in
+		err = a.agents.Forget(ctx, server.ID)
+		if err != nil {
+			logging.Error(r.Context(), "agents.Forget() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// applications no longer run on or depend on a deleted server
+		err = a.applications.ForgetServer(ctx, server.Hostname)
+		if err != nil {
+			logging.Error(r.Context(), "applications.ForgetServer() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// put a notification in the session.Values that a server was deleted
+		a.addNotification(w, r, fmt.Sprintf("Server '%s' was deleted!", server.Hostname))
+
+		// redirect to servers list
+		http.Redirect(w, r, a.prefix+"/server/list", http.StatusSeeOther)
+	}
+
 	// save session
-	err = session.Save(r, w)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
+}
 
-	// render to template
-	render(w, r, "serverUpsert.html",
+// maxImportSize bounds an imported file.
+const maxImportSize = 5 << 20
+
+// renderServerImport renders the import form and, after a dry run, its
+// report.
+func (a *App) renderServerImport(w http.ResponseWriter, r *http.Request, format, data string, report *inventory.Report, err error) {
+	a.Render(w, r, "serverImport.html",
 		struct {
-			CSRF  template.HTML
-			Title string
-			// Role   *models.Role
-			Action string
+			CSRF   template.HTML
+			Format string
+			Data   string
+			Report *inventory.Report
+			Error  error
 		}{
-			CSRF:  csrf.TemplateField(r),
-			Title: "Create Server",
-			// Role:   new(models.Role),
-			Action: "Create",
+			CSRF:   csrf.TemplateField(r),
+			Format: format,
+			Data:   data,
+			Report: report,
+			Error:  err,
 		},
 	)
 }
+
+func (a *App) serverImportHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// render to page
+		a.renderServerImport(w, r, "", "", nil, nil)
+
+	case "POST":
+		// parse form fields, the data is sent as a file or, after a dry
+		// run, as the text that was checked
+		err := r.ParseMultipartForm(maxImportSize)
+		if err != nil && err != http.ErrNotMultipart {
+			http.Error(w, redact.Error(err), http.StatusBadRequest)
+			return
+		}
+
+		format := r.FormValue("format")
+		data := r.FormValue("data")
+		file, header, err := r.FormFile("file")
+		if err == nil {
+			b, err := ioutil.ReadAll(http.MaxBytesReader(w, file, maxImportSize))
+			file.Close()
+			if err != nil {
+				a.renderServerImport(w, r, format, "", nil, err)
+				break
+			}
+			data = string(b)
+			if format == "" {
+				format = inventory.FormatOf(header.Filename)
+			}
+		}
+		if format == "" {
+			format = inventory.CSV
+		}
+
+		rows, err := inventory.Decode(strings.NewReader(data), format)
+		if err != nil {
+			a.renderServerImport(w, r, format, data, nil, err)
+			break
+		}
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		owners, err := inventory.KnownOwners(ctx, a.data.Users)
+		if err != nil {
+			logging.Error(r.Context(), "inventory.KnownOwners() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		fields, err := a.fieldStore.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "fieldStore.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// always plan, the inventory may have changed since the dry run
+		report, err := inventory.Plan(ctx, a.servers, fields, rows, owners)
+		if err != nil {
+			logging.Error(r.Context(), "inventory.Plan() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// a dry run only shows the report
+		if r.FormValue("apply") == "" {
+			a.renderServerImport(w, r, format, data, report, nil)
+			break
+		}
+
+		username := fmt.Sprintf("%v", session.Values["username"])
+
+		// rows that fail are marked in the report, the others are still
+		// applied and audited
+		applyErr := inventory.Apply(ctx, a.servers, report, username)
+		if applyErr != nil {
+			logging.Error(r.Context(), "inventory.Apply() failed", "error", applyErr)
+		}
+
+		// the whole import is one audit record listing what it did
+		err = a.spool.Write(&audit.Record{
+			ID:        primitive.NewObjectID().Hex(),
+			Username:  username,
+			Action:    fmt.Sprintf("IMPORT: %v: %s", r.URL, report.Summary()),
+			Session:   redact.Values(session.Values),
+			CreatedBy: "System",
+			CreatedAt: time.Now().UTC(),
+			RequestID: logging.RequestID(r.Context()),
+		})
+		if err != nil {
+			logging.Error(r.Context(), "spool.Write() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		// show which rows failed
+		if applyErr != nil {
+			a.renderServerImport(w, r, format, data, report, applyErr)
+			break
+		}
+
+		// put a notification in the session.Values with the outcome
+		a.addNotification(w, r, fmt.Sprintf("Import done: %d created, %d updated, %d skipped, %d invalid!",
+			report.Created, report.Updated, report.Skipped, report.Invalid))
+
+		// redirect to servers list
+		http.Redirect(w, r, a.prefix+"/server/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) serverExportHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		format := r.FormValue("format")
+		if format == "" {
+			format = inventory.CSV
+		}
+		if format != inventory.CSV && format != inventory.JSON {
+			http.Error(w, fmt.Sprintf("unknown format '%s', use csv or json", format), http.StatusBadRequest)
+			return
+		}
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		// get all servers
+		list, err := a.servers.List(ctx)
+		if err != nil {
+			logging.Error(r.Context(), "servers.List() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		contentType := "text/csv; charset=utf-8"
+		if format == inventory.JSON {
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=servers.%s", format))
+
+		err = inventory.Encode(w, list, format)
+		if err != nil {
+			logging.Error(r.Context(), "inventory.Encode() failed", "error", err)
+		}
+	}
+
+	// save session
+	err = a.store.Save(r, w, session)
+	if err != nil {
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		return
+	}
+}
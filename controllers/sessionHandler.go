@@ -2,20 +2,29 @@ package controllers
 
 import (
 	"context"
-	"log"
+	"html/template"
 	"net/http"
-
 	"time"
 
 	"github.com/go-stuff/grpc/api"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/redact"
+	"github.com/go-stuff/web/sessionstore"
 )
 
-func sessionListHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) sessionListHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/sessionsHandler.go > sessionListHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -23,27 +32,58 @@ func sessionListHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// display session
-		log.Printf("INFO > controllers/sessionsHandler.go > sessionListHandler() > session: %v %v\n", session.Values["_id"], session.Values["username"])
+		logging.Debug(r.Context(), "list sessions", "session", redact.SessionID(session.ID), "username", session.Values["username"])
 
-		// call api to get a slice of sessions
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// ask the sessions repository for the live sessions
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		sessionSvc := api.NewSessionServiceClient(apiClient)
+		// stores that keep nothing on the server can not list sessions
+		supported := a.data.Sessions != nil
+		var sessions []*sessionstore.Info
+		if supported {
+			sessionRes, err := a.data.Sessions.List(ctx, new(api.SessionListReq))
+			if status.Code(err) == codes.Unimplemented {
+				supported = false
+			} else if err != nil {
+				logging.Error(r.Context(), "sessions.List() failed", "error", err)
+				middleware.ServerError(w, err)
+				return
+			}
 
-		sessionReq := new(api.SessionListReq)
-		sessionRes, err := sessionSvc.List(ctx, sessionReq)
+			for _, s := range sessionRes.GetSessions() {
+				createdAt, _ := ptypes.Timestamp(s.CreatedAt)
+				expiresAt, _ := ptypes.Timestamp(s.ExpiresAt)
+				sessions = append(sessions, &sessionstore.Info{
+					ID:         s.ID,
+					Username:   s.Username,
+					RemoteAddr: s.RemoteAddr,
+					Host:       s.Host,
+					CreatedAt:  createdAt,
+					ExpiresAt:  expiresAt,
+				})
+			}
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
 		if err != nil {
-			log.Printf("ERROR > controllers/sessionsHandler.go > sessionListHandler() > sessionSvc.List(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		render(w, r, "sessionList.html",
+		a.Render(w, r, "sessionList.html",
 			struct {
-				Sessions []*api.Session
+				CSRF         template.HTML
+				Notification string
+				Supported    bool
+				Current      string
+				Sessions     []*sessionstore.Info
 			}{
-				Sessions: sessionRes.Sessions,
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				Supported:    supported,
+				Current:      session.ID,
+				Sessions:     sessions,
 			},
 		)
 	}
@@ -51,8 +91,64 @@ func sessionListHandler(w http.ResponseWriter, r *http.Request) {
 	// save session
 	err = session.Save(r, w)
 	if err != nil {
-		log.Printf("ERROR > controllers/sessionsHandler.go > sessionListHandler() > session.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+func (a *App) sessionRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		// get variables from uri
+		vars := mux.Vars(r)
+
+		// use logout to end your own session
+		if vars["id"] == session.ID {
+			a.addNotification(w, r, "Use Logout to end your own session.")
+			http.Redirect(w, r, a.prefix+"/session/list", http.StatusSeeOther)
+			return
+		}
+
+		// create a context
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
+		defer cancel()
+
+		err = a.store.Revoke(ctx, vars["id"])
+		if err == sessionstore.ErrNotSupported {
+			a.addNotification(w, r, "This session store can not revoke sessions.")
+			http.Redirect(w, r, a.prefix+"/session/list", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			logging.Error(r.Context(), "store.Revoke() failed", "error", err)
+			middleware.ServerError(w, err)
+			return
+		}
+
+		logging.Info(r.Context(), "session revoked", "username", session.Values["username"], "session", redact.SessionID(vars["id"]))
+
+		// put a notification in the session.Values that the session was revoked
+		a.addNotification(w, r, "The session has been revoked!")
+
+		// redirect to session list
+		http.Redirect(w, r, a.prefix+"/session/list", http.StatusSeeOther)
+	}
+
+	// save session
+	err = session.Save(r, w)
+	if err != nil {
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/csrf"
+
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/repository"
+)
+
+func (a *App) statusHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "GET":
+		// the grpc backend is the only one with a connection to show
+		var backend *repository.GRPCStatus
+		if a.backend != nil {
+			status := a.backend.Status()
+			backend = &status
+		}
+
+		// get notifications if there are any
+		notification, err := a.getNotification(w, r)
+		if err != nil {
+			return
+		}
+
+		// render to page
+		a.Render(w, r, "status.html",
+			struct {
+				CSRF         template.HTML
+				Notification string
+				DataBackend  string
+				Backend      *repository.GRPCStatus
+				Spool        audit.SpoolStats
+				LogLevel     string
+				LogLevels    []string
+			}{
+				CSRF:         csrf.TemplateField(r),
+				Notification: notification,
+				DataBackend:  a.dataBackend,
+				Backend:      backend,
+				Spool:        a.spool.Stats(),
+				LogLevel:     logging.GetLevel().String(),
+				LogLevels:    logging.LevelNames(),
+			},
+		)
+	}
+
+	// save session
+	err = session.Save(r, w)
+	if err != nil {
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
+
+// statusLogHandler sets the log level while running, until the next start
+// sets it from LOG_LEVEL again.
+func (a *App) statusLogHandler(w http.ResponseWriter, r *http.Request) {
+	// get session
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+
+	// handle each method
+	switch r.Method {
+	case "POST":
+		level, err := logging.ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// logged before and after so the change shows at either level
+		logging.Info(r.Context(), "log level changed", "from", logging.GetLevel(), "to", level, "username", session.Values["username"])
+		logging.SetLevel(level)
+
+		// put a notification in the session.Values that the level was set
+		a.addNotification(w, r, "The log level is now "+level.String()+".")
+
+		// redirect to status
+		http.Redirect(w, r, a.prefix+"/status", http.StatusSeeOther)
+	}
+
+	// save session
+	err = session.Save(r, w)
+	if err != nil {
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
+		return
+	}
+}
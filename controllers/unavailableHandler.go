@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// unavailable shows the unavailable page instead of the raw grpc errors
+// while the grpc backend can not be reached. Requests fail fast with it
+// while the breaker is open, and a request that failed because its own
+// call could not reach the backend, answered with a 503 by
+// middleware.ServerError, gets it instead.
+func (a *App) unavailable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only process files that are not in the /static/ folder, and only
+		// the grpc backend has a breaker
+		if a.backend == nil || strings.Contains(r.RequestURI, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if a.backend.Breaker.Blocked() {
+			a.unavailableHandler(w, r)
+			return
+		}
+
+		next.ServeHTTP(&unavailableWriter{
+			ResponseWriter: w,
+			a:              a,
+			r:              r,
+		}, r)
+	})
+}
+
+func (a *App) unavailableHandler(w http.ResponseWriter, r *http.Request) {
+	logging.Warn(r.Context(), "backend unavailable", "method", r.Method, "uri", r.RequestURI)
+
+	// browsers and proxies try again once the breaker lets calls through
+	retry := time.Until(a.backend.Breaker.Status().RetryAt)
+	if retry < time.Second {
+		retry = time.Second
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	a.Render(w, r, "unavailable.html",
+		struct {
+			Path       string
+			RetryAfter time.Duration
+		}{
+			Path:       r.URL.Path,
+			RetryAfter: retry.Round(time.Second),
+		},
+	)
+}
+
+// unavailableWriter replaces the 503 of a request whose call to the
+// backend could not reach it with the unavailable page. Other requests
+// failing at the same time keep their own errors.
+type unavailableWriter struct {
+	http.ResponseWriter
+	a        *App
+	r        *http.Request
+	replaced bool
+}
+
+func (w *unavailableWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable {
+		w.replaced = true
+		w.a.unavailableHandler(w.ResponseWriter, w.r)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *unavailableWriter) Write(b []byte) (int, error) {
+	// the body of the replaced error is dropped
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes http.Flusher through.
+func (w *unavailableWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
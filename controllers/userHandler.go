@@ -4,25 +4,27 @@ import (
 	"context"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/go-stuff/grpc/api"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/middleware"
 )
 
 func userSeed() {
 	// TODO IF A ROLE IS REMOVED, Set anyone with that role to read only
 }
 
-func userListHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) userListHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/usersHandler.go > userListHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -30,37 +32,37 @@ func userListHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// call api to get a slice of users
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		roleSvc := api.NewRoleServiceClient(apiClient)
-		userSvc := api.NewUserServiceClient(apiClient)
+		roleSvc := a.data.Roles
+		userSvc := a.data.Users
 
 		roleReq := new(api.RoleListReq)
 		roleRes, err := roleSvc.List(ctx, roleReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/usersHandler.go > userListHandler() > rolesSvc.Slice(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "rolesSvc.Slice() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		userReq := new(api.UserListReq)
 		userRes, err := userSvc.List(ctx, userReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/usersHandler.go > userListHandler() > userSvc.Slice(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "userSvc.Slice() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// get notifications if there are any
-		notification, err := getNotification(w, r)
+		notification, err := a.getNotification(w, r)
 		if err != nil {
-			log.Printf("ERROR > controllers/usersHandler.go > userListHandler() > getNotification(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "getNotification() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		render(w, r, "userList.html",
+		a.Render(w, r, "userList.html",
 			struct {
 				Notification string
 				Roles        []*api.Role
@@ -76,18 +78,18 @@ func userListHandler(w http.ResponseWriter, r *http.Request) {
 	// save session
 	err = session.Save(r, w)
 	if err != nil {
-		log.Printf("ERROR > controllers/usersHandler.go > userListHandler() > session.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
 
-func userReadHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) userReadHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/userHandler.go > userReadHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -98,34 +100,34 @@ func userReadHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role and user service
-		roleSvc := api.NewRoleServiceClient(apiClient)
-		userSvc := api.NewUserServiceClient(apiClient)
+		// role and user service
+		roleSvc := a.data.Roles
+		userSvc := a.data.Users
 
-		// gRPC get all roles
+		// get all roles
 		roleReq := new(api.RoleListReq)
 		roleRes, err := roleSvc.List(ctx, roleReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/userHandler.go > userReadHandler() > rolsSvc.List(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "roleSvc.List() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		// gRPC get a user
+		// get a user
 		userReq := new(api.UserReadReq)
 		userReq.ID = vars["id"]
 		userRes, err := userSvc.Read(ctx, userReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/userHandler.go > userReadHandler() > userSvc.Read(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "userSvc.Read() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// render to page
-		render(w, r, "userRead.html",
+		a.Render(w, r, "userRead.html",
 			struct {
 				Roles []*api.Role
 				User  *api.User
@@ -137,20 +139,20 @@ func userReadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// save session
-	err = store.Save(r, w, session)
+	err = a.store.Save(r, w, session)
 	if err != nil {
-		log.Printf("ERROR > controllers/userHandler.go > userReadHandler() > sessions.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "sessions.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
 
-func userUpdateHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) userUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/usersHandler.go > userUpdateHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -161,34 +163,34 @@ func userUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC role and user services
-		roleSvc := api.NewRoleServiceClient(apiClient)
-		userSvc := api.NewUserServiceClient(apiClient)
+		// role and user services
+		roleSvc := a.data.Roles
+		userSvc := a.data.Users
 
-		// gRPC find a role
+		// find a role
 		roleReq := new(api.RoleListReq)
 		roleRes, err := roleSvc.List(ctx, roleReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/usersHandler.go > userUpdateHandler() > svc.Read(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "svc.Read() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		// gRPC find a user
+		// find a user
 		userReq := new(api.UserReadReq)
 		userReq.ID = vars["id"]
 		userRes, err := userSvc.Read(ctx, userReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/usersHandler.go > userUpdateHandler() > svc.Read(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "svc.Read() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// reder to page
-		render(w, r, "userUpsert.html",
+		a.Render(w, r, "userUpsert.html",
 			struct {
 				CSRF   template.HTML
 				Title  string
@@ -209,21 +211,21 @@ func userUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPCuser service
-		userSvc := api.NewUserServiceClient(apiClient)
+		// user service
+		userSvc := a.data.Users
 
-		// gRPC update a user
+		// update a user
 		userReq := new(api.UserUpdateReq)
 		userReq.ID = vars["id"]
 		userReq.RoleID = r.FormValue("role")
 		userReq.ModifiedBy = session.Values["username"].(string)
 		_, err := userSvc.Update(ctx, userReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/usersHandler.go > userUpdateHandler() > svc.Update(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "svc.Update() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
@@ -231,27 +233,27 @@ func userUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		session.Values["roleid"] = userReq.RoleID
 
 		// put a notification in the session.Values that a user was updated
-		addNotification(w, r, fmt.Sprintf("User '%s' has been updated!", r.FormValue("username")))
+		a.addNotification(w, r, fmt.Sprintf("User '%s' has been updated!", r.FormValue("username")))
 
 		// redirect to user list
-		http.Redirect(w, r, "/user/list", http.StatusSeeOther)
+		http.Redirect(w, r, a.prefix+"/user/list", http.StatusSeeOther)
 	}
 
 	// save session
 	err = session.Save(r, w)
 	if err != nil {
-		log.Printf("ERROR > controllers/usersHandler.go > userUpdateHandler() > session.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
 
-func userDeleteHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) userDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	// get session
-	session, err := store.Get(r, "session")
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		log.Printf("ERROR > controllers/usersHandler.go > userDeleteHandler() > store.Get(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "store.Get() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 
@@ -262,43 +264,43 @@ func userDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
 		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 		defer cancel()
 
-		// gRPC user service
-		svc := api.NewUserServiceClient(apiClient)
+		// user service
+		svc := a.data.Users
 
-		// gRPC get a user
+		// get a user
 		readReq := new(api.UserReadReq)
 		readReq.ID = vars["id"]
 		readRes, err := svc.Read(ctx, readReq)
 		if err != nil {
-			log.Printf("ERROR > controllers/usersHandler.go > userDeleteHandler() > svc.Read(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "svc.Read() failed", "error", err)
+			middleware.ServerError(w, err)
 			return
 		}
 
-		// gRPC delete a user
+		// delete a user
 		deleteReq := new(api.UserDeleteReq)
 		deleteReq.ID = vars["id"]
 		_, err = svc.Delete(ctx, deleteReq)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			middleware.ServerError(w, err)
 			return
 		}
 
 		// put a notification in the session.Values that a user was deleted
-		addNotification(w, r, fmt.Sprintf("User '%s' was deleted!", readRes.User.Username))
+		a.addNotification(w, r, fmt.Sprintf("User '%s' was deleted!", readRes.User.Username))
 
 		// redirect to users list
-		http.Redirect(w, r, "/user/list", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, a.prefix+"/user/list", http.StatusTemporaryRedirect)
 	}
 
 	// save session
 	err = session.Save(r, w)
 	if err != nil {
-		log.Printf("ERROR > controllers/usersHandler.go > userDeleteHandler() > session.Save(): %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.Error(r.Context(), "session.Save() failed", "error", err)
+		middleware.ServerError(w, err)
 		return
 	}
 }
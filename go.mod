@@ -3,10 +3,10 @@ module github.com/go-stuff/web
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-stuff/grpc v0.0.0-20190711234811-a4a057adc810
 	github.com/go-stuff/ldap v0.0.2
-	github.com/go-stuff/mongostore v0.1.17
 	github.com/golang/protobuf v1.3.1
 	github.com/gorilla/csrf v1.5.1
 	github.com/gorilla/mux v1.7.2
@@ -20,4 +20,5 @@ require (
 	golang.org/x/sys v0.0.0-20190616124812-15dcb6c0061f // indirect
 	google.golang.org/genproto v0.0.0-20190611190212-a7e196e89fd3 // indirect
 	google.golang.org/grpc v1.21.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,242 @@
+// Package graph builds the dependency graph of the servers and applications
+// in the inventory, tells what is affected when one of them goes down and
+// draws or exports the graph.
+package graph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-stuff/web/inventory"
+)
+
+// Kinds of node.
+const (
+	Server      = "server"
+	Application = "application"
+)
+
+// Kinds of edge.
+const (
+	// DependsOn is an edge from a node to a node it depends on.
+	DependsOn = "dependson"
+	// RunsOn is an edge from an application to a server it runs on.
+	RunsOn = "runson"
+)
+
+// Node is a server or an application.
+type Node struct {
+	// ID is the kind and the hostname or name, such as server:db-01.
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Environment string `json:"environment,omitempty"`
+	// Ref is the id of the server or application, it is empty for a node
+	// that is depended on but not in the inventory.
+	Ref string `json:"ref,omitempty"`
+}
+
+// Edge is a dependency of From on To.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// Graph is a dependency graph, nodes are sorted applications first and
+// then by name.
+type Graph struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []*Edge `json:"edges"`
+
+	nodes map[string]*Node
+}
+
+// ID returns the id of the node of kind named name.
+func ID(kind, name string) string {
+	return kind + ":" + name
+}
+
+// Build returns the graph of servers and apps.
+func Build(servers []*inventory.Server, apps []*inventory.Application) *Graph {
+	g := &Graph{nodes: make(map[string]*Node)}
+
+	for _, server := range servers {
+		g.add(&Node{ID: ID(Server, server.Hostname), Kind: Server, Name: server.Hostname, Environment: server.Environment, Ref: server.ID})
+	}
+	for _, app := range apps {
+		g.add(&Node{ID: ID(Application, app.Name), Kind: Application, Name: app.Name, Ref: app.ID})
+	}
+
+	for _, server := range servers {
+		for _, hostname := range server.DependsOn {
+			g.link(ID(Server, server.Hostname), Server, hostname, DependsOn)
+		}
+	}
+	for _, app := range apps {
+		from := ID(Application, app.Name)
+		for _, hostname := range app.Servers {
+			g.link(from, Server, hostname, RunsOn)
+		}
+		for _, name := range app.DependsOnApps {
+			g.link(from, Application, name, DependsOn)
+		}
+		for _, hostname := range app.DependsOnServers {
+			g.link(from, Server, hostname, DependsOn)
+		}
+	}
+
+	g.sort()
+	return g
+}
+
+// add adds a node unless there is one with the same id.
+func (g *Graph) add(n *Node) {
+	if g.nodes[n.ID] != nil {
+		return
+	}
+	g.nodes[n.ID] = n
+	g.Nodes = append(g.Nodes, n)
+}
+
+// link adds an edge from a node to the node of kind named name, which is
+// added if it is not in the inventory.
+func (g *Graph) link(from, kind, name, edge string) {
+	to := ID(kind, name)
+	g.add(&Node{ID: to, Kind: kind, Name: name})
+	g.Edges = append(g.Edges, &Edge{From: from, To: to, Kind: edge})
+}
+
+func (g *Graph) sort() {
+	sort.SliceStable(g.Nodes, func(i, j int) bool {
+		if g.Nodes[i].Kind != g.Nodes[j].Kind {
+			return g.Nodes[i].Kind == Application
+		}
+		return g.Nodes[i].Name < g.Nodes[j].Name
+	})
+	sort.SliceStable(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+}
+
+// Node returns the node with id, or nil.
+func (g *Graph) Node(id string) *Node {
+	return g.nodes[id]
+}
+
+// walk returns the ids of the nodes reached from id, including id, by
+// following the edges, or following them back.
+func (g *Graph) walk(id string, back bool) map[string]bool {
+	seen := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, e := range g.Edges {
+			from, to := e.From, e.To
+			if back {
+				from, to = to, from
+			}
+			if from == current && !seen[to] {
+				seen[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+	return seen
+}
+
+// Impact returns the nodes affected when the node id goes down: the nodes
+// that depend on it or run on it, directly or through other nodes.
+func (g *Graph) Impact(id string) []*Node {
+	affected := g.walk(id, true)
+
+	var nodes []*Node
+	for _, n := range g.Nodes {
+		if n.ID != id && affected[n.ID] {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// Around returns the part of the graph around the node id: what it
+// depends on and what depends on it, directly or through other nodes.
+func (g *Graph) Around(id string) *Graph {
+	down := g.walk(id, false)
+	up := g.walk(id, true)
+	return g.subgraph(func(n *Node) bool {
+		return down[n.ID] || up[n.ID]
+	})
+}
+
+// Environment returns the graph with only the servers in env, applications
+// are kept.
+func (g *Graph) Environment(env string) *Graph {
+	return g.subgraph(func(n *Node) bool {
+		return n.Kind == Application || n.Environment == env
+	})
+}
+
+// subgraph returns the nodes that keep returns true for and the edges
+// between them.
+func (g *Graph) subgraph(keep func(*Node) bool) *Graph {
+	sub := &Graph{nodes: make(map[string]*Node)}
+	for _, n := range g.Nodes {
+		if keep(n) {
+			sub.add(n)
+		}
+	}
+	for _, e := range g.Edges {
+		if sub.nodes[e.From] != nil && sub.nodes[e.To] != nil {
+			sub.Edges = append(sub.Edges, e)
+		}
+	}
+	return sub
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language.
+func (g *Graph) WriteDOT(w io.Writer, name string) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "digraph %s {\n", quote(name))
+	bw.WriteString("  rankdir=TB;\n")
+	bw.WriteString("  node [fontname=\"Helvetica\", fontsize=10];\n")
+
+	for _, n := range g.Nodes {
+		shape := "box"
+		if n.Kind == Application {
+			shape = "component"
+		}
+		attrs := fmt.Sprintf("label=%s, shape=%s", quote(n.Name), shape)
+		if n.Environment != "" {
+			attrs += ", tooltip=" + quote(n.Environment)
+		}
+		if n.Ref == "" {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(bw, "  %s [%s];\n", quote(n.ID), attrs)
+	}
+
+	for _, e := range g.Edges {
+		attrs := ""
+		if e.Kind == RunsOn {
+			attrs = " [style=dashed, label=\"runs on\"]"
+		}
+		fmt.Fprintf(bw, "  %s -> %s%s;\n", quote(e.From), quote(e.To), attrs)
+	}
+
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// quote returns s as a DOT string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,209 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+)
+
+// drawing layout in pixels
+const (
+	nodeWidth  = 150
+	nodeHeight = 32
+	gapX       = 24
+	gapY       = 56
+	pad        = 16
+	labelRunes = 20
+)
+
+// back returns the edges that close a cycle, found by a depth first search
+// from each node in turn.
+func (g *Graph) back() map[*Edge]bool {
+	const (
+		unseen = iota
+		open
+		done
+	)
+	state := make(map[string]int)
+	back := make(map[*Edge]bool)
+
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = open
+		for _, e := range g.Edges {
+			if e.From != id {
+				continue
+			}
+			switch state[e.To] {
+			case open:
+				back[e] = true
+			case unseen:
+				visit(e.To)
+			}
+		}
+		state[id] = done
+	}
+	for _, n := range g.Nodes {
+		if state[n.ID] == unseen {
+			visit(n.ID)
+		}
+	}
+
+	return back
+}
+
+// layers places every node one layer below the lowest node that depends on
+// it, with the nodes of each layer ordered under the nodes above them. The
+// edges that close a cycle are left out.
+func (g *Graph) layers() [][]*Node {
+	back := g.back()
+	layer := make(map[string]int)
+	for i := 0; i < len(g.Nodes); i++ {
+		changed := false
+		for _, e := range g.Edges {
+			if !back[e] && layer[e.To] < layer[e.From]+1 {
+				layer[e.To] = layer[e.From] + 1
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	var layers [][]*Node
+	for _, n := range g.Nodes {
+		for len(layers) <= layer[n.ID] {
+			layers = append(layers, nil)
+		}
+		layers[layer[n.ID]] = append(layers[layer[n.ID]], n)
+	}
+
+	// order each layer by the average position of the nodes above it
+	// that depend on it
+	pos := make(map[string]float64)
+	for i, n := range layers[0] {
+		pos[n.ID] = float64(i)
+	}
+	for l := 1; l < len(layers); l++ {
+		centre := make(map[string]float64)
+		for _, n := range layers[l] {
+			sum, count := 0.0, 0
+			for _, e := range g.Edges {
+				if p, ok := pos[e.From]; ok && e.To == n.ID && layer[e.From] < l {
+					sum += p
+					count++
+				}
+			}
+			centre[n.ID] = float64(len(g.Nodes))
+			if count > 0 {
+				centre[n.ID] = sum / float64(count)
+			}
+		}
+		sort.SliceStable(layers[l], func(i, j int) bool {
+			return centre[layers[l][i].ID] < centre[layers[l][j].ID]
+		})
+		for i, n := range layers[l] {
+			pos[n.ID] = float64(i)
+		}
+	}
+
+	return layers
+}
+
+// SVG draws the graph with every node above the nodes it depends on. Nodes
+// link to their page and the node with id highlight is drawn in bold.
+func (g *Graph) SVG(highlight string) string {
+	if len(g.Nodes) == 0 {
+		return ""
+	}
+	layers := g.layers()
+
+	widest := 0
+	for _, l := range layers {
+		if len(l) > widest {
+			widest = len(l)
+		}
+	}
+	width := 2*pad + widest*(nodeWidth+gapX) - gapX
+	height := 2*pad + len(layers)*(nodeHeight+gapY) - gapY
+
+	// top left corner of each node, each layer is centred
+	type point struct{ x, y int }
+	at := make(map[string]point)
+	for l, nodes := range layers {
+		left := (width - len(nodes)*(nodeWidth+gapX) + gapX) / 2
+		for i, n := range nodes {
+			at[n.ID] = point{left + i*(nodeWidth+gapX), pad + l*(nodeHeight+gapY)}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" id="graph" viewBox="0 0 %d %d" width="100%%" style="max-width: %dpx" role="img" aria-label="Dependency graph">`, width, height, width)
+	buf.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="#999"/></marker></defs>`)
+
+	// edges from the bottom of a node to the top of the node it depends on
+	for _, e := range g.Edges {
+		from, to := at[e.From], at[e.To]
+		dash := ""
+		verb := "depends on"
+		if e.Kind == RunsOn {
+			dash = ` stroke-dasharray="4 3"`
+			verb = "runs on"
+		}
+		fmt.Fprintf(&buf, `<line class="edge" data-from="%s" data-to="%s" x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999" stroke-width="1.5"%s marker-end="url(#arrow)"><title>%s %s %s</title></line>`,
+			html.EscapeString(e.From), html.EscapeString(e.To),
+			from.x+nodeWidth/2, from.y+nodeHeight, to.x+nodeWidth/2, to.y,
+			dash, html.EscapeString(g.nodes[e.From].Name), verb, html.EscapeString(g.nodes[e.To].Name))
+	}
+
+	for _, n := range g.Nodes {
+		p := at[n.ID]
+		fill, stroke, dash, href := "#d1ecf1", "#17a2b8", "", "/server/read/"+n.Ref
+		if n.Kind == Application {
+			fill, stroke, href = "#e2d9f3", "#6f42c1", "/application/read/"+n.Ref
+		}
+		if n.Ref == "" {
+			fill, stroke, dash, href = "#f8f9fa", "#adb5bd", ` stroke-dasharray="4 3"`, ""
+		}
+		strokeWidth := 1
+		if n.ID == highlight {
+			strokeWidth = 3
+		}
+
+		title := n.Kind + " " + n.Name
+		if n.Environment != "" {
+			title += " (" + n.Environment + ")"
+		}
+		if n.Ref == "" {
+			title += ", not in the inventory"
+		}
+
+		fmt.Fprintf(&buf, `<g class="node" data-id="%s">`, html.EscapeString(n.ID))
+		if href != "" {
+			fmt.Fprintf(&buf, `<a href="%s">`, html.EscapeString(href))
+		}
+		fmt.Fprintf(&buf, `<title>%s</title>`, html.EscapeString(title))
+		fmt.Fprintf(&buf, `<rect x="%d" y="%d" width="%d" height="%d" rx="4" fill="%s" stroke="%s" stroke-width="%d"%s/>`,
+			p.x, p.y, nodeWidth, nodeHeight, fill, stroke, strokeWidth, dash)
+		fmt.Fprintf(&buf, `<text x="%d" y="%d" font-size="12" text-anchor="middle" dominant-baseline="middle" fill="#212529">%s</text>`,
+			p.x+nodeWidth/2, p.y+nodeHeight/2, html.EscapeString(label(n.Name)))
+		if href != "" {
+			buf.WriteString(`</a>`)
+		}
+		buf.WriteString(`</g>`)
+	}
+
+	buf.WriteString(`</svg>`)
+	return buf.String()
+}
+
+// label shortens a name to fit in a node.
+func label(name string) string {
+	runes := []rune(name)
+	if len(runes) <= labelRunes {
+		return name
+	}
+	return string(runes[:labelRunes-1]) + "…"
+}
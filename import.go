@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/repository"
+)
+
+// runImport is the import subcommand, it checks a csv or json file of
+// servers and, with -apply, creates and updates them:
+//
+//	web import [-apply] [-format csv|json] [-user name] file
+func runImport(db *mongo.Database, data *repository.Repositories, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "apply the import, without it only a dry run is reported")
+	format := flags.String("format", "", "csv or json, by default from the file name")
+	user := flags.String("user", os.Getenv("USER"), "username the import is audited as")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: web import [-apply] [-format csv|json] [-user name] file")
+	}
+	if *format == "" {
+		*format = inventory.FormatOf(flags.Arg(0))
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rows, err := inventory.Decode(file, *format)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// owners must be known users
+	owners, err := inventory.KnownOwners(ctx, data.Users)
+	if err != nil {
+		return err
+	}
+
+	fieldStore, err := inventory.NewFieldStore(db.Collection("serverfields"))
+	if err != nil {
+		return err
+	}
+	fields, err := fieldStore.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	servers, err := inventory.NewStore(db.Collection("servers"))
+	if err != nil {
+		return err
+	}
+	report, err := inventory.Plan(ctx, servers, fields, rows, owners)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tHOSTNAME\tACTION\tPROBLEMS")
+	for _, row := range report.Rows {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", row.Line, row.Server.Hostname, row.Action, strings.Join(row.Errors, "; "))
+	}
+	tw.Flush()
+	fmt.Printf("%d to create, %d to update, %d unchanged, %d invalid\n", report.Created, report.Updated, report.Skipped, report.Invalid)
+
+	if !*apply {
+		fmt.Println("dry run, nothing was changed, use -apply to import")
+		return nil
+	}
+
+	// rows that fail are marked in the report, the others are still
+	// applied and audited
+	applyErr := inventory.Apply(ctx, servers, report, *user)
+
+	// the whole import is one audit record listing what it did, sent
+	// straight to the audit log since the spool belongs to the server
+	err = audit.NewBackend(data.Audits).Create(ctx, &audit.Record{
+		ID:        primitive.NewObjectID().Hex(),
+		Username:  *user,
+		Action:    fmt.Sprintf("IMPORT: %s: %s", flags.Arg(0), report.Summary()),
+		CreatedBy: "System",
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if applyErr != nil {
+		for _, row := range report.Rows {
+			if row.Action == inventory.Failed {
+				fmt.Printf("line %d: %s: %s\n", row.Line, row.Server.Hostname, strings.Join(row.Errors, "; "))
+			}
+		}
+		return applyErr
+	}
+
+	fmt.Println("import applied")
+	return nil
+}
+
+// runExport is the export subcommand, it writes every server as csv or
+// json to a file or stdout:
+//
+//	web export [-format csv|json] [file]
+func runExport(db *mongo.Database, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or json, by default from the file name or csv")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("usage: web export [-format csv|json] [file]")
+	}
+
+	out := os.Stdout
+	if flags.NArg() == 1 {
+		if *format == "" {
+			*format = inventory.FormatOf(flags.Arg(0))
+		}
+		out, err = os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if *format == "" {
+		*format = inventory.CSV
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	servers, err := inventory.NewStore(db.Collection("servers"))
+	if err != nil {
+		return err
+	}
+	list, err := servers.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	return inventory.Encode(out, list, *format)
+}
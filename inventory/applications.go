@@ -0,0 +1,243 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrDuplicateApplication is returned when an application name is already
+// taken.
+var ErrDuplicateApplication = errors.New("an application with this name already exists")
+
+// Application is a group of servers that together provide a service.
+type Application struct {
+	ID          string `bson:"_id"`
+	Name        string `bson:"name"`
+	Description string `bson:"description"`
+	Owner       string `bson:"owner"`
+	// Servers are the hostnames of the servers the application runs on.
+	Servers []string `bson:"servers"`
+	// DependsOnApps are the names of the applications, and
+	// DependsOnServers the hostnames of the servers, this application
+	// depends on.
+	DependsOnApps    []string  `bson:"dependsonapps"`
+	DependsOnServers []string  `bson:"dependsonservers"`
+	CreatedBy        string    `bson:"createdby"`
+	CreatedAt        time.Time `bson:"createdat"`
+	ModifiedBy       string    `bson:"modifiedby"`
+	ModifiedAt       time.Time `bson:"modifiedat"`
+}
+
+// Normalize tidies up an application as entered, hostnames are lower case.
+func (a *Application) Normalize() {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Description = strings.TrimSpace(a.Description)
+	a.Owner = strings.TrimSpace(a.Owner)
+	a.Servers = lower(compact(a.Servers))
+	a.DependsOnApps = compact(a.DependsOnApps)
+	a.DependsOnServers = lower(compact(a.DependsOnServers))
+}
+
+// Validate returns the first problem with an application, or nil.
+func (a *Application) Validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	for _, name := range a.DependsOnApps {
+		if name == a.Name {
+			return fmt.Errorf("%s can not depend on itself", a.Name)
+		}
+	}
+	return nil
+}
+
+// lower returns list in lower case.
+func lower(list []string) []string {
+	for i, item := range list {
+		list[i] = strings.ToLower(item)
+	}
+	return list
+}
+
+// ApplicationStore keeps applications in MongoDB.
+type ApplicationStore struct {
+	col *mongo.Collection
+}
+
+// NewApplicationStore returns an ApplicationStore using col.
+func NewApplicationStore(col *mongo.Collection) *ApplicationStore {
+	return &ApplicationStore{col: col}
+}
+
+// List returns every application sorted by name.
+func (s *ApplicationStore) List(ctx context.Context) ([]*Application, error) {
+	return s.find(ctx, bson.M{})
+}
+
+// ListByServer returns the applications that run on hostname sorted by
+// name.
+func (s *ApplicationStore) ListByServer(ctx context.Context, hostname string) ([]*Application, error) {
+	return s.find(ctx, bson.M{"servers": hostname})
+}
+
+func (s *ApplicationStore) find(ctx context.Context, filter interface{}) ([]*Application, error) {
+	cursor, err := s.col.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var apps []*Application
+	for cursor.Next(ctx) {
+		app := new(Application)
+		err := cursor.Decode(app)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+
+	return apps, cursor.Err()
+}
+
+// Create adds an application and returns its id.
+func (s *ApplicationStore) Create(ctx context.Context, app *Application, createdBy string) (string, error) {
+	err := s.unique(ctx, "", app.Name)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	app.ID = primitive.NewObjectID().Hex()
+	app.CreatedBy = createdBy
+	app.CreatedAt = now
+	app.ModifiedBy = createdBy
+	app.ModifiedAt = now
+
+	_, err = s.col.InsertOne(ctx, app)
+	if err != nil {
+		return "", err
+	}
+	return app.ID, nil
+}
+
+// Read returns an application by id.
+func (s *ApplicationStore) Read(ctx context.Context, id string) (*Application, error) {
+	app := new(Application)
+	err := s.col.FindOne(ctx, bson.M{"_id": id}).Decode(app)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// Update replaces an application, the created fields are kept. A new name
+// is also given to the applications that depend on it.
+func (s *ApplicationStore) Update(ctx context.Context, app *Application, modifiedBy string) error {
+	err := s.unique(ctx, app.ID, app.Name)
+	if err != nil {
+		return err
+	}
+
+	old, err := s.Read(ctx, app.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.col.UpdateOne(ctx,
+		bson.M{"_id": app.ID},
+		bson.M{
+			"$set": bson.M{
+				"name":             app.Name,
+				"description":      app.Description,
+				"owner":            app.Owner,
+				"servers":          app.Servers,
+				"dependsonapps":    app.DependsOnApps,
+				"dependsonservers": app.DependsOnServers,
+				"modifiedby":       modifiedBy,
+				"modifiedat":       time.Now().UTC(),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if old.Name != app.Name {
+		_, err = s.col.UpdateMany(ctx,
+			bson.M{"dependsonapps": old.Name},
+			bson.M{"$set": bson.M{"dependsonapps.$": app.Name}},
+		)
+	}
+	return err
+}
+
+// Delete removes an application and the dependencies on it.
+func (s *ApplicationStore) Delete(ctx context.Context, id string) error {
+	app, err := s.Read(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.col.UpdateMany(ctx,
+		bson.M{"dependsonapps": app.Name},
+		bson.M{"$pull": bson.M{"dependsonapps": app.Name}},
+	)
+	return err
+}
+
+// ForgetServer removes a deleted server from every application.
+func (s *ApplicationStore) ForgetServer(ctx context.Context, hostname string) error {
+	_, err := s.col.UpdateMany(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"servers": hostname},
+			bson.M{"dependsonservers": hostname},
+		}},
+		bson.M{"$pull": bson.M{
+			"servers":          hostname,
+			"dependsonservers": hostname,
+		}},
+	)
+	return err
+}
+
+// RenameServer gives a server that was renamed its new hostname in every
+// application.
+func (s *ApplicationStore) RenameServer(ctx context.Context, old, new string) error {
+	for _, field := range []string{"servers", "dependsonservers"} {
+		_, err := s.col.UpdateMany(ctx,
+			bson.M{field: old},
+			bson.M{"$set": bson.M{field + ".$": new}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unique returns ErrDuplicateApplication if another application than id
+// has name.
+func (s *ApplicationStore) unique(ctx context.Context, id, name string) error {
+	n, err := s.col.CountDocuments(ctx, bson.M{"name": name, "_id": bson.M{"$ne": id}})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicateApplication
+	}
+	return nil
+}
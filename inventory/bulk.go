@@ -0,0 +1,583 @@
+package inventory
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-stuff/grpc/api"
+
+	"github.com/go-stuff/web/repository"
+)
+
+// Formats the inventory is imported from and exported to.
+const (
+	CSV  = "csv"
+	JSON = "json"
+)
+
+// What an import does with a row.
+const (
+	Create  = "create"
+	Update  = "update"
+	Skip    = "skip"
+	Invalid = "invalid"
+	// Failed rows were planned but could not be applied.
+	Failed = "failed"
+)
+
+// allFields in Row.Columns replaces every custom field, as "fields" does
+// in JSON.
+const allFields = "fields"
+
+// Columns are the CSV columns of the built in attributes, in export order,
+// and their JSON field names. List columns hold items separated by
+// semicolons. Custom fields follow as columns of their own, in JSON they
+// are an object under "fields".
+var Columns = []string{
+	"hostname",
+	"ipaddresses",
+	"environment",
+	"os",
+	"owner",
+	"tags",
+	"notes",
+	"checktype",
+	"checktarget",
+	"checkstatus",
+	"tlsendpoints",
+	"dependson",
+}
+
+// record is a server as it is imported and exported.
+type record struct {
+	Hostname     string            `json:"hostname"`
+	IPAddresses  []string          `json:"ipaddresses"`
+	Environment  string            `json:"environment"`
+	OS           string            `json:"os"`
+	Owner        string            `json:"owner"`
+	Tags         []string          `json:"tags"`
+	Notes        string            `json:"notes"`
+	CheckType    string            `json:"checktype,omitempty"`
+	CheckTarget  string            `json:"checktarget,omitempty"`
+	CheckStatus  int               `json:"checkstatus,omitempty"`
+	TLSEndpoints []string          `json:"tlsendpoints"`
+	DependsOn    []string          `json:"dependson"`
+	Fields       map[string]string `json:"fields,omitempty"`
+}
+
+func toRecord(s *Server) *record {
+	return &record{
+		Hostname:     s.Hostname,
+		IPAddresses:  compact(s.IPAddresses),
+		Environment:  s.Environment,
+		OS:           s.OS,
+		Owner:        s.Owner,
+		Tags:         compact(s.Tags),
+		Notes:        s.Notes,
+		CheckType:    s.Check.Type,
+		CheckTarget:  s.Check.Target,
+		CheckStatus:  s.Check.ExpectStatus,
+		TLSEndpoints: compact(s.TLSEndpoints),
+		DependsOn:    compact(s.DependsOn),
+		Fields:       s.Fields,
+	}
+}
+
+// cells returns the record as CSV cells in the order of Columns.
+func (rec *record) cells() []string {
+	status := ""
+	if rec.CheckStatus != 0 {
+		status = strconv.Itoa(rec.CheckStatus)
+	}
+	return []string{
+		rec.Hostname,
+		strings.Join(rec.IPAddresses, ";"),
+		rec.Environment,
+		rec.OS,
+		rec.Owner,
+		strings.Join(rec.Tags, ";"),
+		rec.Notes,
+		rec.CheckType,
+		rec.CheckTarget,
+		status,
+		strings.Join(rec.TLSEndpoints, ";"),
+		strings.Join(rec.DependsOn, ";"),
+	}
+}
+
+func (rec *record) server() *Server {
+	return &Server{
+		Hostname:    rec.Hostname,
+		IPAddresses: rec.IPAddresses,
+		Environment: rec.Environment,
+		OS:          rec.OS,
+		Owner:       rec.Owner,
+		Tags:        rec.Tags,
+		Notes:       rec.Notes,
+		Check: Check{
+			Type:         rec.CheckType,
+			Target:       rec.CheckTarget,
+			ExpectStatus: rec.CheckStatus,
+		},
+		TLSEndpoints: rec.TLSEndpoints,
+		DependsOn:    rec.DependsOn,
+		Fields:       rec.Fields,
+	}
+}
+
+// Diff lists what changed from old to new, built in attributes first and
+// custom fields after them, as "name 'old' -> 'new'".
+func Diff(old, new *Server) []string {
+	var changes []string
+
+	before, after := toRecord(old).cells(), toRecord(new).cells()
+	for i, col := range Columns {
+		if before[i] != after[i] {
+			changes = append(changes, fmt.Sprintf("%s '%s' -> '%s'", col, before[i], after[i]))
+		}
+	}
+
+	names := make(map[string]string)
+	for name, value := range old.Fields {
+		names[name] = value
+	}
+	for name, value := range new.Fields {
+		names[name] = value
+	}
+	for _, name := range fieldNames(names) {
+		if old.Fields[name] != new.Fields[name] {
+			changes = append(changes, fmt.Sprintf("%s '%s' -> '%s'", name, old.Fields[name], new.Fields[name]))
+		}
+	}
+
+	return changes
+}
+
+// Row is one server of an import.
+type Row struct {
+	// Line is the line of a CSV file or the position in a JSON list.
+	Line   int
+	Server *Server
+	// Columns are the columns the import has, from Columns or names of
+	// custom fields. An update leaves the others as they are, nil sets
+	// every column.
+	Columns []string
+	Action  string
+	Errors  []string
+	// Changes are what an update changes, see Diff.
+	Changes []string
+}
+
+// Report is the outcome of an import, or of a dry run of one.
+type Report struct {
+	Rows    []*Row
+	Created int
+	Updated int
+	Skipped int
+	Invalid int
+	Failed  int
+}
+
+// Summary lists the hostnames of the report by action, updates with what
+// they change.
+func (r *Report) Summary() string {
+	byAction := make(map[string][]string)
+	for _, row := range r.Rows {
+		name := row.Server.Hostname
+		if name == "" {
+			name = fmt.Sprintf("line %d", row.Line)
+		}
+		if len(row.Changes) > 0 {
+			name = fmt.Sprintf("%s (%s)", name, strings.Join(row.Changes, ", "))
+		}
+		if row.Action == Failed {
+			name = fmt.Sprintf("%s (%s)", name, strings.Join(row.Errors, ", "))
+		}
+		byAction[row.Action] = append(byAction[row.Action], name)
+	}
+
+	var parts []string
+	for _, action := range []string{Create, Update, Skip, Invalid, Failed} {
+		parts = append(parts, fmt.Sprintf("%s [%s]", action, strings.Join(byAction[action], ", ")))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Decode reads the servers of an import in format. A row that can not be
+// read gets an error, data that can not be read at all returns one.
+func Decode(r io.Reader, format string) ([]*Row, error) {
+	switch format {
+	case JSON:
+		var raws []json.RawMessage
+		err := json.NewDecoder(r).Decode(&raws)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := make([]*Row, 0, len(raws))
+		for i, raw := range raws {
+			// the keys an object has are its columns
+			var keys map[string]json.RawMessage
+			err := json.Unmarshal(raw, &keys)
+			if err != nil {
+				return nil, fmt.Errorf("server %d: %v", i+1, err)
+			}
+			rec := new(record)
+			err = json.Unmarshal(raw, rec)
+			if err != nil {
+				return nil, fmt.Errorf("server %d: %v", i+1, err)
+			}
+
+			row := &Row{Line: i + 1, Server: rec.server(), Columns: []string{}}
+			for _, col := range append(append([]string{}, Columns...), allFields) {
+				if _, ok := keys[col]; ok {
+					row.Columns = append(row.Columns, col)
+				}
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+
+	case CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("the csv file is empty")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// columns may come in any order, columns that are not built in are
+		// custom fields and checked against their definitions by Plan, so a
+		// misspelt header is not silently ignored
+		index := make(map[string]int)
+		var custom, columns []string
+		for i, name := range header {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := index[name]; ok {
+				return nil, fmt.Errorf("csv column '%s' is repeated", name)
+			}
+			index[name] = i
+			columns = append(columns, name)
+
+			builtin := false
+			for _, col := range Columns {
+				if name == col {
+					builtin = true
+				}
+			}
+			if !builtin {
+				custom = append(custom, name)
+			}
+		}
+		if _, ok := index["hostname"]; !ok {
+			return nil, fmt.Errorf("the csv file has no hostname column")
+		}
+
+		var rows []*Row
+		for line := 2; ; line++ {
+			fields, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			get := func(col string) string {
+				i, ok := index[col]
+				if !ok || i >= len(fields) {
+					return ""
+				}
+				return fields[i]
+			}
+
+			// skip blank lines spreadsheets leave at the end
+			if strings.TrimSpace(strings.Join(fields, "")) == "" {
+				continue
+			}
+
+			row := &Row{Line: line, Columns: columns}
+			rec := &record{
+				Hostname:     get("hostname"),
+				IPAddresses:  splitCell(get("ipaddresses")),
+				Environment:  get("environment"),
+				OS:           get("os"),
+				Owner:        get("owner"),
+				Tags:         splitCell(get("tags")),
+				Notes:        get("notes"),
+				CheckType:    get("checktype"),
+				CheckTarget:  get("checktarget"),
+				TLSEndpoints: splitCell(get("tlsendpoints")),
+				DependsOn:    splitCell(get("dependson")),
+			}
+			for _, name := range custom {
+				if value := get(name); value != "" {
+					if rec.Fields == nil {
+						rec.Fields = make(map[string]string)
+					}
+					rec.Fields[name] = value
+				}
+			}
+			if status := strings.TrimSpace(get("checkstatus")); status != "" {
+				rec.CheckStatus, err = strconv.Atoi(status)
+				if err != nil {
+					row.Errors = append(row.Errors, fmt.Sprintf("'%s' is not an http status", status))
+				}
+			}
+			row.Server = rec.server()
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	return nil, fmt.Errorf("unknown format '%s', use csv or json", format)
+}
+
+// splitCell splits a list cell on semicolons, commas or white space.
+func splitCell(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return c == ';' || c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+	})
+}
+
+// KnownOwners returns a check of whether an owner is a known username,
+// for Plan.
+func KnownOwners(ctx context.Context, users repository.Users) (func(owner string) bool, error) {
+	userRes, err := users.List(ctx, new(api.UserListReq))
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := make(map[string]bool, len(userRes.Users))
+	for _, user := range userRes.Users {
+		usernames[strings.ToLower(user.Username)] = true
+	}
+
+	return func(owner string) bool {
+		return usernames[strings.ToLower(owner)]
+	}, nil
+}
+
+// Plan works out what an import of rows would do without changing
+// anything. Rows are invalid when they fail validation, have custom field
+// values that do not fit fields, repeat a hostname of an earlier row or
+// name an owner knownOwner does not know. Rows for hostnames already in
+// the inventory update the columns the row has, or are skipped when
+// nothing changed, and are checked with the values of the other columns
+// kept.
+func Plan(ctx context.Context, store *Store, fields []*Field, rows []*Row, knownOwner func(owner string) bool) (*Report, error) {
+	servers, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*Server, len(servers))
+	for _, server := range servers {
+		existing[server.Hostname] = server
+	}
+
+	report := &Report{Rows: rows}
+	seen := make(map[string]int)
+
+	for _, row := range rows {
+		row.Server.Normalize()
+
+		current := existing[row.Server.Hostname]
+		if current != nil {
+			row.Server = merge(current, row.Server, row.Columns)
+		}
+
+		err := row.Server.Validate()
+		if err != nil {
+			row.Errors = append(row.Errors, err.Error())
+		}
+		err = row.Server.ValidateFields(fields)
+		if err != nil {
+			row.Errors = append(row.Errors, err.Error())
+		}
+		if line, ok := seen[row.Server.Hostname]; ok && row.Server.Hostname != "" {
+			row.Errors = append(row.Errors, fmt.Sprintf("hostname '%s' is also on line %d", row.Server.Hostname, line))
+		} else {
+			seen[row.Server.Hostname] = row.Line
+		}
+		if row.Server.Owner != "" && knownOwner != nil && !knownOwner(row.Server.Owner) {
+			row.Errors = append(row.Errors, fmt.Sprintf("unknown owner '%s'", row.Server.Owner))
+		}
+
+		switch {
+		case len(row.Errors) > 0:
+			row.Action = Invalid
+			report.Invalid++
+		case current == nil:
+			row.Action = Create
+			report.Created++
+		case reflect.DeepEqual(toRecord(current), toRecord(row.Server)):
+			row.Server.ID = current.ID
+			row.Action = Skip
+			report.Skipped++
+		default:
+			row.Server.ID = current.ID
+			row.Changes = Diff(current, row.Server)
+			row.Action = Update
+			report.Updated++
+		}
+	}
+
+	return report, nil
+}
+
+// merge returns current with the columns of imported set, as an update
+// with only those columns leaves it.
+func merge(current, imported *Server, columns []string) *Server {
+	if columns == nil {
+		imported.ID = current.ID
+		return imported
+	}
+
+	merged := *current
+	merged.Fields = make(map[string]string, len(current.Fields))
+	for name, value := range current.Fields {
+		merged.Fields[name] = value
+	}
+
+	for _, col := range columns {
+		switch col {
+		case "hostname":
+			merged.Hostname = imported.Hostname
+		case "ipaddresses":
+			merged.IPAddresses = imported.IPAddresses
+		case "environment":
+			merged.Environment = imported.Environment
+		case "os":
+			merged.OS = imported.OS
+		case "owner":
+			merged.Owner = imported.Owner
+		case "tags":
+			merged.Tags = imported.Tags
+		case "notes":
+			merged.Notes = imported.Notes
+		case "checktype":
+			merged.Check.Type = imported.Check.Type
+		case "checktarget":
+			merged.Check.Target = imported.Check.Target
+		case "checkstatus":
+			merged.Check.ExpectStatus = imported.Check.ExpectStatus
+		case "tlsendpoints":
+			merged.TLSEndpoints = imported.TLSEndpoints
+		case "dependson":
+			merged.DependsOn = imported.DependsOn
+		case allFields:
+			merged.Fields = imported.Fields
+		default:
+			// a custom field, an empty cell clears it
+			if value := imported.Fields[col]; value != "" {
+				merged.Fields[col] = value
+			} else {
+				delete(merged.Fields, col)
+			}
+		}
+	}
+	if len(merged.Fields) == 0 {
+		merged.Fields = nil
+	}
+
+	return &merged
+}
+
+// Apply creates and updates the servers of a planned import, invalid and
+// skipped rows are left alone. A row that fails does not stop the others,
+// it is marked Failed with the error and the lines that failed are
+// returned as an error, so the report always tells what was applied.
+// Running the same import again skips every row it applied.
+func Apply(ctx context.Context, store *Store, report *Report, username string) error {
+	var failed []string
+	for _, row := range report.Rows {
+		var err error
+		switch row.Action {
+		case Create:
+			_, err = store.Create(ctx, row.Server, username)
+			if err != nil {
+				report.Created--
+			}
+		case Update:
+			err = store.Patch(ctx, row.Server, row.Columns, username)
+			if err != nil {
+				report.Updated--
+			}
+		}
+		if err != nil {
+			row.Action = Failed
+			row.Errors = append(row.Errors, err.Error())
+			report.Failed++
+			failed = append(failed, strconv.Itoa(row.Line))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d rows failed to import, lines %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Encode writes servers in format, in a way Decode reads back.
+func Encode(w io.Writer, servers []*Server, format string) error {
+	switch format {
+	case JSON:
+		recs := make([]*record, 0, len(servers))
+		for _, server := range servers {
+			recs = append(recs, toRecord(server))
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(recs)
+
+	case CSV:
+		// a column for every custom field any of the servers has a value for
+		names := make(map[string]string)
+		for _, server := range servers {
+			for name, value := range server.Fields {
+				names[name] = value
+			}
+		}
+		custom := fieldNames(names)
+
+		cw := csv.NewWriter(w)
+		err := cw.Write(append(append([]string{}, Columns...), custom...))
+		if err != nil {
+			return err
+		}
+		for _, server := range servers {
+			cells := toRecord(server).cells()
+			for _, name := range custom {
+				cells = append(cells, server.Fields[name])
+			}
+			err := cw.Write(cells)
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return fmt.Errorf("unknown format '%s', use csv or json", format)
+}
+
+// FormatOf guesses the format of a file from its name, csv unless it ends
+// in .json.
+func FormatOf(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".json") {
+		return JSON
+	}
+	return CSV
+}
@@ -0,0 +1,160 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Facts are what the agent on a server reports about its host.
+type Facts struct {
+	Hostname string `bson:"hostname" json:"hostname"`
+	OS       string `bson:"os" json:"os"`
+	Kernel   string `bson:"kernel" json:"kernel"`
+	// Uptime is in seconds.
+	Uptime   int64 `bson:"uptime" json:"uptime"`
+	Packages int   `bson:"packages" json:"packages"`
+	// Extra holds any other facts an agent wants to report.
+	Extra map[string]string `bson:"extra,omitempty" json:"extra,omitempty"`
+}
+
+// Normalize tidies up facts as reported.
+func (f *Facts) Normalize() {
+	f.Hostname = strings.ToLower(strings.TrimSpace(f.Hostname))
+	f.OS = strings.TrimSpace(f.OS)
+	f.Kernel = strings.TrimSpace(f.Kernel)
+
+	var extra map[string]string
+	for name, value := range f.Extra {
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" || value == "" {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]string)
+		}
+		extra[name] = value
+	}
+	f.Extra = extra
+}
+
+// DiffFacts lists what changed from old to new as "name 'old' -> 'new'".
+// Uptime always changes and is left out.
+func DiffFacts(old, new *Facts) []string {
+	var changes []string
+	diff := func(name, before, after string) {
+		if before != after {
+			changes = append(changes, fmt.Sprintf("%s '%s' -> '%s'", name, before, after))
+		}
+	}
+
+	diff("hostname", old.Hostname, new.Hostname)
+	diff("os", old.OS, new.OS)
+	diff("kernel", old.Kernel, new.Kernel)
+	diff("packages", strconv.Itoa(old.Packages), strconv.Itoa(new.Packages))
+
+	names := make(map[string]string)
+	for name, value := range old.Extra {
+		names[name] = value
+	}
+	for name, value := range new.Extra {
+		names[name] = value
+	}
+	for _, name := range fieldNames(names) {
+		diff(name, old.Extra[name], new.Extra[name])
+	}
+
+	return changes
+}
+
+// CheckIn records that the agent of a server checked in, with facts if it
+// sent them, and clears its stale mark. Facts are kept apart from what
+// admins entered, the OS of the server is left alone. It returns the
+// server as it was before, in one step, so concurrent check-ins each see
+// the facts the one before them left.
+func (s *Store) CheckIn(ctx context.Context, id string, facts *Facts) (*Server, error) {
+	set := bson.M{
+		"checkedinat": time.Now().UTC(),
+		"stale":       false,
+	}
+	if facts != nil {
+		set["facts"] = facts
+	}
+
+	server := new(Server)
+	err := s.col.FindOneAndUpdate(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(server)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// MarkStale marks the servers whose agent last checked in before a time as
+// stale and returns them. Servers that are already stale, or whose agent
+// never checked in, are left alone.
+func (s *Store) MarkStale(ctx context.Context, before time.Time) ([]*Server, error) {
+	filter := bson.M{
+		"checkedinat": bson.M{"$lt": before},
+		"stale":       bson.M{"$ne": true},
+	}
+
+	candidates, err := s.find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// the agent may check in between the find and the update, the filter
+	// is applied again so it is not marked stale
+	var stale []*Server
+	for _, server := range candidates {
+		filter["_id"] = server.ID
+		res, err := s.col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"stale": true}})
+		if err != nil {
+			return nil, err
+		}
+		if res.ModifiedCount > 0 {
+			server.Stale = true
+			stale = append(stale, server)
+		}
+	}
+
+	return stale, nil
+}
+
+// StaleDue returns the servers whose stale mark differs from what the
+// last alert about them said.
+func (s *Store) StaleDue(ctx context.Context) ([]*Server, error) {
+	return s.find(ctx, bson.M{
+		"$or": bson.A{
+			bson.M{"stale": true, "stalealerted": bson.M{"$ne": true}},
+			bson.M{"stale": bson.M{"$ne": true}, "stalealerted": true},
+		},
+	})
+}
+
+// StaleAlerted notes that an alert told the server was stale, or not, and
+// reports whether the note was taken. It is not when the server changed
+// since or the note was already taken, so only one alert is sent.
+func (s *Store) StaleAlerted(ctx context.Context, id string, stale bool) (bool, error) {
+	filter := bson.M{"_id": id, "stalealerted": bson.M{"$ne": stale}}
+	if stale {
+		filter["stale"] = true
+	} else {
+		filter["stale"] = bson.M{"$ne": true}
+	}
+
+	res, err := s.col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"stalealerted": stale}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
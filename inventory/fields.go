@@ -0,0 +1,311 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/go-stuff/web/repository"
+)
+
+// ErrDuplicateField is returned when a custom field name is already taken.
+var ErrDuplicateField = errors.New("a custom field with this name already exists")
+
+// Types of custom field.
+const (
+	Text    = "text"
+	Number  = "number"
+	Boolean = "boolean"
+	Date    = "date"
+	Enum    = "enum"
+)
+
+// FieldTypes are the types a custom field can have.
+var FieldTypes = []string{Text, Number, Boolean, Date, Enum}
+
+// fieldName is what a custom field name looks like, it is also the CSV
+// column of the field.
+var fieldName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Field is a custom attribute admins add to every server.
+type Field struct {
+	ID string `bson:"_id"`
+	// Name is the key of the field in Server.Fields, it can not be
+	// changed once the field is created.
+	Name     string `bson:"name"`
+	Label    string `bson:"label"`
+	Type     string `bson:"type"`
+	Required bool   `bson:"required"`
+	// Values are the choices of an enum field.
+	Values []string `bson:"values"`
+	// Pattern is a regular expression the whole value must match.
+	Pattern    string    `bson:"pattern"`
+	CreatedBy  string    `bson:"createdby"`
+	CreatedAt  time.Time `bson:"createdat"`
+	ModifiedBy string    `bson:"modifiedby"`
+	ModifiedAt time.Time `bson:"modifiedat"`
+}
+
+// Normalize tidies up a field as entered.
+func (f *Field) Normalize() {
+	f.Name = strings.ToLower(strings.TrimSpace(f.Name))
+	f.Label = strings.TrimSpace(f.Label)
+	f.Values = compact(f.Values)
+	f.Pattern = strings.TrimSpace(f.Pattern)
+	if f.Label == "" {
+		f.Label = f.Name
+	}
+	if f.Type != Enum {
+		f.Values = nil
+	}
+}
+
+// Validate returns the first problem with a field definition, or nil.
+func (f *Field) Validate() error {
+	if !fieldName.MatchString(f.Name) {
+		return fmt.Errorf("name '%s' must start with a letter and only have lower case letters, digits and underscores", f.Name)
+	}
+	for _, col := range Columns {
+		if f.Name == col {
+			return fmt.Errorf("name '%s' is taken by a built in attribute", f.Name)
+		}
+	}
+
+	valid := false
+	for _, t := range FieldTypes {
+		if f.Type == t {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("'%s' is not a field type", f.Type)
+	}
+	if f.Type == Enum && len(f.Values) == 0 {
+		return fmt.Errorf("an enum field needs at least one value")
+	}
+
+	if f.Pattern != "" {
+		_, err := regexp.Compile(f.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern '%s' is not a regular expression: %s", f.Pattern, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Check returns the problem with value as the value of the field, or nil.
+// An empty value is only a problem for a required field.
+func (f *Field) Check(value string) error {
+	if value == "" {
+		if f.Required {
+			return fmt.Errorf("%s is required", f.Label)
+		}
+		return nil
+	}
+
+	switch f.Type {
+	case Number:
+		_, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s '%s' is not a number", f.Label, value)
+		}
+	case Boolean:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%s '%s' is not true or false", f.Label, value)
+		}
+	case Date:
+		_, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return fmt.Errorf("%s '%s' is not a date like 2006-01-02", f.Label, value)
+		}
+	case Enum:
+		valid := false
+		for _, v := range f.Values {
+			if value == v {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%s '%s' is not one of %s", f.Label, value, strings.Join(f.Values, ", "))
+		}
+	}
+
+	if f.Pattern != "" {
+		re, err := regexp.Compile("^(?:" + f.Pattern + ")$")
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("%s '%s' does not match %s", f.Label, value, f.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// ValidateFields returns the first problem with the custom field values of
+// a server, or nil. Values for fields that are not defined are a problem.
+func (s *Server) ValidateFields(fields []*Field) error {
+	defined := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		defined[f.Name] = true
+
+		err := f.Check(s.Fields[f.Name])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range fieldNames(s.Fields) {
+		if !defined[name] {
+			return fmt.Errorf("'%s' is not a custom field", name)
+		}
+	}
+
+	return nil
+}
+
+// Misfits returns the servers whose value of field does not fit its
+// definition, as "hostname: problem", so a field is not changed to reject
+// every later edit of servers that have a value for it.
+func Misfits(servers []*Server, field *Field) []string {
+	var misfits []string
+	for _, server := range servers {
+		err := field.Check(server.Fields[field.Name])
+		if err != nil {
+			misfits = append(misfits, fmt.Sprintf("%s: %s", server.Hostname, err.Error()))
+		}
+	}
+	return misfits
+}
+
+// fieldNames returns the keys of values sorted.
+func fieldNames(values map[string]string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FieldStore keeps custom field definitions in MongoDB.
+type FieldStore struct {
+	col *mongo.Collection
+}
+
+// NewFieldStore returns a FieldStore using col and makes sure field names
+// are unique.
+func NewFieldStore(col *mongo.Collection) (*FieldStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unique field name index, remove duplicate field names first: %v", err)
+	}
+
+	return &FieldStore{col: col}, nil
+}
+
+// List returns every field sorted by name.
+func (s *FieldStore) List(ctx context.Context) ([]*Field, error) {
+	cursor, err := s.col.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var fields []*Field
+	for cursor.Next(ctx) {
+		field := new(Field)
+		err := cursor.Decode(field)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, cursor.Err()
+}
+
+// Create adds a field and returns its id.
+func (s *FieldStore) Create(ctx context.Context, field *Field, createdBy string) (string, error) {
+	now := time.Now().UTC()
+	field.ID = primitive.NewObjectID().Hex()
+	field.CreatedBy = createdBy
+	field.CreatedAt = now
+	field.ModifiedBy = createdBy
+	field.ModifiedAt = now
+
+	_, err := s.col.InsertOne(ctx, field)
+	if repository.IsDuplicateKey(err) {
+		return "", ErrDuplicateField
+	}
+	if err != nil {
+		return "", err
+	}
+	return field.ID, nil
+}
+
+// Read returns a field by id.
+func (s *FieldStore) Read(ctx context.Context, id string) (*Field, error) {
+	field := new(Field)
+	err := s.col.FindOne(ctx, bson.M{"_id": id}).Decode(field)
+	if err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// Update replaces the definition of a field, the name and created fields
+// are kept. Check the values servers already have with Misfits first.
+func (s *FieldStore) Update(ctx context.Context, field *Field, modifiedBy string) error {
+	res, err := s.col.UpdateOne(ctx,
+		bson.M{"_id": field.ID},
+		bson.M{
+			"$set": bson.M{
+				"label":      field.Label,
+				"type":       field.Type,
+				"required":   field.Required,
+				"values":     field.Values,
+				"pattern":    field.Pattern,
+				"modifiedby": modifiedBy,
+				"modifiedat": time.Now().UTC(),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Delete removes a field definition, Store.UnsetField removes its values.
+func (s *FieldStore) Delete(ctx context.Context, id string) error {
+	res, err := s.col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
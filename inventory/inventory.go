@@ -0,0 +1,419 @@
+// Package inventory stores the server inventory.
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/go-stuff/web/repository"
+)
+
+// ErrDuplicate is returned when a hostname is already in the inventory.
+var ErrDuplicate = errors.New("a server with this hostname already exists")
+
+// Environments a server can be in.
+var Environments = []string{"Production", "Staging", "Test", "Development"}
+
+// Kinds of reachability check.
+const (
+	// TCP connects to Target, a host:port.
+	TCP = "tcp"
+	// HTTP gets Target, a URL, and expects ExpectStatus.
+	HTTP = "http"
+	// TLS completes a TLS handshake with Target, a host:port.
+	TLS = "tls"
+)
+
+// Check describes how a server is probed, a server without a check type is
+// not probed.
+type Check struct {
+	Type         string `bson:"type"`
+	Target       string `bson:"target"`
+	ExpectStatus int    `bson:"expectstatus,omitempty"`
+}
+
+// Server is a server in the inventory.
+type Server struct {
+	ID          string   `bson:"_id"`
+	Hostname    string   `bson:"hostname"`
+	IPAddresses []string `bson:"ipaddresses"`
+	Environment string   `bson:"environment"`
+	OS          string   `bson:"os"`
+	Owner       string   `bson:"owner"`
+	Tags        []string `bson:"tags"`
+	Notes       string   `bson:"notes"`
+	Check       Check    `bson:"check"`
+	// TLSEndpoints are the host:port endpoints whose certificates are
+	// tracked.
+	TLSEndpoints []string `bson:"tlsendpoints"`
+	// DependsOn are the hostnames of the servers this server depends on.
+	DependsOn []string `bson:"dependson"`
+	// Fields are the values of the custom fields by field name.
+	Fields map[string]string `bson:"fields,omitempty"`
+	// Facts are the last facts reported by the agent of the server,
+	// CheckedInAt is when it last checked in and Stale is set once it
+	// stops checking in. StaleAlerted is whether the last alert said it
+	// was stale, they differ while an alert is held back.
+	Facts        *Facts    `bson:"facts,omitempty"`
+	CheckedInAt  time.Time `bson:"checkedinat,omitempty"`
+	Stale        bool      `bson:"stale,omitempty"`
+	StaleAlerted bool      `bson:"stalealerted,omitempty"`
+	CreatedBy    string    `bson:"createdby"`
+	CreatedAt    time.Time `bson:"createdat"`
+	ModifiedBy   string    `bson:"modifiedby"`
+	ModifiedAt   time.Time `bson:"modifiedat"`
+}
+
+// Normalize tidies up a server as entered: the hostname is lower case,
+// empty list items are dropped and a TLS endpoint given as a port on its
+// own is on the server itself.
+func (s *Server) Normalize() {
+	s.Hostname = strings.ToLower(strings.TrimSpace(s.Hostname))
+	s.IPAddresses = compact(s.IPAddresses)
+	s.OS = strings.TrimSpace(s.OS)
+	s.Owner = strings.TrimSpace(s.Owner)
+	s.Tags = compact(s.Tags)
+	s.Notes = strings.TrimSpace(s.Notes)
+	s.Check.Target = strings.TrimSpace(s.Check.Target)
+	s.TLSEndpoints = compact(s.TLSEndpoints)
+	s.DependsOn = lower(compact(s.DependsOn))
+
+	// custom fields without a value are left out
+	var fields map[string]string
+	for name, value := range s.Fields {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	s.Fields = fields
+
+	for i, endpoint := range s.TLSEndpoints {
+		if _, err := strconv.Atoi(endpoint); err == nil {
+			s.TLSEndpoints[i] = net.JoinHostPort(s.Hostname, endpoint)
+		}
+	}
+
+	switch s.Check.Type {
+	case "":
+		s.Check = Check{}
+	case HTTP:
+		if s.Check.ExpectStatus == 0 {
+			s.Check.ExpectStatus = http.StatusOK
+		}
+	default:
+		s.Check.ExpectStatus = 0
+	}
+}
+
+// Validate returns the first problem with a server, or nil.
+func (s *Server) Validate() error {
+	if s.Hostname == "" {
+		return fmt.Errorf("hostname is required")
+	}
+	for _, ip := range s.IPAddresses {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("'%s' is not an IP address", ip)
+		}
+	}
+	valid := false
+	for _, env := range Environments {
+		if s.Environment == env {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("'%s' is not an environment", s.Environment)
+	}
+
+	for _, endpoint := range s.TLSEndpoints {
+		_, _, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return fmt.Errorf("tls endpoint '%s' is not a host:port", endpoint)
+		}
+	}
+
+	for _, hostname := range s.DependsOn {
+		if hostname == s.Hostname {
+			return fmt.Errorf("a server can not depend on itself")
+		}
+	}
+
+	// the reachability check, tcp and tls need a host:port and http a url
+	switch s.Check.Type {
+	case "":
+	case TCP, TLS:
+		_, _, err := net.SplitHostPort(s.Check.Target)
+		if err != nil {
+			return fmt.Errorf("check target '%s' is not a host:port", s.Check.Target)
+		}
+	case HTTP:
+		u, err := url.Parse(s.Check.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("check target '%s' is not an http or https url", s.Check.Target)
+		}
+		if s.Check.ExpectStatus < 100 || s.Check.ExpectStatus > 599 {
+			return fmt.Errorf("'%d' is not an http status", s.Check.ExpectStatus)
+		}
+	default:
+		return fmt.Errorf("'%s' is not a check type", s.Check.Type)
+	}
+
+	return nil
+}
+
+// compact trims list items and drops the empty ones.
+func compact(list []string) []string {
+	var out []string
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Store keeps servers in MongoDB.
+type Store struct {
+	col *mongo.Collection
+}
+
+// NewStore returns a Store using col and makes sure hostnames are unique.
+func NewStore(col *mongo.Collection) (*Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hostname", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unique hostname index, remove duplicate hostnames first: %v", err)
+	}
+
+	return &Store{col: col}, nil
+}
+
+// List returns every server sorted by hostname.
+func (s *Store) List(ctx context.Context) ([]*Server, error) {
+	return s.find(ctx, bson.M{})
+}
+
+// Search returns the servers sorted by hostname whose custom fields match
+// values, a map of field name to value. Text fields match when they
+// contain the value in any case, other fields must be equal to it. Empty
+// values and names of fields that are not defined are ignored.
+func (s *Store) Search(ctx context.Context, fields []*Field, values map[string]string) ([]*Server, error) {
+	filter := bson.M{}
+	for _, f := range fields {
+		value := strings.TrimSpace(values[f.Name])
+		if value == "" {
+			continue
+		}
+		if f.Type == Text {
+			filter["fields."+f.Name] = bson.M{"$regex": regexp.QuoteMeta(value), "$options": "i"}
+		} else {
+			filter["fields."+f.Name] = value
+		}
+	}
+	return s.find(ctx, filter)
+}
+
+func (s *Store) find(ctx context.Context, filter interface{}) ([]*Server, error) {
+	cursor, err := s.col.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "hostname", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var servers []*Server
+	for cursor.Next(ctx) {
+		server := new(Server)
+		err := cursor.Decode(server)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	return servers, cursor.Err()
+}
+
+// Create adds a server and returns its id.
+func (s *Store) Create(ctx context.Context, server *Server, createdBy string) (string, error) {
+	now := time.Now().UTC()
+	server.ID = primitive.NewObjectID().Hex()
+	server.CreatedBy = createdBy
+	server.CreatedAt = now
+	server.ModifiedBy = createdBy
+	server.ModifiedAt = now
+
+	_, err := s.col.InsertOne(ctx, server)
+	if repository.IsDuplicateKey(err) {
+		return "", ErrDuplicate
+	}
+	if err != nil {
+		return "", err
+	}
+	return server.ID, nil
+}
+
+// Read returns a server by id.
+func (s *Store) Read(ctx context.Context, id string) (*Server, error) {
+	server := new(Server)
+	err := s.col.FindOne(ctx, bson.M{"_id": id}).Decode(server)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Update replaces the details of a server, the created fields are kept. A
+// new hostname is also given to the servers that depend on it,
+// ApplicationStore.RenameServer gives it to applications.
+func (s *Store) Update(ctx context.Context, server *Server, modifiedBy string) error {
+	old := new(Server)
+	err := s.col.FindOneAndUpdate(ctx,
+		bson.M{"_id": server.ID},
+		bson.M{
+			"$set": bson.M{
+				"hostname":     server.Hostname,
+				"ipaddresses":  server.IPAddresses,
+				"environment":  server.Environment,
+				"os":           server.OS,
+				"owner":        server.Owner,
+				"tags":         server.Tags,
+				"notes":        server.Notes,
+				"check":        server.Check,
+				"tlsendpoints": server.TLSEndpoints,
+				"dependson":    server.DependsOn,
+				"fields":       server.Fields,
+				"modifiedby":   modifiedBy,
+				"modifiedat":   time.Now().UTC(),
+			},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(old)
+	if repository.IsDuplicateKey(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+
+	if old.Hostname != server.Hostname {
+		_, err = s.col.UpdateMany(ctx,
+			bson.M{"dependson": old.Hostname},
+			bson.M{"$set": bson.M{"dependson.$": server.Hostname}},
+		)
+	}
+	return err
+}
+
+// Patch updates the given columns of a server, see Columns, and leaves the
+// others as they are. Any custom field name, or "fields", sets every
+// custom field of the server. Nil columns update them all.
+func (s *Store) Patch(ctx context.Context, server *Server, columns []string, modifiedBy string) error {
+	if columns == nil {
+		return s.Update(ctx, server, modifiedBy)
+	}
+
+	set := bson.M{
+		"modifiedby": modifiedBy,
+		"modifiedat": time.Now().UTC(),
+	}
+	unset := bson.M{}
+	for _, col := range columns {
+		switch col {
+		case "hostname":
+			set["hostname"] = server.Hostname
+		case "ipaddresses":
+			set["ipaddresses"] = server.IPAddresses
+		case "environment":
+			set["environment"] = server.Environment
+		case "os":
+			set["os"] = server.OS
+		case "owner":
+			set["owner"] = server.Owner
+		case "tags":
+			set["tags"] = server.Tags
+		case "notes":
+			set["notes"] = server.Notes
+		case "checktype":
+			set["check.type"] = server.Check.Type
+		case "checktarget":
+			set["check.target"] = server.Check.Target
+		case "checkstatus":
+			if server.Check.ExpectStatus == 0 {
+				unset["check.expectstatus"] = ""
+			} else {
+				set["check.expectstatus"] = server.Check.ExpectStatus
+			}
+		case "tlsendpoints":
+			set["tlsendpoints"] = server.TLSEndpoints
+		case "dependson":
+			set["dependson"] = server.DependsOn
+		default:
+			if len(server.Fields) == 0 {
+				unset["fields"] = ""
+			} else {
+				set["fields"] = server.Fields
+			}
+		}
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	res, err := s.col.UpdateOne(ctx, bson.M{"_id": server.ID}, update)
+	if repository.IsDuplicateKey(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Delete removes a server.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	res, err := s.col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// UnsetField removes the values of a custom field from every server.
+func (s *Store) UnsetField(ctx context.Context, name string) error {
+	_, err := s.col.UpdateMany(ctx,
+		bson.M{"fields." + name: bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"fields." + name: ""}},
+	)
+	return err
+}
@@ -0,0 +1,312 @@
+// Package listener opens the sockets the web app serves on. They can be
+// passed in by systemd socket activation, or by the process being
+// restarted with Restart, so a restart does not drop connections.
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by systemd, the
+	// ones before it are stdin, stdout and stderr.
+	listenFDsStart = 3
+
+	// readyEnv names the pipe a restarted process writes to once it is
+	// serving, parentEnv the pipe that is closed when the old process
+	// exits.
+	readyEnv  = "LISTEN_READY_FD"
+	parentEnv = "LISTEN_PARENT_FD"
+)
+
+// parent is the end of the pipe the process started by Restart waits on,
+// it is kept open until this process exits.
+var parent *os.File
+
+// named is a socket and the name it is passed on with.
+type named struct {
+	name string
+	ln   net.Listener
+}
+
+var (
+	mu        sync.Mutex
+	inherit   sync.Once
+	passed    []*named
+	passedErr error
+	opened    []named
+)
+
+// Listen returns the socket named name passed in by systemd or Restart, or
+// listens on addr. An addr of unix:/path listens on a unix socket. systemd
+// names sockets with FileDescriptorName, a single socket passed in without
+// the name is used by the first Listen.
+func Listen(name, addr string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	inherit.Do(func() {
+		passed, passedErr = inherited()
+	})
+	if passedErr != nil {
+		return nil, passedErr
+	}
+
+	ln := take(name)
+	if ln == nil {
+		var err error
+		ln, err = listen(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opened = append(opened, named{name: name, ln: ln})
+	return ln, nil
+}
+
+// take returns the passed socket for name, or nil when there is none.
+func take(name string) net.Listener {
+	for i, p := range passed {
+		if p != nil && p.name == name {
+			passed[i] = nil
+			return p.ln
+		}
+	}
+	if len(opened) == 0 && len(passed) == 1 && passed[0] != nil {
+		ln := passed[0].ln
+		passed[0] = nil
+		return ln
+	}
+	return nil
+}
+
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		// a socket file left by a process that did not shut down would
+		// stop the listen
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// inherited returns the sockets passed in with LISTEN_FDS and their names
+// from LISTEN_FDNAMES. systemd also sets LISTEN_PID, Restart can not know
+// the pid of the process it starts and leaves it unset. The variables are
+// unset so processes started by this one do not take the sockets too.
+func inherited() ([]*named, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	pid := os.Getenv("LISTEN_PID")
+	if fds == "" || (pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS %q is not a number of sockets", fds)
+	}
+
+	var sockets []*named
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		s := &named{ln: ln}
+		if i < len(names) {
+			s.name = names[i]
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets, nil
+}
+
+// Ready is called by a process started by Restart once it is serving on
+// the sockets it was passed. The old process then stops accepting, drains
+// the requests it has and exits. It returns at once when this process was
+// not started by Restart.
+func Ready() error {
+	ready, err := envFile(readyEnv)
+	if err != nil || ready == nil {
+		return err
+	}
+	defer ready.Close()
+
+	_, err = ready.Write([]byte{1})
+	return err
+}
+
+// WaitParent blocks until the process that started this one with Restart
+// has exited, so the files it had open, such as the audit spool, can be
+// opened. It returns at once when this process was not started by Restart.
+func WaitParent() error {
+	old, err := envFile(parentEnv)
+	if err != nil || old == nil {
+		return err
+	}
+	defer old.Close()
+
+	// nothing is written to the pipe, the read returns when the old
+	// process exits and its end is closed
+	_, err = old.Read(make([]byte, 1))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// envFile returns the file whose descriptor is in the environment variable
+// env, or nil when it is not set.
+func envFile(env string) (*os.File, error) {
+	fd := os.Getenv(env)
+	if fd == "" {
+		return nil, nil
+	}
+	os.Unsetenv(env)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s %q is not a file descriptor", env, fd)
+	}
+	return os.NewFile(uintptr(n), env), nil
+}
+
+// Restart starts a new copy of this process, with the same arguments, that
+// takes over the sockets opened by Listen. It returns once the new process
+// calls Ready, or with an error if it exits or does not call it within
+// timeout, when it is killed. Both processes accept on the sockets from
+// then on, the caller stops accepting, drains its requests and exits.
+func Restart(timeout time.Duration) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the sockets are passed as descriptor 3 on, like systemd, then the
+	// ready and parent pipes
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, o := range opened {
+		var file *os.File
+		var err error
+		switch l := o.ln.(type) {
+		case *net.TCPListener:
+			file, err = l.File()
+		case *net.UnixListener:
+			// the socket file has to outlive this process
+			l.SetUnlinkOnClose(false)
+			file, err = l.File()
+		default:
+			err = fmt.Errorf("can not hand over a %T", o.ln)
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		names = append(names, o.name)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w, pr)
+	cmd.Env = append(environ("LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES", readyEnv, parentEnv),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		readyEnv+"="+strconv.Itoa(listenFDsStart+len(files)),
+		parentEnv+"="+strconv.Itoa(listenFDsStart+len(files)+1),
+	)
+
+	err = cmd.Start()
+	w.Close()
+	pr.Close()
+	if err != nil {
+		pw.Close()
+		return err
+	}
+
+	// a read returns a byte when the new process is ready, or EOF when it
+	// exits and the pipe is closed
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		if err != nil {
+			err = errors.New("the new process exited before it was ready")
+		}
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = fmt.Errorf("the new process was not ready after %s", timeout)
+	}
+	if err != nil {
+		pw.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	parent = pw
+	return nil
+}
+
+// environ returns the environment without the variables named.
+func environ(without ...string) []string {
+	var env []string
+next:
+	for _, kv := range os.Environ() {
+		for _, name := range without {
+			if strings.HasPrefix(kv, name+"=") {
+				continue next
+			}
+		}
+		env = append(env, kv)
+	}
+	return env
+}
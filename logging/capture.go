@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Capture redirects the standard log package, so lines the libraries in
+// use log with it are written at info level in the same format.
+func Capture() {
+	log.SetFlags(log.Llongfile)
+	log.SetPrefix("")
+	log.SetOutput(captured{})
+}
+
+type captured struct{}
+
+// Write is called with each line from the log package, prefixed with the
+// file and line it was logged from.
+func (captured) Write(p []byte) (int, error) {
+	s := strings.TrimSuffix(string(p), "\n")
+
+	// the path can not hold ": " and the line is a number, so the first
+	// ": " after a number ends the prefix
+	var where string
+	if i := strings.Index(s, ": "); i >= 0 {
+		if j := strings.LastIndex(s[:i], ":"); j >= 0 {
+			if line, err := strconv.Atoi(s[j+1 : i]); err == nil {
+				where = caller(s[:j], line)
+				s = s[i+2:]
+			}
+		}
+	}
+
+	if Enabled(LevelInfo) {
+		write(LevelInfo, s, "", nil, where, "")
+	}
+	return len(p), nil
+}
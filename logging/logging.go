@@ -0,0 +1,327 @@
+// Package logging writes leveled, structured log lines as logfmt or json.
+// Lines logged with the context of a request carry its request id. The
+// standard log package can be redirected to it with Capture, for the
+// libraries that log with it.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is how important a line is, lines below the level set are not
+// written.
+type Level int32
+
+// Levels, from least to most important.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// LevelNames returns the names of the levels, least important first.
+func LevelNames() []string {
+	return append([]string(nil), levelNames...)
+}
+
+// ParseLevel returns the level named s, debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("%q is not one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Formats of the lines.
+const (
+	Logfmt = "logfmt"
+	JSON   = "json"
+)
+
+var (
+	level int32 = int32(LevelInfo)
+
+	mu     sync.Mutex
+	out    io.Writer = os.Stderr
+	asJSON bool
+)
+
+// SetLevel sets the lowest level written, it can be changed while
+// running.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// GetLevel returns the lowest level written.
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// Enabled reports whether lines of level l are written.
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+// SetFormat sets the format of the lines, logfmt or json.
+func SetFormat(format string) error {
+	switch format {
+	case Logfmt, JSON:
+	default:
+		return fmt.Errorf("%q is not one of %s, %s", format, Logfmt, JSON)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	asJSON = format == JSON
+	return nil
+}
+
+// SetOutput sets where lines are written, stderr by default.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+// WithRequestID returns a copy of ctx carrying the request id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request id carried by ctx, or an empty string.
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Detach returns a background context carrying the request id of ctx. A
+// call made with it is not cancelled when the client goes away, but its
+// log lines and backend calls can still be traced to the request.
+func Detach(ctx context.Context) context.Context {
+	id := RequestID(ctx)
+	if id == "" {
+		return context.Background()
+	}
+	return WithRequestID(context.Background(), id)
+}
+
+// NewRequestID returns a random request id.
+func NewRequestID() string {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Debug logs msg and the key value pairs kv at debug level.
+func Debug(ctx context.Context, msg string, kv ...interface{}) {
+	logAt(ctx, LevelDebug, msg, kv)
+}
+
+// Info logs msg and the key value pairs kv at info level.
+func Info(ctx context.Context, msg string, kv ...interface{}) {
+	logAt(ctx, LevelInfo, msg, kv)
+}
+
+// Warn logs msg and the key value pairs kv at warn level.
+func Warn(ctx context.Context, msg string, kv ...interface{}) {
+	logAt(ctx, LevelWarn, msg, kv)
+}
+
+// Error logs msg and the key value pairs kv at error level. An error
+// value is written as its message.
+func Error(ctx context.Context, msg string, kv ...interface{}) {
+	logAt(ctx, LevelError, msg, kv)
+}
+
+// Fatal logs msg and the key value pairs kv at error level and exits with
+// status 1, for errors the program can not start with.
+func Fatal(ctx context.Context, msg string, kv ...interface{}) {
+	logAt(ctx, LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func logAt(ctx context.Context, l Level, msg string, kv []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	// the caller of Debug, Info, Warn, Error or Fatal
+	pc, file, line, _ := runtime.Caller(2)
+	write(l, msg, RequestID(ctx), kv, caller(file, line), function(pc))
+}
+
+// caller returns the directory, file and line, such as
+// controllers/userHandler.go:42.
+func caller(file string, line int) string {
+	if i := strings.LastIndex(file, "/"); i >= 0 {
+		if j := strings.LastIndex(file[:i], "/"); j >= 0 {
+			file = file[j+1:]
+		}
+	}
+	return file + ":" + strconv.Itoa(line)
+}
+
+// function returns the name of the function without its package, such as
+// (*App).userListHandler.
+func function(pc uintptr) string {
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return ""
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// write writes a line with the time, level, message, request id, the key
+// value pairs and where it was logged.
+func write(l Level, msg, requestID string, kv []interface{}, caller, function string) {
+	fields := []interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", l.String(),
+		"msg", msg,
+	}
+	if requestID != "" {
+		fields = append(fields, "request_id", requestID)
+	}
+	fields = append(fields, kv...)
+	if len(kv)%2 == 1 {
+		// a key without a value is kept rather than dropped
+		fields = append(fields, nil)
+	}
+	fields = append(fields, "caller", caller)
+	if function != "" {
+		fields = append(fields, "func", function)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var b bytes.Buffer
+	if asJSON {
+		writeJSON(&b, fields)
+	} else {
+		writeLogfmt(&b, fields)
+	}
+	b.WriteByte('\n')
+	out.Write(b.Bytes())
+}
+
+func writeLogfmt(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key(fields[i]))
+		b.WriteByte('=')
+
+		s := text(fields[i+1])
+		if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, isControl) >= 0 {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+func writeJSON(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key(fields[i]))
+		b.Write(k)
+		b.WriteByte(':')
+
+		v, err := json.Marshal(value(fields[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(text(fields[i+1]))
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+}
+
+// key returns a key without the characters that would break a logfmt
+// line.
+func key(k interface{}) string {
+	s := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '=' || r == '"' || isControl(r) {
+			return '_'
+		}
+		return r
+	}, text(k))
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+// value returns v as json encodes it, errors and stringers as their text.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, string, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	}
+	return text(v)
+}
+
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
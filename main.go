@@ -1,24 +1,43 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
-	"log"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
-	"regexp"
-	"strconv"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/csrf"
 	"github.com/gorilla/securecookie"
-	"google.golang.org/grpc"
 
-	"github.com/go-stuff/mongostore"
+	"github.com/go-stuff/web/access"
+	"github.com/go-stuff/web/agent"
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/certs"
+	"github.com/go-stuff/web/config"
 	"github.com/go-stuff/web/controllers"
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/listener"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/maintenance"
+	"github.com/go-stuff/web/metrics"
 	"github.com/go-stuff/web/middleware"
+	"github.com/go-stuff/web/notify"
+	"github.com/go-stuff/web/reachability"
+	"github.com/go-stuff/web/redact"
+	"github.com/go-stuff/web/repository"
+	"github.com/go-stuff/web/security"
+	"github.com/go-stuff/web/sessionstore"
+	"github.com/go-stuff/web/tlsconfig"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -26,169 +45,441 @@ import (
 )
 
 func main() {
-	// init environment
-	err := initEnvironment()
+	// load the config from defaults, the config file, the environment,
+	// secret files and flags
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		// the problems are listed one per line for whoever starts it
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	ctx := context.Background()
+
+	// print the effective config, secrets redacted, and exit
+	if cfg.PrintConfig {
+		err = cfg.Dump(os.Stdout)
+		if err != nil {
+			logging.Fatal(ctx, "cfg.Dump() failed", "error", err)
+		}
+		return
+	}
+
+	// init structured, leveled logging
+	err = initLogging(cfg.Log)
+	if err != nil {
+		logging.Fatal(ctx, "initLogging() failed", "error", err)
+	}
+
+	// init redaction before anything sensitive can be logged
+	err = initRedaction(cfg.Redact)
+	if err != nil {
+		logging.Fatal(ctx, "initRedaction() failed", "error", err)
+	}
+
+	// a serve error still shuts down and flushes the audit spool, the exit
+	// status is set once everything is closed
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
 
 	// init database
-	client, ctx, err := initMongoClient()
+	client, err := initMongoClient(cfg.Mongo.URL)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(ctx, "initMongoClient() failed", "error", err)
 	}
-	defer client.Disconnect(ctx)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		err := client.Disconnect(ctx)
+		if err != nil {
+			logging.Error(ctx, "client.Disconnect() failed", "error", err)
+		}
+	}()
 
-	apiClient, err := initAPI()
-	defer apiClient.Close()
+	db := client.Database(cfg.Mongo.DBName)
 
-	// get database name from an environment variable
-	if os.Getenv("MONGOSTORE_HTTPS_ONLY") == "" {
-		os.Setenv("MONGOSTORE_HTTPS_ONLY", "false")
+	// init store
+	sessionStore, err := initSessionStore(db.Collection("sessions"), db.Collection("session_locks"), &cfg.Session)
+	if err != nil {
+		logging.Fatal(ctx, "initSessionStore() failed", "error", err)
 	}
 
-	// set a default session ttl to 20 minutes
-	if os.Getenv("MONGOSTORE_SESSION_TTL") == "" {
-		os.Setenv("MONGOSTORE_SESSION_TTL", strconv.Itoa(20*60))
+	// init metrics, the collectors of the data backend, the app and the
+	// gauges below are registered in one registry that /metrics serves
+	registry := metrics.NewRegistry()
+
+	// init data backend
+	data, backend, closeData, err := initData(cfg.Data.Backend, cfg.GRPC, registry, db, sessionStore)
+	if err != nil {
+		logging.Fatal(ctx, "initData() failed", "error", err)
+	}
+	defer func() {
+		err := closeData()
+		if err != nil {
+			logging.Error(ctx, "closeData() failed", "error", err)
+		}
+	}()
+
+	// the import and export subcommands work on the inventory and exit
+	if len(cfg.Args) > 0 {
+		switch cfg.Args[0] {
+		case "import":
+			err = runImport(db, data, cfg.Args[1:])
+		case "export":
+			err = runExport(db, cfg.Args[1:])
+		default:
+			err = fmt.Errorf("unknown command %q, use import or export", cfg.Args[0])
+		}
+		if err != nil {
+			logging.Fatal(ctx, cfg.Args[0]+" failed", "error", err)
+		}
+		return
 	}
 
-	// get the ttl from an environment variable
-	ttl, err := strconv.Atoi(os.Getenv("MONGOSTORE_SESSION_TTL"))
+	// load the session once per request and only write it when it changed
+	store := sessionstore.NewRequestStore(sessionStore, "session", cfg.Session.RefreshInterval)
+
+	// init concurrent session limits
+	limits, err := initSessionLimits(cfg.Session)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(ctx, "initSessionLimits() failed", "error", err)
 	}
 
-	// get database name from an environment variable
-	if os.Getenv("MONGO_DB_NAME") == "" {
-		os.Setenv("MONGO_DB_NAME", "test")
+	// init tls, the certificate is read again when it changes on disk
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		var reloader *tlsconfig.Reloader
+		tlsConfig, reloader, err = initTLS(cfg.TLS)
+		if err != nil {
+			logging.Fatal(ctx, "initTLS() failed", "error", err)
+		}
+		reloader.Start()
+		defer reloader.Close()
 	}
 
-	// users in this ad group are admins by default
-	if os.Getenv("ADMIN_AD_GROUP") == "" {
-		os.Setenv("ADMIN_AD_GROUP", "SomeADGroup")
+	// init audit export sinks
+	exporter, err := initAuditExporter(cfg.Audit)
+	if err != nil {
+		logging.Fatal(ctx, "initAuditExporter() failed", "error", err)
 	}
 
-	// init store
-	store, err := initMongoStore(client.Database(os.Getenv("MONGO_DB_NAME")).Collection("sessions"), ttl)
+	// init the audit spool, records are synced to disk and sent to the
+	// audit log of the data backend in the background. When started by a
+	// restart it is opened once the old process has closed it and exited,
+	// audit writes wait until then
+	spool, err := initAuditSpool(cfg.Audit.Spool, data.Audits, exporter)
+	if err != nil {
+		logging.Fatal(ctx, "initAuditSpool() failed", "error", err)
+	}
+
+	// publish audit queue depth and the oldest unsent record on /debug/vars
+	expvar.Publish("audit", expvar.Func(func() interface{} {
+		stats := spool.Stats()
+		return map[string]interface{}{
+			"depth":            stats.Depth,
+			"oldest":           stats.Oldest,
+			"oldestAgeSeconds": stats.OldestAge().Seconds(),
+			"sent":             stats.Sent,
+			"failures":         stats.Failures,
+			"deadLettered":     stats.DeadLettered,
+		}
+	}))
+
+	// publish the grpc connection and breaker state on /debug/vars
+	if backend != nil {
+		expvar.Publish("backend", expvar.Func(func() interface{} {
+			return backend.Status()
+		}))
+	}
+
+	// publish the audit queue, live sessions and breaker on /metrics
+	initMetrics(registry, spool, sessionStore, backend)
+
+	// init alert hooks
+	notifier := initNotifier(cfg.Alert)
+
+	// init security event monitoring
+	monitor, err := initSecurityMonitor(cfg.Security, db.Collection("securityevents"), notifier)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(ctx, "initSecurityMonitor() failed", "error", err)
 	}
 
-	// init controllers
-	router := controllers.Init(client, store, apiClient)
+	// init access requests raised from the /noauth page
+	requests := access.NewStore(db.Collection("accessrequests"))
+
+	// init server inventory, its custom fields and the applications on it
+	servers, err := inventory.NewStore(db.Collection("servers"))
+	if err != nil {
+		logging.Fatal(ctx, "inventory.NewStore() failed", "error", err)
+	}
+	fields, err := inventory.NewFieldStore(db.Collection("serverfields"))
+	if err != nil {
+		logging.Fatal(ctx, "inventory.NewFieldStore() failed", "error", err)
+	}
+	applications := inventory.NewApplicationStore(db.Collection("applications"))
 
-	// init middlware
-	middleware.Init(store, apiClient)
+	// init maintenance windows, alerts about servers in a window are held back
+	windows := maintenance.NewStore(db.Collection("maintenance"))
+	feeds, err := maintenance.NewFeedStore(db.Collection("calendartokens"))
+	if err != nil {
+		logging.Fatal(ctx, "maintenance.NewFeedStore() failed", "error", err)
+	}
 
-	// generate an csrf key to use if the GORILLA_CSRF_KEY environment
-	// variable is not set
-	if os.Getenv("GORILLA_CSRF_KEY") == "" {
-		os.Setenv("GORILLA_CSRF_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)))
+	// init reachability checks, servers are probed in the background
+	checks, checker, err := initReachability(cfg.Checks, db, servers, notifier, windows)
+	if err != nil {
+		logging.Fatal(ctx, "initReachability() failed", "error", err)
+	}
+	checker.Start()
+
+	// init tls certificate tracking, endpoints are scanned in the background
+	certStore := certs.NewStore(db.Collection("certificates"))
+	scanner, err := initCertScanner(cfg.Certs, servers, certStore, notifier)
+	if err != nil {
+		logging.Fatal(ctx, "initCertScanner() failed", "error", err)
+	}
+	scanner.Start()
+
+	// init agent check-ins, stale servers are marked in the background
+	agents, agentMonitor, err := initAgents(cfg.Agents, db, servers, notifier, windows)
+	if err != nil {
+		logging.Fatal(ctx, "initAgents() failed", "error", err)
+	}
+	agentMonitor.Start()
+
+	// generate an csrf key to use if GORILLA_CSRF_KEY is not set
+	if cfg.CSRF.Key == "" {
+		cfg.CSRF.Key = base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
 	}
 
 	// Generate Keys
 	// fmt.Println(base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)))
 
-	// All POST requests without a valid token will return HTTP 403 Forbidden.
-	// We should also ensure that our mutating (non-idempotent) handler only
-	// matches on POST requests. We can check that here, at the router level, or
-	// within the handler itself via r.Method.
-	middlewareCSRF := csrf.Protect(
-		[]byte(os.Getenv("GORILLA_CSRF_KEY")),
-		// PS: Don't forget to pass csrf.Secure(false) if you're developing locally
-		// over plain HTTP (just don't leave it on in production).
-		csrf.Secure(false),
-	)
+	// networks that may read /metrics, the config was validated so they
+	// parse
+	metricsAllow, _ := metrics.ParseAllow(cfg.Metrics.Allow)
+
+	// init the app, its routes, templates and middleware
+	app, err := controllers.New(controllers.Config{
+		Sessions:     store,
+		Data:         data,
+		DataBackend:  cfg.Data.Backend,
+		Backend:      backend,
+		Mongo:        client,
+		Spool:        spool,
+		Monitor:      monitor,
+		Requests:     requests,
+		Limits:       limits,
+		Servers:      servers,
+		Fields:       fields,
+		Applications: applications,
+		Checks:       checks,
+		Certs:        certStore,
+		CertScanner:  scanner,
+		Agents:       agents,
+		AgentMonitor: agentMonitor,
+		Windows:      windows,
+		Feeds:        feeds,
+		Metrics:      registry,
+		MetricsAllow: metricsAllow,
+		MetricsToken: cfg.Metrics.Token,
+		LDAP:         cfg.LDAP,
+		CSRFKey:      []byte(cfg.CSRF.Key),
+		// the csrf cookie is only sent over https like the session cookie,
+		// which it is whenever tls is on
+		CSRFSecure: cfg.Session.HTTPSOnly,
+		Prefix:     cfg.Server.BasePath,
+	})
+	if err != nil {
+		logging.Fatal(ctx, "controllers.New() failed", "error", err)
+	}
 
-	// if os.Getenv("ENVIRONMENT") != "production" {
-	// 	middlewareCSRF = csrf.Protect(
-	// 		[]byte(os.Getenv("GORILLA_CSRF_KEY")),
-	// 		// PS: Don't forget to pass csrf.Secure(false) if you're developing locally
-	// 		// over plain HTTP (just don't leave it on in production).
-	// 		csrf.Secure(false),
-	// 	)
-	// }
-
-	// apply middleware
-	router.Use(middlewareCSRF)
-	router.Use(middleware.Headers)
-	router.Use(middleware.Auth) // Auth should be before Permissions
-	router.Use(middleware.Permissions)
-	router.Use(middleware.Audit)
+	// mount the app at its prefix, the root when BASE_PATH is not set
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Server.BasePath+"/", app.Handler())
 
-	// init server
-	server := &http.Server{
-		Addr:           ":8080",
-		Handler:        router,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20, // 1 MB
+	// browsers are told to keep to https once it is served
+	var handler http.Handler = mux
+	if cfg.TLS.Enabled() && cfg.TLS.HSTSMaxAge > 0 {
+		handler = middleware.HSTS(cfg.TLS.HSTSMaxAge, cfg.TLS.HSTSIncludeSubdomains)(handler)
 	}
 
-	// start server
-	log.Println("INFO > main.go > main(): Listening and Serving @", server.Addr)
-	//err = server.ListenAndServeTLS("./cert.pem", "./key.pem")
-	err = server.ListenAndServe()
+	// listen on SERVER_ADDR, or the socket passed by systemd or a restart
+	ln, err := listener.Listen("web", cfg.Server.Addr)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(ctx, "listener.Listen() failed", "error", err)
+	}
+
+	// init server
+	server := &http.Server{
+		Handler:        handler,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    cfg.Server.ReadTimeout,
+		WriteTimeout:   cfg.Server.WriteTimeout,
+		IdleTimeout:    cfg.Server.IdleTimeout,
+		MaxHeaderBytes: 1 << 20, // 1 MB
 	}
-}
 
-func initEnvironment() error {
-	_, err := os.Stat(".env")
-	if os.IsNotExist(err) {
-		log.Println("INFO > main.go > initEnvironment(): .env does not exist")
-	} else {
-		log.Println("INFO > main.go > initEnvironment(): .env loaded")
-		// open .env
-		file, err := os.Open(".env")
+	// start server, the certificate comes from the tls config
+	serveErr := make(chan error, 2)
+	go func() {
+		if tlsConfig != nil {
+			logging.Info(ctx, "listening and serving https", "addr", ln.Addr())
+			serveErr <- server.ServeTLS(ln, "", "")
+			return
+		}
+		logging.Info(ctx, "listening and serving", "addr", ln.Addr())
+		serveErr <- server.Serve(ln)
+	}()
+
+	// redirect plain http to https
+	var redirect *http.Server
+	if cfg.TLS.RedirectAddr != "" {
+		rln, err := listener.Listen("redirect", cfg.TLS.RedirectAddr)
 		if err != nil {
-			return err
+			logging.Fatal(ctx, "listener.Listen() failed", "error", err)
 		}
-		defer file.Close()
-
-		// read each line
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			if scanner.Text() != "" {
-				regex := regexp.MustCompile(`([a-zA-Z0-9-_]*)\s*=\s*"(.*)"`)
-				matches := regex.FindStringSubmatch(scanner.Text())
-				if len(matches) != 3 {
-					return errors.New("error in .env")
-				}
+		redirect = &http.Server{
+			Handler:      tlsconfig.Redirect(ln.Addr().String()),
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+		go func() {
+			logging.Info(ctx, "redirecting http to https", "addr", rln.Addr())
+			serveErr <- redirect.Serve(rln)
+		}()
+	}
+
+	// when started by a restart the old process stops accepting and drains
+	// now that this one is serving
+	err = listener.Ready()
+	if err != nil {
+		logging.Error(ctx, "listener.Ready() failed", "error", err)
+	}
 
-				// []matches = [0]line, [1](group1), [2](group2)
-				err := os.Setenv(matches[1], matches[2])
+	// SIGINT and SIGTERM shut down, SIGHUP hands the sockets to a new
+	// process first so no connections are dropped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+wait:
+	for {
+		select {
+		case err = <-serveErr:
+			logging.Error(ctx, "server.Serve() failed", "error", err)
+			exitCode = 1
+			break wait
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				logging.Info(ctx, "restarting", "signal", sig)
+				err = listener.Restart(cfg.Server.RestartTimeout)
 				if err != nil {
-					return err
+					logging.Error(ctx, "listener.Restart() failed", "error", err)
+					continue
 				}
-
-				// DO NOT PRINT ENVIRONMENT VARIABLES OUT
-				// fmt.Printf("env:%s = %s\n", matches[1], os.Getenv(matches[1]))
 			}
+			logging.Info(ctx, "shutting down", "signal", sig)
+			break wait
 		}
+	}
+
+	// stop accepting connections and wait for the requests in flight
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	err = server.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		logging.Error(ctx, "server.Shutdown() failed", "error", err)
+		server.Close()
+	}
+
+	// stop the background checks, then send what is left in the audit
+	// spool, records that can not be sent stay in it for the next start
+	agentMonitor.Close()
+	scanner.Close()
+	checker.Close()
+
+	// each gets its own deadline, slow requests do not use up the time to
+	// flush the spool or the spool the time to export
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.Audit.Spool.CloseTimeout)
+	err = spool.Close(ctx)
+	cancel()
+	if err != nil {
+		logging.Error(ctx, "spool.Close() failed", "error", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.Audit.ExportCloseTimeout)
+	err = exporter.Close(ctx)
+	cancel()
+	if err != nil {
+		logging.Error(ctx, "exporter.Close() failed", "error", err)
+	}
+
+	// the data backend and mongo client are closed as main returns
+	logging.Info(ctx, "shut down")
+}
+
+func initLogging(cfg config.Log) error {
+	level, err := logging.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	err = logging.SetFormat(cfg.Format)
+	if err != nil {
+		return err
+	}
+	logging.SetLevel(level)
+
+	// lines the libraries log with the log package are written in the
+	// same format
+	logging.Capture()
+
+	return nil
+}
 
-		// catch scanner errors
-		err = scanner.Err()
+func initRedaction(cfg config.Redact) error {
+	// extra session value keys to mask, added to redact.DefaultFields
+	fields := append([]string{}, redact.DefaultFields...)
+	fields = append(fields, cfg.Fields...)
+
+	// extra patterns, one regular expression per line, added to
+	// redact.DefaultPatterns
+	patterns := append([]string{}, redact.DefaultPatterns...)
+	if cfg.PatternsFile != "" {
+		filePatterns, err := redact.ReadPatterns(cfg.PatternsFile)
 		if err != nil {
 			return err
 		}
+		patterns = append(patterns, filePatterns...)
+	}
+
+	// session ids are recorded as a keyed hash when a key is set
+	policy, err := redact.New(fields, patterns, cfg.Mask, []byte(cfg.SessionIDKey))
+	if err != nil {
+		return err
 	}
+
+	redact.SetDefault(policy)
+	logging.SetOutput(policy.Writer(os.Stderr))
+
 	return nil
 }
 
-func initMongoClient() (*mongo.Client, context.Context, error) {
+func initMongoClient(url string) (*mongo.Client, error) {
 	// a Context carries a deadline, cancelation signal, and request-scoped values
 	// across API boundaries. Its methods are safe for simultaneous use by multiple
 	// goroutines
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// use a default mongo uri if the MONGOURL environment variable is not set
-	if os.Getenv("MONGOURL") == "" {
-		os.Setenv("MONGOURL", "mongodb://localhost:27017")
-	}
-
 	// Register custom codecs for protobuf Timestamp and wrapper types
 	//reg := bsoncodec.Registry()
 	//reg := bsoncodec.NewRegistryBuilder().Build()
@@ -196,65 +487,309 @@ func initMongoClient() (*mongo.Client, context.Context, error) {
 	// connect does not do server discovery, use ping
 	client, err := mongo.Connect(ctx,
 		options.Client().
-			ApplyURI(os.Getenv("MONGOURL")), //.
+			ApplyURI(url), //.
 		//	SetRegistry(reg),
 	)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// ping for server discovery
 	err = client.Ping(ctx, readpref.Primary())
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	log.Println("INFO > main.go > initMongoClient(): Connected to MongoDB @", os.Getenv("MONGOURL"))
-	return client, ctx, nil
+	logging.Info(ctx, "connected to mongodb", "url", url)
+	return client, nil
 }
 
-func initMongoStore(col *mongo.Collection, age int) (*mongostore.MongoStore, error) {
-	// generate an authentication key to use if the GORILLA_SESSION_AUTH_KEY environment
-	// variable is not set
-	if os.Getenv("GORILLA_SESSION_AUTH_KEY") == "" {
-		os.Setenv("GORILLA_SESSION_AUTH_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)))
+func initSessionStore(col, locks *mongo.Collection, cfg *config.Session) (sessionstore.Store, error) {
+	// generate an authentication key to use if GORILLA_SESSION_AUTH_KEY is
+	// not set
+	if cfg.AuthKey == "" {
+		cfg.AuthKey = base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
 	}
 
-	// generate an encryption key to use if the GORILLA_SESSION_ENC_KEY environment
-	// variable is not set
-	if os.Getenv("GORILLA_SESSION_ENC_KEY") == "" {
-		os.Setenv("GORILLA_SESSION_ENC_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(16)))
+	// generate an encryption key to use if GORILLA_SESSION_ENC_KEY is not
+	// set, 16 random bytes are 24 base64 characters, an aes-192 key
+	if cfg.EncKey == "" {
+		cfg.EncKey = base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(16))
 	}
 
 	// DO NOT PRINT OUT SESSION KEYS
-	// fmt.Println(os.Getenv("GORILLA_SESSION_AUTH_KEY"))
-	// fmt.Println(os.Getenv("GORILLA_SESSION_ENC_KEY"))
 
 	// Generate Keys
 	// fmt.Println(base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)))
 	// fmt.Println(base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(16)))
 
-	store := mongostore.NewMongoStore(
-		col,
-		age,
-		[]byte(os.Getenv("GORILLA_SESSION_AUTH_KEY")),
-		[]byte(os.Getenv("GORILLA_SESSION_ENC_KEY")),
-	)
+	opts := sessionstore.Options{
+		MaxAge: cfg.TTL,
+		Secure: cfg.HTTPSOnly,
+		KeyPairs: [][]byte{
+			[]byte(cfg.AuthKey),
+			[]byte(cfg.EncKey),
+		},
+	}
+
+	logging.Info(context.Background(), "session store", "store", cfg.Store)
+
+	switch cfg.Store {
+	case "mongo":
+		return sessionstore.NewMongoStore(col, locks, opts)
+	case "memory":
+		return sessionstore.NewMemoryStore(opts), nil
+	case "cookie":
+		return sessionstore.NewCookieStore(opts), nil
+	case "token":
+		// tokens are signed with their own key if one is set
+		key := cfg.TokenKey
+		if key == "" {
+			key = cfg.AuthKey
+		}
+		return sessionstore.NewTokenStore([]byte(key), opts), nil
+	}
+
+	return nil, fmt.Errorf("unknown SESSION_STORE %q, use mongo, memory, cookie or token", cfg.Store)
+}
+
+func initSessionLimits(cfg config.Session) (sessionstore.Limits, error) {
+	roles, err := sessionstore.ParseRoleLimits(cfg.LimitRoles)
+	if err != nil {
+		return sessionstore.Limits{}, err
+	}
+
+	limits := sessionstore.Limits{
+		Max:    cfg.Limit,
+		Roles:  roles,
+		Policy: cfg.LimitPolicy,
+	}
+
+	// sessions kept only in the client can not be counted
+	if (limits.Max > 0 || len(limits.Roles) > 0) &&
+		(cfg.Store == "cookie" || cfg.Store == "token") {
+		logging.Warn(context.Background(), "session limits are not enforced with this session store", "store", cfg.Store)
+	}
+
+	return limits, nil
+}
+
+func initAuditExporter(cfg config.Audit) (*audit.Exporter, error) {
+	exporter := audit.NewExporter()
+
+	// syslog sink, AUDIT_SYSLOG_NETWORK is one of udp, tcp or tls
+	if cfg.Syslog.Addr != "" {
+		var tlsConfig *tls.Config
+		if cfg.Syslog.Network == "tls" {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+			// trust a private ca if one is given, otherwise use the system roots
+			if cfg.Syslog.CAFile != "" {
+				pem, err := ioutil.ReadFile(cfg.Syslog.CAFile)
+				if err != nil {
+					return nil, err
+				}
+				tlsConfig.RootCAs = x509.NewCertPool()
+				if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+					return nil, errors.New("AUDIT_SYSLOG_CA_FILE contains no certificates")
+				}
+			}
+		}
+
+		sink := audit.NewSyslogSink(cfg.Syslog.Network, cfg.Syslog.Addr, tlsConfig)
+		if cfg.Syslog.AppName != "" {
+			sink.AppName = cfg.Syslog.AppName
+		}
+		exporter.Add(sink, cfg.Syslog.Retry.Audit(), 0)
+	}
+
+	// rotating json-lines file sink
+	if cfg.File.Path != "" {
+		sink := audit.NewFileSink(cfg.File.Path, cfg.File.MaxSizeMB<<20, cfg.File.MaxBackups)
+		exporter.Add(sink, cfg.File.Retry.Audit(), 0)
+	}
+
+	// hmac signed webhook sink
+	if cfg.Webhook.URL != "" {
+		sink := audit.NewWebhookSink(cfg.Webhook.URL, []byte(cfg.Webhook.Secret))
+		exporter.Add(sink, cfg.Webhook.Retry.Audit(), 0)
+	}
+
+	return exporter, nil
+}
+
+func initAuditSpool(cfg config.AuditSpool, audits repository.Audits, exporter *audit.Exporter) (*audit.Spool, error) {
+	opts := audit.DefaultSpoolOptions
+	opts.BatchSize = cfg.BatchSize
+	opts.FlushInterval = cfg.FlushInterval
+	opts.MaxBackoff = cfg.MaxBackoff
+	opts.MaxRejections = cfg.MaxRejections
+
+	return audit.OpenSpoolAfter(listener.WaitParent, cfg.Dir, audit.NewBackend(audits), exporter, opts)
+}
 
-	return store, nil
+func initNotifier(cfg config.Alert) *notify.Notifier {
+	// alerts are always logged and also posted to a webhook if one is set
+	hooks := []notify.Hook{notify.LogHook{}}
+	if cfg.WebhookURL != "" {
+		hooks = append(hooks, notify.NewWebhookHook(cfg.WebhookURL, []byte(cfg.WebhookSecret)))
+	}
+	return notify.New(hooks...)
+}
+
+func initSecurityMonitor(cfg config.Security, col *mongo.Collection, notifier *notify.Notifier) (*security.Monitor, error) {
+	opts := security.DefaultOptions
+	opts.FailureThreshold = cfg.FailureThreshold
+	opts.FailureWindow = cfg.FailureWindow
+	opts.LockoutDuration = cfg.LockoutDuration
+
+	// usual admin hours as "start-end" in 24 hour clock, e.g. "07-19"
+	start, end, err := cfg.Hours()
+	if err != nil {
+		return nil, err
+	}
+	opts.AdminHoursStart = start
+	opts.AdminHoursEnd = end
+
+	return security.NewMonitor(col, notifier, opts)
+}
+
+func initTLS(cfg config.TLS) (*tls.Config, *tlsconfig.Reloader, error) {
+	tlsConfig, reloader, err := tlsconfig.New(tlsconfig.Options{
+		CertFile:       cfg.CertFile,
+		KeyFile:        cfg.KeyFile,
+		MinVersion:     cfg.MinVersion,
+		Ciphers:        cfg.Ciphers,
+		ClientCAFile:   cfg.ClientCAFile,
+		ReloadInterval: cfg.ReloadInterval,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logging.Info(context.Background(), "certificate loaded", "file", cfg.CertFile, "expires", reloader.Expires().Format(time.RFC3339))
+	return tlsConfig, reloader, nil
+}
+
+// initMetrics registers the gauges read from the audit spool, the session
+// store and the grpc backend in registry.
+func initMetrics(registry *metrics.Registry, spool *audit.Spool, store sessionstore.Store, backend *repository.GRPCConn) {
+	registry.NewGaugeFunc("web_audit_queue_depth", "Audit records waiting to be sent.", func() float64 {
+		return float64(spool.Stats().Depth)
+	})
+	registry.NewGaugeFunc("web_audit_queue_oldest_age_seconds", "How long the oldest unsent audit record has waited.", func() float64 {
+		return spool.Stats().OldestAge().Seconds()
+	})
+	registry.NewCounterFunc("web_audit_sent_total", "Audit records sent to the audit log.", func() float64 {
+		return float64(spool.Stats().Sent)
+	})
+	registry.NewCounterFunc("web_audit_failures_total", "Failed attempts to send audit records.", func() float64 {
+		return float64(spool.Stats().Failures)
+	})
+	registry.NewCounterFunc("web_audit_dead_lettered_total", "Audit records the audit log rejected, moved to the dead letter file.", func() float64 {
+		return float64(spool.Stats().DeadLettered)
+	})
+
+	// cookie and token sessions are not kept on the server and can not be
+	// counted
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	_, err := store.Count(ctx)
+	cancel()
+	if err != sessionstore.ErrNotSupported {
+		registry.NewGaugeFunc("web_sessions_active", "Sessions that have not expired.", func() float64 {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			n, err := store.Count(ctx)
+			if err != nil {
+				logging.Error(ctx, "store.Count() failed", "error", err)
+				return math.NaN()
+			}
+			return float64(n)
+		})
+	}
+
+	if backend != nil {
+		registry.NewGaugeFunc("web_grpc_breaker_open", "1 while calls to the grpc backend fail fast.", func() float64 {
+			if backend.Breaker.State() == repository.Open {
+				return 1
+			}
+			return 0
+		})
+	}
+}
+
+func initData(backend string, cfg config.GRPC, registry *metrics.Registry, db *mongo.Database, sessions sessionstore.Store) (*repository.Repositories, *repository.GRPCConn, func() error, error) {
+	logging.Info(context.Background(), "data backend", "backend", backend)
+
+	switch backend {
+	case "grpc":
+		opts := cfg.Options()
+		opts.Metrics = registry
+		conn, err := repository.DialGRPC(opts)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		logging.Info(context.Background(), "connected to the grpc api", "addr", cfg.Addr)
+		return repository.NewGRPC(conn.ClientConn, sessions), conn, conn.Close, nil
+	case "mongo":
+		return repository.NewMongo(db, sessions), nil, func() error { return nil }, nil
+	case "memory":
+		// the inventory is still kept in mongo, only users, roles, routes
+		// and the audit log are lost on restart
+		return repository.NewMemory(sessions), nil, func() error { return nil }, nil
+	}
+
+	return nil, nil, nil, fmt.Errorf("unknown DATA_BACKEND %q, use grpc, mongo or memory", backend)
+}
+
+func initReachability(cfg config.Checks, db *mongo.Database, servers *inventory.Store, notifier *notify.Notifier, suppressor reachability.Suppressor) (*reachability.Store, *reachability.Checker, error) {
+	opts := reachability.DefaultOptions
+	opts.Interval = cfg.Interval
+	opts.Timeout = cfg.Timeout
+	// results in a row needed before a server is reported up or down
+	opts.Dampening = cfg.Dampening
+
+	checks, err := reachability.NewStore(db.Collection("serverchecks"), db.Collection("serverstatus"), cfg.Retention)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return checks, reachability.NewChecker(servers, checks, notifier, suppressor, opts), nil
 }
 
-func initAPI() (*grpc.ClientConn, error) {
-	// creds, err := credentials.NewClientTLSFromFile("./certs/cert.pem", "")
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// with cert
-	//conn, err := grpc.Dial("127.0.0.1:6000", grpc.WithTransportCredentials(creds))
-	// without cert
-	conn, err := grpc.Dial("127.0.0.1:6000", grpc.WithInsecure())
+func initCertScanner(cfg config.Certs, servers *inventory.Store, certStore *certs.Store, notifier *notify.Notifier) (*certs.Scanner, error) {
+	opts := certs.DefaultOptions
+	opts.Interval = cfg.ScanInterval
+	opts.Timeout = cfg.ScanTimeout
+
+	// days before expiry to warn at, e.g. "30,14,7,1"
+	thresholds, err := certs.ParseThresholds(cfg.WarnDays)
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	opts.Thresholds = thresholds
+
+	// trust a private ca on top of the system roots if one is given
+	if cfg.CAFile != "" {
+		opts.Roots, err = certs.LoadRoots(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return certs.NewScanner(servers, certStore, notifier, opts), nil
+}
+
+func initAgents(cfg config.Agents, db *mongo.Database, servers *inventory.Store, notifier *notify.Notifier, suppressor agent.Suppressor) (*agent.Store, *agent.Monitor, error) {
+	opts := agent.DefaultOptions
+	// how long after its last check-in a server is stale
+	opts.StaleAfter = cfg.StaleAfter
+
+	agents, err := agent.NewStore(db.Collection("agenttokens"), db.Collection("serverfacts"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return agents, agent.NewMonitor(servers, agents, notifier, suppressor, opts), nil
 }
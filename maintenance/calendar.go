@@ -0,0 +1,54 @@
+package maintenance
+
+import (
+	"sort"
+	"time"
+)
+
+// Day is a day of a calendar month view.
+type Day struct {
+	Date        time.Time
+	InMonth     bool
+	Today       bool
+	Occurrences []*Occurrence
+}
+
+// Month returns the weeks, Monday first, of the month that t is in, with
+// the occurrences of windows on each day in t's location.
+func Month(windows []*Window, t time.Time) [][]*Day {
+	loc := t.Location()
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+
+	// back up to the monday on or before the first
+	offset := (int(first.Weekday()) + 6) % 7
+	start := first.AddDate(0, 0, -offset)
+
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	var weeks [][]*Day
+	for day := start; day.Before(first.AddDate(0, 1, 0)); {
+		week := make([]*Day, 0, 7)
+		for i := 0; i < 7; i++ {
+			next := day.AddDate(0, 0, 1)
+
+			d := &Day{
+				Date:    day,
+				InMonth: day.Month() == first.Month(),
+				Today:   day.Equal(today),
+			}
+			for _, w := range windows {
+				d.Occurrences = append(d.Occurrences, w.Occurrences(day, next)...)
+			}
+			sort.Slice(d.Occurrences, func(i, j int) bool {
+				return d.Occurrences[i].Start.Before(d.Occurrences[j].Start)
+			})
+
+			week = append(week, d)
+			day = next
+		}
+		weeks = append(weeks, week)
+	}
+
+	return weeks
+}
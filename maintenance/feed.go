@@ -0,0 +1,125 @@
+package maintenance
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidFeedToken is returned for a feed token that was never issued
+// or has been replaced.
+var ErrInvalidFeedToken = errors.New("invalid calendar feed token")
+
+// FeedToken is the calendar feed token of a user, calendar clients can not
+// log in so the token is part of the feed url. A user has at most one.
+type FeedToken struct {
+	Username string `bson:"_id"`
+	// Hash is the sha256 of the token, the token itself is only shown
+	// when it is issued.
+	Hash      string    `bson:"hash"`
+	Prefix    string    `bson:"prefix"`
+	CreatedAt time.Time `bson:"createdat"`
+	UsedAt    time.Time `bson:"usedat,omitempty"`
+}
+
+// hash returns the hex sha256 of a token.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// FeedStore keeps calendar feed tokens in MongoDB.
+type FeedStore struct {
+	col *mongo.Collection
+}
+
+// NewFeedStore returns a FeedStore using col and makes sure its index
+// exists.
+func NewFeedStore(col *mongo.Collection) (*FeedStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &FeedStore{col: col}, nil
+}
+
+// Issue creates a new feed token for a user, replacing any they had, and
+// returns it. It can not be read back later.
+func (s *FeedStore) Issue(ctx context.Context, username string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	_, err = s.col.ReplaceOne(ctx,
+		bson.M{"_id": username},
+		&FeedToken{
+			Username:  username,
+			Hash:      hash(token),
+			Prefix:    token[:8],
+			CreatedAt: time.Now().UTC(),
+		},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Token returns the feed token of a user, or nil if they have none.
+func (s *FeedStore) Token(ctx context.Context, username string) (*FeedToken, error) {
+	token := new(FeedToken)
+	err := s.col.FindOne(ctx, bson.M{"_id": username}).Decode(token)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Verify returns the user a token was issued to and notes that it was
+// used.
+func (s *FeedStore) Verify(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrInvalidFeedToken
+	}
+
+	t := new(FeedToken)
+	err := s.col.FindOneAndUpdate(ctx,
+		bson.M{"hash": hash(token)},
+		bson.M{"$set": bson.M{"usedat": time.Now().UTC()}},
+	).Decode(t)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidFeedToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return t.Username, nil
+}
+
+// Revoke removes the feed token of a user.
+func (s *FeedStore) Revoke(ctx context.Context, username string) error {
+	_, err := s.col.DeleteOne(ctx, bson.M{"_id": username})
+	return err
+}
@@ -0,0 +1,97 @@
+package maintenance
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// icalTime is the UTC date-time format of iCalendar.
+const icalTime = "20060102T150405Z"
+
+// ICal writes windows as an iCalendar feed, RFC 5545, one event per
+// window with its recurrence as a rule. hostnames maps server ids to
+// hostnames for the event descriptions.
+func ICal(w io.Writer, windows []*Window, hostnames map[string]string) error {
+	bw := bufio.NewWriter(w)
+	line := func(name, value string) {
+		writeFolded(bw, name+":"+value)
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//go-stuff//web//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	line("X-WR-CALNAME", "Maintenance")
+
+	for _, win := range windows {
+		var servers []string
+		for _, id := range win.ServerIDs {
+			if hostname, ok := hostnames[id]; ok {
+				servers = append(servers, hostname)
+			}
+		}
+
+		description := win.Description
+		if len(servers) > 0 {
+			description += "\nServers: " + strings.Join(servers, ", ")
+		}
+		if len(win.Tags) > 0 {
+			description += "\nTags: " + strings.Join(win.Tags, ", ")
+		}
+		if win.Owner != "" {
+			description += "\nOwner: " + win.Owner
+		}
+
+		line("BEGIN", "VEVENT")
+		line("UID", win.ID+"@go-stuff-web")
+		line("DTSTAMP", win.ModifiedAt.UTC().Format(icalTime))
+		line("LAST-MODIFIED", win.ModifiedAt.UTC().Format(icalTime))
+		line("DTSTART", win.Start.UTC().Format(icalTime))
+		line("DTEND", win.End.UTC().Format(icalTime))
+		if win.Recurrence != Once {
+			rule := "FREQ=" + strings.ToUpper(win.Recurrence)
+			if !win.Until.IsZero() {
+				rule += ";UNTIL=" + win.Until.UTC().Format(icalTime)
+			}
+			line("RRULE", rule)
+		}
+		line("SUMMARY", escapeText(win.Title))
+		line("DESCRIPTION", escapeText(strings.TrimSpace(description)))
+		line("END", "VEVENT")
+	}
+
+	line("END", "VCALENDAR")
+	return bw.Flush()
+}
+
+// escapeText escapes a TEXT value.
+func escapeText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// writeFolded writes a content line ending in CRLF, folded so no line is
+// longer than 75 octets without splitting a character.
+func writeFolded(w *bufio.Writer, s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		fmt.Fprintf(w, "%s\r\n ", s[:cut])
+		s = s[cut:]
+		// the leading space of a continuation counts towards its length
+		limit = 74
+	}
+	fmt.Fprintf(w, "%s\r\n", s)
+}
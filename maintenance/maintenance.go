@@ -0,0 +1,437 @@
+// Package maintenance schedules maintenance windows for servers, picked
+// one by one or by tag. Health-check alerts about a server are held back
+// while it is in a window.
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/go-stuff/web/inventory"
+)
+
+// How a window repeats.
+const (
+	Once    = ""
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+// Recurrences are the ways a window can repeat.
+var Recurrences = []string{Once, Daily, Weekly, Monthly}
+
+// maxOccurrences bounds the expansion of a recurring window.
+const maxOccurrences = 10000
+
+// Window is a maintenance window.
+type Window struct {
+	ID    string `bson:"_id"`
+	Title string `bson:"title"`
+	// ServerIDs and Tags pick the servers in the window, a server is in it
+	// if it is listed or has one of the tags.
+	ServerIDs []string  `bson:"serverids"`
+	Tags      []string  `bson:"tags"`
+	Start     time.Time `bson:"start"`
+	End       time.Time `bson:"end"`
+	// Recurrence repeats the window from Start until Until, or forever if
+	// Until is not set. A monthly window skips months without the day of
+	// Start, as an iCalendar FREQ=MONTHLY rule does.
+	Recurrence  string    `bson:"recurrence"`
+	Until       time.Time `bson:"until,omitempty"`
+	Owner       string    `bson:"owner"`
+	Description string    `bson:"description"`
+	CreatedBy   string    `bson:"createdby"`
+	CreatedAt   time.Time `bson:"createdat"`
+	ModifiedBy  string    `bson:"modifiedby"`
+	ModifiedAt  time.Time `bson:"modifiedat"`
+}
+
+// Occurrence is one time a window takes place.
+type Occurrence struct {
+	Window *Window
+	Start  time.Time
+	End    time.Time
+}
+
+// Normalize tidies up a window as entered.
+func (w *Window) Normalize() {
+	w.Title = strings.TrimSpace(w.Title)
+	w.Tags = trim(w.Tags)
+	w.ServerIDs = trim(w.ServerIDs)
+	w.Owner = strings.TrimSpace(w.Owner)
+	w.Description = strings.TrimSpace(w.Description)
+	if w.Recurrence == Once {
+		w.Until = time.Time{}
+	}
+}
+
+// Validate returns the first problem with a window, or nil.
+func (w *Window) Validate() error {
+	if w.Title == "" {
+		return fmt.Errorf("title is required")
+	}
+	if len(w.ServerIDs) == 0 && len(w.Tags) == 0 {
+		return fmt.Errorf("pick at least one server or tag")
+	}
+	if w.Start.IsZero() || w.End.IsZero() {
+		return fmt.Errorf("start and end are required")
+	}
+	if !w.End.After(w.Start) {
+		return fmt.Errorf("the end must be after the start")
+	}
+
+	valid := false
+	for _, r := range Recurrences {
+		if w.Recurrence == r {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("'%s' is not a recurrence", w.Recurrence)
+	}
+
+	// a window must fit between its repeats, the shortest month apart is
+	// 28 days
+	repeat := w.next(w.Start, 1)
+	if w.Recurrence == Monthly {
+		repeat = w.Start.AddDate(0, 0, 28)
+	}
+	if w.Recurrence != Once && repeat.Before(w.End) {
+		return fmt.Errorf("a %s window can not be longer than its repeat", w.Recurrence)
+	}
+	if !w.Until.IsZero() && w.Until.Before(w.Start) {
+		return fmt.Errorf("the repeat must not end before the start")
+	}
+
+	return nil
+}
+
+// next returns t moved on by n repeats of the window. A month without the
+// day of t overflows into the next, see Occurrences.
+func (w *Window) next(t time.Time, n int) time.Time {
+	switch w.Recurrence {
+	case Daily:
+		return t.AddDate(0, 0, n)
+	case Weekly:
+		return t.AddDate(0, 0, 7*n)
+	case Monthly:
+		return t.AddDate(0, n, 0)
+	}
+	return t
+}
+
+// skip returns a number of repeats that start at or before t, close to
+// the last one, so long running windows are not expanded from the start.
+func (w *Window) skip(t time.Time) int {
+	if !t.After(w.Start) {
+		return 0
+	}
+
+	// days are not always 24 hours, one repeat less is always early enough
+	n := 0
+	switch w.Recurrence {
+	case Daily:
+		n = int(t.Sub(w.Start)/(24*time.Hour)) - 1
+	case Weekly:
+		n = int(t.Sub(w.Start)/(7*24*time.Hour)) - 1
+	case Monthly:
+		n = (t.Year()-w.Start.Year())*12 + int(t.Month()-w.Start.Month()) - 1
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Occurrences returns the times the window takes place that overlap from
+// to to, in order.
+func (w *Window) Occurrences(from, to time.Time) []*Occurrence {
+	length := w.End.Sub(w.Start)
+
+	var list []*Occurrence
+	first := w.skip(from.Add(-length))
+	for n := first; n < first+maxOccurrences; n++ {
+		start := w.next(w.Start, n)
+		if !start.Before(to) || (!w.Until.IsZero() && start.After(w.Until)) {
+			break
+		}
+		// months without the day are skipped
+		if w.Recurrence == Monthly && start.Day() != w.Start.Day() {
+			continue
+		}
+		end := start.Add(length)
+		if end.After(from) {
+			list = append(list, &Occurrence{Window: w, Start: start, End: end})
+		}
+		if w.Recurrence == Once {
+			break
+		}
+	}
+	return list
+}
+
+// Next returns the first occurrence of the window that has not ended by
+// t, or nil if there is none.
+func (w *Window) Next(t time.Time) *Occurrence {
+	// the next occurrence starts within two repeats of t, or of the start
+	// of a window that has not started yet, a monthly window skips a month
+	// at most
+	from := t
+	if w.Start.After(from) {
+		from = w.Start
+	}
+	list := w.Occurrences(t, w.next(from, 2).Add(w.End.Sub(w.Start)))
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// ActiveAt reports whether the window takes place at t.
+func (w *Window) ActiveAt(t time.Time) bool {
+	return len(w.Occurrences(t, t.Add(time.Nanosecond))) > 0
+}
+
+// Covers reports whether server is in the window.
+func (w *Window) Covers(server *inventory.Server) bool {
+	for _, id := range w.ServerIDs {
+		if id == server.ID {
+			return true
+		}
+	}
+	for _, tag := range w.Tags {
+		for _, t := range server.Tags {
+			if strings.EqualFold(tag, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conflicts lists the windows in others that take place at the same time
+// as w, within horizon of its start or of now if that is later, on a
+// server that depends on or is depended on by a server in w. Taking both
+// down at once is usually a mistake.
+func Conflicts(w *Window, others []*Window, servers []*inventory.Server, horizon time.Duration) []string {
+	byHostname := make(map[string]*inventory.Server, len(servers))
+	for _, server := range servers {
+		byHostname[server.Hostname] = server
+	}
+
+	// pairs of related servers, the first in w
+	type pair struct{ in, other *inventory.Server }
+	var pairs []pair
+	for _, server := range servers {
+		if !w.Covers(server) {
+			continue
+		}
+		for _, hostname := range server.DependsOn {
+			if dep := byHostname[hostname]; dep != nil {
+				pairs = append(pairs, pair{server, dep})
+			}
+		}
+		for _, other := range servers {
+			for _, hostname := range other.DependsOn {
+				if hostname == server.Hostname {
+					pairs = append(pairs, pair{server, other})
+				}
+			}
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	// windows that started in the past are checked from now on
+	from := w.Start
+	if now := time.Now(); now.After(from) {
+		from = now
+	}
+	to := from.Add(horizon)
+	mine := w.Occurrences(from, to)
+
+	seen := make(map[string]bool)
+	var conflicts []string
+	for _, other := range others {
+		if other.ID == w.ID {
+			continue
+		}
+		overlap, ok := overlaps(mine, other.Occurrences(from, to))
+		if !ok {
+			continue
+		}
+		for _, p := range pairs {
+			if !other.Covers(p.other) {
+				continue
+			}
+
+			relation := fmt.Sprintf("%s depends on %s", p.in.Hostname, p.other.Hostname)
+			for _, hostname := range p.other.DependsOn {
+				if hostname == p.in.Hostname {
+					relation = fmt.Sprintf("%s depends on %s", p.other.Hostname, p.in.Hostname)
+				}
+			}
+
+			message := fmt.Sprintf("%s, which is in '%s' at the same time from %s",
+				relation, other.Title, overlap.Local().Format("2006-Jan-02 03:04 PM MST"))
+			if !seen[message] {
+				seen[message] = true
+				conflicts = append(conflicts, message)
+			}
+		}
+	}
+
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// overlaps returns the start of the first overlap of two lists of
+// occurrences, and false if they do not overlap.
+func overlaps(a, b []*Occurrence) (time.Time, bool) {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Start.Before(y.End) && y.Start.Before(x.End) {
+				if x.Start.After(y.Start) {
+					return x.Start, true
+				}
+				return y.Start, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// trim trims list items and drops the empty ones.
+func trim(list []string) []string {
+	var out []string
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Store keeps maintenance windows in MongoDB.
+type Store struct {
+	col *mongo.Collection
+}
+
+// NewStore returns a Store using col.
+func NewStore(col *mongo.Collection) *Store {
+	return &Store{col: col}
+}
+
+// List returns every window, the first to start first.
+func (s *Store) List(ctx context.Context) ([]*Window, error) {
+	cursor, err := s.col.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "start", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var windows []*Window
+	for cursor.Next(ctx) {
+		window := new(Window)
+		err := cursor.Decode(window)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+
+	return windows, cursor.Err()
+}
+
+// Create adds a window and returns its id.
+func (s *Store) Create(ctx context.Context, window *Window, createdBy string) (string, error) {
+	now := time.Now().UTC()
+	window.ID = primitive.NewObjectID().Hex()
+	window.CreatedBy = createdBy
+	window.CreatedAt = now
+	window.ModifiedBy = createdBy
+	window.ModifiedAt = now
+
+	_, err := s.col.InsertOne(ctx, window)
+	if err != nil {
+		return "", err
+	}
+	return window.ID, nil
+}
+
+// Read returns a window by id.
+func (s *Store) Read(ctx context.Context, id string) (*Window, error) {
+	window := new(Window)
+	err := s.col.FindOne(ctx, bson.M{"_id": id}).Decode(window)
+	if err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
+// Update replaces the details of a window, the created fields are kept.
+func (s *Store) Update(ctx context.Context, window *Window, modifiedBy string) error {
+	res, err := s.col.UpdateOne(ctx,
+		bson.M{"_id": window.ID},
+		bson.M{
+			"$set": bson.M{
+				"title":       window.Title,
+				"serverids":   window.ServerIDs,
+				"tags":        window.Tags,
+				"start":       window.Start,
+				"end":         window.End,
+				"recurrence":  window.Recurrence,
+				"until":       window.Until,
+				"owner":       window.Owner,
+				"description": window.Description,
+				"modifiedby":  modifiedBy,
+				"modifiedat":  time.Now().UTC(),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Delete removes a window.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	res, err := s.col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Suppressed reports whether server is in a window at t, alerts about it
+// are then held back.
+func (s *Store) Suppressed(ctx context.Context, server *inventory.Server, t time.Time) (bool, error) {
+	windows, err := s.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, w := range windows {
+		if w.Covers(server) && w.ActiveAt(t) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
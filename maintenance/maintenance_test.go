@@ -0,0 +1,57 @@
+package maintenance
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonthlyOccurrences(t *testing.T) {
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2021, month, d, 22, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		start time.Time
+		want  []time.Time
+	}{
+		{"every month has the 15th", day(time.January, 15), []time.Time{
+			day(time.January, 15), day(time.February, 15), day(time.March, 15), day(time.April, 15), day(time.May, 15),
+		}},
+		{"months without the 31st are skipped", day(time.January, 31), []time.Time{
+			day(time.January, 31), day(time.March, 31), day(time.May, 31),
+		}},
+		{"february is skipped for the 30th", day(time.January, 30), []time.Time{
+			day(time.January, 30), day(time.March, 30), day(time.April, 30), day(time.May, 30),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &Window{Start: tt.start, End: tt.start.Add(4 * time.Hour), Recurrence: Monthly}
+			list := w.Occurrences(day(time.January, 1), day(time.June, 1))
+
+			if len(list) != len(tt.want) {
+				t.Fatalf("%d occurrences, want %d", len(list), len(tt.want))
+			}
+			for i, o := range list {
+				if !o.Start.Equal(tt.want[i]) {
+					t.Errorf("occurrence %d at %v, want %v", i+1, o.Start, tt.want[i])
+				}
+			}
+
+			// after the last one in the list the next is a month, or two, on
+			next := w.Next(list[len(list)-1].End)
+			if next == nil || next.Start.Day() != tt.start.Day() {
+				t.Errorf("next %+v, want on day %d", next, tt.start.Day())
+			}
+		})
+	}
+
+	t.Run("longer than the shortest month", func(t *testing.T) {
+		w := &Window{Title: "t", Tags: []string{"db"}, Start: day(time.January, 1), End: day(time.January, 30), Recurrence: Monthly}
+		if w.Validate() == nil {
+			t.Error("a 29 day monthly window is valid")
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// ParseAllow parses addresses and networks such as 127.0.0.1 or
+// 10.0.0.0/8, an address is a network of just itself.
+func ParseAllow(allow []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, a := range allow {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or network", a)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			a = fmt.Sprintf("%s/%d", a, bits)
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or network", a)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Handler serves the metrics of registry to clients connecting from one of
+// the allowed networks, or sending token as a bearer token when it is set.
+// Everyone else is forbidden.
+func Handler(registry *Registry, allow []*net.IPNet, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r, allow, token) {
+			logging.Warn(r.Context(), "metrics not allowed", "remote", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		_, err := registry.WriteTo(w)
+		if err != nil {
+			logging.Error(r.Context(), "WriteTo() failed", "error", err)
+		}
+	})
+}
+
+func allowed(r *http.Request, allow []*net.IPNet, token string) bool {
+	if token != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	// the address of the connection, a forwarded for header could be
+	// set by anyone
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
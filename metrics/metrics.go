@@ -0,0 +1,303 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the prometheus text format. Metrics are registered in a Registry, the
+// program makes one and passes it to what it measures. A counter or
+// histogram registered again under its name is shared, such as by two apps
+// served from one process, any other reuse of a name panics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of a latency histogram in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+type metric interface {
+	// write writes the samples of the metric after its help and type.
+	write(w *bufio.Writer)
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: reuse of metric name " + name)
+	}
+	r.metrics[name] = m
+}
+
+// shared returns the metric registered as name when it is of the same type
+// as m, or registers m.
+func (r *Registry) shared(name string, m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[name]; ok {
+		if fmt.Sprintf("%T", existing) != fmt.Sprintf("%T", m) {
+			panic("metrics: reuse of metric name " + name)
+		}
+		return existing
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// WriteTo writes every metric in the prometheus text format, sorted by
+// name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// series keys the samples of a metric by their label values.
+type series struct {
+	mu     sync.Mutex
+	keys   []string
+	values map[string][]string
+}
+
+// key returns the key of values, adding them the first time. There must
+// be a value for each label.
+func (s *series) key(d desc, values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, not %d", d.name, len(d.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := s.values[key]; !ok {
+		if s.values == nil {
+			s.values = make(map[string][]string)
+		}
+		s.values[key] = append([]string(nil), values...)
+		s.keys = append(s.keys, key)
+		sort.Strings(s.keys)
+	}
+	return key
+}
+
+// labels formats the labels and their values, with extra pairs after
+// them, as {name="value",...}.
+func labels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	pair := func(name, value string) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+		b.WriteByte('"')
+	}
+	for i, name := range names {
+		pair(name, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pair(extra[i], extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// CounterVec is a count that only goes up, one for each set of label
+// values.
+type CounterVec struct {
+	desc
+	series
+	counts map[string]float64
+}
+
+// NewCounterVec registers a counter with labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		counts: make(map[string]float64),
+	}
+	return r.shared(name, c).(*CounterVec)
+}
+
+// Inc adds one to the count of the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds n, which must not be negative, to the count of the label
+// values.
+func (c *CounterVec) Add(n float64, values ...string) {
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	c.counts[c.key(c.desc, values)] += n
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels(c.labels, c.values[key]), formatFloat(c.counts[key]))
+	}
+}
+
+// HistogramVec counts observations, such as latencies, in buckets, one
+// histogram for each set of label values.
+type HistogramVec struct {
+	desc
+	series
+	buckets []float64
+	hists   map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with labels, buckets are the upper
+// bounds of its buckets in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		hists:   make(map[string]*histogram),
+	}
+	return r.shared(name, h).(*HistogramVec)
+}
+
+// Observe adds v to the histogram of the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	key := h.key(h.desc, values)
+	hist, ok := h.hists[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.hists[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	for _, key := range h.keys {
+		hist, values := h.hists[key], h.values[key]
+
+		// buckets are cumulative, each counts the observations at or below
+		// its bound
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(h.labels, values, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(h.labels, values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels(h.labels, values), hist.count)
+	}
+}
+
+// funcMetric is a gauge or counter whose value is read when the metrics
+// are written.
+type funcMetric struct {
+	desc
+	f func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is f, it is called each time
+// the metrics are written.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, &funcMetric{desc: desc{name: name, help: help, kind: "gauge"}, f: f})
+}
+
+// NewCounterFunc registers a counter whose value is f, for a count kept
+// elsewhere.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(name, &funcMetric{desc: desc{name: name, help: help, kind: "counter"}, f: f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.f()))
+}
@@ -1,49 +1,47 @@
 package middleware
 
 import (
-	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
-	"github.com/go-stuff/grpc/api"
-	"github.com/golang/protobuf/ptypes"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/redact"
 )
 
 // Audit any changes to the system
-func Audit(next http.Handler) http.Handler {
+func (m *Middleware) Audit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// only consider put, post and patch
 		switch r.Method {
 		case "PUT", "POST", "PATCH":
 
 			// get session
-			session, err := store.Get(r, "session")
+			session, err := m.store.Get(r, "session")
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				ServerError(w, err)
 				return
 			}
 
 			if session.Values["username"] != nil {
-				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-				defer cancel()
-				auditSvc := api.NewAuditServiceClient(apiClient)
-
-				auditReq := new(api.AuditCreateReq)
-				auditReq.Audit = &api.Audit{
+				// the spool syncs the record to disk and sends it to the
+				// AuditService in the background, an error here means the
+				// record could not be kept and the request must not go ahead
+				err = m.spool.Write(&audit.Record{
 					ID:        primitive.NewObjectID().Hex(),
 					Username:  fmt.Sprintf("%v", session.Values["username"]),
 					Action:    fmt.Sprintf("%v: %v", r.Method, r.URL),
-					Session:   fmt.Sprintf("%v", session.Values),
+					Session:   redact.Values(session.Values),
 					CreatedBy: "System",
-					CreatedAt: ptypes.TimestampNow(),
-				}
-				_, err = auditSvc.Create(ctx, auditReq)
+					CreatedAt: time.Now().UTC(),
+					RequestID: logging.RequestID(r.Context()),
+				})
 				if err != nil {
-					log.Printf("ERROR > controllers/loginHandler.go > auditSvc.Create(): %s\n", err.Error())
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					logging.Error(r.Context(), "spool.Write() failed", "error", err)
+					ServerError(w, err)
 					return
 				}
 			}
@@ -2,7 +2,9 @@ package middleware
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/csrf"
 )
@@ -54,3 +56,19 @@ func Headers(next http.Handler) http.Handler {
 		return
 	})
 }
+
+// HSTS middleware tells browsers to only use https for maxAge, it is used
+// when the app is served over tls.
+func HSTS(maxAge time.Duration, includeSubdomains bool) func(http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Strict-Transport-Security", value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
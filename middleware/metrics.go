@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/go-stuff/web/metrics"
+)
+
+// newHTTPMetrics registers the request count and duration in registry.
+func newHTTPMetrics(registry *metrics.Registry) (*metrics.CounterVec, *metrics.HistogramVec) {
+	requests := registry.NewCounterVec("web_http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	duration := registry.NewHistogramVec("web_http_request_duration_seconds",
+		"How long HTTP requests took by route and method.", metrics.DefaultBuckets, "route", "method")
+	return requests, duration
+}
+
+// Metrics counts requests and how long they took by the path template of
+// their route, such as /server/read/{id}, so the ids of a path do not
+// each get their own series.
+func (m *Middleware) Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sw, r)
+
+		route, err := routeTemplate(r)
+		if err != nil {
+			route = "unknown"
+		}
+		m.httpRequests.Inc(route, r.Method, strconv.Itoa(sw.status))
+		m.httpDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// routeTemplate returns the path template of the route of the request.
+func routeTemplate(r *http.Request) (string, error) {
+	return mux.CurrentRoute(r).GetPathTemplate()
+}
+
+// statusWriter records the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes http.Flusher through.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
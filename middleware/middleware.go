@@ -1,17 +1,52 @@
 package middleware
 
 import (
-	"github.com/go-stuff/mongostore"
-	"google.golang.org/grpc"
-)
+	"net/http"
 
-var (
-	store     *mongostore.MongoStore
-	apiClient *grpc.ClientConn
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/metrics"
+	"github.com/go-stuff/web/redact"
+	"github.com/go-stuff/web/repository"
+	"github.com/go-stuff/web/security"
+	"github.com/go-stuff/web/sessionstore"
 )
 
-// Init gets the store pointer from main.go
-func Init(mongostore *mongostore.MongoStore, apiclient *grpc.ClientConn) {
-	store = mongostore
-	apiClient = apiclient
+// Middleware is the session, auth, permission and audit middleware of an
+// app, each app has its own.
+type Middleware struct {
+	store   *sessionstore.RequestStore
+	routes  repository.Routes
+	spool   *audit.Spool
+	monitor *security.Monitor
+	// prefix is the path the app is mounted under, redirects start with
+	// it.
+	prefix string
+
+	httpRequests *metrics.CounterVec
+	httpDuration *metrics.HistogramVec
+}
+
+// New returns the Middleware of the app mounted under prefix, requests are
+// counted and timed in registry.
+func New(sessionStore *sessionstore.RequestStore, routes repository.Routes, auditspool *audit.Spool, securitymonitor *security.Monitor, registry *metrics.Registry, prefix string) *Middleware {
+	m := &Middleware{
+		store:   sessionStore,
+		routes:  routes,
+		spool:   auditspool,
+		monitor: securitymonitor,
+		prefix:  prefix,
+	}
+	m.httpRequests, m.httpDuration = newHTTPMetrics(registry)
+	return m
+}
+
+// ServerError replies to a request that failed with err, with a 503 when
+// the data backend could not be reached, the app shows its unavailable
+// page for it, and a 500 otherwise.
+func ServerError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if repository.Unreachable(err) {
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, redact.Error(err), code)
 }
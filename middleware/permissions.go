@@ -3,17 +3,17 @@ package middleware
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/go-stuff/grpc/api"
-	"github.com/gorilla/mux"
+
+	"github.com/go-stuff/web/logging"
 )
 
 // Permissions allows or denies access to routes
-func Permissions(next http.Handler) http.Handler {
+func (m *Middleware) Permissions(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only process files that are not in the /static/ folder and not the favicon,ico.
 		if strings.Contains(r.RequestURI, "/static/") || strings.Contains(r.RequestURI, "/favicon.ico") {
@@ -21,42 +21,42 @@ func Permissions(next http.Handler) http.Handler {
 			return
 		}
 
-		log.Printf("INFO > middleware/permission.go > Permissions() > method: %v, %v\n", r.Method, r.RequestURI)
+		logging.Debug(r.Context(), "check permission", "method", r.Method, "uri", r.RequestURI)
 
-		currentRoute := mux.CurrentRoute(r)
-		pathTemplate, err := currentRoute.GetPathTemplate()
+		pathTemplate, err := routeTemplate(r)
 		if err != nil {
-			log.Printf("ERROR > middleware/permission.go > currentRoute.GetPathTemplate(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "routeTemplate() failed", "error", err)
+			ServerError(w, err)
 			return
 		}
 
-		log.Printf("INFO > middleware/permission.go > Permissions() > pathTemplate: %s\n", pathTemplate)
+		logging.Debug(r.Context(), "route found", "route", pathTemplate)
 
 		// get session
-		session, err := store.Get(r, "session")
+		session, err := m.store.Get(r, "session")
 		if err != nil {
-			log.Printf("ERROR > middleware/Permissions.go > store.Get(): %s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logging.Error(r.Context(), "store.Get() failed", "error", err)
+			ServerError(w, err)
 			return
 		}
 
 		if pathTemplate != "/noauth" &&
+			pathTemplate != "/noauth/request" &&
 			pathTemplate != "/login" &&
 			pathTemplate != "/logout" {
 
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			ctx, cancel := context.WithTimeout(logging.Detach(r.Context()), 30*time.Second)
 			defer cancel()
 
-			routeSvc := api.NewRouteServiceClient(apiClient)
+			routeSvc := m.routes
 
 			// use the api to find a role
 			routeReq := new(api.RouteReadByRoleIDAndPathReq)
 
 			// if there is no role, redirect to the login screen
 			if session.Values["roleid"] == nil || session.Values["roleid"] == "" {
-				log.Println("INFO > middleware/Permissions.go > no role, redirect to login")
-				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				logging.Info(r.Context(), "no role, redirect to login")
+				http.Redirect(w, r, m.prefix+"/login", http.StatusSeeOther)
 				return
 			}
 
@@ -67,36 +67,31 @@ func Permissions(next http.Handler) http.Handler {
 			routeReq.Route.Path = pathTemplate
 			routeRes, err := routeSvc.ReadByRoleIDAndPath(ctx, routeReq)
 			if err != nil {
-				log.Printf("ERROR > controllers/permissions.go > permissionFM() > routeSvc.RouteReadByRoleIDAndPath(): %s\n", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				logging.Error(r.Context(), "routeSvc.RouteReadByRoleIDAndPath() failed", "error", err)
+				ServerError(w, err)
 				return
 			}
-			log.Printf("INFO > controllers/controllers.go > permissionFM() > pathTemplate = permission: %s = %v\n", pathTemplate, routeRes.Route.Permission)
+			logging.Debug(r.Context(), "permission", "route", pathTemplate, "permission", routeRes.Route.Permission)
 
 			if routeRes.Route.Permission == false {
-				log.Printf("WARN > middleware/permission.go > Permissions() > The role: %v has no permissions to route: %v\n", roleid, pathTemplate)
+				logging.Warn(r.Context(), "role has no permission to route", "roleid", roleid, "route", pathTemplate)
+
+				// record the denial as a security event
+				err = m.monitor.Denied(ctx, fmt.Sprintf("%v", session.Values["username"]), r.RemoteAddr, pathTemplate, roleid)
+				if err != nil {
+					logging.Error(r.Context(), "monitor.Denied() failed", "error", err)
+				}
 
 				session.Values["pathtemplate"] = pathTemplate
 				// save session
 				err = session.Save(r, w)
 				if err != nil {
-					log.Printf("ERROR > middleware/Permissions.go > session.Save(): %s\n", err.Error())
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					logging.Error(r.Context(), "session.Save() failed", "error", err)
+					ServerError(w, err)
 					return
 				}
 
-				http.Redirect(w, r, "/noauth", http.StatusTemporaryRedirect)
-				return
-			}
-		}
-
-		// if there is no role, the session is empty, do not save the session
-		if session.Values["roleid"] != nil && session.Values["roleid"] != "" {
-			// save session
-			err = session.Save(r, w)
-			if err != nil {
-				log.Printf("ERROR > middleware/Permissions.go > session.Save(): %s\n", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Redirect(w, r, m.prefix+"/noauth", http.StatusTemporaryRedirect)
 				return
 			}
 		}
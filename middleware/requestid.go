@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// RequestIDHeader carries the request id, in the response and from a
+// proxy in front of the app that already gave the request one.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID gives each request an id, kept from the request header when a
+// proxy set a sane one. It is returned in the response header and carried
+// by the context of the request, so it is on every line logged with it,
+// on its audit records and in the metadata of its calls to the backend.
+// A line is logged for each request once it is served, at debug level for
+// static files and probes.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(logging.WithRequestID(r.Context(), id))
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sw, r)
+
+		log := logging.Info
+		if quiet(r.URL.Path) {
+			log = logging.Debug
+		}
+		log(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// validRequestID reports whether id is short and only letters, digits,
+// dashes, dots and underscores, anything else could forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// quiet reports whether path is requested too often to log each time.
+func quiet(path string) bool {
+	return strings.Contains(path, "/static/") ||
+		strings.HasSuffix(path, "/healthz") ||
+		strings.HasSuffix(path, "/readyz") ||
+		strings.HasSuffix(path, "/metrics")
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// Session loads the session once for the whole request and writes it at
+// most once, after every other middleware and the handler are done with it.
+func (m *Middleware) Session(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only process files that are not in the /static/ folder and not the favicon,ico.
+		if strings.Contains(r.RequestURI, "/static/") || strings.Contains(r.RequestURI, "/favicon.ico") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw, sr, err := m.store.Begin(w, r)
+		if err != nil {
+			logging.Error(r.Context(), "store.Begin() failed", "error", err)
+			ServerError(w, err)
+			return
+		}
+
+		next.ServeHTTP(sw, sr)
+
+		// write the session if the handler did not write a response
+		err = m.store.End(sw)
+		if err != nil {
+			logging.Error(r.Context(), "store.End() failed", "error", err)
+			ServerError(w, err)
+			return
+		}
+	})
+}
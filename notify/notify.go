@@ -0,0 +1,135 @@
+// Package notify delivers operational alerts, such as security anomalies,
+// to hooks like the log or a signed webhook.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-stuff/web/audit"
+	"github.com/go-stuff/web/logging"
+)
+
+// Alert is a single notification.
+type Alert struct {
+	Source  string            `json:"source"`
+	Kind    string            `json:"kind"`
+	Subject string            `json:"subject"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Hook receives alerts.
+type Hook interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Notifier sends every alert to all of its hooks.
+type Notifier struct {
+	hooks   []Hook
+	timeout time.Duration
+}
+
+// New returns a Notifier for the given hooks.
+func New(hooks ...Hook) *Notifier {
+	return &Notifier{
+		hooks:   hooks,
+		timeout: 10 * time.Second,
+	}
+}
+
+// Send delivers an alert to every hook in the background so the caller is
+// never held up by a slow hook. Send on a nil Notifier does nothing.
+func (n *Notifier) Send(alert Alert) {
+	if n == nil {
+		return
+	}
+	if alert.Time.IsZero() {
+		alert.Time = time.Now().UTC()
+	}
+
+	for _, hook := range n.hooks {
+		go func(hook Hook) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+			defer cancel()
+
+			err := hook.Notify(ctx, alert)
+			if err != nil {
+				logging.Error(ctx, "hook.Notify() failed", "hook", fmt.Sprintf("%T", hook), "error", err)
+			}
+		}(hook)
+	}
+}
+
+// LogHook writes alerts to the standard logger.
+type LogHook struct{}
+
+// Notify logs the alert.
+func (LogHook) Notify(ctx context.Context, alert Alert) error {
+	logging.Warn(ctx, "alert", "source", alert.Source, "kind", alert.Kind, "subject", alert.Subject, "message", alert.Message, "fields", alert.Fields)
+	return nil
+}
+
+// Headers set on every webhook request.
+const (
+	WebhookTimestampHeader = "X-Alert-Timestamp"
+	WebhookSignatureHeader = "X-Alert-Signature"
+)
+
+// WebhookHook POSTs alerts as JSON. When a secret is set the request
+// carries an HMAC-SHA256 of "<timestamp>.<body>" as "sha256=<hex>".
+type WebhookHook struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+// NewWebhookHook returns a WebhookHook with a 10 second client timeout.
+func NewWebhookHook(url string, secret []byte) *WebhookHook {
+	return &WebhookHook{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify posts the alert.
+func (h *WebhookHook) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if len(h.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+audit.Sign(h.Secret, timestamp, body))
+	}
+
+	res, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("alert webhook returned %s", res.Status)
+	}
+	return nil
+}
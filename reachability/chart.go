@@ -0,0 +1,103 @@
+package reachability
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"time"
+)
+
+// chart layout in pixels
+const (
+	chartWidth  = 720
+	chartHeight = 160
+	chartPad    = 30
+	stripHeight = 12
+)
+
+// Chart draws the history of a server between since and until as an SVG:
+// latency as a line over a strip coloured by up/down status.
+func Chart(results []*Result, since, until time.Time) string {
+	plotWidth := float64(chartWidth - 2*chartPad)
+	plotHeight := float64(chartHeight - 2*chartPad - stripHeight)
+	span := until.Sub(since).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+
+	x := func(t time.Time) float64 {
+		return chartPad + plotWidth*t.Sub(since).Seconds()/span
+	}
+
+	var max time.Duration
+	for _, res := range results {
+		if res.Up && res.Latency > max {
+			max = res.Latency
+		}
+	}
+	if max < time.Millisecond {
+		max = time.Millisecond
+	}
+	y := func(d time.Duration) float64 {
+		return chartPad + plotHeight - plotHeight*float64(d)/float64(max)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="100%%" role="img" aria-label="Reachability history">`, chartWidth, chartHeight)
+
+	// axes and labels
+	fmt.Fprintf(&buf, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#ccc"/>`, chartPad, chartPad, chartPad, chartHeight-chartPad)
+	fmt.Fprintf(&buf, `<text x="%d" y="%d" font-size="10" fill="#666">%s</text>`, 2, chartPad-8, max.Round(time.Millisecond))
+	fmt.Fprintf(&buf, `<text x="%d" y="%d" font-size="10" fill="#666">%s</text>`, chartPad, chartHeight-8, since.Local().Format("Jan 02 03:04 PM"))
+	fmt.Fprintf(&buf, `<text x="%d" y="%d" font-size="10" fill="#666" text-anchor="end">%s</text>`, chartWidth-chartPad, chartHeight-8, until.Local().Format("Jan 02 03:04 PM"))
+
+	// status strip, each result lasts until the next one
+	stripY := chartHeight - chartPad - stripHeight
+	for i, res := range results {
+		end := until
+		if i+1 < len(results) {
+			end = results[i+1].CheckedAt
+		}
+		colour := "#28a745"
+		if !res.Up {
+			colour = "#dc3545"
+		}
+		width := x(end) - x(res.CheckedAt)
+		if width < 1 {
+			width = 1
+		}
+		fmt.Fprintf(&buf, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"><title>%s %s</title></rect>`,
+			x(res.CheckedAt), stripY, width, stripHeight, colour, res.CheckedAt.Local().Format("03:04:05 PM"), state(res))
+	}
+
+	// latency of the results that were up, broken where the server was
+	// down
+	open := false
+	for _, res := range results {
+		if !res.Up {
+			if open {
+				buf.WriteString(`"/>`)
+				open = false
+			}
+			continue
+		}
+		if !open {
+			buf.WriteString(`<polyline fill="none" stroke="#007bff" stroke-width="1.5" points="`)
+			open = true
+		}
+		fmt.Fprintf(&buf, "%.1f,%.1f ", x(res.CheckedAt), y(res.Latency))
+	}
+	if open {
+		buf.WriteString(`"/>`)
+	}
+
+	buf.WriteString(`</svg>`)
+	return buf.String()
+}
+
+func state(res *Result) string {
+	if res.Up {
+		return fmt.Sprintf("up %s", res.Latency.Round(time.Millisecond))
+	}
+	return "down " + html.EscapeString(res.Error)
+}
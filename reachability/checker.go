@@ -0,0 +1,278 @@
+package reachability
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/notify"
+)
+
+// Options tune the Checker.
+type Options struct {
+	// Interval is the time between rounds of checks.
+	Interval time.Duration
+	// Timeout bounds a single probe.
+	Timeout time.Duration
+	// Dampening is the number of results in a row that must disagree with
+	// the current state before it changes and an alert is sent, so a
+	// flapping server does not flood the alert hooks.
+	Dampening int
+	// Concurrency is the number of servers probed at the same time.
+	Concurrency int
+}
+
+// DefaultOptions check every minute, give a server 5 seconds to answer
+// and change state after 3 results in a row.
+var DefaultOptions = Options{
+	Interval:    time.Minute,
+	Timeout:     5 * time.Second,
+	Dampening:   3,
+	Concurrency: 10,
+}
+
+// Suppressor holds back the alerts about a server, such as while it is in
+// a maintenance window.
+type Suppressor interface {
+	Suppressed(ctx context.Context, server *inventory.Server, t time.Time) (bool, error)
+}
+
+// Checker probes every server in the inventory that has a check, records
+// the results and sends an alert when a server changes state, unless the
+// Suppressor holds it back.
+type Checker struct {
+	servers    *inventory.Store
+	store      *Store
+	notifier   *notify.Notifier
+	suppressor Suppressor
+	opts       Options
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewChecker returns a Checker, Start runs it. suppressor may be nil.
+func NewChecker(servers *inventory.Store, store *Store, notifier *notify.Notifier, suppressor Suppressor, opts Options) *Checker {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultOptions.Interval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultOptions.Timeout
+	}
+	if opts.Dampening < 1 {
+		opts.Dampening = 1
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = DefaultOptions.Concurrency
+	}
+
+	return &Checker{
+		servers:    servers,
+		store:      store,
+		notifier:   notifier,
+		suppressor: suppressor,
+		opts:       opts,
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start checks every server once per Interval in the background until
+// Close is called.
+func (c *Checker) Start() {
+	go c.run()
+}
+
+// Close stops the checker and waits for a running round to finish.
+func (c *Checker) Close() {
+	close(c.quit)
+	<-c.done
+}
+
+func (c *Checker) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		ctx := context.Background()
+		err := c.CheckAll(ctx)
+		if err != nil {
+			logging.Error(ctx, "CheckAll() failed", "error", err)
+		}
+
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll probes every server with a check once. Servers that no longer
+// have a check lose their status.
+func (c *Checker) CheckAll(ctx context.Context) error {
+	servers, err := c.servers.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := c.store.Statuses(ctx)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, c.opts.Concurrency)
+	var wg sync.WaitGroup
+
+	for _, server := range servers {
+		if server.Check.Type == "" {
+			continue
+		}
+
+		st := statuses[server.ID]
+		delete(statuses, server.ID)
+		if st == nil {
+			st = &Status{ServerID: server.ID}
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(server *inventory.Server, st *Status) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := c.check(ctx, server, st)
+			if err != nil {
+				logging.Error(ctx, "check() failed", "hostname", server.Hostname, "error", err)
+			}
+		}(server, st)
+	}
+	wg.Wait()
+
+	// what is left belongs to deleted servers or servers without a check
+	for id := range statuses {
+		err := c.store.deleteStatus(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check probes one server, records the result and moves its status on.
+func (c *Checker) check(ctx context.Context, server *inventory.Server, st *Status) error {
+	res := Probe(ctx, server.Check, c.opts.Timeout)
+	res.ServerID = server.ID
+
+	err := c.store.Record(ctx, res)
+	if err != nil {
+		return err
+	}
+
+	c.update(ctx, server, st, res)
+
+	return c.store.saveStatus(ctx, st)
+}
+
+// update moves the status of server on by res and alerts when its state
+// is not the one last alerted about. An alert held back stays due, so it
+// is sent once the server leaves its maintenance window, unless the server
+// is back in the state last alerted about by then.
+func (c *Checker) update(ctx context.Context, server *inventory.Server, st *Status, res *Result) {
+	// statuses saved before alerts were held back told about their state
+	if st.Alerted == "" {
+		st.Alerted = st.State
+	}
+
+	changed := st.apply(res, c.opts.Dampening)
+	if st.State == st.Alerted {
+		return
+	}
+
+	if c.suppressed(ctx, server, res.CheckedAt) {
+		if changed {
+			logging.Info(ctx, "alert held back for maintenance", "hostname", server.Hostname)
+		}
+		return
+	}
+
+	c.alert(server, st)
+	st.Alerted = st.State
+}
+
+// suppressed reports whether alerts about server are held back at t. The
+// alert is sent if that can not be told.
+func (c *Checker) suppressed(ctx context.Context, server *inventory.Server, t time.Time) bool {
+	if c.suppressor == nil {
+		return false
+	}
+
+	suppressed, err := c.suppressor.Suppressed(ctx, server, t)
+	if err != nil {
+		logging.Error(ctx, "Suppressed() failed", "hostname", server.Hostname, "error", err)
+		return false
+	}
+	return suppressed
+}
+
+// apply moves the status on by one result and reports whether the state
+// changed. The first result sets the state without a change.
+func (st *Status) apply(res *Result, dampening int) bool {
+	st.Latency = res.Latency
+	st.Error = res.Error
+	st.CheckedAt = res.CheckedAt
+
+	state := Down
+	if res.Up {
+		state = Up
+	}
+
+	if st.State == "" {
+		st.State = state
+		st.Alerted = state
+		st.Since = res.CheckedAt
+		st.Streak = 0
+		return false
+	}
+
+	if state == st.State {
+		st.Streak = 0
+		return false
+	}
+
+	st.Streak++
+	if st.Streak < dampening {
+		return false
+	}
+
+	st.State = state
+	st.Since = res.CheckedAt
+	st.Streak = 0
+	return true
+}
+
+func (c *Checker) alert(server *inventory.Server, st *Status) {
+	message := fmt.Sprintf("%s is up again", server.Hostname)
+	if st.State == Down {
+		message = fmt.Sprintf("%s is down: %s", server.Hostname, st.Error)
+	}
+
+	c.notifier.Send(notify.Alert{
+		Source:  "reachability",
+		Kind:    st.State,
+		Subject: server.Hostname,
+		Message: message,
+		Time:    st.Since,
+		Fields: map[string]string{
+			"check":   server.Check.Type,
+			"target":  server.Check.Target,
+			"latency": st.Latency.String(),
+		},
+	})
+}
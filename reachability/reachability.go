@@ -0,0 +1,286 @@
+// Package reachability probes the servers in the inventory, keeps their
+// up/down status and a history of results, and alerts when a server goes
+// down or comes back.
+package reachability
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/go-stuff/web/inventory"
+)
+
+// Server states.
+const (
+	Up   = "up"
+	Down = "down"
+)
+
+// Result is the outcome of one probe.
+type Result struct {
+	ID        string        `bson:"_id"`
+	ServerID  string        `bson:"serverid"`
+	Up        bool          `bson:"up"`
+	Latency   time.Duration `bson:"latency"`
+	Error     string        `bson:"error,omitempty"`
+	CheckedAt time.Time     `bson:"checkedat"`
+}
+
+// Status is the dampened state of a server. State only changes once
+// enough results in a row disagree with it, Streak counts them. Alerted is
+// the state the last alert told about, while it differs from State an
+// alert is held back.
+type Status struct {
+	ServerID  string        `bson:"_id"`
+	State     string        `bson:"state"`
+	Since     time.Time     `bson:"since"`
+	Streak    int           `bson:"streak"`
+	Alerted   string        `bson:"alerted,omitempty"`
+	Latency   time.Duration `bson:"latency"`
+	Error     string        `bson:"error,omitempty"`
+	CheckedAt time.Time     `bson:"checkedat"`
+}
+
+// Probe runs check once and reports whether the server answered and how
+// long it took.
+func Probe(ctx context.Context, check inventory.Check, timeout time.Duration) *Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := probe(ctx, check)
+	res := &Result{
+		Up:        err == nil,
+		Latency:   time.Since(start),
+		CheckedAt: start.UTC(),
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func probe(ctx context.Context, check inventory.Check) error {
+	dialer := new(net.Dialer)
+
+	switch check.Type {
+	case inventory.TCP:
+		conn, err := dialer.DialContext(ctx, "tcp", check.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case inventory.TLS:
+		conn, err := dialer.DialContext(ctx, "tcp", check.Target)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		host, _, err := net.SplitHostPort(check.Target)
+		if err != nil {
+			return err
+		}
+
+		// only reachability is checked here, an untrusted certificate
+		// still answers
+		deadline, _ := ctx.Deadline()
+		conn.SetDeadline(deadline)
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		})
+		return tlsConn.Handshake()
+
+	case inventory.HTTP:
+		req, err := http.NewRequest("GET", check.Target, nil)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				DisableKeepAlives: true,
+			},
+			// the status of the target itself is wanted, not of where
+			// it redirects to
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		expect := check.ExpectStatus
+		if expect == 0 {
+			expect = http.StatusOK
+		}
+		if res.StatusCode != expect {
+			return fmt.Errorf("status %d, expected %d", res.StatusCode, expect)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown check type %q", check.Type)
+}
+
+// Store keeps results and statuses in MongoDB.
+type Store struct {
+	results  *mongo.Collection
+	statuses *mongo.Collection
+}
+
+// NewStore returns a Store keeping results in results for retention and
+// statuses in statuses, and makes sure the indexes exist.
+func NewStore(results, statuses *mongo.Collection, retention time.Duration) (*Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	seconds := int64(retention.Seconds())
+
+	// an index can not be changed in place, drop the retention index if
+	// the retention was changed since it was created
+	cursor, err := results.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var index bson.M
+		err := cursor.Decode(&index)
+		if err != nil {
+			return nil, err
+		}
+		if index["name"] == "checkedat_1" && expireAfter(index["expireAfterSeconds"]) != seconds {
+			_, err := results.Indexes().DropOne(ctx, "checkedat_1")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	_, err = results.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "serverid", Value: 1}, {Key: "checkedat", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "checkedat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(seconds)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		results:  results,
+		statuses: statuses,
+	}, nil
+}
+
+// expireAfter reads the expireAfterSeconds of an index, which the server
+// may return as any number type.
+func expireAfter(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return -1
+}
+
+// Record adds a result to the history of a server.
+func (s *Store) Record(ctx context.Context, res *Result) error {
+	res.ID = primitive.NewObjectID().Hex()
+	_, err := s.results.InsertOne(ctx, res)
+	return err
+}
+
+// History returns the results of a server since a time, oldest first.
+func (s *Store) History(ctx context.Context, serverID string, since time.Time) ([]*Result, error) {
+	cursor, err := s.results.Find(ctx,
+		bson.M{
+			"serverid":  serverID,
+			"checkedat": bson.M{"$gte": since},
+		},
+		options.Find().SetSort(bson.D{{Key: "checkedat", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []*Result
+	for cursor.Next(ctx) {
+		res := new(Result)
+		err := cursor.Decode(res)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+
+	return results, cursor.Err()
+}
+
+// Status returns the status of a server, or nil if it was never checked.
+func (s *Store) Status(ctx context.Context, serverID string) (*Status, error) {
+	st := new(Status)
+	err := s.statuses.FindOne(ctx, bson.M{"_id": serverID}).Decode(st)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Statuses returns the status of every checked server by server id.
+func (s *Store) Statuses(ctx context.Context) (map[string]*Status, error) {
+	cursor, err := s.statuses.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	statuses := make(map[string]*Status)
+	for cursor.Next(ctx) {
+		st := new(Status)
+		err := cursor.Decode(st)
+		if err != nil {
+			return nil, err
+		}
+		statuses[st.ServerID] = st
+	}
+
+	return statuses, cursor.Err()
+}
+
+// saveStatus replaces the status of a server.
+func (s *Store) saveStatus(ctx context.Context, st *Status) error {
+	_, err := s.statuses.ReplaceOne(ctx, bson.M{"_id": st.ServerID}, st, options.Replace().SetUpsert(true))
+	return err
+}
+
+// deleteStatus forgets the status of a server.
+func (s *Store) deleteStatus(ctx context.Context, serverID string) error {
+	_, err := s.statuses.DeleteOne(ctx, bson.M{"_id": serverID})
+	return err
+}
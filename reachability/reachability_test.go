@@ -0,0 +1,281 @@
+package reachability
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-stuff/web/inventory"
+	"github.com/go-stuff/web/notify"
+)
+
+// closedAddr returns an address nothing listens on.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// listen accepts and closes connections on addr until the returned func
+// is called.
+func listen(t *testing.T, addr string) func() {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return func() { ln.Close() }
+}
+
+func TestProbe(t *testing.T) {
+	up := closedAddr(t)
+	stop := listen(t, up)
+	defer stop()
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/missing", http.StatusFound)
+		case "/missing":
+			http.NotFound(w, r)
+		}
+	}))
+	defer web.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+
+	// accepts but never answers, a tls handshake waits for the timeout
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			// held open until the listener is closed
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		check   inventory.Check
+		wantUp  bool
+		wantErr string
+	}{
+		{"tcp up", inventory.Check{Type: inventory.TCP, Target: up}, true, ""},
+		{"tcp refused", inventory.Check{Type: inventory.TCP, Target: closedAddr(t)}, false, "refused"},
+		{"tls up with an untrusted certificate", inventory.Check{Type: inventory.TLS, Target: secure.Listener.Addr().String()}, true, ""},
+		{"tls handshake times out", inventory.Check{Type: inventory.TLS, Target: silent.Addr().String()}, false, "timeout"},
+		{"tls without a port", inventory.Check{Type: inventory.TLS, Target: "127.0.0.1"}, false, "port"},
+		{"http ok", inventory.Check{Type: inventory.HTTP, Target: web.URL + "/"}, true, ""},
+		{"https ok", inventory.Check{Type: inventory.HTTP, Target: secure.URL + "/"}, true, ""},
+		{"http unexpected status", inventory.Check{Type: inventory.HTTP, Target: web.URL + "/missing"}, false, "status 404, expected 200"},
+		{"http expected status", inventory.Check{Type: inventory.HTTP, Target: web.URL + "/missing", ExpectStatus: http.StatusNotFound}, true, ""},
+		{"http redirect is not followed", inventory.Check{Type: inventory.HTTP, Target: web.URL + "/moved", ExpectStatus: http.StatusFound}, true, ""},
+		{"unknown type", inventory.Check{Type: "ping", Target: up}, false, "unknown check type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Probe(context.Background(), tt.check, 200*time.Millisecond)
+
+			if res.Up != tt.wantUp {
+				t.Errorf("up = %v, want %v, error %q", res.Up, tt.wantUp, res.Error)
+			}
+			if !strings.Contains(res.Error, tt.wantErr) || (tt.wantErr == "") != (res.Error == "") {
+				t.Errorf("error = %q, want %q", res.Error, tt.wantErr)
+			}
+			if res.CheckedAt.IsZero() || res.CheckedAt.Location() != time.UTC {
+				t.Errorf("checked at %v, want a UTC time", res.CheckedAt)
+			}
+			if res.Latency <= 0 || res.Latency > 5*time.Second {
+				t.Errorf("latency %v out of range", res.Latency)
+			}
+		})
+	}
+}
+
+// alerts is a hook that hands alerts to the test.
+type alerts chan notify.Alert
+
+func (a alerts) Notify(ctx context.Context, alert notify.Alert) error {
+	a <- alert
+	return nil
+}
+
+// next returns the next alert, or nil if none comes shortly.
+func (a alerts) next() *notify.Alert {
+	select {
+	case alert := <-a:
+		return &alert
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestCheckerDampening(t *testing.T) {
+	addr := closedAddr(t)
+
+	tests := []struct {
+		name string
+		// steps is the state of the listener for each round, u is up and
+		// d is down
+		steps string
+		// want is the state after each round and, in upper case, an
+		// alert sent for that round
+		want string
+	}{
+		{"first result sets the state without an alert", "u", "u"},
+		{"first result down", "d", "d"},
+		{"goes down after three results", "udddd", "uuuDd"},
+		{"a blip is not an alert", "uduuddu", "uuuuuuu"},
+		{"comes back after three results", "dduuuu", "ddddUu"},
+		{"flapping sends nothing", "ududududu", "uuuuuuuuu"},
+		{"down and back up", "udddduuu", "uuuDdddU"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := make(alerts, len(tt.steps))
+			c := NewChecker(nil, nil, notify.New(sent), nil, Options{
+				Timeout:   200 * time.Millisecond,
+				Dampening: 3,
+			})
+			server := &inventory.Server{
+				ID:       "1",
+				Hostname: "web1",
+				Check:    inventory.Check{Type: inventory.TCP, Target: addr},
+			}
+			st := &Status{ServerID: server.ID}
+
+			stop := func() {}
+			for i, step := range tt.steps {
+				stop()
+				stop = func() {}
+				if step == 'u' {
+					stop = listen(t, addr)
+				}
+
+				res := Probe(context.Background(), server.Check, c.opts.Timeout)
+				res.ServerID = server.ID
+				c.update(context.Background(), server, st, res)
+
+				want := string(tt.want[i])
+				state := strings.ToLower(want)[:1]
+				if st.State[:1] != state {
+					t.Fatalf("round %d: state %s, want %s", i+1, st.State, state)
+				}
+
+				alert := sent.next()
+				if want != state {
+					if alert == nil {
+						t.Fatalf("round %d: no alert", i+1)
+					}
+					if alert.Kind != st.State || alert.Subject != server.Hostname || !alert.Time.Equal(st.Since) {
+						t.Errorf("round %d: alert %+v for status %+v", i+1, alert, st)
+					}
+				} else if alert != nil {
+					t.Fatalf("round %d: unexpected alert %+v", i+1, alert)
+				}
+			}
+			stop()
+		})
+	}
+}
+
+// window is a suppressor that holds alerts back while it is open.
+type window struct{ open bool }
+
+func (w *window) Suppressed(ctx context.Context, server *inventory.Server, t time.Time) (bool, error) {
+	return w.open, nil
+}
+
+func TestCheckerSuppression(t *testing.T) {
+	addr := closedAddr(t)
+
+	tests := []struct {
+		name  string
+		steps string
+		// held is x for each round in a maintenance window
+		held string
+		want string
+	}{
+		{"no window", "udd", "---", "uDd"},
+		{"down in a window is sent when it closes", "uddd", "-xx-", "uddD"},
+		{"back up before the window closes sends nothing", "uduu", "-xx-", "uduu"},
+		{"up in a window after a down alert", "uduu", "--x-", "uDuU"},
+		{"still in the window sends nothing", "udddd", "-xxxx", "udddd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := make(alerts, len(tt.steps))
+			w := new(window)
+			c := NewChecker(nil, nil, notify.New(sent), w, Options{
+				Timeout:   200 * time.Millisecond,
+				Dampening: 1,
+			})
+			server := &inventory.Server{
+				ID:       "1",
+				Hostname: "web1",
+				Check:    inventory.Check{Type: inventory.TCP, Target: addr},
+			}
+			st := &Status{ServerID: server.ID}
+
+			stop := func() {}
+			for i, step := range tt.steps {
+				stop()
+				stop = func() {}
+				if step == 'u' {
+					stop = listen(t, addr)
+				}
+				w.open = tt.held[i] == 'x'
+
+				res := Probe(context.Background(), server.Check, c.opts.Timeout)
+				res.ServerID = server.ID
+				c.update(context.Background(), server, st, res)
+
+				want := string(tt.want[i])
+				state := strings.ToLower(want)
+				if st.State[:1] != state {
+					t.Fatalf("round %d: state %s, want %s", i+1, st.State, state)
+				}
+
+				alert := sent.next()
+				if want != state {
+					if alert == nil {
+						t.Fatalf("round %d: no alert", i+1)
+					}
+					if alert.Kind != st.State || !alert.Time.Equal(st.Since) {
+						t.Errorf("round %d: alert %+v for status %+v", i+1, alert, st)
+					}
+				} else if alert != nil {
+					t.Fatalf("round %d: unexpected alert %+v", i+1, alert)
+				}
+			}
+			stop()
+		})
+	}
+}
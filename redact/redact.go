@@ -0,0 +1,300 @@
+// Package redact masks sensitive data before it reaches audit records, log
+// output and error pages.
+package redact
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultMask replaces anything that is redacted.
+const DefaultMask = "[REDACTED]"
+
+// DefaultFields are session value keys that are always masked unless the
+// policy is built with its own list.
+var DefaultFields = []string{
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"key",
+}
+
+// DefaultPatterns mask LDAP distinguished names and the Active Directory
+// diagnostic text that tells an attacker why a bind failed, and the
+// session IDs logged by mongostore.
+var DefaultPatterns = []string{
+	`(?i)\b(?:cn|ou|dc|uid)=[^,\s"]+`,
+	`(?i)LdapErr: DSID-[^,]*(?:, comment: [^,]*)?(?:, data [0-9a-f]+)?(?:, v[0-9a-f]+)?`,
+	`session\.ID: ([0-9a-f]{24})`,
+}
+
+// DefaultSessionIDFields are session value keys that hold the session ID.
+var DefaultSessionIDFields = []string{
+	"_id",
+}
+
+// Policy lists what to redact and how.
+type Policy struct {
+	// Fields are session value keys, compared without case, whose values
+	// are replaced by Mask.
+	Fields []string
+	// Patterns are masked wherever they match. If a pattern has capture
+	// groups only the groups are masked so the surrounding text stays
+	// readable.
+	Patterns []*regexp.Regexp
+	// Mask replaces redacted values.
+	Mask string
+	// SessionIDFields are session value keys holding the session ID.
+	SessionIDFields []string
+	// HashKey records session IDs as a keyed hash instead of the raw value
+	// so entries for one session can still be correlated. New always sets
+	// one, a Policy built without it masks session IDs.
+	HashKey []byte
+}
+
+// New builds a Policy. nil fields or patterns select the defaults, an
+// empty mask selects DefaultMask. An empty hashKey selects a random key,
+// session IDs hashed with it correlate until the process exits but not
+// across restarts or instances.
+func New(fields []string, patterns []string, mask string, hashKey []byte) (*Policy, error) {
+	if fields == nil {
+		fields = DefaultFields
+	}
+	if patterns == nil {
+		patterns = DefaultPatterns
+	}
+	if mask == "" {
+		mask = DefaultMask
+	}
+	if len(hashKey) == 0 {
+		hashKey = make([]byte, 32)
+		_, err := rand.Read(hashKey)
+		if err != nil {
+			return nil, fmt.Errorf("redact session id key: %v", err)
+		}
+	}
+
+	p := &Policy{
+		Mask:            mask,
+		SessionIDFields: DefaultSessionIDFields,
+		HashKey:         hashKey,
+	}
+
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			p.Fields = append(p.Fields, strings.ToLower(field))
+		}
+	}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %v", pattern, err)
+		}
+		p.Patterns = append(p.Patterns, re)
+	}
+
+	return p, nil
+}
+
+// ReadPatterns reads one regular expression per line from a file, blank
+// lines and lines starting with # are skipped.
+func ReadPatterns(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// String masks every pattern match in s.
+func (p *Policy) String(s string) string {
+	for _, re := range p.Patterns {
+		if re.NumSubexp() == 0 {
+			s = re.ReplaceAllLiteralString(s, p.Mask)
+			continue
+		}
+		s = maskGroups(re, s, p.Mask)
+	}
+	return s
+}
+
+// maskGroups replaces only the capture groups of each match.
+func maskGroups(re *regexp.Regexp, s string, mask string) string {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		for g := 1; g < len(m)/2; g++ {
+			start, end := m[2*g], m[2*g+1]
+			if start < last || start < 0 {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(mask)
+			last = end
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Error returns the masked error message, or an empty string for nil.
+func (p *Policy) Error(err error) string {
+	if err == nil {
+		return ""
+	}
+	return p.String(err.Error())
+}
+
+// SessionID returns a keyed hash of id, or Mask when no HashKey is set. An
+// empty id is returned as it is.
+func (p *Policy) SessionID(id string) string {
+	if id == "" {
+		return id
+	}
+	if len(p.HashKey) == 0 {
+		return p.Mask
+	}
+	mac := hmac.New(sha256.New, p.HashKey)
+	mac.Write([]byte(id))
+	return "h:" + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Values formats session values the way fmt prints a map, with sensitive
+// fields masked, session IDs hashed and patterns applied to the rest.
+func (p *Policy) Values(values map[interface{}]interface{}) string {
+	keys := make([]string, 0, len(values))
+	byKey := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key := fmt.Sprintf("%v", k)
+		keys = append(keys, key)
+		byKey[key] = v
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("map[")
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(key)
+		b.WriteString(":")
+
+		switch {
+		case contains(p.Fields, strings.ToLower(key)):
+			b.WriteString(p.Mask)
+		case contains(p.SessionIDFields, key):
+			b.WriteString(p.SessionID(fmt.Sprintf("%v", byKey[key])))
+		default:
+			b.WriteString(p.String(fmt.Sprintf("%v", byKey[key])))
+		}
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer returns an io.Writer that applies the policy to everything
+// written before passing it on to w. It is meant for log.SetOutput, the
+// log package writes one line per call so patterns never straddle calls.
+func (p *Policy) Writer(w io.Writer) io.Writer {
+	return &writer{policy: p, out: w}
+}
+
+type writer struct {
+	policy *Policy
+	out    io.Writer
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	_, err := io.WriteString(w.out, w.policy.String(string(b)))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+var (
+	mu  sync.RWMutex
+	std = mustDefault()
+)
+
+func mustDefault() *Policy {
+	p, err := New(nil, nil, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// SetDefault replaces the policy used by the package level functions.
+func SetDefault(p *Policy) {
+	mu.Lock()
+	std = p
+	mu.Unlock()
+}
+
+// Default returns the policy used by the package level functions.
+func Default() *Policy {
+	mu.RLock()
+	defer mu.RUnlock()
+	return std
+}
+
+// String masks s with the default policy.
+func String(s string) string {
+	return Default().String(s)
+}
+
+// Error masks an error message with the default policy.
+func Error(err error) string {
+	return Default().Error(err)
+}
+
+// SessionID hashes a session ID with the default policy.
+func SessionID(id string) string {
+	return Default().SessionID(id)
+}
+
+// Values formats session values with the default policy.
+func Values(values map[interface{}]interface{}) string {
+	return Default().Values(values)
+}
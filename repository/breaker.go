@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// Breaker states.
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half-open"
+)
+
+// errUnavailable is returned without calling the backend while the breaker
+// is open.
+var errUnavailable = status.Error(codes.Unavailable, "the grpc backend is unavailable, calls are failing fast")
+
+// Breaker stops calls to a backend that keeps failing. After Threshold
+// failures in a row it opens and calls fail at once, after Cooldown one
+// call is let through and closes it again if it succeeds.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	failures    uint64
+	openedAt    time.Time
+	probing     bool
+	lastErr     string
+	lastErrAt   time.Time
+}
+
+// NewBreaker returns a closed Breaker.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     Closed,
+	}
+}
+
+// Allow reports whether a call may be made.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = HalfOpen
+		b.probing = true
+		return true
+	case HalfOpen:
+		// one call at a time finds out if the backend is back
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Blocked reports whether calls fail fast, the breaker is open and its
+// cooldown has not passed.
+func (b *Breaker) Blocked() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == Open && time.Since(b.openedAt) < b.cooldown
+}
+
+// Record records the result of an allowed call made with ctx. Only errors
+// that say the backend could not be reached count as failures, a not found
+// or invalid argument is the backend working.
+func (b *Breaker) Record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if !Unreachable(err) {
+		b.consecutive = 0
+		if b.state != Closed {
+			logging.Info(ctx, "the grpc backend is available again")
+			b.state = Closed
+		}
+		return
+	}
+
+	b.consecutive++
+	b.failures++
+	b.lastErr = err.Error()
+	b.lastErrAt = time.Now()
+
+	if b.state == HalfOpen || (b.state == Closed && b.consecutive >= b.threshold) {
+		logging.Warn(ctx, "the grpc backend keeps failing, failing fast", "failures", b.consecutive, "cooldown", b.cooldown)
+		b.state = Open
+		b.openedAt = time.Now()
+	}
+}
+
+// Release ends an allowed call without a result, such as when the caller
+// gave up on it. A half-open breaker lets the next call probe the backend.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Unreachable reports whether err means the backend could not be reached,
+// or the call failed fast while it can not be.
+func Unreachable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// State returns Closed, Open or HalfOpen.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Failures returns the number of failed calls since the breaker was made.
+func (b *Breaker) Failures() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
+
+// BreakerStatus is a snapshot of a Breaker.
+type BreakerStatus struct {
+	State       string
+	Consecutive int
+	Failures    uint64
+	OpenedAt    time.Time
+	// RetryAt is when an open breaker lets a call through again.
+	RetryAt     time.Time
+	LastError   string
+	LastErrorAt time.Time
+}
+
+// Status returns a snapshot of the breaker.
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{
+		State:       b.state,
+		Consecutive: b.consecutive,
+		Failures:    b.failures,
+		OpenedAt:    b.openedAt,
+		LastError:   b.lastErr,
+		LastErrorAt: b.lastErrAt,
+	}
+	if b.state == Open {
+		st.RetryAt = b.openedAt.Add(b.cooldown)
+	}
+	return st
+}
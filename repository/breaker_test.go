@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBreakerRelease(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond)
+	b.Record(context.Background(), status.Error(codes.Unavailable, "down"))
+	if b.State() != Open {
+		t.Fatalf("state %s after a failure, want %s", b.State(), Open)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("the probe was not allowed after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("a second call was allowed while probing")
+	}
+
+	// the caller gave up on the probe, the breaker stays half-open and
+	// the next call probes instead
+	b.Release()
+	if b.State() != HalfOpen {
+		t.Errorf("state %s after a released probe, want %s", b.State(), HalfOpen)
+	}
+	if !b.Allow() {
+		t.Fatal("the next probe was not allowed after a release")
+	}
+
+	b.Record(context.Background(), nil)
+	if b.State() != Closed {
+		t.Errorf("state %s after a successful probe, want %s", b.State(), Closed)
+	}
+}
+
+func TestBreakerOpens(t *testing.T) {
+	ctx := context.Background()
+	down := status.Error(codes.Unavailable, "down")
+
+	b := NewBreaker(3, time.Hour)
+	b.Record(ctx, down)
+	b.Record(ctx, down)
+	if b.State() != Closed {
+		t.Fatalf("state %s after 2 failures, want %s", b.State(), Closed)
+	}
+
+	// an answer from the backend, even an error, resets the count
+	b.Record(ctx, status.Error(codes.NotFound, "no such user"))
+	b.Record(ctx, down)
+	b.Record(ctx, down)
+	if b.State() != Closed {
+		t.Fatalf("state %s after a reset and 2 failures, want %s", b.State(), Closed)
+	}
+
+	b.Record(ctx, status.Error(codes.DeadlineExceeded, "slow"))
+	if b.State() != Open {
+		t.Fatalf("state %s after 3 failures, want %s", b.State(), Open)
+	}
+	if b.Allow() {
+		t.Error("a call was allowed while open")
+	}
+	if !b.Blocked() {
+		t.Error("not blocked while open")
+	}
+
+	st := b.Status()
+	if st.Failures != 5 || st.Consecutive != 3 || st.LastError != status.Error(codes.DeadlineExceeded, "slow").Error() {
+		t.Errorf("status %+v, want 5 failures, 3 in a row and the last error", st)
+	}
+	if !st.RetryAt.Equal(st.OpenedAt.Add(time.Hour)) {
+		t.Errorf("retry at %v, want the cooldown after %v", st.RetryAt, st.OpenedAt)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	ctx := context.Background()
+	down := status.Error(codes.Unavailable, "down")
+
+	b := NewBreaker(1, time.Millisecond)
+	b.Record(ctx, down)
+	if !b.Blocked() {
+		t.Fatal("not blocked after opening")
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// once the cooldown passed calls are no longer failed fast, one probes
+	if b.Blocked() {
+		t.Error("blocked after the cooldown")
+	}
+	if !b.Allow() {
+		t.Fatal("the probe was not allowed after the cooldown")
+	}
+	if b.State() != HalfOpen {
+		t.Fatalf("state %s while probing, want %s", b.State(), HalfOpen)
+	}
+
+	// a failed probe opens it again for another cooldown
+	b.Record(ctx, down)
+	if b.State() != Open || !b.Blocked() {
+		t.Fatalf("state %s after a failed probe, want %s and blocked", b.State(), Open)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("the second probe was not allowed")
+	}
+	b.Record(ctx, nil)
+	if b.State() != Closed || b.Blocked() {
+		t.Errorf("state %s after a successful probe, want %s", b.State(), Closed)
+	}
+	if st := b.Status(); st.Consecutive != 0 || !st.RetryAt.IsZero() {
+		t.Errorf("status %+v, want no failures in a row and no retry time", st)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"unavailable", status.Error(codes.Unavailable, "down"), true},
+		{"deadline", status.Error(codes.DeadlineExceeded, "slow"), true},
+		{"failing fast", errUnavailable, true},
+		{"not found", status.Error(codes.NotFound, "no such user"), false},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad id"), false},
+		{"cancelled", status.Error(codes.Canceled, "gone"), false},
+		{"not a status", errors.New("mongo: no documents in result"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unreachable(tt.err); got != tt.want {
+				t.Errorf("Unreachable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
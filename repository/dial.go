@@ -0,0 +1,248 @@
+package repository
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/metrics"
+)
+
+// GRPCOptions are how the go-stuff/grpc service is reached.
+type GRPCOptions struct {
+	Addr string
+	// TLS turns on tls, the server is verified against the system roots
+	// or CAFile. CertFile and KeyFile are the client certificate of
+	// mutual tls, ServerName overrides the name verified.
+	TLS        bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// Timeout is the deadline of each call.
+	Timeout time.Duration
+	// Attempts is how many times a call is tried while the backend can not
+	// be reached, waiting Backoff doubled up to MaxBackoff in between.
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// DialTimeout is how long Dial waits for the backend to answer.
+	DialTimeout time.Duration
+	// BreakerThreshold failures in a row open the breaker for
+	// BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Metrics is the registry the calls are counted and timed in, they
+	// are not served when it is nil.
+	Metrics *metrics.Registry
+}
+
+// DefaultGRPCOptions reach the service on 127.0.0.1:6000 without tls.
+var DefaultGRPCOptions = GRPCOptions{
+	Addr:             "127.0.0.1:6000",
+	Timeout:          10 * time.Second,
+	Attempts:         3,
+	Backoff:          100 * time.Millisecond,
+	MaxBackoff:       2 * time.Second,
+	DialTimeout:      10 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// GRPCConn is a connection to the go-stuff/grpc service whose calls have a
+// deadline, are retried and go through a Breaker.
+type GRPCConn struct {
+	*grpc.ClientConn
+	Breaker *Breaker
+	opts    GRPCOptions
+
+	calls    *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+// GRPCStatus is the state of a GRPCConn.
+type GRPCStatus struct {
+	Addr       string
+	TLS        bool
+	Connection string
+	Breaker    BreakerStatus
+}
+
+// DialGRPC connects to the service and checks it answers, failing within
+// DialTimeout with an error saying why when it does not.
+func DialGRPC(opts GRPCOptions) (*GRPCConn, error) {
+	creds, err := grpcCredentials(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &GRPCConn{
+		Breaker: NewBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+		opts:    opts,
+	}
+
+	// an unserved registry keeps the counts when no registry is given
+	registry := opts.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+	c.calls = registry.NewCounterVec("web_grpc_client_calls_total",
+		"Calls to the grpc backend by method and status code.", "method", "code")
+	c.duration = registry.NewHistogramVec("web_grpc_client_call_duration_seconds",
+		"How long calls to the grpc backend took by method, retries included.", metrics.DefaultBuckets, "method")
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.DialTimeout)
+	defer cancel()
+
+	c.ClientConn, err = grpc.DialContext(ctx, opts.Addr,
+		creds,
+		grpc.WithBlock(),
+		// a tls handshake that fails is reported instead of waiting for
+		// DialTimeout
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithUnaryInterceptor(c.intercept),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("can not reach the grpc backend at %s within %s, check it is running and GRPC_ADDR and the GRPC_TLS settings: %v", opts.Addr, opts.DialTimeout, err)
+	}
+
+	err = c.Check(ctx)
+	if err != nil {
+		c.ClientConn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Check asks the service whether it is serving with the standard health
+// check. The service may not serve it, then the answer that it does not
+// is all there is to go on.
+func (c *GRPCConn) Check(ctx context.Context) error {
+	res, err := grpc_health_v1.NewHealthClient(c.ClientConn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err == nil && res.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		err = fmt.Errorf("it is %s", res.Status)
+	}
+	if err != nil {
+		return fmt.Errorf("the grpc backend at %s is not healthy: %v", c.opts.Addr, err)
+	}
+	return nil
+}
+
+func grpcCredentials(opts GRPCOptions) (grpc.DialOption, error) {
+	if !opts.TLS {
+		return grpc.WithInsecure(), nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
+	}
+
+	// trust a private ca if one is given, otherwise use the system roots
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("GRPC_CA_FILE contains no certificates")
+		}
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+// RequestIDMetadata is the metadata key the request id of a call is sent
+// in, so the backend can log it with the call.
+const RequestIDMetadata = "x-request-id"
+
+// intercept gives each call its deadline and the request id of its
+// context, retries it while the backend can not be reached and records the
+// result in the breaker.
+func (c *GRPCConn) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if !c.Breaker.Allow() {
+		c.calls.Inc(method, codes.Unavailable.String())
+		logging.Debug(ctx, "grpc call failed fast", "method", method)
+		return errUnavailable
+	}
+
+	if id := logging.RequestID(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, RequestIDMetadata, id)
+	}
+
+	start := time.Now()
+
+	backoff := c.opts.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+		err = invoker(callCtx, method, req, reply, cc, opts...)
+		cancel()
+
+		// only calls that never reached the backend are tried again, a
+		// deadline may have passed after it made a change
+		if status.Code(err) != codes.Unavailable || attempt >= c.opts.Attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+
+	// a caller that was cancelled or ran out of time says nothing about the
+	// backend, the call is neither a failure nor a successful probe
+	if err != nil && ctx.Err() != nil {
+		c.Breaker.Release()
+	} else {
+		c.Breaker.Record(ctx, err)
+	}
+	c.calls.Inc(method, status.Code(err).String())
+	c.duration.Observe(time.Since(start).Seconds(), method)
+	logging.Debug(ctx, "grpc call", "method", method, "code", status.Code(err), "duration", time.Since(start))
+	return err
+}
+
+// Status returns the state of the connection and its breaker.
+func (c *GRPCConn) Status() GRPCStatus {
+	return GRPCStatus{
+		Addr:       c.opts.Addr,
+		TLS:        c.opts.TLS,
+		Connection: c.ClientConn.GetState().String(),
+		Breaker:    c.Breaker.Status(),
+	}
+}
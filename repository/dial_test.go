@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/logging"
+	"github.com/go-stuff/web/metrics"
+)
+
+// testConn returns a GRPCConn that tries each call up to 3 times and opens
+// its breaker after threshold failures.
+func testConn(threshold int) *GRPCConn {
+	registry := metrics.NewRegistry()
+	return &GRPCConn{
+		Breaker: NewBreaker(threshold, time.Hour),
+		opts: GRPCOptions{
+			Timeout:    time.Second,
+			Attempts:   3,
+			Backoff:    time.Millisecond,
+			MaxBackoff: 2 * time.Millisecond,
+		},
+		calls:    registry.NewCounterVec("calls", "", "method", "code"),
+		duration: registry.NewHistogramVec("duration", "", metrics.DefaultBuckets, "method"),
+	}
+}
+
+// invoker answers each call with the next error of errs, the last one
+// once they run out, and counts the calls.
+func invoker(calls *int, errs ...error) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+		return errs[len(errs)-1]
+	}
+}
+
+func TestInterceptRetries(t *testing.T) {
+	down := status.Error(codes.Unavailable, "down")
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantCode  codes.Code
+	}{
+		{"success", []error{nil}, 1, codes.OK},
+		{"unavailable then success", []error{down, nil}, 2, codes.OK},
+		{"unavailable every time", []error{down}, 3, codes.Unavailable},
+		{"not found", []error{status.Error(codes.NotFound, "no such user")}, 1, codes.NotFound},
+		{"invalid argument", []error{status.Error(codes.InvalidArgument, "bad id")}, 1, codes.InvalidArgument},
+		// the backend may have made the change before the deadline passed
+		{"deadline exceeded", []error{status.Error(codes.DeadlineExceeded, "slow")}, 1, codes.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConn(5)
+			var calls int
+			err := c.intercept(context.Background(), "/api.UserService/List", nil, nil, nil, invoker(&calls, tt.errs...))
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("code %s, want %s", status.Code(err), tt.wantCode)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestInterceptCancelled(t *testing.T) {
+	c := testConn(1)
+	c.opts.Backoff = time.Hour
+	c.opts.MaxBackoff = time.Hour
+
+	// the caller gives up while the call waits to be tried again
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	down := status.Error(codes.Unavailable, "down")
+	invoke := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		calls++
+		cancel()
+		return down
+	}
+
+	err := c.intercept(ctx, "/api.UserService/List", nil, nil, nil, invoke)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("code %s, want %s", status.Code(err), codes.Unavailable)
+	}
+	if calls != 1 {
+		t.Errorf("%d calls, want no retry after the caller was cancelled", calls)
+	}
+
+	// a threshold of one would have opened it had the call counted
+	if c.Breaker.State() != Closed {
+		t.Errorf("state %s after a cancelled call, want %s", c.Breaker.State(), Closed)
+	}
+}
+
+func TestInterceptBreaker(t *testing.T) {
+	c := testConn(2)
+	down := status.Error(codes.Unavailable, "down")
+
+	// each call that can not reach the backend after its retries is one
+	// failure
+	for i := 0; i < 2; i++ {
+		var calls int
+		c.intercept(context.Background(), "/api.UserService/List", nil, nil, nil, invoker(&calls, down))
+	}
+	if c.Breaker.State() != Open {
+		t.Fatalf("state %s after 2 failed calls, want %s", c.Breaker.State(), Open)
+	}
+
+	// open, calls fail fast without reaching the backend
+	var calls int
+	err := c.intercept(context.Background(), "/api.UserService/List", nil, nil, nil, invoker(&calls, nil))
+	if calls != 0 {
+		t.Errorf("%d calls while open, want 0", calls)
+	}
+	if err != errUnavailable || !Unreachable(err) {
+		t.Errorf("err = %v, want the fail fast error", err)
+	}
+	if !c.Breaker.Blocked() {
+		t.Error("not blocked while open")
+	}
+}
+
+func TestInterceptRequestID(t *testing.T) {
+	c := testConn(5)
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+
+	var got []string
+	invoke := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		got = md.Get(RequestIDMetadata)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("the call has no deadline")
+		}
+		return nil
+	}
+
+	err := c.intercept(ctx, "/api.UserService/List", nil, nil, nil, invoke)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "req-1" {
+		t.Errorf("request id metadata %q, want req-1", got)
+	}
+}
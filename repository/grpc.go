@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/go-stuff/grpc/api"
+	"google.golang.org/grpc"
+
+	"github.com/go-stuff/web/sessionstore"
+)
+
+// NewGRPC returns repositories served by the go-stuff/grpc service on
+// conn. Sessions are listed from sessions, the session store, which may
+// be nil.
+func NewGRPC(conn *grpc.ClientConn, sessions sessionstore.Store) *Repositories {
+	return &Repositories{
+		Users:  &grpcUsers{api.NewUserServiceClient(conn)},
+		Roles:  &grpcRoles{api.NewRoleServiceClient(conn)},
+		Routes: &grpcRoutes{api.NewRouteServiceClient(conn)},
+		Audits: &grpcAudits{api.NewAuditServiceClient(conn)},
+		// listed from the store that revokes them, not the service, so
+		// both see the same sessions whichever store is configured
+		Sessions: newSessions(sessions),
+	}
+}
+
+type grpcUsers struct {
+	c api.UserServiceClient
+}
+
+func (u *grpcUsers) List(ctx context.Context, req *api.UserListReq) (*api.UserListRes, error) {
+	return u.c.List(ctx, req)
+}
+
+func (u *grpcUsers) Create(ctx context.Context, req *api.UserCreateReq) (*api.UserCreateRes, error) {
+	return u.c.Create(ctx, req)
+}
+
+func (u *grpcUsers) Read(ctx context.Context, req *api.UserReadReq) (*api.UserReadRes, error) {
+	return u.c.Read(ctx, req)
+}
+
+func (u *grpcUsers) ReadByUsername(ctx context.Context, req *api.UserReadByUsernameReq) (*api.UserReadByUsernameRes, error) {
+	return u.c.ReadByUsername(ctx, req)
+}
+
+func (u *grpcUsers) Update(ctx context.Context, req *api.UserUpdateReq) (*api.UserUpdateRes, error) {
+	return u.c.Update(ctx, req)
+}
+
+func (u *grpcUsers) Delete(ctx context.Context, req *api.UserDeleteReq) (*api.UserDeleteRes, error) {
+	return u.c.Delete(ctx, req)
+}
+
+type grpcRoles struct {
+	c api.RoleServiceClient
+}
+
+func (r *grpcRoles) List(ctx context.Context, req *api.RoleListReq) (*api.RoleListRes, error) {
+	return r.c.List(ctx, req)
+}
+
+func (r *grpcRoles) Create(ctx context.Context, req *api.RoleCreateReq) (*api.RoleCreateRes, error) {
+	return r.c.Create(ctx, req)
+}
+
+func (r *grpcRoles) Read(ctx context.Context, req *api.RoleReadReq) (*api.RoleReadRes, error) {
+	return r.c.Read(ctx, req)
+}
+
+func (r *grpcRoles) ReadByName(ctx context.Context, req *api.RoleReadByNameReq) (*api.RoleReadByNameRes, error) {
+	return r.c.ReadByName(ctx, req)
+}
+
+func (r *grpcRoles) Update(ctx context.Context, req *api.RoleUpdateReq) (*api.RoleUpdateRes, error) {
+	return r.c.Update(ctx, req)
+}
+
+func (r *grpcRoles) Delete(ctx context.Context, req *api.RoleDeleteReq) (*api.RoleDeleteRes, error) {
+	return r.c.Delete(ctx, req)
+}
+
+type grpcRoutes struct {
+	c api.RouteServiceClient
+}
+
+func (r *grpcRoutes) List(ctx context.Context, req *api.RouteListReq) (*api.RouteListRes, error) {
+	return r.c.List(ctx, req)
+}
+
+func (r *grpcRoutes) ListByRoleID(ctx context.Context, req *api.RouteListByRoleIDReq) (*api.RouteListByRoleIDRes, error) {
+	return r.c.ListByRoleID(ctx, req)
+}
+
+func (r *grpcRoutes) Create(ctx context.Context, req *api.RouteCreateReq) (*api.RouteCreateRes, error) {
+	return r.c.Create(ctx, req)
+}
+
+func (r *grpcRoutes) Read(ctx context.Context, req *api.RouteReadReq) (*api.RouteReadRes, error) {
+	return r.c.Read(ctx, req)
+}
+
+func (r *grpcRoutes) ReadByRoleIDAndPath(ctx context.Context, req *api.RouteReadByRoleIDAndPathReq) (*api.RouteReadByRoleIDAndPathRes, error) {
+	return r.c.ReadByRoleIDAndPath(ctx, req)
+}
+
+func (r *grpcRoutes) UpdateByRoleIDAndPath(ctx context.Context, req *api.RouteUpdateByRoleIDAndPathReq) (*api.RouteUpdateByRoleIDAndPathRes, error) {
+	return r.c.UpdateByRoleIDAndPath(ctx, req)
+}
+
+func (r *grpcRoutes) Delete(ctx context.Context, req *api.RouteDeleteReq) (*api.RouteDeleteRes, error) {
+	return r.c.Delete(ctx, req)
+}
+
+type grpcAudits struct {
+	c api.AuditServiceClient
+}
+
+func (a *grpcAudits) List(ctx context.Context, req *api.AuditListReq) (*api.AuditListRes, error) {
+	return a.c.List(ctx, req)
+}
+
+func (a *grpcAudits) List100(ctx context.Context, req *api.AuditList100Req) (*api.AuditList100Res, error) {
+	return a.c.List100(ctx, req)
+}
+
+func (a *grpcAudits) Create(ctx context.Context, req *api.AuditCreateReq) (*api.AuditCreateRes, error) {
+	return a.c.Create(ctx, req)
+}
+
+func (a *grpcAudits) Read(ctx context.Context, req *api.AuditReadReq) (*api.AuditReadRes, error) {
+	return a.c.Read(ctx, req)
+}
@@ -0,0 +1,407 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/go-stuff/grpc/api"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/sessionstore"
+)
+
+// NewMemory returns empty repositories kept in process memory. Everything
+// is lost on restart and not shared between instances, it is meant for
+// demos and tests. The repositories hand out copies, a caller changing
+// what it was given does not change what is kept. Sessions are listed from
+// sessions, the session store, which may be nil.
+func NewMemory(sessions sessionstore.Store) *Repositories {
+	return &Repositories{
+		Users:    &memoryUsers{users: make(map[string]*api.User)},
+		Roles:    &memoryRoles{roles: make(map[string]*api.Role)},
+		Routes:   &memoryRoutes{routes: make(map[string]*api.Route)},
+		Audits:   &memoryAudits{ids: make(map[string]bool)},
+		Sessions: newSessions(sessions),
+	}
+}
+
+type memoryUsers struct {
+	mu    sync.Mutex
+	users map[string]*api.User
+}
+
+func (u *memoryUsers) List(ctx context.Context, req *api.UserListReq) (*api.UserListRes, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	res := new(api.UserListRes)
+	for _, user := range u.users {
+		res.Users = append(res.Users, proto.Clone(user).(*api.User))
+	}
+	sort.Slice(res.Users, func(i, j int) bool {
+		return res.Users[i].Username < res.Users[j].Username
+	})
+	return res, nil
+}
+
+func (u *memoryUsers) Create(ctx context.Context, req *api.UserCreateReq) (*api.UserCreateRes, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	user := &api.User{
+		ID:         primitive.NewObjectID().Hex(),
+		Username:   req.Username,
+		Groups:     append([]string(nil), req.Groups...),
+		RoleID:     req.RoleID,
+		CreatedBy:  req.CreatedBy,
+		CreatedAt:  ptypes.TimestampNow(),
+		ModifiedBy: req.CreatedBy,
+		ModifiedAt: ptypes.TimestampNow(),
+	}
+	u.users[user.ID] = user
+
+	return &api.UserCreateRes{ID: user.ID}, nil
+}
+
+func (u *memoryUsers) Read(ctx context.Context, req *api.UserReadReq) (*api.UserReadRes, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	res := &api.UserReadRes{User: new(api.User)}
+	if user, ok := u.users[req.ID]; ok {
+		res.User = proto.Clone(user).(*api.User)
+	}
+	return res, nil
+}
+
+func (u *memoryUsers) ReadByUsername(ctx context.Context, req *api.UserReadByUsernameReq) (*api.UserReadByUsernameRes, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	res := &api.UserReadByUsernameRes{User: new(api.User)}
+	for _, user := range u.users {
+		if user.Username == req.Username {
+			res.User = proto.Clone(user).(*api.User)
+			break
+		}
+	}
+	return res, nil
+}
+
+func (u *memoryUsers) Update(ctx context.Context, req *api.UserUpdateReq) (*api.UserUpdateRes, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	user, ok := u.users[req.ID]
+	if !ok {
+		return &api.UserUpdateRes{}, nil
+	}
+	user.Groups = append([]string(nil), req.Groups...)
+	user.RoleID = req.RoleID
+	user.ModifiedBy = req.ModifiedBy
+	user.ModifiedAt = ptypes.TimestampNow()
+
+	return &api.UserUpdateRes{Updated: 1}, nil
+}
+
+func (u *memoryUsers) Delete(ctx context.Context, req *api.UserDeleteReq) (*api.UserDeleteRes, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	res := new(api.UserDeleteRes)
+	if _, ok := u.users[req.ID]; ok {
+		delete(u.users, req.ID)
+		res.Deleted = 1
+	}
+	return res, nil
+}
+
+type memoryRoles struct {
+	mu    sync.Mutex
+	roles map[string]*api.Role
+}
+
+func (r *memoryRoles) List(ctx context.Context, req *api.RoleListReq) (*api.RoleListRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := new(api.RoleListRes)
+	for _, role := range r.roles {
+		res.Roles = append(res.Roles, proto.Clone(role).(*api.Role))
+	}
+	sort.Slice(res.Roles, func(i, j int) bool {
+		return res.Roles[i].Name < res.Roles[j].Name
+	})
+	return res, nil
+}
+
+func (r *memoryRoles) Create(ctx context.Context, req *api.RoleCreateReq) (*api.RoleCreateRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	role := &api.Role{
+		ID:          primitive.NewObjectID().Hex(),
+		Name:        req.Name,
+		Description: req.Description,
+		Group:       req.Group,
+		CreatedBy:   req.CreatedBy,
+		CreatedAt:   ptypes.TimestampNow(),
+		ModifiedBy:  req.CreatedBy,
+		ModifiedAt:  ptypes.TimestampNow(),
+	}
+	r.roles[role.ID] = role
+
+	return &api.RoleCreateRes{ID: role.ID}, nil
+}
+
+func (r *memoryRoles) Read(ctx context.Context, req *api.RoleReadReq) (*api.RoleReadRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := &api.RoleReadRes{Role: new(api.Role)}
+	if role, ok := r.roles[req.ID]; ok {
+		res.Role = proto.Clone(role).(*api.Role)
+	}
+	return res, nil
+}
+
+func (r *memoryRoles) ReadByName(ctx context.Context, req *api.RoleReadByNameReq) (*api.RoleReadByNameRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := &api.RoleReadByNameRes{Role: new(api.Role)}
+	for _, role := range r.roles {
+		if role.Name == req.Name {
+			res.Role = proto.Clone(role).(*api.Role)
+			break
+		}
+	}
+	return res, nil
+}
+
+func (r *memoryRoles) Update(ctx context.Context, req *api.RoleUpdateReq) (*api.RoleUpdateRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	role, ok := r.roles[req.ID]
+	if !ok {
+		return &api.RoleUpdateRes{}, nil
+	}
+	role.Name = req.Name
+	role.Description = req.Description
+	role.Group = req.Group
+	role.ModifiedBy = req.ModifiedBy
+	role.ModifiedAt = ptypes.TimestampNow()
+
+	return &api.RoleUpdateRes{Updated: 1}, nil
+}
+
+func (r *memoryRoles) Delete(ctx context.Context, req *api.RoleDeleteReq) (*api.RoleDeleteRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := new(api.RoleDeleteRes)
+	if _, ok := r.roles[req.ID]; ok {
+		delete(r.roles, req.ID)
+		res.Deleted = 1
+	}
+	return res, nil
+}
+
+type memoryRoutes struct {
+	mu     sync.Mutex
+	routes map[string]*api.Route
+}
+
+// list returns copies of the routes keep returns true for, sorted by
+// path, the caller holds the lock.
+func (r *memoryRoutes) list(keep func(*api.Route) bool) []*api.Route {
+	var routes []*api.Route
+	for _, route := range r.routes {
+		if keep(route) {
+			routes = append(routes, proto.Clone(route).(*api.Route))
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].ID < routes[j].ID
+	})
+	return routes
+}
+
+// find returns the route of a role on a path, the caller holds the lock.
+func (r *memoryRoutes) find(roleID, path string) *api.Route {
+	for _, route := range r.routes {
+		if route.RoleID == roleID && route.Path == path {
+			return route
+		}
+	}
+	return nil
+}
+
+func (r *memoryRoutes) List(ctx context.Context, req *api.RouteListReq) (*api.RouteListRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &api.RouteListRes{Routes: r.list(func(*api.Route) bool { return true })}, nil
+}
+
+func (r *memoryRoutes) ListByRoleID(ctx context.Context, req *api.RouteListByRoleIDReq) (*api.RouteListByRoleIDRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &api.RouteListByRoleIDRes{Routes: r.list(func(route *api.Route) bool {
+		return route.RoleID == req.RoleID
+	})}, nil
+}
+
+func (r *memoryRoutes) Create(ctx context.Context, req *api.RouteCreateReq) (*api.RouteCreateRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	route := &api.Route{
+		ID:         primitive.NewObjectID().Hex(),
+		RoleID:     req.RoleID,
+		Path:       req.Path,
+		Permission: req.Permission,
+		CreatedBy:  req.CreatedBy,
+		CreatedAt:  ptypes.TimestampNow(),
+		ModifiedBy: req.CreatedBy,
+		ModifiedAt: ptypes.TimestampNow(),
+	}
+	r.routes[route.ID] = route
+
+	return &api.RouteCreateRes{ID: route.ID}, nil
+}
+
+func (r *memoryRoutes) Read(ctx context.Context, req *api.RouteReadReq) (*api.RouteReadRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := &api.RouteReadRes{Route: new(api.Route)}
+	if route, ok := r.routes[req.ID]; ok {
+		res.Route = proto.Clone(route).(*api.Route)
+	}
+	return res, nil
+}
+
+func (r *memoryRoutes) ReadByRoleIDAndPath(ctx context.Context, req *api.RouteReadByRoleIDAndPathReq) (*api.RouteReadByRoleIDAndPathRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := &api.RouteReadByRoleIDAndPathRes{Route: new(api.Route)}
+	if route := r.find(req.Route.RoleID, req.Route.Path); route != nil {
+		res.Route = proto.Clone(route).(*api.Route)
+	}
+	return res, nil
+}
+
+// UpdateByRoleIDAndPath sets the permission of a role on a path, adding
+// the route when the role has none for the path yet.
+func (r *memoryRoutes) UpdateByRoleIDAndPath(ctx context.Context, req *api.RouteUpdateByRoleIDAndPathReq) (*api.RouteUpdateByRoleIDAndPathRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	route := r.find(req.RoleID, req.Path)
+	if route == nil {
+		route = &api.Route{
+			ID:        primitive.NewObjectID().Hex(),
+			RoleID:    req.RoleID,
+			Path:      req.Path,
+			CreatedBy: req.ModifiedBy,
+			CreatedAt: ptypes.TimestampNow(),
+		}
+		r.routes[route.ID] = route
+	}
+	route.Permission = req.Permission
+	route.ModifiedBy = req.ModifiedBy
+	route.ModifiedAt = ptypes.TimestampNow()
+
+	return &api.RouteUpdateByRoleIDAndPathRes{Updated: 1}, nil
+}
+
+func (r *memoryRoutes) Delete(ctx context.Context, req *api.RouteDeleteReq) (*api.RouteDeleteRes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := new(api.RouteDeleteRes)
+	if _, ok := r.routes[req.ID]; ok {
+		delete(r.routes, req.ID)
+		res.Deleted = 1
+	}
+	return res, nil
+}
+
+type memoryAudits struct {
+	mu     sync.Mutex
+	audits []*api.Audit
+	ids    map[string]bool
+}
+
+func (a *memoryAudits) List(ctx context.Context, req *api.AuditListReq) (*api.AuditListRes, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := new(api.AuditListRes)
+	for _, audit := range a.audits {
+		res.Audits = append(res.Audits, proto.Clone(audit).(*api.Audit))
+	}
+	return res, nil
+}
+
+func (a *memoryAudits) List100(ctx context.Context, req *api.AuditList100Req) (*api.AuditList100Res, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := new(api.AuditList100Res)
+	for _, audit := range a.audits {
+		res.Audits = append(res.Audits, proto.Clone(audit).(*api.Audit))
+	}
+	sort.SliceStable(res.Audits, func(i, j int) bool {
+		ti, tj := res.Audits[i].CreatedAt, res.Audits[j].CreatedAt
+		if ti.Seconds != tj.Seconds {
+			return ti.Seconds > tj.Seconds
+		}
+		return ti.Nanos > tj.Nanos
+	})
+	if len(res.Audits) > 100 {
+		res.Audits = res.Audits[:100]
+	}
+	return res, nil
+}
+
+// Create stores an audit, a replayed audit fails with AlreadyExists like
+// it does from the grpc service.
+func (a *memoryAudits) Create(ctx context.Context, req *api.AuditCreateReq) (*api.AuditCreateRes, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	audit := proto.Clone(newAudit(req.Audit)).(*api.Audit)
+	if a.ids[audit.ID] {
+		return nil, status.Errorf(codes.AlreadyExists, "audit %s already exists", audit.ID)
+	}
+	a.ids[audit.ID] = true
+	a.audits = append(a.audits, audit)
+	return &api.AuditCreateRes{ID: audit.ID}, nil
+}
+
+func (a *memoryAudits) Read(ctx context.Context, req *api.AuditReadReq) (*api.AuditReadRes, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := &api.AuditReadRes{Audit: new(api.Audit)}
+	for _, audit := range a.audits {
+		if audit.ID == req.ID {
+			res.Audit = proto.Clone(audit).(*api.Audit)
+			break
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,441 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/go-stuff/grpc/api"
+	"github.com/golang/protobuf/ptypes"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/sessionstore"
+)
+
+// NewMongo returns repositories kept in db, in the same collections and
+// documents as the go-stuff/grpc service, so a deployment can move between
+// the two without migrating. Sessions are listed from sessions, the
+// session store, which may be nil.
+func NewMongo(db *mongo.Database, sessions sessionstore.Store) *Repositories {
+	return &Repositories{
+		Users:    &mongoUsers{db.Collection("users")},
+		Roles:    &mongoRoles{db.Collection("roles")},
+		Routes:   &mongoRoutes{db.Collection("routes")},
+		Audits:   &mongoAudits{db.Collection("audit")},
+		Sessions: newSessions(sessions),
+	}
+}
+
+// IsDuplicateKey reports whether err is MongoDB refusing a write because a
+// unique index already has its key.
+func IsDuplicateKey(err error) bool {
+	switch err := err.(type) {
+	case mongo.WriteException:
+		for _, we := range err.WriteErrors {
+			if duplicateKeyCode(int32(we.Code)) {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return duplicateKeyCode(err.Code)
+	}
+	return false
+}
+
+func duplicateKeyCode(code int32) bool {
+	return code == 11000 || code == 11001 || code == 12582
+}
+
+func sortBy(key string, order int) *options.FindOptions {
+	return options.Find().SetSort(bson.D{{Key: key, Value: order}})
+}
+
+// findOne decodes the first document matching filter into v, a missing
+// document leaves v empty.
+func findOne(ctx context.Context, col *mongo.Collection, filter interface{}, v interface{}) error {
+	err := col.FindOne(ctx, filter).Decode(v)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	return err
+}
+
+type mongoUsers struct {
+	col *mongo.Collection
+}
+
+func (u *mongoUsers) find(ctx context.Context, filter interface{}) ([]*api.User, error) {
+	cursor, err := u.col.Find(ctx, filter, sortBy("username", 1))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []*api.User
+	for cursor.Next(ctx) {
+		user := new(api.User)
+		err := cursor.Decode(user)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, cursor.Err()
+}
+
+func (u *mongoUsers) List(ctx context.Context, req *api.UserListReq) (*api.UserListRes, error) {
+	users, err := u.find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	return &api.UserListRes{Users: users}, nil
+}
+
+func (u *mongoUsers) Create(ctx context.Context, req *api.UserCreateReq) (*api.UserCreateRes, error) {
+	user := &api.User{
+		ID:         primitive.NewObjectID().Hex(),
+		Username:   req.Username,
+		Groups:     req.Groups,
+		RoleID:     req.RoleID,
+		CreatedBy:  req.CreatedBy,
+		CreatedAt:  ptypes.TimestampNow(),
+		ModifiedBy: req.CreatedBy,
+		ModifiedAt: ptypes.TimestampNow(),
+	}
+
+	_, err := u.col.InsertOne(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return &api.UserCreateRes{ID: user.ID}, nil
+}
+
+func (u *mongoUsers) Read(ctx context.Context, req *api.UserReadReq) (*api.UserReadRes, error) {
+	res := &api.UserReadRes{User: new(api.User)}
+	err := findOne(ctx, u.col, bson.M{"_id": req.ID}, res.User)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (u *mongoUsers) ReadByUsername(ctx context.Context, req *api.UserReadByUsernameReq) (*api.UserReadByUsernameRes, error) {
+	res := &api.UserReadByUsernameRes{User: new(api.User)}
+	err := findOne(ctx, u.col, bson.M{"username": req.Username}, res.User)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (u *mongoUsers) Update(ctx context.Context, req *api.UserUpdateReq) (*api.UserUpdateRes, error) {
+	updateRes, err := u.col.UpdateOne(ctx,
+		bson.M{"_id": req.ID},
+		bson.M{
+			"$set": bson.M{
+				"groups":     req.Groups,
+				"roleid":     req.RoleID,
+				"modifiedby": req.ModifiedBy,
+				"modifiedat": ptypes.TimestampNow(),
+			},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.UserUpdateRes{Updated: updateRes.ModifiedCount}, nil
+}
+
+func (u *mongoUsers) Delete(ctx context.Context, req *api.UserDeleteReq) (*api.UserDeleteRes, error) {
+	deleteRes, err := u.col.DeleteOne(ctx, bson.M{"_id": req.ID})
+	if err != nil {
+		return nil, err
+	}
+	return &api.UserDeleteRes{Deleted: deleteRes.DeletedCount}, nil
+}
+
+type mongoRoles struct {
+	col *mongo.Collection
+}
+
+func (r *mongoRoles) List(ctx context.Context, req *api.RoleListReq) (*api.RoleListRes, error) {
+	cursor, err := r.col.Find(ctx, bson.M{}, sortBy("name", 1))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	res := new(api.RoleListRes)
+	for cursor.Next(ctx) {
+		role := new(api.Role)
+		err := cursor.Decode(role)
+		if err != nil {
+			return nil, err
+		}
+		res.Roles = append(res.Roles, role)
+	}
+
+	return res, cursor.Err()
+}
+
+func (r *mongoRoles) Create(ctx context.Context, req *api.RoleCreateReq) (*api.RoleCreateRes, error) {
+	role := &api.Role{
+		ID:          primitive.NewObjectID().Hex(),
+		Name:        req.Name,
+		Description: req.Description,
+		Group:       req.Group,
+		CreatedBy:   req.CreatedBy,
+		CreatedAt:   ptypes.TimestampNow(),
+		ModifiedBy:  req.CreatedBy,
+		ModifiedAt:  ptypes.TimestampNow(),
+	}
+
+	_, err := r.col.InsertOne(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RoleCreateRes{ID: role.ID}, nil
+}
+
+func (r *mongoRoles) Read(ctx context.Context, req *api.RoleReadReq) (*api.RoleReadRes, error) {
+	res := &api.RoleReadRes{Role: new(api.Role)}
+	err := findOne(ctx, r.col, bson.M{"_id": req.ID}, res.Role)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *mongoRoles) ReadByName(ctx context.Context, req *api.RoleReadByNameReq) (*api.RoleReadByNameRes, error) {
+	res := &api.RoleReadByNameRes{Role: new(api.Role)}
+	err := findOne(ctx, r.col, bson.M{"name": req.Name}, res.Role)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *mongoRoles) Update(ctx context.Context, req *api.RoleUpdateReq) (*api.RoleUpdateRes, error) {
+	updateRes, err := r.col.UpdateOne(ctx,
+		bson.M{"_id": req.ID},
+		bson.M{
+			"$set": bson.M{
+				"name":        req.Name,
+				"description": req.Description,
+				"group":       req.Group,
+				"modifiedby":  req.ModifiedBy,
+				"modifiedat":  ptypes.TimestampNow(),
+			},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RoleUpdateRes{Updated: updateRes.ModifiedCount}, nil
+}
+
+func (r *mongoRoles) Delete(ctx context.Context, req *api.RoleDeleteReq) (*api.RoleDeleteRes, error) {
+	deleteRes, err := r.col.DeleteOne(ctx, bson.M{"_id": req.ID})
+	if err != nil {
+		return nil, err
+	}
+	return &api.RoleDeleteRes{Deleted: deleteRes.DeletedCount}, nil
+}
+
+type mongoRoutes struct {
+	col *mongo.Collection
+}
+
+func (r *mongoRoutes) find(ctx context.Context, filter interface{}, opts *options.FindOptions) ([]*api.Route, error) {
+	cursor, err := r.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var routes []*api.Route
+	for cursor.Next(ctx) {
+		route := new(api.Route)
+		err := cursor.Decode(route)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, cursor.Err()
+}
+
+func (r *mongoRoutes) List(ctx context.Context, req *api.RouteListReq) (*api.RouteListRes, error) {
+	routes, err := r.find(ctx, bson.M{}, sortBy("path", 1))
+	if err != nil {
+		return nil, err
+	}
+	return &api.RouteListRes{Routes: routes}, nil
+}
+
+func (r *mongoRoutes) ListByRoleID(ctx context.Context, req *api.RouteListByRoleIDReq) (*api.RouteListByRoleIDRes, error) {
+	routes, err := r.find(ctx, bson.M{"roleid": req.RoleID}, sortBy("path", 1))
+	if err != nil {
+		return nil, err
+	}
+	return &api.RouteListByRoleIDRes{Routes: routes}, nil
+}
+
+func (r *mongoRoutes) Create(ctx context.Context, req *api.RouteCreateReq) (*api.RouteCreateRes, error) {
+	route := &api.Route{
+		ID:         primitive.NewObjectID().Hex(),
+		RoleID:     req.RoleID,
+		Path:       req.Path,
+		Permission: req.Permission,
+		CreatedBy:  req.CreatedBy,
+		CreatedAt:  ptypes.TimestampNow(),
+		ModifiedBy: req.CreatedBy,
+		ModifiedAt: ptypes.TimestampNow(),
+	}
+
+	_, err := r.col.InsertOne(ctx, route)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RouteCreateRes{ID: route.ID}, nil
+}
+
+func (r *mongoRoutes) Read(ctx context.Context, req *api.RouteReadReq) (*api.RouteReadRes, error) {
+	res := &api.RouteReadRes{Route: new(api.Route)}
+	err := findOne(ctx, r.col, bson.M{"_id": req.ID}, res.Route)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *mongoRoutes) ReadByRoleIDAndPath(ctx context.Context, req *api.RouteReadByRoleIDAndPathReq) (*api.RouteReadByRoleIDAndPathRes, error) {
+	res := &api.RouteReadByRoleIDAndPathRes{Route: new(api.Route)}
+	err := findOne(ctx, r.col, bson.M{"roleid": req.Route.RoleID, "path": req.Route.Path}, res.Route)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateByRoleIDAndPath sets the permission of a role on a path, adding
+// the route when the role has none for the path yet.
+func (r *mongoRoutes) UpdateByRoleIDAndPath(ctx context.Context, req *api.RouteUpdateByRoleIDAndPathReq) (*api.RouteUpdateByRoleIDAndPathRes, error) {
+	updateRes, err := r.col.UpdateOne(ctx,
+		bson.M{"roleid": req.RoleID, "path": req.Path},
+		bson.M{
+			"$set": bson.M{
+				"permission": req.Permission,
+				"modifiedby": req.ModifiedBy,
+				"modifiedat": ptypes.TimestampNow(),
+			},
+			"$setOnInsert": bson.M{
+				"_id":       primitive.NewObjectID().Hex(),
+				"createdby": req.ModifiedBy,
+				"createdat": ptypes.TimestampNow(),
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RouteUpdateByRoleIDAndPathRes{Updated: updateRes.ModifiedCount + updateRes.UpsertedCount}, nil
+}
+
+func (r *mongoRoutes) Delete(ctx context.Context, req *api.RouteDeleteReq) (*api.RouteDeleteRes, error) {
+	deleteRes, err := r.col.DeleteOne(ctx, bson.M{"_id": req.ID})
+	if err != nil {
+		return nil, err
+	}
+	return &api.RouteDeleteRes{Deleted: deleteRes.DeletedCount}, nil
+}
+
+type mongoAudits struct {
+	col *mongo.Collection
+}
+
+func (a *mongoAudits) find(ctx context.Context, opts *options.FindOptions) ([]*api.Audit, error) {
+	cursor, err := a.col.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var audits []*api.Audit
+	for cursor.Next(ctx) {
+		audit := new(api.Audit)
+		err := cursor.Decode(audit)
+		if err != nil {
+			return nil, err
+		}
+		audits = append(audits, audit)
+	}
+
+	return audits, cursor.Err()
+}
+
+func (a *mongoAudits) List(ctx context.Context, req *api.AuditListReq) (*api.AuditListRes, error) {
+	audits, err := a.find(ctx, options.Find())
+	if err != nil {
+		return nil, err
+	}
+	return &api.AuditListRes{Audits: audits}, nil
+}
+
+func (a *mongoAudits) List100(ctx context.Context, req *api.AuditList100Req) (*api.AuditList100Res, error) {
+	audits, err := a.find(ctx, sortBy("createdat", -1).SetLimit(100))
+	if err != nil {
+		return nil, err
+	}
+	return &api.AuditList100Res{Audits: audits}, nil
+}
+
+// Create stores an audit, a replayed audit fails with AlreadyExists like
+// it does from the grpc service.
+func (a *mongoAudits) Create(ctx context.Context, req *api.AuditCreateReq) (*api.AuditCreateRes, error) {
+	audit := newAudit(req.Audit)
+
+	_, err := a.col.InsertOne(ctx, audit)
+	if IsDuplicateKey(err) {
+		return nil, status.Errorf(codes.AlreadyExists, "audit %s already exists", audit.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.AuditCreateRes{ID: audit.ID}, nil
+}
+
+func (a *mongoAudits) Read(ctx context.Context, req *api.AuditReadReq) (*api.AuditReadRes, error) {
+	res := &api.AuditReadRes{Audit: new(api.Audit)}
+	err := findOne(ctx, a.col, bson.M{"_id": req.ID}, res.Audit)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// newAudit copies an audit to be stored, giving it an id and a time when
+// it has none.
+func newAudit(in *api.Audit) *api.Audit {
+	audit := &api.Audit{
+		ID:        in.ID,
+		Username:  in.Username,
+		Action:    in.Action,
+		Session:   in.Session,
+		CreatedBy: in.CreatedBy,
+		CreatedAt: in.CreatedAt,
+	}
+	if audit.ID == "" {
+		audit.ID = primitive.NewObjectID().Hex()
+	}
+	if audit.CreatedAt == nil {
+		audit.CreatedAt = ptypes.TimestampNow()
+	}
+	return audit
+}
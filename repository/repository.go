@@ -0,0 +1,66 @@
+// Package repository is where users, roles, routes, the audit log and
+// sessions are kept. The requests and responses are the messages of the go-stuff/grpc
+// api, so the same handlers work with the gRPC service, directly with
+// MongoDB or with process memory.
+package repository
+
+import (
+	"context"
+
+	"github.com/go-stuff/grpc/api"
+)
+
+// Users keeps the users that have logged in and the role of each.
+type Users interface {
+	List(ctx context.Context, req *api.UserListReq) (*api.UserListRes, error)
+	Create(ctx context.Context, req *api.UserCreateReq) (*api.UserCreateRes, error)
+	Read(ctx context.Context, req *api.UserReadReq) (*api.UserReadRes, error)
+	ReadByUsername(ctx context.Context, req *api.UserReadByUsernameReq) (*api.UserReadByUsernameRes, error)
+	Update(ctx context.Context, req *api.UserUpdateReq) (*api.UserUpdateRes, error)
+	Delete(ctx context.Context, req *api.UserDeleteReq) (*api.UserDeleteRes, error)
+}
+
+// Roles keeps the roles and the ad group each is given to.
+type Roles interface {
+	List(ctx context.Context, req *api.RoleListReq) (*api.RoleListRes, error)
+	Create(ctx context.Context, req *api.RoleCreateReq) (*api.RoleCreateRes, error)
+	Read(ctx context.Context, req *api.RoleReadReq) (*api.RoleReadRes, error)
+	ReadByName(ctx context.Context, req *api.RoleReadByNameReq) (*api.RoleReadByNameRes, error)
+	Update(ctx context.Context, req *api.RoleUpdateReq) (*api.RoleUpdateRes, error)
+	Delete(ctx context.Context, req *api.RoleDeleteReq) (*api.RoleDeleteRes, error)
+}
+
+// Routes keeps the permission each role has on each route.
+type Routes interface {
+	List(ctx context.Context, req *api.RouteListReq) (*api.RouteListRes, error)
+	ListByRoleID(ctx context.Context, req *api.RouteListByRoleIDReq) (*api.RouteListByRoleIDRes, error)
+	Create(ctx context.Context, req *api.RouteCreateReq) (*api.RouteCreateRes, error)
+	Read(ctx context.Context, req *api.RouteReadReq) (*api.RouteReadRes, error)
+	ReadByRoleIDAndPath(ctx context.Context, req *api.RouteReadByRoleIDAndPathReq) (*api.RouteReadByRoleIDAndPathRes, error)
+	UpdateByRoleIDAndPath(ctx context.Context, req *api.RouteUpdateByRoleIDAndPathReq) (*api.RouteUpdateByRoleIDAndPathRes, error)
+	Delete(ctx context.Context, req *api.RouteDeleteReq) (*api.RouteDeleteRes, error)
+}
+
+// Audits keeps the audit log. Create keeps the id and time of the audit
+// when they are set, so a record sent twice is stored once, the second
+// Create fails with codes.AlreadyExists.
+type Audits interface {
+	List(ctx context.Context, req *api.AuditListReq) (*api.AuditListRes, error)
+	List100(ctx context.Context, req *api.AuditList100Req) (*api.AuditList100Res, error)
+	Create(ctx context.Context, req *api.AuditCreateReq) (*api.AuditCreateRes, error)
+	Read(ctx context.Context, req *api.AuditReadReq) (*api.AuditReadRes, error)
+}
+
+// Sessions lists the sessions of logged in users.
+type Sessions interface {
+	List(ctx context.Context, req *api.SessionListReq) (*api.SessionListRes, error)
+}
+
+// Repositories are the repositories of one backend.
+type Repositories struct {
+	Users    Users
+	Roles    Roles
+	Routes   Routes
+	Audits   Audits
+	Sessions Sessions
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/go-stuff/grpc/api"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stuff/web/sessionstore"
+)
+
+// newSessions returns Sessions listing the sessions of store, or nil
+// without a store.
+func newSessions(store sessionstore.Store) Sessions {
+	if store == nil {
+		return nil
+	}
+	return &storeSessions{store}
+}
+
+// storeSessions lists the sessions of a session store. Stores that keep
+// nothing on the server answer with codes.Unimplemented.
+type storeSessions struct {
+	store sessionstore.Store
+}
+
+func (s *storeSessions) List(ctx context.Context, req *api.SessionListReq) (*api.SessionListRes, error) {
+	infos, err := s.store.List(ctx)
+	if err == sessionstore.ErrNotSupported {
+		return nil, status.Error(codes.Unimplemented, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(api.SessionListRes)
+	for _, info := range infos {
+		createdAt, err := ptypes.TimestampProto(info.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt, err := ptypes.TimestampProto(info.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		res.Sessions = append(res.Sessions, &api.Session{
+			ID:         info.ID,
+			Username:   info.Username,
+			RemoteAddr: info.RemoteAddr,
+			Host:       info.Host,
+			CreatedAt:  createdAt,
+			ExpiresAt:  expiresAt,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,376 @@
+// Package security records security events such as failed logins,
+// lockouts and permission denials, and raises alerts for simple anomalies.
+package security
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/go-stuff/web/notify"
+)
+
+// Event kinds.
+const (
+	LoginFailure     = "login_failure"
+	LoginSuccess     = "login_success"
+	Lockout          = "lockout"
+	PermissionDenied = "permission_denied"
+	TokenDenied      = "token_denied"
+	Anomaly          = "anomaly"
+)
+
+// Event is a single security event.
+type Event struct {
+	ID         string    `bson:"_id"`
+	Kind       string    `bson:"kind"`
+	Username   string    `bson:"username"`
+	RemoteAddr string    `bson:"remoteaddr"`
+	Path       string    `bson:"path,omitempty"`
+	Detail     string    `bson:"detail,omitempty"`
+	CreatedAt  time.Time `bson:"createdat"`
+}
+
+// Options tune lockouts and anomaly detection.
+type Options struct {
+	// FailureThreshold failed logins for one user within FailureWindow
+	// lock the user out for LockoutDuration.
+	FailureThreshold int
+	FailureWindow    time.Duration
+	LockoutDuration  time.Duration
+	// AdminHoursStart and AdminHoursEnd are the hours, in Location, during
+	// which admin logins are expected. Equal values disable the check.
+	AdminHoursStart int
+	AdminHoursEnd   int
+	Location        *time.Location
+}
+
+// DefaultOptions lock a user out for 15 minutes after 5 failures in 15
+// minutes and expect admins between 07:00 and 19:00 local time.
+var DefaultOptions = Options{
+	FailureThreshold: 5,
+	FailureWindow:    15 * time.Minute,
+	LockoutDuration:  15 * time.Minute,
+	AdminHoursStart:  7,
+	AdminHoursEnd:    19,
+	Location:         time.Local,
+}
+
+// Monitor stores events in MongoDB and sends alerts through a Notifier.
+type Monitor struct {
+	col      *mongo.Collection
+	notifier *notify.Notifier
+	opts     Options
+}
+
+// NewMonitor returns a Monitor using col for storage and makes sure the
+// indexes used by its queries exist.
+func NewMonitor(col *mongo.Collection, notifier *notify.Notifier, opts Options) (*Monitor, error) {
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "kind", Value: 1}, {Key: "createdat", Value: -1}}},
+		{Keys: bson.D{{Key: "createdat", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Monitor{
+		col:      col,
+		notifier: notifier,
+		opts:     opts,
+	}, nil
+}
+
+// host strips the port from a remote address.
+func host(remoteAddr string) string {
+	h, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return h
+}
+
+func (m *Monitor) record(ctx context.Context, ev *Event) error {
+	ev.ID = primitive.NewObjectID().Hex()
+	ev.RemoteAddr = host(ev.RemoteAddr)
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now().UTC()
+	}
+
+	_, err := m.col.InsertOne(ctx, ev)
+	return err
+}
+
+func (m *Monitor) alert(ev *Event, message string) {
+	m.notifier.Send(notify.Alert{
+		Source:  "security",
+		Kind:    ev.Kind,
+		Subject: ev.Username,
+		Message: message,
+		Time:    ev.CreatedAt,
+		Fields: map[string]string{
+			"remoteaddr": ev.RemoteAddr,
+			"path":       ev.Path,
+			"detail":     ev.Detail,
+		},
+	})
+}
+
+// Locked reports whether username is locked out and until when.
+func (m *Monitor) Locked(ctx context.Context, username string) (bool, time.Time, error) {
+	if m.opts.FailureThreshold < 1 {
+		return false, time.Time{}, nil
+	}
+
+	var ev Event
+	err := m.col.FindOne(ctx,
+		bson.M{
+			"username":  username,
+			"kind":      Lockout,
+			"createdat": bson.M{"$gte": time.Now().UTC().Add(-m.opts.LockoutDuration)},
+		},
+		options.FindOne().SetSort(bson.D{{Key: "createdat", Value: -1}}),
+	).Decode(&ev)
+	if err == mongo.ErrNoDocuments {
+		return false, time.Time{}, nil
+	}
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	return true, ev.CreatedAt.Add(m.opts.LockoutDuration), nil
+}
+
+// LoginFailed records a failed login and locks the user out once the
+// failure threshold is reached within the window.
+func (m *Monitor) LoginFailed(ctx context.Context, username, remoteAddr, reason string) error {
+	ev := &Event{
+		Kind:       LoginFailure,
+		Username:   username,
+		RemoteAddr: remoteAddr,
+		Detail:     reason,
+	}
+	err := m.record(ctx, ev)
+	if err != nil {
+		return err
+	}
+
+	if m.opts.FailureThreshold < 1 {
+		return nil
+	}
+
+	// a user that is already locked out is not locked out again
+	locked, _, err := m.Locked(ctx, username)
+	if err != nil || locked {
+		return err
+	}
+
+	// failures before the last successful login or the last lockout no
+	// longer count
+	since := time.Now().UTC().Add(-m.opts.FailureWindow)
+	for _, kind := range []string{LoginSuccess, Lockout} {
+		last, err := m.latest(ctx, username, kind)
+		if err != nil {
+			return err
+		}
+		if last.After(since) {
+			since = last
+		}
+	}
+
+	failures, err := m.col.CountDocuments(ctx, bson.M{
+		"username":  username,
+		"kind":      LoginFailure,
+		"createdat": bson.M{"$gt": since},
+	})
+	if err != nil {
+		return err
+	}
+
+	if failures >= int64(m.opts.FailureThreshold) {
+		lockout := &Event{
+			Kind:       Lockout,
+			Username:   username,
+			RemoteAddr: remoteAddr,
+			Detail:     fmt.Sprintf("%d failed logins within %s, locked for %s", failures, m.opts.FailureWindow, m.opts.LockoutDuration),
+		}
+		err = m.record(ctx, lockout)
+		if err != nil {
+			return err
+		}
+		m.alert(lockout, "burst of failed logins, account locked")
+	}
+
+	return nil
+}
+
+// latest returns when username last had an event of kind, or the zero
+// time.
+func (m *Monitor) latest(ctx context.Context, username, kind string) (time.Time, error) {
+	var ev Event
+	err := m.col.FindOne(ctx,
+		bson.M{"username": username, "kind": kind},
+		options.FindOne().SetSort(bson.D{{Key: "createdat", Value: -1}}),
+	).Decode(&ev)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return ev.CreatedAt, err
+}
+
+// LoginSucceeded records a successful login, which clears the count of
+// failed logins, and raises an anomaly for a first login from a new
+// address and for admin logins outside the usual hours.
+func (m *Monitor) LoginSucceeded(ctx context.Context, username, remoteAddr string, admin bool) error {
+	addr := host(remoteAddr)
+
+	// look at the history before this login is added to it
+	previous, err := m.col.CountDocuments(ctx, bson.M{
+		"username": username,
+		"kind":     LoginSuccess,
+	})
+	if err != nil {
+		return err
+	}
+	fromAddr, err := m.col.CountDocuments(ctx, bson.M{
+		"username":   username,
+		"kind":       LoginSuccess,
+		"remoteaddr": addr,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = m.record(ctx, &Event{
+		Kind:       LoginSuccess,
+		Username:   username,
+		RemoteAddr: addr,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the very first login has nothing to compare against
+	if previous > 0 && fromAddr == 0 {
+		ev := &Event{
+			Kind:       Anomaly,
+			Username:   username,
+			RemoteAddr: addr,
+			Detail:     "first login from a new address",
+		}
+		err = m.record(ctx, ev)
+		if err != nil {
+			return err
+		}
+		m.alert(ev, ev.Detail)
+	}
+
+	if admin && !m.withinAdminHours(time.Now()) {
+		ev := &Event{
+			Kind:       Anomaly,
+			Username:   username,
+			RemoteAddr: addr,
+			Detail:     fmt.Sprintf("admin login outside %02d:00-%02d:00", m.opts.AdminHoursStart, m.opts.AdminHoursEnd),
+		}
+		err = m.record(ctx, ev)
+		if err != nil {
+			return err
+		}
+		m.alert(ev, ev.Detail)
+	}
+
+	return nil
+}
+
+func (m *Monitor) withinAdminHours(t time.Time) bool {
+	start, end := m.opts.AdminHoursStart, m.opts.AdminHoursEnd
+	if start == end {
+		return true
+	}
+	hour := t.In(m.opts.Location).Hour()
+	if start < end {
+		return hour >= start && hour < end
+	}
+	// the window wraps past midnight
+	return hour >= start || hour < end
+}
+
+// Denied records that a role was refused access to a route.
+func (m *Monitor) Denied(ctx context.Context, username, remoteAddr, pathTemplate, roleID string) error {
+	return m.record(ctx, &Event{
+		Kind:       PermissionDenied,
+		Username:   username,
+		RemoteAddr: remoteAddr,
+		Path:       pathTemplate,
+		Detail:     fmt.Sprintf("roleid %s", roleID),
+	})
+}
+
+// TokenRefused records that a request authenticated by a token instead of
+// a session was refused, such as an agent check-in with a revoked
+// enrolment token. who names the kind of client.
+func (m *Monitor) TokenRefused(ctx context.Context, who, remoteAddr, path, reason string) error {
+	return m.record(ctx, &Event{
+		Kind:       TokenDenied,
+		Username:   who,
+		RemoteAddr: remoteAddr,
+		Path:       path,
+		Detail:     reason,
+	})
+}
+
+// List returns the most recent events, newest first.
+func (m *Monitor) List(ctx context.Context, limit int64) ([]*Event, error) {
+	cursor, err := m.col.Find(ctx,
+		bson.M{},
+		options.Find().
+			SetSort(bson.D{{Key: "createdat", Value: -1}}).
+			SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []*Event
+	for cursor.Next(ctx) {
+		ev := new(Event)
+		err := cursor.Decode(ev)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+
+	return events, cursor.Err()
+}
+
+// Counts returns the number of events of each kind since a point in time.
+func (m *Monitor) Counts(ctx context.Context, since time.Time) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, kind := range []string{LoginFailure, LoginSuccess, Lockout, PermissionDenied, TokenDenied, Anomaly} {
+		n, err := m.col.CountDocuments(ctx, bson.M{
+			"kind":      kind,
+			"createdat": bson.M{"$gte": since.UTC()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		counts[kind] = n
+	}
+
+	return counts, nil
+}
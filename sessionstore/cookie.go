@@ -0,0 +1,54 @@
+package sessionstore
+
+import (
+	"context"
+
+	"github.com/gorilla/sessions"
+)
+
+// CookieStore keeps the whole session in an encrypted cookie. Nothing is
+// kept on the server so sessions can not be listed or revoked, they end
+// when the cookie expires or the keys change.
+type CookieStore struct {
+	*sessions.CookieStore
+}
+
+// NewCookieStore returns a CookieStore, opts.KeyPairs should include an
+// encryption key so session values are not readable by the client.
+func NewCookieStore(opts Options) *CookieStore {
+	cs := sessions.NewCookieStore(opts.KeyPairs...)
+	cs.Options = opts.sessionOptions()
+	cs.MaxAge(opts.MaxAge)
+
+	return &CookieStore{CookieStore: cs}
+}
+
+// List is not supported.
+func (s *CookieStore) List(ctx context.Context) ([]*Info, error) {
+	return nil, ErrNotSupported
+}
+
+// Count is not supported.
+func (s *CookieStore) Count(ctx context.Context) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Revoke is not supported.
+func (s *CookieStore) Revoke(ctx context.Context, id string) error {
+	return ErrNotSupported
+}
+
+// Evict is not supported.
+func (s *CookieStore) Evict(ctx context.Context, id, notice string) error {
+	return ErrNotSupported
+}
+
+// Lock is not supported.
+func (s *CookieStore) Lock(ctx context.Context, username string) (func(), error) {
+	return nil, ErrNotSupported
+}
+
+// Ping always succeeds, sessions are only kept in the cookie.
+func (s *CookieStore) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package sessionstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What to do when a login would go over the limit.
+const (
+	// Reject refuses the new login.
+	Reject = "reject"
+	// Evict ends the oldest sessions to make room for the new one.
+	Evict = "evict"
+)
+
+// ErrTooManySessions is returned by Enforce when the policy is Reject and
+// the user already holds the maximum number of sessions.
+var ErrTooManySessions = errors.New("too many concurrent sessions")
+
+// Limits cap the number of concurrent sessions of one user.
+type Limits struct {
+	// Max applies to every role without its own limit, zero means no
+	// limit.
+	Max int
+	// Roles are limits by role name, they take precedence over Max.
+	Roles map[string]int
+	// Policy is Reject or Evict.
+	Policy string
+}
+
+// ParseRoleLimits reads limits written as "Admin=2,Read Only=5".
+func ParseRoleLimits(s string) (map[string]int, error) {
+	roles := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("session limit %q is not role=max", pair)
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("session limit %q: %v", pair, err)
+		}
+		roles[strings.TrimSpace(kv[0])] = max
+	}
+	return roles, nil
+}
+
+// limit returns the limit for a role, zero means no limit.
+func (l Limits) limit(role string) int {
+	if max, ok := l.Roles[role]; ok {
+		return max
+	}
+	return l.Max
+}
+
+// Enforce makes room for a login of username with the given role. current
+// is the ID of the session being logged in, if it already has one, and is
+// not counted. With the Evict policy the oldest sessions over the limit are
+// evicted with notice, with Reject ErrTooManySessions is returned. The
+// sessions of username are counted and evicted under store.Lock, and
+// sessions started after current are left to count current when their own
+// login is enforced, so concurrent logins can not both take the last slot
+// or evict each other. Stores that can not list sessions return
+// ErrNotSupported.
+func Enforce(ctx context.Context, store Store, limits Limits, username, role, current, notice string) error {
+	max := limits.limit(role)
+	if max < 1 {
+		return nil
+	}
+
+	unlock, err := store.Lock(ctx, username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	all, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var started time.Time
+	for _, info := range all {
+		if info.ID == current {
+			started = info.CreatedAt
+		}
+	}
+
+	var held []*Info
+	for _, info := range all {
+		if info.Username != username || info.ID == current {
+			continue
+		}
+		if !started.IsZero() && info.CreatedAt.After(started) {
+			continue
+		}
+		held = append(held, info)
+	}
+
+	// the new session needs one slot
+	over := len(held) + 1 - max
+	if over < 1 {
+		return nil
+	}
+
+	if limits.Policy != Evict {
+		return ErrTooManySessions
+	}
+
+	sort.Slice(held, func(i, j int) bool {
+		return held[i].CreatedAt.Before(held[j].CreatedAt)
+	})
+	for _, info := range held[:over] {
+		err := store.Evict(ctx, info.ID, notice)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
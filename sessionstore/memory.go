@@ -0,0 +1,168 @@
+package sessionstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps sessions in process memory. Sessions are lost on
+// restart and not shared between instances, it is meant for development
+// and tests.
+type MemoryStore struct {
+	*serverStore
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore(opts Options) *MemoryStore {
+	return &MemoryStore{
+		serverStore: newServerStore(&memoryBackend{
+			sessions: make(map[string]*memorySession),
+		}, opts),
+	}
+}
+
+type memorySession struct {
+	values    map[interface{}]interface{}
+	createdAt time.Time
+	expiresAt time.Time
+}
+
+type memoryBackend struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+
+	// limit is held by Lock, sessions are only kept in this process so
+	// one lock for every user is enough
+	limit sync.Mutex
+}
+
+func copyValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	c := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
+
+// expire drops sessions past their expiry, the caller holds the lock.
+func (m *memoryBackend) expire(now time.Time) {
+	for id, s := range m.sessions {
+		if now.After(s.expiresAt) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *memoryBackend) load(ctx context.Context, id string, values map[interface{}]interface{}) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || time.Now().After(s.expiresAt) {
+		return false, nil
+	}
+	for k, v := range s.values {
+		values[k] = v
+	}
+	return true, nil
+}
+
+func (m *memoryBackend) insert(ctx context.Context, id string, values map[interface{}]interface{}, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(time.Now())
+	m.sessions[id] = &memorySession{
+		values:    copyValues(values),
+		createdAt: time.Now().UTC(),
+		expiresAt: expires,
+	}
+	return nil
+}
+
+func (m *memoryBackend) update(ctx context.Context, id string, values map[interface{}]interface{}, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// a session revoked while the request was running stays revoked
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil
+	}
+	s.values = copyValues(values)
+	s.expiresAt = expires
+	return nil
+}
+
+func (m *memoryBackend) delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memoryBackend) lock(ctx context.Context, username string) (func(), error) {
+	m.limit.Lock()
+	return m.limit.Unlock, nil
+}
+
+func (m *memoryBackend) ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryBackend) evict(ctx context.Context, id, notice string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil
+	}
+	s.values = map[interface{}]interface{}{EvictedKey: notice}
+	return nil
+}
+
+func (m *memoryBackend) list(ctx context.Context) ([]*Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(time.Now())
+
+	infos := make([]*Info, 0, len(m.sessions))
+	for id, s := range m.sessions {
+		if _, ok := s.values[EvictedKey]; ok {
+			continue
+		}
+		infos = append(infos, &Info{
+			ID:         id,
+			Username:   str(s.values, "username"),
+			RemoteAddr: str(s.values, "remoteaddr"),
+			Host:       str(s.values, "host"),
+			CreatedAt:  s.createdAt,
+			ExpiresAt:  s.expiresAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ExpiresAt.After(infos[j].ExpiresAt)
+	})
+
+	return infos, nil
+}
+
+func (m *memoryBackend) count(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(time.Now())
+
+	n := 0
+	for _, s := range m.sessions {
+		if _, ok := s.values[EvictedKey]; !ok {
+			n++
+		}
+	}
+	return n, nil
+}
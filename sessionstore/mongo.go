@@ -0,0 +1,299 @@
+package sessionstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// lockLease is how long a lock taken by Lock is held at most, so a lock
+// left by an instance that died is taken over.
+const lockLease = 30 * time.Second
+
+// fields the Mongo backend keeps next to the session values, documents
+// keep the layout used by mongostore so the SessionService can still read
+// them
+var bookkeeping = map[string]bool{
+	"_id":        true,
+	"createdat":  true,
+	"modifiedat": true,
+	"expiresat":  true,
+	"ttl":        true,
+}
+
+// isDuplicateKey reports whether err is MongoDB refusing a write because a
+// unique index already has its key.
+func isDuplicateKey(err error) bool {
+	switch err := err.(type) {
+	case mongo.WriteException:
+		for _, we := range err.WriteErrors {
+			if we.Code == 11000 || we.Code == 11001 {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return err.Code == 11000 || err.Code == 11001
+	}
+	return false
+}
+
+// MongoStore keeps sessions in a MongoDB collection that expires them
+// through a TTL index.
+type MongoStore struct {
+	*serverStore
+}
+
+// NewMongoStore returns a MongoStore keeping sessions in col and the
+// leases taken by Lock in locks, and makes sure the TTL indexes of both
+// exist.
+func NewMongoStore(col, locks *mongo.Collection, opts Options) (*MongoStore, error) {
+	m := &mongoBackend{col: col, locks: locks}
+
+	err := ensureTTLIndex(col, "ttl", int32(opts.MaxAge))
+	if err != nil {
+		return nil, err
+	}
+
+	// a lease is removed once it runs out, a lock left by an instance that
+	// died is taken over before that
+	err = ensureTTLIndex(locks, "lockeduntil", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoStore{
+		serverStore: newServerStore(m, opts),
+	}, nil
+}
+
+type mongoBackend struct {
+	col   *mongo.Collection
+	locks *mongo.Collection
+}
+
+// mongoSession is the part of a session document shown on the sessions
+// page, timestamps are stored as protobuf timestamps.
+type mongoSession struct {
+	ID         string      `bson:"_id"`
+	Username   string      `bson:"username"`
+	RemoteAddr string      `bson:"remoteaddr"`
+	Host       string      `bson:"host"`
+	CreatedAt  pbTimestamp `bson:"createdat"`
+	ExpiresAt  pbTimestamp `bson:"expiresat"`
+}
+
+// pbTimestamp is a protobuf timestamp as the driver stores it.
+type pbTimestamp struct {
+	Seconds int64 `bson:"seconds"`
+	Nanos   int32 `bson:"nanos"`
+}
+
+func (ts pbTimestamp) time() time.Time {
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC()
+}
+
+// ensureTTLIndex creates the index expiring the documents of col after
+// the time in key, unless it exists.
+func ensureTTLIndex(col *mongo.Collection, key string, expireAfter int32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := col.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var index bson.M
+		err := cursor.Decode(&index)
+		if err != nil {
+			return err
+		}
+		if index["name"] == key+"_1" {
+			return nil
+		}
+	}
+
+	_, err = col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: key, Value: 1}},
+		Options: options.Index().
+			SetBackground(true).
+			SetSparse(true).
+			SetExpireAfterSeconds(expireAfter),
+	})
+	return err
+}
+
+func (m *mongoBackend) load(ctx context.Context, id string, values map[interface{}]interface{}) (bool, error) {
+	var doc bson.M
+	err := m.col.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for k, v := range doc {
+		if !bookkeeping[k] {
+			values[k] = v
+		}
+	}
+	return true, nil
+}
+
+func (m *mongoBackend) fields(values map[interface{}]interface{}) bson.D {
+	var doc bson.D
+	for k, v := range values {
+		key := fmt.Sprintf("%v", k)
+		if !bookkeeping[key] {
+			doc = append(doc, bson.E{Key: key, Value: v})
+		}
+	}
+	return doc
+}
+
+func (m *mongoBackend) insert(ctx context.Context, id string, values map[interface{}]interface{}, expires time.Time) error {
+	expiresAt, err := ptypes.TimestampProto(expires)
+	if err != nil {
+		return err
+	}
+
+	doc := bson.D{{Key: "_id", Value: id}}
+	doc = append(doc, m.fields(values)...)
+	doc = append(doc,
+		bson.E{Key: "createdat", Value: ptypes.TimestampNow()},
+		bson.E{Key: "modifiedat", Value: ptypes.TimestampNow()},
+		bson.E{Key: "expiresat", Value: expiresAt},
+		bson.E{Key: "ttl", Value: time.Now().UTC()},
+	)
+
+	_, err = m.col.InsertOne(ctx, doc)
+	return err
+}
+
+func (m *mongoBackend) update(ctx context.Context, id string, values map[interface{}]interface{}, expires time.Time) error {
+	expiresAt, err := ptypes.TimestampProto(expires)
+	if err != nil {
+		return err
+	}
+
+	doc := m.fields(values)
+	doc = append(doc,
+		bson.E{Key: "modifiedat", Value: ptypes.TimestampNow()},
+		bson.E{Key: "expiresat", Value: expiresAt},
+		bson.E{Key: "ttl", Value: time.Now().UTC()},
+	)
+
+	// a session revoked while the request was running stays revoked
+	_, err = m.col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": doc})
+	return err
+}
+
+func (m *mongoBackend) delete(ctx context.Context, id string) error {
+	_, err := m.col.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (m *mongoBackend) evict(ctx context.Context, id, notice string) error {
+	expiresAt, err := ptypes.TimestampProto(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	// the TTL index removes the notice along with expired sessions
+	_, err = m.col.ReplaceOne(ctx, bson.M{"_id": id}, bson.D{
+		{Key: "_id", Value: id},
+		{Key: EvictedKey, Value: notice},
+		{Key: "createdat", Value: ptypes.TimestampNow()},
+		{Key: "modifiedat", Value: ptypes.TimestampNow()},
+		{Key: "expiresat", Value: expiresAt},
+		{Key: "ttl", Value: time.Now().UTC()},
+	})
+	return err
+}
+
+// lock takes a lease document in the locks collection, the upsert fails
+// with a duplicate key while another caller holds an unexpired lease.
+func (m *mongoBackend) lock(ctx context.Context, username string) (func(), error) {
+	id := username
+	holder := primitive.NewObjectID().Hex()
+
+	for {
+		now := time.Now().UTC()
+		_, err := m.locks.UpdateOne(ctx,
+			bson.M{"_id": id, "lockeduntil": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"lockeduntil": now.Add(lockLease), "holder": holder}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			break
+		}
+		if !isDuplicateKey(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		m.locks.DeleteOne(ctx, bson.M{"_id": id, "holder": holder})
+	}, nil
+}
+
+func (m *mongoBackend) ping(ctx context.Context) error {
+	return m.col.Database().Client().Ping(ctx, readpref.Primary())
+}
+
+// liveFilter matches the sessions that are not evicted.
+var liveFilter = bson.M{
+	EvictedKey: bson.M{"$exists": false},
+}
+
+func (m *mongoBackend) list(ctx context.Context) ([]*Info, error) {
+	cursor, err := m.col.Find(ctx, liveFilter,
+		options.Find().SetSort(bson.D{{Key: "ttl", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var infos []*Info
+	for cursor.Next(ctx) {
+		var doc mongoSession
+		err := cursor.Decode(&doc)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, &Info{
+			ID:         doc.ID,
+			Username:   doc.Username,
+			RemoteAddr: doc.RemoteAddr,
+			Host:       doc.Host,
+			CreatedAt:  doc.CreatedAt.time(),
+			ExpiresAt:  doc.ExpiresAt.time(),
+		})
+	}
+
+	return infos, cursor.Err()
+}
+
+func (m *mongoBackend) count(ctx context.Context) (int, error) {
+	n, err := m.col.CountDocuments(ctx, liveFilter)
+	return int(n), err
+}
@@ -0,0 +1,224 @@
+package sessionstore
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// RefreshKey is the session value holding the unix time the session was
+// last written, it decides when an unchanged session is written again to
+// push its expiry out.
+const RefreshKey = "refreshedat"
+
+type contextKey int
+
+const requestSessionKey contextKey = 0
+
+// RequestStore wraps a Store so a request loads its session once and only
+// writes it when it changed. Get and New return the session loaded by
+// Begin, Save writes it only if the values changed since it was loaded or
+// last written, or the expiry refresh is due. A session nobody saved is
+// written just before the response headers go out once the refresh is
+// due.
+type RequestStore struct {
+	Store
+	name    string
+	refresh time.Duration
+}
+
+// NewRequestStore wraps store for the session called name. An unchanged
+// session is written again once refresh has passed since its last write,
+// a refresh of zero or less writes it on every request.
+func NewRequestStore(store Store, name string, refresh time.Duration) *RequestStore {
+	return &RequestStore{
+		Store:   store,
+		name:    name,
+		refresh: refresh,
+	}
+}
+
+// requestSession is the state of the session of one request.
+type requestSession struct {
+	store    *RequestStore
+	r        *http.Request
+	session  *sessions.Session
+	snapshot map[interface{}]interface{}
+	maxAge   int
+	sent     bool
+}
+
+func fromContext(r *http.Request) *requestSession {
+	rs, _ := r.Context().Value(requestSessionKey).(*requestSession)
+	return rs
+}
+
+// Get returns the session loaded for this request.
+func (s *RequestStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	rs := fromContext(r)
+	if rs != nil && name == s.name {
+		return rs.session, nil
+	}
+	return s.Store.Get(r, name)
+}
+
+// New returns the session loaded for this request, there is only one per
+// request.
+func (s *RequestStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	rs := fromContext(r)
+	if rs != nil && name == s.name {
+		return rs.session, nil
+	}
+	return s.Store.New(r, name)
+}
+
+// Save writes the session loaded for this request if it is due.
+func (s *RequestStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	rs := fromContext(r)
+	if rs != nil && session == rs.session {
+		if rw, ok := w.(*responseWriter); ok {
+			w = rw.ResponseWriter
+		}
+		return rs.write(w, true)
+	}
+	return s.Store.Save(r, w, session)
+}
+
+// Begin loads the session and returns the writer and request the rest of
+// the chain must use.
+func (s *RequestStore) Begin(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, error) {
+	loaded, err := s.Store.New(r, s.name)
+	if err != nil {
+		return w, r, err
+	}
+
+	// the session must point back at this store so session.Save is deferred
+	session := sessions.NewSession(s, s.name)
+	session.ID = loaded.ID
+	session.Values = loaded.Values
+	session.Options = loaded.Options
+	session.IsNew = loaded.IsNew
+
+	rs := &requestSession{
+		store:    s,
+		session:  session,
+		snapshot: copyValues(loaded.Values),
+		maxAge:   loaded.Options.MaxAge,
+	}
+	rs.r = r.WithContext(context.WithValue(r.Context(), requestSessionKey, rs))
+
+	return &responseWriter{ResponseWriter: w, rs: rs}, rs.r, nil
+}
+
+// End writes the session if nothing was written to the response.
+func (s *RequestStore) End(w http.ResponseWriter) error {
+	rw, ok := w.(*responseWriter)
+	if !ok {
+		return nil
+	}
+	return rw.rs.flush(rw.ResponseWriter)
+}
+
+// refreshDue reports whether an unchanged session should be written to
+// push its expiry out.
+func (rs *requestSession) refreshDue() bool {
+	if rs.store.refresh <= 0 {
+		return true
+	}
+
+	var last int64
+	switch v := rs.session.Values[RefreshKey].(type) {
+	case int64:
+		last = v
+	case int:
+		last = int64(v)
+	case int32:
+		last = int64(v)
+	case float64:
+		last = int64(v)
+	}
+	return time.Since(time.Unix(last, 0)) >= rs.store.refresh
+}
+
+// due reports whether the session has to be written, save is whether
+// the handler saved it.
+func (rs *requestSession) due(save bool) bool {
+	session := rs.session
+
+	// deleting, e.g. on logout
+	if session.Options.MaxAge < 0 {
+		return save && !session.IsNew && rs.maxAge >= 0
+	}
+
+	dirty := rs.maxAge != session.Options.MaxAge || !reflect.DeepEqual(rs.snapshot, session.Values)
+	if save && dirty {
+		return true
+	}
+
+	// a session nobody saved is never created
+	return !session.IsNew && rs.refreshDue()
+}
+
+// write writes the session if it is due and remembers what was written.
+func (rs *requestSession) write(w http.ResponseWriter, save bool) error {
+	if !rs.due(save) {
+		return nil
+	}
+
+	if rs.session.Options.MaxAge >= 0 {
+		rs.session.Values[RefreshKey] = time.Now().Unix()
+	}
+	err := rs.store.Store.Save(rs.r, w, rs.session)
+	if err != nil {
+		return err
+	}
+
+	rs.snapshot = copyValues(rs.session.Values)
+	rs.maxAge = rs.session.Options.MaxAge
+	rs.session.IsNew = false
+	return nil
+}
+
+// flush writes the session when its expiry refresh is due, once, before
+// the response headers go out.
+func (rs *requestSession) flush(w http.ResponseWriter) error {
+	if rs.sent {
+		return nil
+	}
+	rs.sent = true
+	return rs.write(w, false)
+}
+
+// responseWriter writes the session just before the headers go out.
+type responseWriter struct {
+	http.ResponseWriter
+	rs *requestSession
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	err := w.rs.flush(w.ResponseWriter)
+	if err != nil {
+		logging.Error(w.rs.r.Context(), "flush() failed", "error", err)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	err := w.rs.flush(w.ResponseWriter)
+	if err != nil {
+		logging.Error(w.rs.r.Context(), "flush() failed", "error", err)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes http.Flusher through.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
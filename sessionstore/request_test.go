@@ -0,0 +1,238 @@
+package sessionstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// countingStore counts the writes that reach the store and whether the
+// response headers had gone out by then.
+type countingStore struct {
+	Store
+	writes        int
+	afterHeaders  bool
+	headerWritten func() bool
+}
+
+func (s *countingStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	s.writes++
+	if s.headerWritten != nil && s.headerWritten() {
+		s.afterHeaders = true
+	}
+	return s.Store.Save(r, w, session)
+}
+
+// recorder notes when the headers are written.
+type recorder struct {
+	*httptest.ResponseRecorder
+	wroteHeader bool
+}
+
+func (w *recorder) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseRecorder.Write(b)
+}
+
+// requestTest is one request for a session stored in a memory store.
+type requestTest struct {
+	store   *countingStore
+	w       *recorder
+	sw      http.ResponseWriter
+	r       *http.Request
+	rs      *RequestStore
+	session *sessions.Session
+}
+
+// begin stores a session last written at refreshedAt and begins a request
+// for it, an unchanged session is written again after a minute.
+func begin(t *testing.T, refreshedAt time.Time) *requestTest {
+	mem := NewMemoryStore(Options{
+		MaxAge:   3600,
+		KeyPairs: [][]byte{[]byte("0123456789abcdef0123456789abcdef")},
+	})
+
+	// log in
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := mem.New(r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["username"] = "jdoe"
+	session.Values[RefreshKey] = refreshedAt.Unix()
+	w := httptest.NewRecorder()
+	err = mem.Save(r, w, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := &requestTest{
+		store: &countingStore{Store: mem},
+		w:     &recorder{ResponseRecorder: httptest.NewRecorder()},
+	}
+	tt.store.headerWritten = func() bool { return tt.w.wroteHeader }
+	tt.rs = NewRequestStore(tt.store, "session", time.Minute)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	tt.sw, tt.r, err = tt.rs.Begin(tt.w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt.session, err = tt.rs.Get(tt.r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tt.session.IsNew {
+		t.Fatal("session not loaded")
+	}
+	return tt
+}
+
+func (tt *requestTest) save(t *testing.T) {
+	err := tt.session.Save(tt.r, tt.sw)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (tt *requestTest) end(t *testing.T) {
+	err := tt.rs.End(tt.sw)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestStoreWrites(t *testing.T) {
+	fresh := time.Now()
+	stale := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name        string
+		refreshedAt time.Time
+		handler     func(t *testing.T, tt *requestTest)
+		want        int
+	}{
+		{"unchanged, not due", fresh, func(t *testing.T, tt *requestTest) {}, 0},
+		{"unchanged and saved, not due", fresh, func(t *testing.T, tt *requestTest) {
+			tt.save(t)
+		}, 0},
+		{"dirty and saved", fresh, func(t *testing.T, tt *requestTest) {
+			tt.session.Values["notification"] = "saved"
+			tt.save(t)
+		}, 1},
+		{"dirty and saved twice", fresh, func(t *testing.T, tt *requestTest) {
+			tt.session.Values["notification"] = "saved"
+			tt.save(t)
+			tt.save(t)
+		}, 1},
+		{"dirty, not saved", fresh, func(t *testing.T, tt *requestTest) {
+			tt.session.Values["notification"] = "lost"
+		}, 0},
+		{"refresh due", stale, func(t *testing.T, tt *requestTest) {}, 1},
+		{"refresh due, saved then ended", stale, func(t *testing.T, tt *requestTest) {
+			tt.save(t)
+		}, 1},
+		{"logout", fresh, func(t *testing.T, tt *requestTest) {
+			tt.session.Options.MaxAge = -1
+			tt.save(t)
+		}, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := begin(t, tc.refreshedAt)
+			tc.handler(t, tt)
+			tt.end(t)
+			if tt.store.writes != tc.want {
+				t.Errorf("%d writes, want %d", tt.store.writes, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestStoreSaveThenEnd(t *testing.T) {
+	tt := begin(t, time.Now())
+	tt.session.Values["notification"] = "saved"
+	tt.save(t)
+	if tt.store.writes != 1 {
+		t.Fatalf("%d writes at Save, want 1", tt.store.writes)
+	}
+	tt.end(t)
+	if tt.store.writes != 1 {
+		t.Errorf("%d writes after End, want no second write", tt.store.writes)
+	}
+
+	// the values written are what the next request loads
+	next := httptest.NewRequest("GET", "/", nil)
+	for _, c := range tt.w.Result().Cookies() {
+		next.AddCookie(c)
+	}
+	session, err := tt.store.Store.New(next, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Values["notification"] != "saved" {
+		t.Errorf("next request loaded %v, want the saved notification", session.Values)
+	}
+}
+
+func TestRequestStoreFlushBeforeHeaders(t *testing.T) {
+	tt := begin(t, time.Now().Add(-time.Hour))
+
+	// a handler that writes the body without saving
+	_, err := tt.sw.Write([]byte("ok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tt.store.writes != 1 {
+		t.Fatalf("%d writes when the body was written, want 1", tt.store.writes)
+	}
+	if tt.store.afterHeaders {
+		t.Error("session written after the headers went out")
+	}
+	if len(tt.w.Result().Cookies()) == 0 {
+		t.Error("session cookie missing from the response")
+	}
+
+	tt.end(t)
+	if tt.store.writes != 1 {
+		t.Errorf("%d writes after End, want 1", tt.store.writes)
+	}
+}
+
+func TestRequestStoreNewSession(t *testing.T) {
+	mem := NewMemoryStore(Options{MaxAge: 3600})
+	store := &countingStore{Store: mem}
+	rs := NewRequestStore(store, "session", 0)
+
+	// a visitor without a session is not given one unless it is saved
+	sw, r, err := rs.Begin(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rs.End(sw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.writes != 0 {
+		t.Errorf("%d writes for an unsaved new session, want 0", store.writes)
+	}
+
+	n, err := mem.Count(r.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d sessions stored, want 0", n)
+	}
+}
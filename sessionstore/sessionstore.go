@@ -0,0 +1,241 @@
+// Package sessionstore provides gorilla session stores that can be swapped
+// without touching the handlers: MongoDB, in-memory, encrypted cookies and
+// stateless signed tokens.
+package sessionstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EvictedKey holds the eviction notice of a session that was evicted, the
+// session itself is new and empty.
+const EvictedKey = "evicted"
+
+// ErrNotSupported is returned by List, Revoke, Evict and Lock on backends
+// that keep no server side state.
+var ErrNotSupported = errors.New("not supported by this session store")
+
+// Store is a gorilla session store that can also list and revoke sessions
+// where the backend allows it.
+type Store interface {
+	sessions.Store
+	// List returns the live sessions.
+	List(ctx context.Context) ([]*Info, error)
+	// Count returns how many sessions List would return, without reading
+	// them.
+	Count(ctx context.Context) (int, error)
+	// Revoke ends a session before it expires.
+	Revoke(ctx context.Context, id string) error
+	// Evict ends a session and leaves a notice that its owner sees on
+	// their next request.
+	Evict(ctx context.Context, id, notice string) error
+	// Lock holds off other callers of Lock for the same user, across
+	// instances where the backend is shared, until the returned func is
+	// called. It makes counting and evicting sessions atomic.
+	Lock(ctx context.Context, username string) (func(), error)
+	// Ping checks the backend sessions are kept in can be reached.
+	Ping(ctx context.Context) error
+}
+
+// Info describes a live session.
+type Info struct {
+	ID         string
+	Username   string
+	RemoteAddr string
+	Host       string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// Options are shared by every store.
+type Options struct {
+	// MaxAge is the session lifetime in seconds.
+	MaxAge int
+	// Secure only sends the cookie over HTTPS.
+	Secure bool
+	// KeyPairs authenticate and optionally encrypt cookies, see
+	// securecookie.CodecsFromPairs.
+	KeyPairs [][]byte
+}
+
+func (o Options) sessionOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   o.MaxAge,
+		Secure:   o.Secure,
+		HttpOnly: true,
+	}
+}
+
+func (o Options) codecs() []securecookie.Codec {
+	codecs := securecookie.CodecsFromPairs(o.KeyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(o.MaxAge)
+		}
+	}
+	return codecs
+}
+
+// backend keeps session values on the server, the cookie only carries the
+// session ID.
+type backend interface {
+	load(ctx context.Context, id string, values map[interface{}]interface{}) (bool, error)
+	insert(ctx context.Context, id string, values map[interface{}]interface{}, expires time.Time) error
+	update(ctx context.Context, id string, values map[interface{}]interface{}, expires time.Time) error
+	delete(ctx context.Context, id string) error
+	evict(ctx context.Context, id, notice string) error
+	list(ctx context.Context) ([]*Info, error)
+	count(ctx context.Context) (int, error)
+	lock(ctx context.Context, username string) (func(), error)
+	ping(ctx context.Context) error
+}
+
+// serverStore signs the session ID into a cookie and keeps the values in a
+// backend.
+type serverStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend backend
+}
+
+func newServerStore(b backend, opts Options) *serverStore {
+	return &serverStore{
+		Codecs:  opts.codecs(),
+		Options: opts.sessionOptions(),
+		backend: b,
+	}
+}
+
+// Get returns the session for the request from the registry.
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named in the request cookie. A session that has
+// expired or was revoked comes back as a new session without an error so
+// the user is simply asked to log in again.
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	err = securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	found, err := s.backend.load(r.Context(), id, session.Values)
+	if err != nil {
+		return session, err
+	}
+	if !found {
+		return session, nil
+	}
+
+	// an evicted session starts over but keeps the notice for its owner
+	if notice, ok := session.Values[EvictedKey]; ok {
+		session.Values = map[interface{}]interface{}{EvictedKey: notice}
+		return session, nil
+	}
+
+	session.ID = id
+	session.IsNew = false
+
+	return session, nil
+}
+
+// Save stores the session values and refreshes the cookie, a negative
+// MaxAge deletes the session.
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx := r.Context()
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := s.backend.delete(ctx, session.ID)
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	expires := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second).UTC()
+
+	if session.ID == "" {
+		session.ID = primitive.NewObjectID().Hex()
+		err := s.backend.insert(ctx, session.ID, session.Values, expires)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := s.backend.update(ctx, session.ID, session.Values, expires)
+		if err != nil {
+			return err
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+// List returns the live sessions.
+func (s *serverStore) List(ctx context.Context) ([]*Info, error) {
+	return s.backend.list(ctx)
+}
+
+// Count returns the number of live sessions.
+func (s *serverStore) Count(ctx context.Context) (int, error) {
+	return s.backend.count(ctx)
+}
+
+// Revoke deletes a session, the next request with its cookie starts over.
+func (s *serverStore) Revoke(ctx context.Context, id string) error {
+	return s.backend.delete(ctx, id)
+}
+
+// Evict replaces a session with its eviction notice.
+func (s *serverStore) Evict(ctx context.Context, id, notice string) error {
+	return s.backend.evict(ctx, id, notice)
+}
+
+// Lock holds off other callers of Lock for username.
+func (s *serverStore) Lock(ctx context.Context, username string) (func(), error) {
+	return s.backend.lock(ctx, username)
+}
+
+// Ping checks the backend can be reached.
+func (s *serverStore) Ping(ctx context.Context) error {
+	return s.backend.ping(ctx)
+}
+
+// str returns a session value as a string, or an empty string if it is
+// not set.
+func str(values map[interface{}]interface{}, key string) string {
+	v, ok := values[key]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
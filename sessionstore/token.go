@@ -0,0 +1,185 @@
+package sessionstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidToken is returned for a token that is malformed or whose
+// signature does not match.
+var ErrInvalidToken = errors.New("invalid session token")
+
+// TokenStore keeps the session in a stateless token signed with
+// HMAC-SHA256. The token is sent as the session cookie and is also
+// accepted in an "Authorization: Bearer" header so API clients can use it.
+// The payload is gob encoded like the values of the other stores, so values
+// keep their types and types other than the basic ones must be registered
+// with gob.Register. Values are readable by whoever holds the token, only
+// store what the client may see. Sessions can not be listed or revoked.
+type TokenStore struct {
+	Options *sessions.Options
+	key     []byte
+}
+
+// token is the signed payload.
+type token struct {
+	ID        string
+	IssuedAt  int64
+	ExpiresAt int64
+	Values    map[interface{}]interface{}
+}
+
+// NewTokenStore returns a TokenStore signing with key.
+func NewTokenStore(key []byte, opts Options) *TokenStore {
+	return &TokenStore{
+		Options: opts.sessionOptions(),
+		key:     key,
+	}
+}
+
+// Get returns the session for the request from the registry.
+func (s *TokenStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New decodes the token from the Authorization header or the cookie. An
+// expired token comes back as a new session without an error.
+func (s *TokenStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	raw := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		raw = strings.TrimPrefix(auth, "Bearer ")
+	} else if c, err := r.Cookie(name); err == nil {
+		raw = c.Value
+	}
+	if raw == "" {
+		return session, nil
+	}
+
+	tok, err := s.decode(raw)
+	if err != nil {
+		return session, err
+	}
+	if time.Now().Unix() >= tok.ExpiresAt {
+		return session, nil
+	}
+
+	for k, v := range tok.Values {
+		session.Values[k] = v
+	}
+	session.ID = tok.ID
+	session.IsNew = false
+
+	return session, nil
+}
+
+// Save signs a new token and sets it as the cookie, a negative MaxAge
+// clears the cookie.
+func (s *TokenStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = primitive.NewObjectID().Hex()
+	}
+
+	now := time.Now()
+	tok := &token{
+		ID:        session.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Duration(session.Options.MaxAge) * time.Second).Unix(),
+		Values:    session.Values,
+	}
+
+	encoded, err := s.encode(tok)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+func (s *TokenStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *TokenStore) encode(tok *token) (string, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(tok)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b.Bytes())
+	return payload + "." + s.sign(payload), nil
+}
+
+func (s *TokenStore) decode(raw string) (*token, error) {
+	parts := strings.SplitN(raw, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(s.sign(parts[0])), []byte(parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	tok := new(token)
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(tok)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return tok, nil
+}
+
+// List is not supported.
+func (s *TokenStore) List(ctx context.Context) ([]*Info, error) {
+	return nil, ErrNotSupported
+}
+
+// Count is not supported.
+func (s *TokenStore) Count(ctx context.Context) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Revoke is not supported.
+func (s *TokenStore) Revoke(ctx context.Context, id string) error {
+	return ErrNotSupported
+}
+
+// Evict is not supported.
+func (s *TokenStore) Evict(ctx context.Context, id, notice string) error {
+	return ErrNotSupported
+}
+
+// Lock is not supported.
+func (s *TokenStore) Lock(ctx context.Context, username string) (func(), error) {
+	return nil, ErrNotSupported
+}
+
+// Ping always succeeds, sessions are only kept in the cookie.
+func (s *TokenStore) Ping(ctx context.Context) error {
+	return nil
+}
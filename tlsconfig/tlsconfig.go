@@ -0,0 +1,300 @@
+// Package tlsconfig builds the tls config the web app serves https with.
+// The certificate and key are read again when they change on disk, so a
+// renewed certificate is served without a restart.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stuff/web/logging"
+)
+
+// Options are the files and policy of the tls config.
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is the lowest tls version accepted, 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string
+	// Ciphers is the cipher suite policy of tls 1.2 and below, modern or
+	// compatible, tls 1.3 suites are always the go defaults.
+	Ciphers string
+	// ClientCAFile, when set, is the ca bundle client certificates must be
+	// signed by, clients without one are turned away.
+	ClientCAFile string
+	// ReloadInterval is how often the certificate and key are checked for
+	// changes.
+	ReloadInterval time.Duration
+}
+
+// DefaultOptions accept tls 1.2 and above with modern ciphers and check
+// the certificate for changes every 30 seconds.
+var DefaultOptions = Options{
+	MinVersion:     "1.2",
+	Ciphers:        Modern,
+	ReloadInterval: 30 * time.Second,
+}
+
+// Cipher suite policies.
+const (
+	// Modern suites have forward secrecy and authenticated encryption.
+	Modern = "modern"
+	// Compatible adds the cbc suites old clients need.
+	Compatible = "compatible"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var modern = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var compatible = append(append([]uint16{}, modern...),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+)
+
+// ParseVersion returns the tls version of a MinVersion such as "1.2".
+func ParseVersion(s string) (uint16, error) {
+	v, ok := versions[s]
+	if !ok {
+		return 0, fmt.Errorf("%q is not one of 1.0, 1.1, 1.2, 1.3", s)
+	}
+	return v, nil
+}
+
+// CipherSuites returns the cipher suites of a policy.
+func CipherSuites(policy string) ([]uint16, error) {
+	switch policy {
+	case Modern:
+		return modern, nil
+	case Compatible:
+		return compatible, nil
+	}
+	return nil, fmt.Errorf("%q is not one of %s, %s", policy, Modern, Compatible)
+}
+
+// New returns the tls config of opts and the Reloader serving its
+// certificate, Start runs the reloader.
+func New(opts Options) (*tls.Config, *Reloader, error) {
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = DefaultOptions.ReloadInterval
+	}
+
+	version, err := ParseVersion(opts.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	suites, err := CipherSuites(opts.Ciphers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reloader, err := NewReloader(opts.CertFile, opts.KeyFile, opts.ReloadInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:       version,
+		CipherSuites:     suites,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		GetCertificate:   reloader.GetCertificate,
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, errors.New("TLS_CLIENT_CA_FILE contains no certificates")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, reloader, nil
+}
+
+// Reloader serves a certificate and key, reading them again when either
+// file changes. A pair that fails to load is logged and the last good one
+// is kept.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	stamp   string
+	expires time.Time
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewReloader loads the certificate and key, Start watches them.
+func NewReloader(certFile, keyFile string, interval time.Duration) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	_, err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, it is the
+// GetCertificate of a tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Expires returns when the current certificate expires.
+func (r *Reloader) Expires() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.expires
+}
+
+// Reload reads the certificate and key if they changed since they were
+// last read, reporting whether they did.
+func (r *Reloader) Reload() (bool, error) {
+	stamp, err := r.stat()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := stamp == r.stamp
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// a failed pair is not retried until the files change again, the
+	// certificate may be renewed before the key is
+	r.stamp = stamp
+	if err != nil {
+		return false, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	cert.Leaf = leaf
+
+	r.cert = &cert
+	r.expires = leaf.NotAfter
+	return true, nil
+}
+
+// stat returns the size and modification time of both files.
+func (r *Reloader) stat() (string, error) {
+	var stamp []string
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp = append(stamp, fmt.Sprintf("%d/%d", info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(stamp, ","), nil
+}
+
+// Start checks the certificate and key for changes once per interval in
+// the background until Close is called.
+func (r *Reloader) Start() {
+	go r.run()
+}
+
+// Close stops the reloader.
+func (r *Reloader) Close() {
+	close(r.quit)
+	<-r.done
+}
+
+func (r *Reloader) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.Reload()
+		if err != nil {
+			logging.Error(context.Background(), "Reload() failed", "error", err)
+			continue
+		}
+		if reloaded {
+			logging.Info(context.Background(), "certificate reloaded", "file", r.certFile, "expires", r.Expires().Format(time.RFC3339))
+		}
+	}
+}
+
+// Redirect returns a handler that redirects every request to https on
+// the port of httpsAddr, such as ":443" or ":8443".
+func Redirect(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}